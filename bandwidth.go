@@ -0,0 +1,178 @@
+package walker
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"code.google.com/p/log4go"
+)
+
+// throttleChunk is the most a throttledReader reads at once, so that a single
+// large read can't run far past the limit before it is charged for.
+const throttleChunk = 32 * 1024
+
+// bandwidthPollInterval is how often the FetchManager reads the bandwidth
+// limits from a BandwidthLimitStore
+var bandwidthPollInterval = 10 * time.Second
+
+// tokenBucket meters bytes against a rate. It holds at most a second's worth
+// of tokens, so after an idle period a host can burst for about a second
+// before being held to the rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n tokens from the bucket, which refills at rate per second,
+// and returns how long the caller must wait before using them. The bucket
+// goes into debt rather than refusing, so callers are served in order. A rate
+// <= 0 means no limit.
+func (tb *tokenBucket) reserve(n int64, rate int64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := time.Now()
+	if tb.last.IsZero() {
+		tb.tokens = float64(rate)
+	} else {
+		tb.tokens += now.Sub(tb.last).Seconds() * float64(rate)
+		if tb.tokens > float64(rate) {
+			tb.tokens = float64(rate)
+		}
+	}
+	tb.last = now
+
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / float64(rate) * float64(time.Second))
+}
+
+// reset forgets the bucket's history, so the next reserve starts with a full
+// bucket.
+func (tb *tokenBucket) reset() {
+	tb.mu.Lock()
+	tb.last = time.Time{}
+	tb.mu.Unlock()
+}
+
+// bandwidthLimiter caps how fast the fetchers read response bodies, in bytes
+// per second, across the whole process (bandwidth_limit) and for each host
+// (host_bandwidth_limit). Since a host is only crawled by one fetcher at a
+// time, each fetcher keeps the bucket for its host.
+//
+// The limits can be changed while crawling; see setLimits.
+type bandwidthLimiter struct {
+	global     tokenBucket
+	globalRate int64
+	hostRate   int64
+}
+
+func newBandwidthLimiter(global, perHost int64) *bandwidthLimiter {
+	bl := &bandwidthLimiter{}
+	bl.setLimits(global, perHost)
+	return bl
+}
+
+// setLimits changes the limits (0 for no limit). Reads already waiting are
+// not affected.
+func (bl *bandwidthLimiter) setLimits(global, perHost int64) {
+	oldGlobal := atomic.SwapInt64(&bl.globalRate, global)
+	oldPerHost := atomic.SwapInt64(&bl.hostRate, perHost)
+	if oldGlobal != global || oldPerHost != perHost {
+		log4go.Info("Bandwidth limits set to %v bytes/sec (%v per host)", global, perHost)
+	}
+	bandwidthLimitMetric.Set(global)
+	hostBandwidthLimitMetric.Set(perHost)
+}
+
+// limits returns the current global and per-host limits.
+func (bl *bandwidthLimiter) limits() (global, perHost int64) {
+	return atomic.LoadInt64(&bl.globalRate), atomic.LoadInt64(&bl.hostRate)
+}
+
+// wait blocks until n more bytes may be read from a host whose bucket is
+// host. Returns errFetchInterrupted if ctx is canceled first.
+func (bl *bandwidthLimiter) wait(ctx context.Context, host *tokenBucket, n int64) error {
+	global, perHost := bl.limits()
+	d := bl.global.reserve(n, global)
+	if hd := host.reserve(n, perHost); hd > d {
+		d = hd
+	}
+	if d <= 0 {
+		return nil
+	}
+
+	throttledFetchersMetric.Add(1)
+	defer throttledFetchersMetric.Add(-1)
+	throttleWaitMetric.Observe(d.Seconds())
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return errFetchInterrupted
+	}
+}
+
+// pollBandwidthLimits applies any limits stored in the datastore (if it is a
+// BandwidthLimitStore), falling back to the configured ones.
+func (fm *FetchManager) pollBandwidthLimits() {
+	bls, ok := fm.Datastore.(BandwidthLimitStore)
+	if !ok {
+		return
+	}
+	global, perHost, err := bls.BandwidthLimits()
+	if err != nil {
+		log4go.Error("Failed to read bandwidth limits: %v", err)
+		return
+	}
+	if global < 0 {
+		global = Config.Fetcher.BandwidthLimit
+	}
+	if perHost < 0 {
+		perHost = Config.Fetcher.HostBandwidthLimit
+	}
+	fm.bandwidth.setLimits(global, perHost)
+}
+
+// throttledReader limits reads of a response body to the fetcher's bandwidth
+// limits. Bytes are charged as they arrive over the wire (see wireBytes), so
+// a compressed body is limited by its compressed size.
+type throttledReader struct {
+	f       *fetcher
+	body    io.Reader
+	charged int64
+}
+
+// throttle wraps a response body so reads from it are held to the bandwidth
+// limits.
+func (f *fetcher) throttle(body io.Reader) io.Reader {
+	return &throttledReader{f: f, body: body}
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := tr.body.Read(p)
+
+	used := int64(n)
+	if wire := wireBytes(tr.body); wire > 0 {
+		used = wire - tr.charged
+		tr.charged = wire
+	}
+	if used > 0 {
+		if werr := tr.f.fm.bandwidth.wait(tr.f.ctx, &tr.f.hostBandwidth, used); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,106 @@
+package walker
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+)
+
+// errContentTooLarge is the FetchError for bodies larger than
+// Config.Fetcher.MaxHTTPContentSizeBytes, or MaxDecompressedSizeBytes once
+// decoded (unless they are being truncated)
+var errContentTooLarge = fmt.Errorf("Content size exceeded MaxHTTPContentSizeBytes")
+
+// limitedBody wraps a response body that is being streamed to a handler. It
+// reads at most limit bytes, computing the fnv fingerprint of what it reads as
+// it goes. If the body is longer than limit it either stops short (truncate
+// is true) or returns errContentTooLarge.
+//
+// Close does not close the wrapped body; the fetcher takes care of that once
+// the handler is done.
+type limitedBody struct {
+	rc        io.ReadCloser
+	remaining int64
+	truncate  bool
+	hash      hash.Hash64
+
+	// n is the number of bytes read so far
+	n int64
+
+	// truncated is set if we stopped reading before the end of the body
+	truncated bool
+
+	// err is returned by every Read after the first error (including EOF)
+	err error
+}
+
+func newLimitedBody(rc io.ReadCloser, limit int64, truncate bool) *limitedBody {
+	return &limitedBody{
+		rc:        rc,
+		remaining: limit,
+		truncate:  truncate,
+		hash:      fnv.New64(),
+	}
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.err != nil {
+		return 0, lb.err
+	}
+
+	if lb.remaining <= 0 {
+		// We've hit the limit, see if there is anything past it
+		var one [1]byte
+		n, err := io.ReadAtLeast(lb.rc, one[:], 1)
+		if n == 0 {
+			lb.err = err
+		} else if lb.truncate {
+			lb.truncated = true
+			lb.err = io.EOF
+		} else {
+			lb.err = errContentTooLarge
+		}
+		return 0, lb.err
+	}
+
+	if int64(len(p)) > lb.remaining {
+		p = p[:lb.remaining]
+	}
+	n, err := lb.rc.Read(p)
+	lb.hash.Write(p[:n])
+	lb.remaining -= int64(n)
+	lb.n += int64(n)
+	if err == errContentTooLarge && lb.truncate {
+		// The (compressed) body went over the limit on the wire
+		lb.truncated = true
+		err = io.EOF
+	}
+	if err != nil {
+		lb.err = err
+	}
+	return n, err
+}
+
+// Close is a no-op, see limitedBody.
+func (lb *limitedBody) Close() error {
+	return nil
+}
+
+// finish reads whatever the handler left unread, so that the fingerprint
+// covers the whole (limited) body. Returns any read error other than EOF.
+func (lb *limitedBody) finish() error {
+	_, err := io.Copy(ioutil.Discard, lb)
+	return err
+}
+
+// size returns the number of bytes read so far.
+func (lb *limitedBody) size() int64 {
+	return lb.n
+}
+
+// fingerprint returns the fnv fingerprint of everything read so far.
+func (lb *limitedBody) fingerprint() int64 {
+	return int64(lb.hash.Sum64())
+}
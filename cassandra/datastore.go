@@ -3,8 +3,10 @@ package cassandra
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -290,6 +292,18 @@ func (ds *Datastore) UnclaimHost(host string) {
 	}
 }
 
+// ExcludeHost is documented on the walker.HostExcluder interface.
+func (ds *Datastore) ExcludeHost(host string, reason string) {
+	err := ds.db.Query(`UPDATE domain_info
+						SET
+							excluded = true,
+							exclude_reason = ?
+						WHERE dom = ?`, reason, host).Exec()
+	if err != nil {
+		log4go.Error("Failed to exclude %v (%v): %v", host, reason, err)
+	}
+}
+
 // LinksForHost is documented on the walker.Datastore interface.
 func (ds *Datastore) LinksForHost(domain string) <-chan *walker.URL {
 	links, err := ds.getSegmentLinks(domain)
@@ -313,18 +327,20 @@ func (ds *Datastore) LinksForHost(domain string) <-chan *walker.URL {
 // TODO: change our LinksForHost implementation to kick off a goroutine to feed
 // 			the channel, instead of keeping all links in memory as we do now.
 func (ds *Datastore) getSegmentLinks(domain string) (links []*walker.URL, err error) {
-	q := ds.db.Query(`SELECT dom, subdom, path, proto, time
+	q := ds.db.Query(`SELECT dom, subdom, path, proto, time, etag, lastmod
 						FROM segments WHERE dom = ?`, domain)
 	iter := q.Iter()
 	defer func() { err = iter.Close() }()
 
-	var dbdomain, subdomain, path, protocol string
+	var dbdomain, subdomain, path, protocol, etag, lastmod string
 	var crawlTime time.Time
-	for iter.Scan(&dbdomain, &subdomain, &path, &protocol, &crawlTime) {
+	for iter.Scan(&dbdomain, &subdomain, &path, &protocol, &crawlTime, &etag, &lastmod) {
 		u, e := walker.CreateURL(dbdomain, subdomain, path, protocol, crawlTime)
 		if e != nil {
 			log4go.Error("Error adding link (%v) to crawl: %v", u, e)
 		} else {
+			u.ETag = etag
+			u.LastModified = lastmod
 			log4go.Debug("Adding link: %v", u)
 			links = append(links, u)
 		}
@@ -339,20 +355,39 @@ type dbfield struct {
 	value interface{}
 }
 
+// insertLink inserts a row into the links table with the given columns
+func (ds *Datastore) insertLink(inserts []dbfield) error {
+	names := []string{}
+	values := []interface{}{}
+	placeholders := []string{}
+	for _, f := range inserts {
+		names = append(names, f.name)
+		values = append(values, f.value)
+		placeholders = append(placeholders, "?")
+	}
+	return ds.db.Query(
+		fmt.Sprintf(`INSERT INTO links (%s) VALUES (%s)`,
+			strings.Join(names, ", "), strings.Join(placeholders, ", ")),
+		values...,
+	).Exec()
+}
+
 // StoreURLFetchResults is documented on the walker.Datastore interface.
 func (ds *Datastore) StoreURLFetchResults(fr *walker.FetchResults) {
-	url := fr.URL
-	if len(fr.RedirectedFrom) > 0 {
-		// Remember that the actual response of this FetchResults is from
-		// the url at the end of RedirectedFrom
-		url = fr.RedirectedFrom[len(fr.RedirectedFrom)-1]
+	if fr.Interrupted {
+		ds.requeueInterrupted(fr)
+		return
 	}
 
-	dom, subdom, err := fr.URL.TLDPlusOneAndSubdomain()
+	url := responseURL(fr)
+
+	// The response came from url, which may be on another domain if we
+	// followed a redirect there
+	dom, subdom, err := url.TLDPlusOneAndSubdomain()
 	if err != nil {
 		// Consider storing in the link table so we don't keep trying to crawl
 		// this link
-		log4go.Error("StoreURLFetchResults not storing %v: %v", fr.URL, err)
+		log4go.Error("StoreURLFetchResults not storing %v: %v", url, err)
 		return
 	}
 
@@ -365,12 +400,32 @@ func (ds *Datastore) StoreURLFetchResults(fr *walker.FetchResults) {
 		dbfield{"fnv", fr.FnvFingerprint},
 	}
 
+	if fr.SimHash != 0 {
+		inserts = append(inserts, dbfield{"simhash", fr.SimHash})
+	}
+
+	if fr.StructFingerprint != 0 {
+		inserts = append(inserts, dbfield{"structfp", fr.StructFingerprint})
+	}
+
 	if fr.FetchError != nil {
 		inserts = append(inserts, dbfield{"err", fr.FetchError.Error()})
 	}
 
+	if fr.HandlerError != nil {
+		inserts = append(inserts, ds.handlerErrorFields(url, fr.FetchTime, fr.HandlerError)...)
+	}
+
+	if re, ok := fr.FetchError.(*walker.RedirectError); ok {
+		// url redirected to re.Target, which we didn't follow
+		inserts = append(inserts, dbfield{"redto_url", re.Target.String()})
+	}
+
 	if fr.ExcludedByRobots {
 		inserts = append(inserts, dbfield{"robot_ex", true})
+		if fr.RobotsReason != "" {
+			inserts = append(inserts, dbfield{"robot_reason", fr.RobotsReason})
+		}
 	}
 
 	if fr.Response != nil {
@@ -381,6 +436,26 @@ func (ds *Datastore) StoreURLFetchResults(fr *walker.FetchResults) {
 		inserts = append(inserts, dbfield{"mime", fr.MimeType})
 	}
 
+	if fr.Attempts > 0 {
+		inserts = append(inserts, dbfield{"attempts", fr.Attempts})
+	}
+
+	if fr.RemoteIP != "" {
+		inserts = append(inserts, dbfield{"ip", fr.RemoteIP})
+	}
+
+	if fr.Encoding != "" {
+		inserts = append(inserts, dbfield{"encoding", fr.Encoding})
+	}
+
+	if fr.Canonical != nil {
+		inserts = append(inserts, dbfield{"canonical", fr.Canonical.String()})
+	}
+
+	if etag, lastmod := cacheValidators(fr); etag != "" || lastmod != "" {
+		inserts = append(inserts, dbfield{"etag", etag}, dbfield{"lastmod", lastmod})
+	}
+
 	if fr.Body != "" {
 		inserts = append(inserts, dbfield{"body", fr.Body})
 	}
@@ -393,20 +468,7 @@ func (ds *Datastore) StoreURLFetchResults(fr *walker.FetchResults) {
 		inserts = append(inserts, dbfield{"headers", h})
 	}
 
-	// Put the values together and run the query
-	names := []string{}
-	values := []interface{}{}
-	placeholders := []string{}
-	for _, f := range inserts {
-		names = append(names, f.name)
-		values = append(values, f.value)
-		placeholders = append(placeholders, "?")
-	}
-	err = ds.db.Query(
-		fmt.Sprintf(`INSERT INTO links (%s) VALUES (%s)`,
-			strings.Join(names, ", "), strings.Join(placeholders, ", ")),
-		values...,
-	).Exec()
+	err = ds.insertLink(inserts)
 	if err != nil {
 		log4go.Error("Failed storing fetch results: %v", err)
 		return
@@ -435,6 +497,128 @@ func (ds *Datastore) StoreURLFetchResults(fr *walker.FetchResults) {
 	}
 }
 
+// cacheValidators returns the ETag and Last-Modified values to store for fr.
+// A 304 response need not repeat them, in which case the values we sent (from
+// the previous crawl) are still valid and are carried forward.
+func cacheValidators(fr *walker.FetchResults) (etag string, lastmod string) {
+	if fr.Response == nil {
+		return
+	}
+	etag = fr.Response.Header.Get("ETag")
+	lastmod = fr.Response.Header.Get("Last-Modified")
+	if fr.Response.StatusCode == http.StatusNotModified {
+		if etag == "" {
+			etag = fr.URL.ETag
+		}
+		if lastmod == "" {
+			lastmod = fr.URL.LastModified
+		}
+	}
+	return
+}
+
+// requeueInterrupted handles a fetch that was aborted by a fetcher shutdown.
+// Rather than storing a crawl, it flags the link's latest row as getnow so the
+// dispatcher will put it in the next segment for this domain.
+// responseURL returns the url the response in fr came from, which is the end
+// of fr.RedirectedFrom if redirects were followed.
+func responseURL(fr *walker.FetchResults) *walker.URL {
+	if len(fr.RedirectedFrom) > 0 {
+		return fr.RedirectedFrom[len(fr.RedirectedFrom)-1]
+	}
+	return fr.URL
+}
+
+// StoreHandlerError is documented on the walker.HandlerErrorStore interface.
+func (ds *Datastore) StoreHandlerError(fr *walker.FetchResults, err error) {
+	url := responseURL(fr)
+	dom, subdom, derr := url.TLDPlusOneAndSubdomain()
+	if derr != nil {
+		log4go.Error("StoreHandlerError not storing %v: %v", url, derr)
+		return
+	}
+
+	sets := []string{}
+	values := []interface{}{}
+	for _, f := range ds.handlerErrorFields(url, fr.FetchTime, err) {
+		sets = append(sets, f.name+" = ?")
+		values = append(values, f.value)
+	}
+	// An async handler may finish before StoreURLFetchResults stores fr, and
+	// this UPDATE works either way, since it only sets the handler's columns
+	values = append(values, dom, subdom, url.RequestURI(), url.Scheme, fr.FetchTime)
+	qerr := ds.db.Query(
+		fmt.Sprintf(`UPDATE links SET %s
+					WHERE dom = ? AND subdom = ? AND path = ? AND proto = ? AND time = ?`,
+			strings.Join(sets, ", ")),
+		values...,
+	).Exec()
+	if qerr != nil {
+		log4go.Error("Failed to store handler error for %v: %v", url, qerr)
+	}
+}
+
+// handlerErrorFields returns the links fields recording err, returned by the
+// handler for the crawl of u at fetchTime. A RetryLaterError has the
+// dispatcher queue u again right away, unless the handler has asked that
+// more than cassandra.max_handler_retries times in a row.
+func (ds *Datastore) handlerErrorFields(u *walker.URL, fetchTime time.Time, err error) []dbfield {
+	fields := []dbfield{dbfield{"handler_err", err.Error()}}
+	if !walker.IsRetryLater(err) {
+		return fields
+	}
+
+	retries := ds.handlerRetries(u, fetchTime) + 1
+	fields = append(fields, dbfield{"handler_retries", retries})
+	if retries <= walker.Config.Cassandra.MaxHandlerRetries {
+		fields = append(fields, dbfield{"getnow", true})
+	} else {
+		log4go.Info("Handler asked to retry %v %d times in a row, not retrying it again until its next crawl",
+			u, retries)
+	}
+	return fields
+}
+
+// handlerRetries returns the handler_retries of the latest crawl of u before
+// fetchTime, which is 0 if the handler didn't ask to retry that one (or it
+// can't be read).
+func (ds *Datastore) handlerRetries(u *walker.URL, fetchTime time.Time) int {
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		return 0
+	}
+
+	itr := ds.db.Query(`SELECT handler_retries FROM links
+						WHERE dom = ? AND subdom = ? AND path = ? AND proto = ? AND time < ?`,
+		dom, subdom, u.RequestURI(), u.Scheme, fetchTime).Iter()
+	// Rows are in ascending time order, so the last one is the latest crawl
+	var retries, latest int
+	for itr.Scan(&retries) {
+		latest = retries
+	}
+	if err := itr.Close(); err != nil {
+		log4go.Error("Failed to read handler retries of %v: %v", u, err)
+		return 0
+	}
+	return latest
+}
+
+func (ds *Datastore) requeueInterrupted(fr *walker.FetchResults) {
+	dom, subdom, path, proto, lastCrawled, err := fr.URL.PrimaryKey()
+	if err != nil {
+		log4go.Error("requeueInterrupted not storing %v: %v", fr.URL, err)
+		return
+	}
+
+	log4go.Debug("Requeueing interrupted fetch of %v", fr.URL)
+	err = ds.db.Query(`UPDATE links SET getnow = true
+						WHERE dom = ? AND subdom = ? AND path = ? AND proto = ? AND time = ?`,
+		dom, subdom, path, proto, lastCrawled).Exec()
+	if err != nil {
+		log4go.Error("Failed to requeue interrupted fetch of %v: %v", fr.URL, err)
+	}
+}
+
 // StoreParsedURL is documented on the walker.Datastore interface.
 func (ds *Datastore) StoreParsedURL(u *walker.URL, fr *walker.FetchResults) {
 	if !u.IsAbs() {
@@ -443,10 +627,14 @@ func (ds *Datastore) StoreParsedURL(u *walker.URL, fr *walker.FetchResults) {
 	}
 	dom, subdom, err := u.TLDPlusOneAndSubdomain()
 	if err != nil {
-		log4go.Debug("StoreParsedURL not storing %v: %v", fr.URL, err)
+		log4go.Debug("StoreParsedURL not storing %v: %v", u, err)
 		return
 	}
 
+	if walker.Config.Cassandra.StoreEdges && fr != nil && u.Link != nil {
+		ds.storeEdge(referer(u, fr), u, fr.FetchTime)
+	}
+
 	exists := ds.hasDomain(dom)
 
 	if !exists && walker.Config.Cassandra.AddNewDomains {
@@ -455,17 +643,79 @@ func (ds *Datastore) StoreParsedURL(u *walker.URL, fr *walker.FetchResults) {
 		exists = true
 	}
 
-	if exists {
+	if !exists {
+		return
+	}
+
+	inserts := []dbfield{
+		dbfield{"dom", dom},
+		dbfield{"subdom", subdom},
+		dbfield{"path", u.RequestURI()},
+		dbfield{"proto", u.Scheme},
+		dbfield{"time", walker.NotYetCrawled},
+	}
+	if ref := referer(u, fr); ref != "" {
+		inserts = append(inserts, dbfield{"ref", ref})
+	}
+
+	if u.Sitemap != nil {
+		log4go.Fine("Inserting sitemap URL: %v", u)
+		var lastmod interface{}
+		if !u.Sitemap.LastMod.IsZero() {
+			lastmod = u.Sitemap.LastMod
+		}
+		inserts = append(inserts,
+			dbfield{"sitemap", true},
+			dbfield{"sm_lastmod", lastmod},
+			dbfield{"sm_changefreq", u.Sitemap.ChangeFreq},
+			dbfield{"sm_priority", u.Sitemap.Priority},
+		)
+		err = ds.insertLink(inserts)
+		if err != nil {
+			log4go.Error("failed inserting sitemap url (%v): %v", u, err)
+		}
+	} else {
 		log4go.Fine("Inserting parsed URL: %v", u)
-		err = ds.db.Query(`INSERT INTO links (dom, subdom, path, proto, time)
-							VALUES (?, ?, ?, ?, ?)`,
-			dom, subdom, u.RequestURI(), u.Scheme, walker.NotYetCrawled).Exec()
+		err = ds.insertLink(inserts)
 		if err != nil {
 			log4go.Error("failed inserting parsed url (%v): %v", u, err)
 		}
 	}
 }
 
+// storeEdge records in the edges table that the page source links to u,
+// which was parsed out of it
+func (ds *Datastore) storeEdge(source string, u *walker.URL, found time.Time) {
+	target := u.String()
+	rel := strings.Join(u.Link.Rel, " ")
+	insert := `INSERT INTO edges (url, out, other, anchor, rel, time) VALUES (?, ?, ?, ?, ?, ?)`
+	err := ds.db.Query(insert, source, true, target, u.Link.Text, rel, found).Exec()
+	if err == nil {
+		err = ds.db.Query(insert, target, false, source, u.Link.Text, rel, found).Exec()
+	}
+	if err != nil {
+		log4go.Error("Failed to store edge %v -> %v: %v", source, target, err)
+	}
+}
+
+// referer returns the URL that led fr to u: the link that redirected to u if
+// u is one of fr's redirects, otherwise the page fr fetched (the end of its
+// redirects), which u was parsed from or redirects to. Returns "" if fr is
+// nil.
+func referer(u *walker.URL, fr *walker.FetchResults) string {
+	if fr == nil {
+		return ""
+	}
+	prev := fr.URL
+	for _, r := range fr.RedirectedFrom {
+		if r.String() == u.String() {
+			return prev.String()
+		}
+		prev = r
+	}
+	return prev.String()
+}
+
 // KeepAlive is documented on the walker.Datastore interface.
 func (ds *Datastore) KeepAlive() error {
 	err := ds.db.Query(`INSERT INTO active_fetchers (tok) VALUES (?) USING TTL ?`,
@@ -697,6 +947,93 @@ func (ds *Datastore) UpdateDomain(domain string, info *DomainInfo, cfg DomainInf
 	return err
 }
 
+// DomainProfiles is documented on the ModelDatastore interface. Profiles that
+// fail to parse are logged and left out.
+func (ds *Datastore) DomainProfiles(domain string) (map[string]*walker.DomainProfile, error) {
+	profiles := map[string]*walker.DomainProfile{}
+	itr := ds.db.Query(`SELECT subdom, profile FROM domain_profiles WHERE dom = ?`, domain).Iter()
+	var subdom, text string
+	for itr.Scan(&subdom, &text) {
+		p, err := walker.ParseDomainProfile(text)
+		if err != nil {
+			log4go.Error("Bad domain profile for %v (subdomain %q): %v", domain, subdom, err)
+			continue
+		}
+		profiles[subdom] = p
+	}
+	err := itr.Close()
+	if err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// SetDomainProfile is documented on the ModelDatastore interface.
+func (ds *Datastore) SetDomainProfile(domain string, subdomain string, profile *walker.DomainProfile) error {
+	if profile == nil {
+		return ds.db.Query(`DELETE FROM domain_profiles WHERE dom = ? AND subdom = ?`,
+			domain, subdomain).Exec()
+	}
+	return ds.db.Query(`INSERT INTO domain_profiles (dom, subdom, profile) VALUES (?, ?, ?)`,
+		domain, subdomain, profile.String()).Exec()
+}
+
+// Keys of the bandwidth limits in walker_globals
+const (
+	bandwidthLimitKey     = "bandwidth_limit"
+	hostBandwidthLimitKey = "host_bandwidth_limit"
+)
+
+// BandwidthLimits is documented on the ModelDatastore interface.
+func (ds *Datastore) BandwidthLimits() (global int64, perHost int64, err error) {
+	global, perHost = -1, -1
+	itr := ds.db.Query(`SELECT key, val FROM walker_globals WHERE key IN (?, ?)`,
+		bandwidthLimitKey, hostBandwidthLimitKey).Iter()
+	var key string
+	var val int64
+	for itr.Scan(&key, &val) {
+		switch key {
+		case bandwidthLimitKey:
+			global = val
+		case hostBandwidthLimitKey:
+			perHost = val
+		}
+	}
+	err = itr.Close()
+	if err != nil {
+		return -1, -1, err
+	}
+	return global, perHost, nil
+}
+
+// SetBandwidthLimits is documented on the ModelDatastore interface.
+func (ds *Datastore) SetBandwidthLimits(global int64, perHost int64) error {
+	limits := []struct {
+		key string
+		val int64
+	}{
+		{bandwidthLimitKey, global},
+		{hostBandwidthLimitKey, perHost},
+	}
+	for _, l := range limits {
+		if l.val > math.MaxInt32 {
+			return fmt.Errorf("%v of %v is too large (max %v)", l.key, l.val, math.MaxInt32)
+		}
+	}
+	for _, l := range limits {
+		var err error
+		if l.val < 0 {
+			err = ds.db.Query(`DELETE FROM walker_globals WHERE key = ?`, l.key).Exec()
+		} else {
+			err = ds.db.Query(`INSERT INTO walker_globals (key, val) VALUES (?, ?)`, l.key, l.val).Exec()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //
 // LinkInfo calls
 //
@@ -719,7 +1056,7 @@ func (ds *Datastore) FindLink(u *walker.URL, collectContent bool) (*LinkInfo, er
 	}
 
 	itr := ds.db.Query(
-		`SELECT dom, subdom, path, proto, time, stat, err, robot_ex `+
+		`SELECT dom, subdom, path, proto, time, stat, err, robot_ex, robot_reason, attempts, structfp, ip, ref, encoding, canonical `+
 			extraSelect+
 			"FROM links "+
 			"WHERE dom = ? AND"+
@@ -802,7 +1139,7 @@ func (ds *Datastore) ListLinks(domain string, query LQ) ([]*LinkInfo, error) {
 	if query.Seed == nil {
 		table = []queryEntry{
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, robot_reason, attempts, structfp, ip, ref, encoding, canonical
                       FROM links 
                       WHERE dom = ?`,
 				args: []interface{}{domain},
@@ -819,7 +1156,7 @@ func (ds *Datastore) ListLinks(domain string, query LQ) ([]*LinkInfo, error) {
 
 		table = []queryEntry{
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, robot_reason, attempts, structfp, ip, ref, encoding, canonical
                       FROM links 
                       WHERE dom = ? AND 
                             subdom = ? AND 
@@ -828,14 +1165,14 @@ func (ds *Datastore) ListLinks(domain string, query LQ) ([]*LinkInfo, error) {
 				args: []interface{}{dom, sub, pat, pro},
 			},
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex 
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, robot_reason, attempts, structfp, ip, ref, encoding, canonical
                       FROM links 
                       WHERE dom = ? AND subdom = ? AND 
                             path > ?`,
 				args: []interface{}{dom, sub, pat},
 			},
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex 
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, robot_reason, attempts, structfp, ip, ref, encoding, canonical
                       FROM links 
                       WHERE dom = ? AND 
                             subdom > ?`,
@@ -865,7 +1202,8 @@ func (ds *Datastore) ListLinks(domain string, query LQ) ([]*LinkInfo, error) {
 
 func (ds *Datastore) ListLinkHistorical(u *walker.URL) ([]*LinkInfo, error) {
 	query := `SELECT dom, subdom, path, proto, time, stat,
-						err, robot_ex, redto_url, getnow, mime, fnv
+						err, robot_ex, robot_reason, redto_url, getnow, mime, fnv, simhash, structfp, attempts,
+						handler_err, ip, ref, encoding, canonical
               FROM links
               WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`
 	tld1, subtld1, err := u.TLDPlusOneAndSubdomain()
@@ -876,13 +1214,15 @@ func (ds *Datastore) ListLinkHistorical(u *walker.URL) ([]*LinkInfo, error) {
 	itr := ds.db.Query(query, tld1, subtld1, u.RequestURI(), u.Scheme).Iter()
 
 	var linfos []*LinkInfo
-	var dom, sub, path, prot, getError, mime, redtoURL string
+	var dom, sub, path, prot, getError, robotsReason, mime, redtoURL, handlerError string
+	var ip, ref, encoding, canonical string
 	var crawlTime time.Time
-	var status int
-	var fnvFP int64
+	var status, attempts int
+	var fnvFP, simhash, structFP int64
 	var robotsExcluded, getnow bool
 	for itr.Scan(&dom, &sub, &path, &prot, &crawlTime, &status,
-		&getError, &robotsExcluded, &redtoURL, &getnow, &mime, &fnvFP) {
+		&getError, &robotsExcluded, &robotsReason, &redtoURL, &getnow, &mime, &fnvFP, &simhash, &structFP,
+		&attempts, &handlerError, &ip, &ref, &encoding, &canonical) {
 		// If we need pagination here at some point...
 		//if count < seedIndex {
 		//	count++
@@ -891,15 +1231,24 @@ func (ds *Datastore) ListLinkHistorical(u *walker.URL) ([]*LinkInfo, error) {
 
 		u, _ := walker.CreateURL(dom, sub, path, prot, crawlTime)
 		linfo := &LinkInfo{
-			URL:            u,
-			Status:         status,
-			Error:          getError,
-			CrawlTime:      crawlTime,
-			RobotsExcluded: robotsExcluded,
-			RedirectedTo:   redtoURL,
-			GetNow:         getnow,
-			Mime:           mime,
-			FnvFingerprint: fnvFP,
+			URL:               u,
+			Status:            status,
+			Error:             getError,
+			CrawlTime:         crawlTime,
+			RobotsExcluded:    robotsExcluded,
+			RobotsReason:      robotsReason,
+			RedirectedTo:      redtoURL,
+			GetNow:            getnow,
+			Mime:              mime,
+			FnvFingerprint:    fnvFP,
+			SimHash:           simhash,
+			StructFingerprint: structFP,
+			Attempts:          attempts,
+			HandlerError:      handlerError,
+			RemoteIP:          ip,
+			Referer:           ref,
+			Encoding:          encoding,
+			Canonical:         canonical,
 		}
 		linfos = append(linfos, linfo)
 
@@ -912,6 +1261,167 @@ func (ds *Datastore) ListLinkHistorical(u *walker.URL) ([]*LinkInfo, error) {
 	return linfos, err
 }
 
+func (ds *Datastore) ListInlinks(u *walker.URL, limit int) ([]*Edge, error) {
+	return ds.listEdges(u, false, limit)
+}
+
+func (ds *Datastore) ListOutlinks(u *walker.URL, limit int) ([]*Edge, error) {
+	return ds.listEdges(u, true, limit)
+}
+
+// listEdges lists the edges stored under u: the links on it if out is true,
+// otherwise the links to it
+func (ds *Datastore) listEdges(u *walker.URL, out bool, limit int) ([]*Edge, error) {
+	query := `SELECT other, anchor, rel, time FROM edges WHERE url = ? AND out = ?`
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	itr := ds.db.Query(query, u.String(), out).Iter()
+
+	var edges []*Edge
+	var other, anchor, rel string
+	var found time.Time
+	for itr.Scan(&other, &anchor, &rel, &found) {
+		ou, err := walker.ParseURL(other)
+		if err != nil {
+			log4go.Error("Bad URL %q in edges of %v: %v", other, u, err)
+			continue
+		}
+		edge := &Edge{
+			Source: u,
+			Target: ou,
+			Anchor: anchor,
+			Rel:    strings.Fields(rel),
+			Time:   found,
+		}
+		if !out {
+			edge.Source, edge.Target = ou, u
+		}
+		edges = append(edges, edge)
+	}
+	return edges, itr.Close()
+}
+
+func (ds *Datastore) CountInlinks(u *walker.URL) (int, error) {
+	var count int
+	err := ds.db.Query(`SELECT COUNT(*) FROM edges WHERE url = ? AND out = ?`, u.String(), false).Scan(&count)
+	return count, err
+}
+
+func (ds *Datastore) NearDuplicates(domain string, maxDistance int) ([][]*LinkInfo, error) {
+	latest, err := ds.latestFetches(domain)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]int64, len(latest))
+	for i, linfo := range latest {
+		hashes[i] = linfo.SimHash
+	}
+
+	var dups [][]*LinkInfo
+	for _, cluster := range walker.SimHashClusters(hashes, maxDistance) {
+		group := make([]*LinkInfo, len(cluster))
+		for i, j := range cluster {
+			group[i] = latest[j]
+		}
+		dups = append(dups, group)
+	}
+	return dups, nil
+}
+
+func (ds *Datastore) TemplateGroups(domain string, minLinks int, samples int) ([]*TemplateGroup, error) {
+	latest, err := ds.latestFetches(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*TemplateGroup
+	byFP := map[int64]*TemplateGroup{}
+	for _, linfo := range latest {
+		if linfo.StructFingerprint == 0 {
+			continue
+		}
+		g, ok := byFP[linfo.StructFingerprint]
+		if !ok {
+			g = &TemplateGroup{StructFingerprint: linfo.StructFingerprint}
+			byFP[linfo.StructFingerprint] = g
+			groups = append(groups, g)
+		}
+		g.NumLinks++
+		if len(g.Links) < samples {
+			g.Links = append(g.Links, linfo)
+		}
+	}
+
+	sort.Stable(byNumLinks(groups))
+	for i, g := range groups {
+		if g.NumLinks < minLinks {
+			groups = groups[:i]
+			break
+		}
+	}
+	return groups, nil
+}
+
+// byNumLinks sorts TemplateGroups with the most links first
+type byNumLinks []*TemplateGroup
+
+func (s byNumLinks) Len() int {
+	return len(s)
+}
+
+func (s byNumLinks) Less(i, j int) bool {
+	return s[i].NumLinks > s[j].NumLinks
+}
+
+func (s byNumLinks) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// latestFetches returns a LinkInfo for the latest fetch (or parsed row, if it
+// hasn't been fetched) of each link in domain, with just the URL, Status,
+// CrawlTime, Mime, SimHash and StructFingerprint set.
+func (ds *Datastore) latestFetches(domain string) ([]*LinkInfo, error) {
+	itr := ds.db.Query(`SELECT subdom, path, proto, time, stat, mime, simhash, structfp
+						FROM links WHERE dom = ?`, domain).Iter()
+
+	var latest []*LinkInfo
+	var subdom, path, proto, mime string
+	var crawlTime time.Time
+	var status int
+	var simhash, structFP int64
+	var prev [3]string
+	for itr.Scan(&subdom, &path, &proto, &crawlTime, &status, &mime, &simhash, &structFP) {
+		u, err := walker.CreateURL(domain, subdom, path, proto, crawlTime)
+		if err != nil {
+			log4go.Error("Skipping link of %v: %v", domain, err)
+			continue
+		}
+		linfo := &LinkInfo{
+			URL:               u,
+			Status:            status,
+			CrawlTime:         crawlTime,
+			Mime:              mime,
+			SimHash:           simhash,
+			StructFingerprint: structFP,
+		}
+
+		// Rows for a link come out oldest first, so the last one is the
+		// latest fetch
+		key := [3]string{subdom, path, proto}
+		if len(latest) > 0 && key == prev {
+			latest[len(latest)-1] = linfo
+		} else {
+			latest = append(latest, linfo)
+		}
+		prev = key
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("error selecting links for %v: %v", domain, err)
+	}
+	return latest, nil
+}
+
 func (ds *Datastore) InsertLink(link string, excludeDomainReason string) error {
 	errors := ds.InsertLinks([]string{link}, excludeDomainReason)
 	if len(errors) > 0 {
@@ -1005,15 +1515,17 @@ func (ds *Datastore) InsertLinks(links []string, excludeDomainReason string) []e
 //  This is used to implement filterRegex on ListLinks]
 func (ds *Datastore) collectLinkInfos(linfos []*LinkInfo, rtimes map[string]rememberTimes, itr *gocql.Iter, limit int,
 	linkAccept func(string) bool, collectContent bool) ([]*LinkInfo, error) {
-	var domain, subdomain, path, protocol, anerror string
+	var domain, subdomain, path, protocol, anerror, robotsReason, ip, ref, encoding, canonical string
 	var crawlTime time.Time
 	var robotsExcluded bool
-	var status int
+	var status, attempts int
+	var structFP int64
 	var body string
 	var headers map[string]string
 	var httpHeaders http.Header
 
-	args := []interface{}{&domain, &subdomain, &path, &protocol, &crawlTime, &status, &anerror, &robotsExcluded}
+	args := []interface{}{&domain, &subdomain, &path, &protocol, &crawlTime, &status, &anerror, &robotsExcluded,
+		&robotsReason, &attempts, &structFP, &ip, &ref, &encoding, &canonical}
 	if collectContent {
 		args = append(args, &body, &headers)
 	}
@@ -1032,6 +1544,10 @@ func (ds *Datastore) collectLinkInfos(linfos []*LinkInfo, rtimes map[string]reme
 		qq, yes := rtimes[urlString]
 
 		if yes && qq.ctm.After(crawlTime) {
+			// Only the parsed link row (time = epoch) has the referer
+			if linfos[qq.ind].Referer == "" {
+				linfos[qq.ind].Referer = ref
+			}
 			continue
 		}
 
@@ -1048,18 +1564,28 @@ func (ds *Datastore) collectLinkInfos(linfos []*LinkInfo, rtimes map[string]reme
 		}
 
 		linfo := &LinkInfo{
-			URL:            u,
-			Status:         status,
-			Error:          anerror,
-			RobotsExcluded: robotsExcluded,
-			CrawlTime:      crawlTime,
-			Body:           body,
-			Headers:        httpHeaders,
+			URL:               u,
+			Status:            status,
+			Error:             anerror,
+			RobotsExcluded:    robotsExcluded,
+			RobotsReason:      robotsReason,
+			CrawlTime:         crawlTime,
+			Attempts:          attempts,
+			StructFingerprint: structFP,
+			RemoteIP:          ip,
+			Referer:           ref,
+			Encoding:          encoding,
+			Canonical:         canonical,
+			Body:              body,
+			Headers:           httpHeaders,
 		}
 
 		nindex := -1
 		if yes {
 			nindex = qq.ind
+			if linfo.Referer == "" {
+				linfo.Referer = linfos[qq.ind].Referer
+			}
 			linfos[qq.ind] = linfo
 		} else {
 			// If you've reached the limit, then we're all done
@@ -255,11 +255,15 @@ type LinksExpectation struct {
 	CrawlTime        time.Time
 	FetchError       string
 	ExcludedByRobots bool
+	RobotsReason     string
 	Status           int
 	MimeType         string
 	FnvFingerprint   uint64
 	Body             string
 	Headers          map[string]string
+	Attempts         int
+	ETag             string
+	LastModified     string
 }
 
 var StoreURLExpectations []StoreURLExpectation
@@ -313,6 +317,7 @@ func init() {
 			Input: &walker.FetchResults{
 				URL:              walker.MustParse("http://test.com/page3.html"),
 				ExcludedByRobots: true,
+				RobotsReason:     "disallowed by robots.txt",
 				FnvFingerprint:   3,
 			},
 			Expected: &LinksExpectation{
@@ -321,6 +326,7 @@ func init() {
 				Protocol:         "http",
 				CrawlTime:        time.Unix(0, 0),
 				ExcludedByRobots: true,
+				RobotsReason:     "disallowed by robots.txt",
 				FnvFingerprint:   3,
 			},
 		},
@@ -332,6 +338,7 @@ func init() {
 					StatusCode: 200,
 				},
 				FnvFingerprint: 4,
+				Attempts:       2,
 			},
 			Expected: &LinksExpectation{
 				Domain:         "test.com",
@@ -340,6 +347,7 @@ func init() {
 				CrawlTime:      time.Unix(1234, 5678),
 				Status:         200,
 				FnvFingerprint: 4,
+				Attempts:       2,
 			},
 		},
 		StoreURLExpectation{
@@ -409,6 +417,57 @@ func init() {
 				},
 			},
 		},
+		StoreURLExpectation{
+			Input: &walker.FetchResults{
+				URL:       walker.MustParse("http://test.com/page6.html"),
+				FetchTime: time.Unix(0, 0),
+				Response: &http.Response{
+					StatusCode: 200,
+					Header: http.Header{
+						"Etag":          []string{`"v2"`},
+						"Last-Modified": []string{"Wed, 21 Oct 2015 07:28:00 GMT"},
+					},
+				},
+			},
+			Expected: &LinksExpectation{
+				Domain:       "test.com",
+				Path:         "/page6.html",
+				Protocol:     "http",
+				CrawlTime:    time.Unix(0, 0),
+				Status:       200,
+				ETag:         `"v2"`,
+				LastModified: "Wed, 21 Oct 2015 07:28:00 GMT",
+				Headers: map[string]string{
+					"Etag":          `"v2"`,
+					"Last-Modified": "Wed, 21 Oct 2015 07:28:00 GMT",
+				},
+			},
+		},
+		StoreURLExpectation{
+			// A 304 that doesn't repeat the validators carries the previous
+			// ones forward
+			Input: &walker.FetchResults{
+				URL: &walker.URL{
+					URL:          walker.MustParse("http://test.com/page7.html").URL,
+					LastCrawled:  time.Unix(0, 0),
+					ETag:         `"v1"`,
+					LastModified: "Tue, 20 Oct 2015 07:28:00 GMT",
+				},
+				FetchTime: time.Unix(0, 0),
+				Response: &http.Response{
+					StatusCode: 304,
+				},
+			},
+			Expected: &LinksExpectation{
+				Domain:       "test.com",
+				Path:         "/page7.html",
+				Protocol:     "http",
+				CrawlTime:    time.Unix(0, 0),
+				Status:       304,
+				ETag:         `"v1"`,
+				LastModified: "Tue, 20 Oct 2015 07:28:00 GMT",
+			},
+		},
 	}
 }
 
@@ -432,15 +491,15 @@ func TestStoreURLFetchResults(t *testing.T) {
 		actual := &LinksExpectation{}
 
 		err := db.Query(
-			`SELECT err, robot_ex, stat, mime, fnv, body, headers FROM links
+			`SELECT err, robot_ex, robot_reason, stat, mime, fnv, body, headers, attempts, etag, lastmod FROM links
 			WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`, // AND time = ?`,
 			exp.Domain,
 			exp.Subdomain,
 			exp.Path,
 			exp.Protocol,
 			//exp.CrawlTime,
-		).Scan(&actual.FetchError, &actual.ExcludedByRobots, &actual.Status, &actual.MimeType, &actual.FnvFingerprint,
-			&actual.Body, &actual.Headers)
+		).Scan(&actual.FetchError, &actual.ExcludedByRobots, &actual.RobotsReason, &actual.Status, &actual.MimeType, &actual.FnvFingerprint,
+			&actual.Body, &actual.Headers, &actual.Attempts, &actual.ETag, &actual.LastModified)
 		if err != nil {
 			t.Errorf("Did not find row in links: %+v\nInput: %+v\nError: %v", exp, tcase.Input, err)
 		}
@@ -453,6 +512,10 @@ func TestStoreURLFetchResults(t *testing.T) {
 			t.Errorf("Expected robot_ex: %v\nBut got: %v\nFor input: %+v",
 				exp.ExcludedByRobots, actual.ExcludedByRobots, tcase.Input)
 		}
+		if exp.RobotsReason != actual.RobotsReason {
+			t.Errorf("Expected robot_reason: %q\nBut got: %q\nFor input: %+v",
+				exp.RobotsReason, actual.RobotsReason, tcase.Input)
+		}
 		if exp.Status != actual.Status {
 			t.Errorf("Expected stat: %v\nBut got: %v\nFor input: %+v",
 				exp.Status, actual.Status, tcase.Input)
@@ -465,6 +528,14 @@ func TestStoreURLFetchResults(t *testing.T) {
 			t.Errorf("Expected FnvFingerprint: %v\nBut got: %v\nFor input: %+v",
 				exp.FnvFingerprint, actual.FnvFingerprint, tcase.Input)
 		}
+		if exp.ETag != actual.ETag || exp.LastModified != actual.LastModified {
+			t.Errorf("Expected etag/lastmod: %q/%q\nBut got: %q/%q\nFor input: %+v",
+				exp.ETag, exp.LastModified, actual.ETag, actual.LastModified, tcase.Input)
+		}
+		if exp.Attempts != actual.Attempts {
+			t.Errorf("Expected Attempts: %v\nBut got: %v\nFor input: %+v",
+				exp.Attempts, actual.Attempts, tcase.Input)
+		}
 		if exp.Body != actual.Body {
 			t.Errorf("Expected Body: %v\nBut got: %v\nFor input: %+v",
 				exp.Body, actual.Body, tcase.Input)
@@ -993,3 +1064,577 @@ func TestUpdateDomain(t *testing.T) {
 	check("Priority & Exclude")
 
 }
+
+func TestExcludeHost(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	insertDomainInfo := `INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+								VALUES (?, ?, ?, ?)`
+	insertSegment := `INSERT INTO segments (dom, subdom, path, proto)
+						VALUES (?, ?, ?, ?)`
+	queries := []*gocql.Query{
+		db.Query(insertDomainInfo, "test.com", gocql.UUID{}, 1, true),
+		db.Query(insertSegment, "test.com", "", "page1.html", "http"),
+	}
+	for _, q := range queries {
+		err := q.Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert test data: %v\nQuery: %v", err, q)
+		}
+	}
+
+	host := ds.ClaimNewHost()
+	if host != "test.com" {
+		t.Fatalf("Expected to claim test.com, got %q", host)
+	}
+	reason := "resolved to blacklisted IP 127.0.0.1 (a private address)"
+	ds.ExcludeHost(host, reason)
+	ds.UnclaimHost(host)
+
+	dinfo, err := ds.FindDomain("test.com")
+	if dinfo == nil || err != nil {
+		t.Fatalf("Failed to FindDomain: %v", err)
+	}
+	if !dinfo.Excluded || dinfo.ExcludeReason != reason {
+		t.Errorf("Expected test.com to be excluded with reason %q, got Excluded %v, ExcludeReason %q",
+			reason, dinfo.Excluded, dinfo.ExcludeReason)
+	}
+}
+
+func TestStoreRedirectNotFollowed(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	// a.com/page1.html redirected to a.com/page2.html, which redirected to
+	// b.com/page1.html; the last redirect was not followed
+	fr := walker.FetchResults{
+		URL:            walker.MustParse("http://a.com/page1.html"),
+		RedirectedFrom: []*walker.URL{walker.MustParse("http://a.com/page2.html")},
+		FetchError: &walker.RedirectError{
+			Target: walker.MustParse("http://b.com/page1.html"),
+			Reason: "redirects to another domain are not followed (cross_domain_redirects: record)",
+		},
+		FetchTime: time.Unix(0, 0),
+	}
+	ds.StoreURLFetchResults(&fr)
+
+	expected := []struct {
+		link  string
+		redto string
+	}{
+		{link: "http://a.com/page1.html", redto: "http://a.com/page2.html"},
+		{link: "http://a.com/page2.html", redto: "http://b.com/page1.html"},
+	}
+	for _, exp := range expected {
+		url := walker.MustParse(exp.link)
+		dom, subdom, _ := url.TLDPlusOneAndSubdomain()
+		var redto string
+		err := db.Query("SELECT redto_url FROM links WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?",
+			dom, subdom, url.RequestURI(), url.Scheme).Scan(&redto)
+		if err != nil {
+			t.Errorf("Failed to find link %q: %v", exp.link, err)
+			continue
+		}
+		if redto != exp.redto {
+			t.Errorf("Redirect mismatch for %v: got %q, expected %q", exp.link, redto, exp.redto)
+		}
+	}
+
+	// The target wasn't fetched, so nothing is stored for it here
+	var count int
+	err := db.Query(`SELECT COUNT(*) FROM links WHERE dom = 'b.com'`).Scan(&count)
+	if err != nil {
+		t.Fatalf("Failed to count b.com links: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected no links stored for b.com, found %v", count)
+	}
+}
+
+func TestStoreHandlerError(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	tests := []struct {
+		link   string
+		err    error
+		getnow bool
+	}{
+		{"http://a.com/ok.html", nil, false},
+		{"http://a.com/bad.html", fmt.Errorf("bad"), false},
+		{"http://a.com/retry.html", walker.RetryLater(fmt.Errorf("busy")), true},
+	}
+	for _, test := range tests {
+		ds.StoreURLFetchResults(&walker.FetchResults{
+			URL:          walker.MustParse(test.link),
+			FetchTime:    time.Unix(0, 0),
+			HandlerError: test.err,
+		})
+	}
+
+	for _, test := range tests {
+		url := walker.MustParse(test.link)
+		dom, subdom, _ := url.TLDPlusOneAndSubdomain()
+		var handlerErr string
+		var getnow bool
+		err := db.Query(`SELECT handler_err, getnow FROM links
+						WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`,
+			dom, subdom, url.RequestURI(), url.Scheme).Scan(&handlerErr, &getnow)
+		if err != nil {
+			t.Errorf("Failed to find link %q: %v", test.link, err)
+			continue
+		}
+		expected := ""
+		if test.err != nil {
+			expected = test.err.Error()
+		}
+		if handlerErr != expected {
+			t.Errorf("handler_err mismatch for %v: got %q, expected %q", test.link, handlerErr, expected)
+		}
+		if getnow != test.getnow {
+			t.Errorf("getnow mismatch for %v: got %v, expected %v", test.link, getnow, test.getnow)
+		}
+
+		linfos, err := ds.ListLinkHistorical(url)
+		if err != nil {
+			t.Errorf("ListLinkHistorical failed for %v: %v", test.link, err)
+			continue
+		}
+		if len(linfos) != 1 || linfos[0].HandlerError != expected {
+			t.Errorf("Expected one historical entry with HandlerError %q for %v", expected, test.link)
+		}
+	}
+}
+
+func TestStoreHandlerRetriesCapped(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	orig := walker.Config.Cassandra.MaxHandlerRetries
+	defer func() { walker.Config.Cassandra.MaxHandlerRetries = orig }()
+	walker.Config.Cassandra.MaxHandlerRetries = 2
+
+	url := walker.MustParse("http://a.com/retry.html")
+	dom, subdom, _ := url.TLDPlusOneAndSubdomain()
+	store := func(sec int64, err error) {
+		ds.StoreURLFetchResults(&walker.FetchResults{
+			URL:          url,
+			FetchTime:    time.Unix(sec, 0),
+			HandlerError: err,
+		})
+	}
+	expect := func(sec int64, retries int, getnow bool) {
+		var gotRetries int
+		var gotGetnow bool
+		err := db.Query(`SELECT handler_retries, getnow FROM links
+						WHERE dom = ? AND subdom = ? AND path = ? AND proto = ? AND time = ?`,
+			dom, subdom, url.RequestURI(), url.Scheme, time.Unix(sec, 0)).Scan(&gotRetries, &gotGetnow)
+		if err != nil {
+			t.Errorf("Failed to find crawl %v of %v: %v", sec, url, err)
+			return
+		}
+		if gotRetries != retries || gotGetnow != getnow {
+			t.Errorf("Crawl %v: got handler_retries %v, getnow %v; expected %v, %v",
+				sec, gotRetries, gotGetnow, retries, getnow)
+		}
+	}
+
+	busy := walker.RetryLater(fmt.Errorf("busy"))
+	for sec := int64(1); sec <= 3; sec++ {
+		store(sec, busy)
+	}
+	expect(1, 1, true)
+	expect(2, 2, true)
+	expect(3, 3, false)
+
+	// A fetch the handler didn't ask to retry starts the count over
+	store(4, nil)
+	store(5, busy)
+	expect(4, 0, false)
+	expect(5, 1, true)
+
+	// An async handler's error counts the same, whether it's stored after
+	// the fetch results or before
+	ds.StoreHandlerError(&walker.FetchResults{URL: url, FetchTime: time.Unix(6, 0)}, busy)
+	store(6, nil)
+	expect(6, 2, true)
+	store(7, nil)
+	ds.StoreHandlerError(&walker.FetchResults{URL: url, FetchTime: time.Unix(7, 0)}, busy)
+	expect(7, 3, false)
+
+	var handlerErr string
+	err := db.Query(`SELECT handler_err FROM links
+					WHERE dom = ? AND subdom = ? AND path = ? AND proto = ? AND time = ?`,
+		dom, subdom, url.RequestURI(), url.Scheme, time.Unix(7, 0)).Scan(&handlerErr)
+	if err != nil || handlerErr != busy.Error() {
+		t.Errorf("Expected handler_err %q stored by StoreHandlerError, got %q (%v)", busy.Error(), handlerErr, err)
+	}
+}
+
+func TestNearDuplicates(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	insertLink := `INSERT INTO links (dom, subdom, path, proto, time, simhash) VALUES (?, ?, ?, ?, ?, ?)`
+	queries := []*gocql.Query{
+		db.Query(insertLink, "a.com", "", "/1.html", "http", time.Unix(1000, 0), 0x0f0f0f0f0f0f0f0f),
+		db.Query(insertLink, "a.com", "www", "/2.html", "http", time.Unix(1000, 0), 0x0f0f0f0f0f0f0f0e),
+		db.Query(insertLink, "a.com", "", "/3.html", "http", time.Unix(1000, 0), 0x7070707070707070),
+		db.Query(insertLink, "a.com", "", "/4.html", "http", time.Unix(1000, 0), 0x7070707070707071),
+
+		// Only the latest fetch counts; /5.html used to match /1.html
+		db.Query(insertLink, "a.com", "", "/5.html", "http", time.Unix(1000, 0), 0x0f0f0f0f0f0f0f0f),
+		db.Query(insertLink, "a.com", "", "/5.html", "http", time.Unix(2000, 0), 0x5555555555555555),
+
+		// Links without a SimHash are never duplicates
+		db.Query(`INSERT INTO links (dom, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?)`,
+			"a.com", "", "/6.html", "http", walker.NotYetCrawled),
+		db.Query(`INSERT INTO links (dom, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?)`,
+			"a.com", "", "/7.html", "http", walker.NotYetCrawled),
+
+		// Other domains aren't included
+		db.Query(insertLink, "b.com", "", "/1.html", "http", time.Unix(1000, 0), 0x0f0f0f0f0f0f0f0f),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert link: %v\nQuery: %v", err, q)
+		}
+	}
+
+	groups, err := ds.NearDuplicates("a.com", 3)
+	if err != nil {
+		t.Fatalf("NearDuplicates failed: %v", err)
+	}
+	var got [][]string
+	for _, group := range groups {
+		var links []string
+		for _, linfo := range group {
+			links = append(links, linfo.URL.String())
+		}
+		got = append(got, links)
+	}
+	expected := [][]string{
+		{"http://a.com/1.html", "http://www.a.com/2.html"},
+		{"http://a.com/3.html", "http://a.com/4.html"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("NearDuplicates mismatch\nGot:      %v\nExpected: %v", got, expected)
+	}
+
+	groups, err = ds.NearDuplicates("a.com", 0)
+	if err != nil {
+		t.Fatalf("NearDuplicates failed: %v", err)
+	}
+	if len(groups) != 0 {
+		t.Errorf("Expected no exact SimHash matches, got %v", groups)
+	}
+}
+
+func TestTemplateGroups(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	fetched := []struct {
+		link     string
+		structFP int64
+	}{
+		{"http://a.com/search?q=1", 10},
+		{"http://a.com/search?q=2", 10},
+		{"http://a.com/search?q=3", 10},
+		{"http://a.com/about.html", 20},
+		{"http://www.a.com/", 30},
+		{"http://www.a.com/index.html", 30},
+		{"http://a.com/notes.txt", 0},
+		{"http://b.com/search?q=1", 10},
+	}
+	for _, f := range fetched {
+		ds.StoreURLFetchResults(&walker.FetchResults{
+			URL:               walker.MustParse(f.link),
+			FetchTime:         time.Unix(1000, 0),
+			StructFingerprint: f.structFP,
+		})
+	}
+	// Only the latest fetch counts; about.html used to look like a search
+	ds.StoreURLFetchResults(&walker.FetchResults{
+		URL:               walker.MustParse("http://a.com/about.html"),
+		FetchTime:         time.Unix(500, 0),
+		StructFingerprint: 10,
+	})
+
+	groups, err := ds.TemplateGroups("a.com", 2, 2)
+	if err != nil {
+		t.Fatalf("TemplateGroups failed: %v", err)
+	}
+	type group struct {
+		fp    int64
+		num   int
+		links []string
+	}
+	var got []group
+	for _, g := range groups {
+		gr := group{fp: g.StructFingerprint, num: g.NumLinks}
+		for _, linfo := range g.Links {
+			gr.links = append(gr.links, linfo.URL.String())
+		}
+		got = append(got, gr)
+	}
+	expected := []group{
+		{10, 3, []string{"http://a.com/search?q=1", "http://a.com/search?q=2"}},
+		{30, 2, []string{"http://www.a.com/", "http://www.a.com/index.html"}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("TemplateGroups mismatch\nGot:      %+v\nExpected: %+v", got, expected)
+	}
+
+	groups, err = ds.TemplateGroups("a.com", 1, 10)
+	if err != nil {
+		t.Fatalf("TemplateGroups failed: %v", err)
+	}
+	if len(groups) != 3 || groups[2].StructFingerprint != 20 {
+		t.Errorf("Expected 3 groups with the single about.html last, got %v", groups)
+	}
+
+	// The fingerprint is returned with the link too
+	linfo, err := ds.FindLink(walker.MustParse("http://a.com/search?q=1"), false)
+	if err != nil {
+		t.Fatalf("FindLink failed: %v", err)
+	}
+	if linfo.StructFingerprint != 10 {
+		t.Errorf("Expected FindLink to return StructFingerprint 10, got %v", linfo.StructFingerprint)
+	}
+	linfos, err := ds.ListLinkHistorical(walker.MustParse("http://a.com/about.html"))
+	if err != nil {
+		t.Fatalf("ListLinkHistorical failed: %v", err)
+	}
+	if len(linfos) != 2 || linfos[0].StructFingerprint != 10 || linfos[1].StructFingerprint != 20 {
+		t.Errorf("Expected ListLinkHistorical to return each fetch's StructFingerprint, got %v", linfos)
+	}
+}
+
+func TestFetchContext(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched) VALUES (?, ?, ?, ?)`,
+		"test2.com", gocql.UUID{}, 1, false).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test2.com: %v", err)
+	}
+
+	page := walker.MustParse("http://test2.com/index.html")
+	fr := &walker.FetchResults{
+		URL:            walker.MustParse("http://test2.com/"),
+		RedirectedFrom: []*walker.URL{page},
+		FetchTime:      time.Unix(1000, 0),
+		RemoteIP:       "203.0.113.7",
+		Encoding:       "windows-1252",
+		Canonical:      walker.MustParse("http://test2.com/canonical.html"),
+		Response:       &http.Response{StatusCode: 200},
+	}
+	ds.StoreURLFetchResults(fr)
+	ds.StoreParsedURL(walker.MustParse("http://test2.com/parsed.html"), fr)
+	ds.StoreParsedURL(page, fr)
+	ds.StoreParsedURL(walker.MustParse("http://test2.com/seeded.html"), nil)
+
+	referers := map[string]string{
+		"http://test2.com/parsed.html": "http://test2.com/index.html",
+		"http://test2.com/index.html":  "http://test2.com/",
+		"http://test2.com/seeded.html": "",
+	}
+	for link, ref := range referers {
+		linfo, err := ds.FindLink(walker.MustParse(link), false)
+		if err != nil || linfo == nil {
+			t.Errorf("FindLink failed for %v: %v", link, err)
+			continue
+		}
+		if linfo.Referer != ref {
+			t.Errorf("Referer mismatch for %v: got %q, expected %q", link, linfo.Referer, ref)
+		}
+	}
+
+	// index.html has both a fetch and a parsed link row
+	linfo, err := ds.FindLink(page, false)
+	if err != nil {
+		t.Fatalf("FindLink failed: %v", err)
+	}
+	if linfo.RemoteIP != "203.0.113.7" || linfo.Encoding != "windows-1252" ||
+		linfo.Canonical != "http://test2.com/canonical.html" {
+		t.Errorf("Expected FindLink to return the latest fetch's IP, encoding and canonical, got %q, %q and %q",
+			linfo.RemoteIP, linfo.Encoding, linfo.Canonical)
+	}
+	linfos, err := ds.ListLinkHistorical(page)
+	if err != nil {
+		t.Fatalf("ListLinkHistorical failed: %v", err)
+	}
+	if len(linfos) != 2 || linfos[0].Referer != "http://test2.com/" || linfos[1].RemoteIP != "203.0.113.7" ||
+		linfos[1].Encoding != "windows-1252" || linfos[1].Canonical != "http://test2.com/canonical.html" {
+		t.Errorf("Expected ListLinkHistorical to return the referer and the fetch's IP, encoding and canonical, got %+v",
+			linfos)
+	}
+}
+
+func TestEdges(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	orig := walker.Config.Cassandra.StoreEdges
+	defer func() { walker.Config.Cassandra.StoreEdges = orig }()
+
+	link := func(target string, text string, rel ...string) *walker.URL {
+		u := walker.MustParse(target)
+		u.Link = &walker.LinkHints{Text: text, Rel: rel}
+		return u
+	}
+	page1 := &walker.FetchResults{URL: walker.MustParse("http://a.com/page1.html"), FetchTime: time.Unix(1000, 0)}
+	page2 := &walker.FetchResults{URL: walker.MustParse("http://b.com/page2.html"), FetchTime: time.Unix(2000, 0)}
+
+	walker.Config.Cassandra.StoreEdges = false
+	ds.StoreParsedURL(link("http://a.com/ignored.html", "Ignored"), page1)
+
+	walker.Config.Cassandra.StoreEdges = true
+	ds.StoreParsedURL(link("http://a.com/target.html", "Target", "nofollow"), page1)
+	ds.StoreParsedURL(link("http://a.com/other.html", "Other"), page1)
+	ds.StoreParsedURL(link("http://a.com/target.html", "The target"), page2)
+	// Links that weren't parsed out of a page aren't edges
+	ds.StoreParsedURL(walker.MustParse("http://a.com/seeded.html"), nil)
+	ds.StoreParsedURL(walker.MustParse("http://a.com/redirected.html"), page1)
+
+	target := walker.MustParse("http://a.com/target.html")
+	inlinks, err := ds.ListInlinks(target, 0)
+	if err != nil {
+		t.Fatalf("ListInlinks failed: %v", err)
+	}
+	type edge struct {
+		source, target, anchor, rel string
+		time                        int64
+	}
+	var got []edge
+	for _, e := range inlinks {
+		got = append(got, edge{e.Source.String(), e.Target.String(), e.Anchor, strings.Join(e.Rel, " "), e.Time.Unix()})
+	}
+	expected := []edge{
+		{"http://a.com/page1.html", "http://a.com/target.html", "Target", "nofollow", 1000},
+		{"http://b.com/page2.html", "http://a.com/target.html", "The target", "", 2000},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("ListInlinks mismatch\nGot:      %v\nExpected: %v", got, expected)
+	}
+
+	count, err := ds.CountInlinks(target)
+	if err != nil || count != 2 {
+		t.Errorf("Expected CountInlinks to return 2, got %v (%v)", count, err)
+	}
+	inlinks, err = ds.ListInlinks(target, 1)
+	if err != nil || len(inlinks) != 1 {
+		t.Errorf("Expected ListInlinks to return 1 edge with limit 1, got %v (%v)", inlinks, err)
+	}
+
+	outlinks, err := ds.ListOutlinks(page1.URL, 0)
+	if err != nil {
+		t.Fatalf("ListOutlinks failed: %v", err)
+	}
+	var targets []string
+	for _, e := range outlinks {
+		if e.Source.String() != "http://a.com/page1.html" {
+			t.Errorf("Expected outlinks from page1.html, got one from %v", e.Source)
+		}
+		targets = append(targets, e.Target.String())
+	}
+	if !reflect.DeepEqual(targets, []string{"http://a.com/other.html", "http://a.com/target.html"}) {
+		t.Errorf("Unexpected outlinks of page1.html: %v", targets)
+	}
+
+	for _, u := range []string{"http://a.com/ignored.html", "http://a.com/seeded.html", "http://a.com/redirected.html"} {
+		if count, _ := ds.CountInlinks(walker.MustParse(u)); count != 0 {
+			t.Errorf("Expected no edges to %v, got %v", u, count)
+		}
+	}
+}
+
+func TestDomainProfiles(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	var _ walker.DomainProfiler = ds
+
+	err := ds.SetDomainProfile("test.com", "", &walker.DomainProfile{UserAgent: "Partner Bot"})
+	if err != nil {
+		t.Fatalf("Failed to SetDomainProfile: %v", err)
+	}
+	err = ds.SetDomainProfile("test.com", "www", &walker.DomainProfile{DefaultCrawlDelay: "100ms"})
+	if err != nil {
+		t.Fatalf("Failed to SetDomainProfile: %v", err)
+	}
+	// A bad profile (written other than through SetDomainProfile) is skipped
+	err = db.Query(`INSERT INTO domain_profiles (dom, subdom, profile) VALUES (?, ?, ?)`,
+		"test.com", "bad", "default_crawl_delay: soon").Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	profiles, err := ds.DomainProfiles("test.com")
+	if err != nil {
+		t.Fatalf("Failed to get DomainProfiles: %v", err)
+	}
+	expected := map[string]*walker.DomainProfile{
+		"":    &walker.DomainProfile{UserAgent: "Partner Bot"},
+		"www": &walker.DomainProfile{DefaultCrawlDelay: "100ms"},
+	}
+	if !reflect.DeepEqual(profiles, expected) {
+		t.Errorf("DomainProfiles mismatch\nGot:      %v\nExpected: %v", profiles, expected)
+	}
+
+	err = ds.SetDomainProfile("test.com", "www", nil)
+	if err != nil {
+		t.Fatalf("Failed to remove profile: %v", err)
+	}
+	profiles, err = ds.DomainProfiles("test.com")
+	if err != nil {
+		t.Fatalf("Failed to get DomainProfiles: %v", err)
+	}
+	if _, ok := profiles["www"]; ok || len(profiles) != 1 {
+		t.Errorf("Expected only the test.com profile after removing www, got %v", profiles)
+	}
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	var _ walker.BandwidthLimitStore = ds
+
+	err := ds.SetBandwidthLimits(-1, -1)
+	if err != nil {
+		t.Fatalf("Failed to clear bandwidth limits: %v", err)
+	}
+	global, perHost, err := ds.BandwidthLimits()
+	if err != nil {
+		t.Fatalf("Failed to get BandwidthLimits: %v", err)
+	}
+	if global != -1 || perHost != -1 {
+		t.Errorf("Expected no limits to be set, got %v and %v", global, perHost)
+	}
+
+	err = ds.SetBandwidthLimits(1000000, 0)
+	if err != nil {
+		t.Fatalf("Failed to SetBandwidthLimits: %v", err)
+	}
+	global, perHost, err = ds.BandwidthLimits()
+	if err != nil {
+		t.Fatalf("Failed to get BandwidthLimits: %v", err)
+	}
+	if global != 1000000 || perHost != 0 {
+		t.Errorf("Expected limits 1000000 and 0, got %v and %v", global, perHost)
+	}
+
+	err = ds.SetBandwidthLimits(1<<40, 0)
+	if err == nil {
+		t.Errorf("Expected an error setting a limit too large to store")
+	}
+
+	err = ds.SetBandwidthLimits(-1, -1)
+	if err != nil {
+		t.Fatalf("Failed to clear bandwidth limits: %v", err)
+	}
+}
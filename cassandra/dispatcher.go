@@ -4,6 +4,7 @@ import (
 	"container/heap"
 	"fmt"
 	"math"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -11,6 +12,17 @@ import (
 	"code.google.com/p/log4go"
 	"github.com/gocql/gocql"
 	"github.com/iParadigms/walker"
+	"github.com/iParadigms/walker/metrics"
+)
+
+// Dispatcher metrics, served at /metrics (see the metrics package)
+var (
+	segmentsMetric = metrics.NewCounterVec("walker_dispatcher_segments_total",
+		"Segment generations, by result (dispatched, empty, pruned or error)", "result")
+	segmentDurationMetric = metrics.NewHistogram("walker_dispatcher_segment_duration_seconds",
+		"Time taken to generate a segment for a domain", metrics.DefBuckets)
+	segmentLinksMetric = metrics.NewCounter("walker_dispatcher_segment_links_total",
+		"Links dispatched in segments")
 )
 
 // Dispatcher analyzes what we've crawled so far (generally on a per-domain
@@ -357,9 +369,12 @@ func (d *Dispatcher) quitSignaled() bool {
 func (d *Dispatcher) generateRoutine() {
 	for domain := range d.domains {
 		d.generatingWG.Add(1)
+		start := time.Now()
 		if err := d.generateSegment(domain); err != nil {
 			log4go.Error("error generating segment for %v: %v", domain, err)
+			segmentsMetric.WithLabelValues("error").Inc()
 		}
+		segmentDurationMetric.Observe(time.Since(start).Seconds())
 		d.generatingWG.Done()
 	}
 	log4go.Debug("Finishing generateRoutine")
@@ -395,6 +410,27 @@ type cell struct {
 	subdom, path, proto string
 	crawlTime           time.Time
 	getnow              bool
+	etag, lastmod       string
+	simhash             int64
+	canonical           string
+
+	// sitemap hints, see the links table
+	sitemap      bool
+	smLastmod    time.Time
+	smChangefreq string
+	smPriority   float64
+}
+
+// carrySitemapHints copies the sitemap hints of an earlier row for the same
+// link, since they are only stored on the row for the parsed link.
+func (c *cell) carrySitemapHints(earlier *cell) {
+	if c.sitemap || !earlier.sitemap {
+		return
+	}
+	c.sitemap = true
+	c.smLastmod = earlier.smLastmod
+	c.smChangefreq = earlier.smChangefreq
+	c.smPriority = earlier.smPriority
 }
 
 // 2 cells are equivalent if their full link renders to the same string.
@@ -441,6 +477,22 @@ func (pq *PriorityURL) Pop() interface{} {
 	return x
 }
 
+// bySitemapPriority sorts URLs found in sitemaps by descending sitemap
+// priority.
+type bySitemapPriority []*walker.URL
+
+func (s bySitemapPriority) Len() int {
+	return len(s)
+}
+
+func (s bySitemapPriority) Less(i, j int) bool {
+	return s[i].Sitemap.Priority > s[j].Sitemap.Priority
+}
+
+func (s bySitemapPriority) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
 // createInsertAllColumns produces an insert statement that will usable to clone a CQL row. Arguments are:
 //   (a) the table that the cloned rows are coming from
 //   (b) An iterator that points to the set of rows the user plans to copy
@@ -581,6 +633,7 @@ func (d *Dispatcher) generateSegment(domain string) error {
 	}
 	if lastEmptyDispatch.After(lastDispatch) && time.Since(lastEmptyDispatch) < d.emptyDispatchRetryInterval {
 		log4go.Debug("generateSegment pruned dispatch of domain %v", domain)
+		segmentsMetric.WithLabelValues("pruned").Inc()
 		return nil
 	}
 
@@ -594,6 +647,17 @@ func (d *Dispatcher) generateSegment(domain string) error {
 	var crawledLinks PriorityURL     // already crawled links, oldest links out first
 	heap.Init(&crawledLinks)
 
+	// Crawled links due for a refresh, and their SimHashes; near-duplicates
+	// among them go to duplicateLinks, refreshed after everything else
+	var refreshLinks []*walker.URL
+	var refreshHashes []int64
+	var duplicateLinks PriorityURL
+	heap.Init(&duplicateLinks)
+
+	// Uncrawled links found in sitemaps go ahead of other uncrawled links,
+	// highest sitemap priority first
+	var sitemapLinks bySitemapPriority
+
 	// cell push will push the argument cell onto one of the three link-lists.
 	// logs failure if CreateURL fails. It also keeps track of total and uncrawled
 	// links by incrementing linksCount and uncrawledLinksCount
@@ -613,20 +677,47 @@ func (d *Dispatcher) generateSegment(domain string) error {
 			return
 		}
 
+		u.ETag = c.etag
+		u.LastModified = c.lastmod
+
 		if walker.Config.Dispatcher.CorrectLinkNormalization {
 			u = d.correctURLNormalization(u)
 		}
 
-		if c.getnow {
+		if c.sitemap {
+			u.Sitemap = &walker.SitemapHints{
+				LastMod:    c.smLastmod,
+				ChangeFreq: c.smChangefreq,
+				Priority:   c.smPriority,
+			}
+		}
+
+		// A sitemap saying the page changed since we crawled it is as good as
+		// getnow
+		changed := c.sitemap && !c.crawlTime.Equal(walker.NotYetCrawled) && c.smLastmod.After(c.crawlTime)
+
+		if c.getnow || changed {
 			getNowLinks = append(getNowLinks, u)
+		} else if c.crawlTime.Equal(walker.NotYetCrawled) && c.sitemap {
+			sitemapLinks = append(sitemapLinks, u)
+			if len(sitemapLinks) >= 2*limit {
+				sort.Stable(sitemapLinks)
+				sitemapLinks = sitemapLinks[:limit]
+			}
 		} else if c.crawlTime.Equal(walker.NotYetCrawled) {
 			if len(uncrawledLinks) < limit {
 				uncrawledLinks = append(uncrawledLinks, u)
 			}
+		} else if c.sitemap && c.smChangefreq == "never" {
+			// The sitemap says it's archived, don't bother refreshing it
+		} else if walker.Config.Dispatcher.SkipNonCanonical && c.canonical != "" && c.canonical != u.String() {
+			// The page said another page is the canonical version of it,
+			// which is crawled as a link of its own
 		} else {
 			// Was this link crawled less than MinLinkRefreshTime?
 			if c.crawlTime.Add(d.minRecrawlDelta).Before(now) {
-				heap.Push(&crawledLinks, u)
+				refreshLinks = append(refreshLinks, u)
+				refreshHashes = append(refreshHashes, c.simhash)
 			}
 		}
 
@@ -643,7 +734,8 @@ func (d *Dispatcher) generateSegment(domain string) error {
 	// The only risk is: if a node is down and does not receive some link
 	// writes, then comes back up and is read for this query it may be missing
 	// some of the newly crawled links. This is unlikely and seems acceptable.
-	q := d.db.Query(`SELECT subdom, path, proto, time, getnow
+	q := d.db.Query(`SELECT subdom, path, proto, time, getnow, etag, lastmod,
+							sitemap, sm_lastmod, sm_changefreq, sm_priority, simhash, canonical
 						FROM links WHERE dom = ?`, domain)
 	q.Consistency(gocql.One)
 
@@ -652,11 +744,17 @@ func (d *Dispatcher) generateSegment(domain string) error {
 	var current cell
 	var previous cell
 	iter := q.Iter()
-	for iter.Scan(&current.subdom, &current.path, &current.proto, &current.crawlTime, &current.getnow) {
+	for iter.Scan(&current.subdom, &current.path, &current.proto, &current.crawlTime, &current.getnow,
+		&current.etag, &current.lastmod,
+		&current.sitemap, &current.smLastmod, &current.smChangefreq, &current.smPriority, &current.simhash,
+		&current.canonical) {
 		if start {
 			previous = current
 			start = false
 		}
+		if current.equivalent(&previous) {
+			current.carrySitemapHints(&previous)
+		}
 
 		// IMPL NOTE: So the trick here is that, within a given domain, the entries
 		// come out so that the crawlTime increases as you iterate. So in order to
@@ -681,6 +779,33 @@ func (d *Dispatcher) generateSegment(domain string) error {
 		return fmt.Errorf("error selecting links for %v: %v", domain, err)
 	}
 
+	sort.Stable(sitemapLinks)
+	if len(sitemapLinks) > limit {
+		sitemapLinks = sitemapLinks[:limit]
+	}
+	uncrawledLinks = append(sitemapLinks, uncrawledLinks...)
+
+	// Of each group of near-duplicates, only the one crawled longest ago is
+	// refreshed with the other crawled links
+	duplicate := make([]bool, len(refreshLinks))
+	for _, cluster := range walker.SimHashClusters(refreshHashes, walker.Config.Dispatcher.NearDuplicateDistance) {
+		oldest := cluster[0]
+		for _, i := range cluster {
+			duplicate[i] = true
+			if refreshLinks[i].LastCrawled.Before(refreshLinks[oldest].LastCrawled) {
+				oldest = i
+			}
+		}
+		duplicate[oldest] = false
+	}
+	for i, u := range refreshLinks {
+		if duplicate[i] {
+			heap.Push(&duplicateLinks, u)
+		} else {
+			heap.Push(&crawledLinks, u)
+		}
+	}
+
 	//
 	// Merge the 3 link types
 	//
@@ -710,6 +835,10 @@ func (d *Dispatcher) generateSegment(domain string) error {
 		for crawledLinks.Len() > 0 && len(links) < limit {
 			links = append(links, heap.Pop(&crawledLinks).(*walker.URL))
 		}
+
+		for duplicateLinks.Len() > 0 && len(links) < limit {
+			links = append(links, heap.Pop(&duplicateLinks).(*walker.URL))
+		}
 	}
 
 	//
@@ -723,9 +852,9 @@ func (d *Dispatcher) generateSegment(domain string) error {
 			return err
 		}
 		err = d.db.Query(`INSERT INTO segments
-			(dom, subdom, path, proto, time)
-			VALUES (?, ?, ?, ?, ?)`,
-			dom, subdom, u.RequestURI(), u.Scheme, u.LastCrawled).Exec()
+			(dom, subdom, path, proto, time, etag, lastmod)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			dom, subdom, u.RequestURI(), u.Scheme, u.LastCrawled, u.ETag, u.LastModified).Exec()
 		if err != nil {
 			log4go.Error("Failed to insert link (%v), error: %v", u, err)
 		}
@@ -765,5 +894,11 @@ func (d *Dispatcher) generateSegment(domain string) error {
 	}
 	log4go.Info("Generated segment for %v (%v links)", domain, len(links))
 
+	if dispatched {
+		segmentsMetric.WithLabelValues("dispatched").Inc()
+		segmentLinksMetric.Add(int64(len(links)))
+	} else {
+		segmentsMetric.WithLabelValues("empty").Inc()
+	}
 	return nil
 }
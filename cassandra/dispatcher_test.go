@@ -3,6 +3,8 @@
 package cassandra
 
 import (
+	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -1159,3 +1161,252 @@ func TestDispatchPruning(t *testing.T) {
 	}
 
 }
+
+func TestDispatcherCarriesValidators(t *testing.T) {
+	db := GetTestDB()
+	q := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+					VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false)
+	if err := q.Exec(); err != nil {
+		t.Fatalf("Failed to insert test domain info: %v\nQuery: %v", err, q)
+	}
+
+	// Only the validators of the latest crawl should be dispatched
+	insertLink := `INSERT INTO links (dom, subdom, path, proto, time, etag, lastmod) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	err := db.Query(insertLink, "test.com", "", "/page1.html", "http", time.Now().AddDate(0, 0, -2),
+		`"old"`, "Mon, 19 Oct 2015 07:28:00 GMT").Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert link: %v", err)
+	}
+	err = db.Query(insertLink, "test.com", "", "/page1.html", "http", time.Now().AddDate(0, 0, -1),
+		`"new"`, "Tue, 20 Oct 2015 07:28:00 GMT").Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert link: %v", err)
+	}
+
+	runDispatcher(t)
+
+	ds := getDS(t)
+	var links []*walker.URL
+	for u := range ds.LinksForHost("test.com") {
+		links = append(links, u)
+	}
+	if len(links) != 1 {
+		t.Fatalf("Expected 1 link in segment, got %v", links)
+	}
+	if links[0].ETag != `"new"` || links[0].LastModified != "Tue, 20 Oct 2015 07:28:00 GMT" {
+		t.Errorf("Expected latest validators, got ETag %q, LastModified %q",
+			links[0].ETag, links[0].LastModified)
+	}
+}
+
+func TestDispatcherSitemapHints(t *testing.T) {
+	origMaxLinksPerSegment := walker.Config.Dispatcher.MaxLinksPerSegment
+	defer func() {
+		walker.Config.Dispatcher.MaxLinksPerSegment = origMaxLinksPerSegment
+	}()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 2
+
+	db := GetTestDB()
+	q := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+					VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false)
+	if err := q.Exec(); err != nil {
+		t.Fatalf("Failed to insert test domain info: %v\nQuery: %v", err, q)
+	}
+
+	insertLink := `INSERT INTO links (dom, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?)`
+	insertSitemapLink := `INSERT INTO links (dom, subdom, path, proto, time, sitemap, sm_lastmod, sm_priority)
+							VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	now := time.Now()
+	queries := []*gocql.Query{
+		// An uncrawled link not in any sitemap
+		db.Query(insertLink, "test.com", "", "/a.html", "http", walker.NotYetCrawled),
+		// Uncrawled sitemap links, which go before /a.html by priority
+		db.Query(insertSitemapLink, "test.com", "", "/b.html", "http", walker.NotYetCrawled,
+			true, nil, 0.9),
+		db.Query(insertSitemapLink, "test.com", "", "/c.html", "http", walker.NotYetCrawled,
+			true, nil, 0.1),
+		// A crawled link the sitemap says has changed since
+		db.Query(insertSitemapLink, "test.com", "", "/d.html", "http", walker.NotYetCrawled,
+			true, now.AddDate(0, 0, -1), 0.5),
+		db.Query(insertLink, "test.com", "", "/d.html", "http", now.AddDate(0, 0, -2)),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert link: %v\nQuery: %v", err, q)
+		}
+	}
+
+	runDispatcher(t)
+
+	ds := getDS(t)
+	expected := map[string]bool{
+		"http://test.com/b.html": true,
+		"http://test.com/d.html": true,
+	}
+	var links []*walker.URL
+	for u := range ds.LinksForHost("test.com") {
+		links = append(links, u)
+		if !expected[u.String()] {
+			t.Errorf("Unexpected link in segment: %v", u)
+		}
+		delete(expected, u.String())
+	}
+	for link := range expected {
+		t.Errorf("Expected %v in segment, got %v", link, links)
+	}
+}
+
+func TestDispatcherNearDuplicates(t *testing.T) {
+	origMaxLinksPerSegment := walker.Config.Dispatcher.MaxLinksPerSegment
+	origNearDuplicateDistance := walker.Config.Dispatcher.NearDuplicateDistance
+	defer func() {
+		walker.Config.Dispatcher.MaxLinksPerSegment = origMaxLinksPerSegment
+		walker.Config.Dispatcher.NearDuplicateDistance = origNearDuplicateDistance
+	}()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 2
+	walker.Config.Dispatcher.NearDuplicateDistance = 6
+
+	db := GetTestDB()
+	q := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+					VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false)
+	if err := q.Exec(); err != nil {
+		t.Fatalf("Failed to insert test domain info: %v\nQuery: %v", err, q)
+	}
+
+	// /b.html is a near-duplicate of /a.html, so /c.html is refreshed before
+	// it even though /b.html was crawled longer ago
+	insertLink := `INSERT INTO links (dom, subdom, path, proto, time, simhash) VALUES (?, ?, ?, ?, ?, ?)`
+	now := time.Now()
+	queries := []*gocql.Query{
+		db.Query(insertLink, "test.com", "", "/a.html", "http", now.AddDate(0, 0, -3), 0x0f0f0f0f0f0f0f0f),
+		db.Query(insertLink, "test.com", "", "/b.html", "http", now.AddDate(0, 0, -2), 0x0f0f0f0f0f0f0f0e),
+		db.Query(insertLink, "test.com", "", "/c.html", "http", now.AddDate(0, 0, -1), 0x7070707070707070),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert link: %v\nQuery: %v", err, q)
+		}
+	}
+
+	runDispatcher(t)
+
+	ds := getDS(t)
+	expected := map[string]bool{
+		"http://test.com/a.html": true,
+		"http://test.com/c.html": true,
+	}
+	var links []*walker.URL
+	for u := range ds.LinksForHost("test.com") {
+		links = append(links, u)
+		if !expected[u.String()] {
+			t.Errorf("Unexpected link in segment: %v", u)
+		}
+		delete(expected, u.String())
+	}
+	for link := range expected {
+		t.Errorf("Expected %v in segment, got %v", link, links)
+	}
+}
+
+// BenchmarkDispatcherNearDuplicates dispatches a domain with tens of
+// thousands of crawled links, most of them near-duplicates from a handful of
+// templates, which is where clustering their SimHashes gets expensive.
+func BenchmarkDispatcherNearDuplicates(b *testing.B) {
+	db := GetTestDB()
+	q := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+					VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false)
+	if err := q.Exec(); err != nil {
+		b.Fatalf("Failed to insert test domain info: %v\nQuery: %v", err, q)
+	}
+
+	// Three of every four pages come from one of 30 templates, their
+	// fingerprints a few bits off the template's; the rest are unrelated
+	r := rand.New(rand.NewSource(1))
+	templates := make([]int64, 30)
+	for i := range templates {
+		templates[i] = r.Int63()
+	}
+	insertLink := `INSERT INTO links (dom, subdom, path, proto, time, simhash) VALUES (?, ?, ?, ?, ?, ?)`
+	crawled := time.Now().AddDate(0, 0, -1)
+	for i := 0; i < 30000; i++ {
+		simhash := r.Int63()
+		if i%4 != 0 {
+			simhash = templates[i%len(templates)]
+			for j := r.Intn(6); j > 0; j-- {
+				simhash ^= 1 << uint(r.Intn(64))
+			}
+		}
+		q := db.Query(insertLink, "test.com", "", fmt.Sprintf("/page%d.html", i), "http",
+			crawled.Add(-time.Duration(i)*time.Second), simhash)
+		if err := q.Exec(); err != nil {
+			b.Fatalf("Failed to insert link: %v\nQuery: %v", err, q)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := db.Query(`TRUNCATE segments`).Exec(); err != nil {
+			b.Fatalf("Failed to truncate segments: %v", err)
+		}
+		q := db.Query(`UPDATE domain_info SET dispatched = ? WHERE dom = ?`, false, "test.com")
+		if err := q.Exec(); err != nil {
+			b.Fatalf("Failed to reset domain info: %v\nQuery: %v", err, q)
+		}
+		b.StartTimer()
+
+		d := &Dispatcher{}
+		if err := d.oneShot(1); err != nil {
+			b.Fatalf("Failed to run dispatcher: %v", err)
+		}
+	}
+}
+
+func TestDispatcherSkipNonCanonical(t *testing.T) {
+	origSkipNonCanonical := walker.Config.Dispatcher.SkipNonCanonical
+	defer func() {
+		walker.Config.Dispatcher.SkipNonCanonical = origSkipNonCanonical
+	}()
+	walker.Config.Dispatcher.SkipNonCanonical = true
+
+	db := GetTestDB()
+	q := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+					VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false)
+	if err := q.Exec(); err != nil {
+		t.Fatalf("Failed to insert test domain info: %v\nQuery: %v", err, q)
+	}
+
+	// /b.html says /a.html is its canonical version, so it isn't refreshed;
+	// /a.html and /c.html name themselves (or nothing) and are
+	insertLink := `INSERT INTO links (dom, subdom, path, proto, time, canonical) VALUES (?, ?, ?, ?, ?, ?)`
+	now := time.Now()
+	queries := []*gocql.Query{
+		db.Query(insertLink, "test.com", "", "/a.html", "http", now.AddDate(0, 0, -1), "http://test.com/a.html"),
+		db.Query(insertLink, "test.com", "", "/b.html", "http", now.AddDate(0, 0, -1), "http://test.com/a.html"),
+		db.Query(insertLink, "test.com", "", "/c.html", "http", now.AddDate(0, 0, -1), nil),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert link: %v\nQuery: %v", err, q)
+		}
+	}
+
+	runDispatcher(t)
+
+	ds := getDS(t)
+	expected := map[string]bool{
+		"http://test.com/a.html": true,
+		"http://test.com/c.html": true,
+	}
+	var links []*walker.URL
+	for u := range ds.LinksForHost("test.com") {
+		links = append(links, u)
+		if !expected[u.String()] {
+			t.Errorf("Unexpected link in segment: %v", u)
+		}
+		delete(expected, u.String())
+	}
+	for link := range expected {
+		t.Errorf("Expected %v in segment, got %v", link, links)
+	}
+}
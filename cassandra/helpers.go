@@ -120,10 +120,23 @@ CREATE TABLE {{.Keyspace}}.links (
 	-- error text, describes the error if we could not fetch (otherwise null)
 	err text,
 
+	-- the error the handler returned for this fetch, if it failed (see
+	-- walker.FallibleHandler); links it asked to retry later are also marked
+	-- getnow, up to cassandra.max_handler_retries times in a row
+	handler_err text,
+
+	-- how many fetches in a row of this link the handler asked to retry
+	-- later, including this one (null if it didn't)
+	handler_retries int,
+
 	-- true if this link was excluded from the crawl due to robots.txt rules
 	-- (null implies we were not excluded)
 	robot_ex boolean,
 
+	-- why robots.txt excluded this link, ex. "disallowed by robots.txt" or
+	-- "robots.txt unreachable (503 Service Unavailable)" (null if not excluded)
+	robot_reason text,
+
 	-- If this link redirects to another link target, the target link is stored
 	-- in this field
 	redto_url text,
@@ -137,30 +150,85 @@ CREATE TABLE {{.Keyspace}}.links (
 	-- fnv fingerprint, a hash of the page contents for identity comparison
 	fnv bigint,
 
+	-- SimHash fingerprint of the visible text of an HTML page, for finding
+	-- near-duplicates (see walker.SimHash); null if not computed
+	simhash bigint,
+
+	-- structure fingerprint, a hash of the page structure only (defined as:
+	-- html tags only, all contents and attributes stripped); null if the page
+	-- isn't HTML
+	structfp bigint,
+
 	-- body stores the content for this link (if cassandra.store_response_body is true)
 	body text,
 
 	-- headers stores the http headers for this link (if cassandra.store_response_headers is true)
 	headers MAP<text,text>,
 
-	---- Items yet to be added to walker
+	-- number of requests made for this crawl; more than 1 means transient
+	-- failures were retried (null if we did not fetch)
+	attempts int,
+
+	-- the ETag and Last-Modified headers returned by the server, sent back as
+	-- If-None-Match and If-Modified-Since when the link is recrawled
+	etag text,
+	lastmod text,
+
+	-- sitemap is true if this link was listed in one of its host's sitemaps,
+	-- and sm_lastmod, sm_changefreq and sm_priority are the hints the sitemap
+	-- gave. They are only set on the row for the parsed link (time = epoch)
+	sitemap boolean,
+	sm_lastmod timestamp,
+	sm_changefreq text,
+	sm_priority double,
+
+	-- ip address of the remote server that returned the response (null if
+	-- we did not connect, or don't know)
+	ip text,
+
+	-- referer, the page this link was last parsed from (or the link that
+	-- redirected to it). Only set on the row for the parsed link (time =
+	-- epoch)
+	ref text,
+
+	-- encoding the HTML page was decoded from, ex. "utf-8" or "windows-1252"
+	-- (null if the page isn't HTML)
+	encoding text,
+
+	-- canonical URL the page gave, with <link rel="canonical"> or a Link
+	-- header (null if it gave none). The dispatcher skips refreshing pages
+	-- whose canonical is another page if dispatcher.skip_non_canonical is set
+	canonical text,
 
-	-- structure fingerprint, a hash of the page structure only (defined as:
-	-- html tags only, all contents and attributes stripped)
-	--structfp bigint,
+	PRIMARY KEY (dom, subdom, path, proto, time)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' }
+	AND caching = 'NONE';
 
-	-- ip address of the remote server
-	--ip text,
+-- edges holds the links walker parsed out of pages (if
+-- cassandra.store_edges is true). Each link is stored twice, once under the
+-- page it was found on (out = true) and once under the link it points to
+-- (out = false), so both can be listed quickly.
+CREATE TABLE {{.Keyspace}}.edges (
+	-- the page this row is stored under, ex. "http://a.com/index.html"
+	url text,
 
-	-- referer, maybe can be kept for parsed links
-	--ref text,
+	-- true if url links to other, false if other links to url
+	out boolean,
 
+	-- the page at the other end of the link
+	other text,
 
+	-- the text of the link (the contents of the <a> element)
+	anchor text,
 
-	-- encoding of the text, ex. "utf8"
-	--encoding text,
+	-- the rel attribute of the link, ex. "nofollow"
+	rel text,
 
-	PRIMARY KEY (dom, subdom, path, proto, time)
+	-- when the page the link is on was fetched (the latest time, if the
+	-- link was found more than once)
+	time timestamp,
+
+	PRIMARY KEY ((url, out), other)
 ) WITH compaction = { 'class' : 'LeveledCompactionStrategy' }
 	AND caching = 'NONE';
 
@@ -175,6 +243,11 @@ CREATE TABLE {{.Keyspace}}.segments (
 	-- time this link was last crawled, so that we can use if-modified-since headers
 	time timestamp,
 
+	-- validators from the last crawl (see links table), so that we can use
+	-- if-none-match and if-modified-since headers
+	etag text,
+	lastmod text,
+
 	PRIMARY KEY (dom, subdom, path, proto)
 ) WITH compaction = { 'class' : 'LeveledCompactionStrategy' }
 	AND caching = 'NONE'
@@ -262,6 +335,20 @@ CREATE TABLE {{.Keyspace}}.walker_globals (
 	key text,
 	val int,
 	PRIMARY KEY (key)
+);
+
+-- domain_profiles holds per-domain overrides of the fetcher configuration
+-- (see walker.DomainProfile), read by fetchers when they claim a domain.
+CREATE TABLE {{.Keyspace}}.domain_profiles (
+	dom text,
+
+	-- the subdomain this profile is for, or empty for the whole domain
+	subdom text,
+
+	-- the profile as yaml, ex. "user_agent: Partner Bot"
+	profile text,
+
+	PRIMARY KEY (dom, subdom)
 );`
 
 // initdb ensures we only try to create the cassandra schema once in testing
@@ -290,7 +377,7 @@ func GetTestDB() *gocql.Session {
 		panic(fmt.Sprintf("Could not connect to local cassandra db: %v", err))
 	}
 
-	tables := []string{"links", "segments", "domain_info", "active_fetchers"}
+	tables := []string{"links", "edges", "segments", "domain_info", "active_fetchers", "domain_profiles"}
 	for _, table := range tables {
 		err := db.Query(fmt.Sprintf(`TRUNCATE %v`, table)).Exec()
 		if err != nil {
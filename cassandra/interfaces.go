@@ -31,6 +31,28 @@ type ModelDatastore interface {
 	// UpdateDomain.
 	UpdateDomain(domain string, info *DomainInfo, cfg DomainInfoUpdateConfig) error
 
+	// DomainProfiles returns the profiles for domain and its subdomains,
+	// keyed by subdomain ("" for the domain itself); see
+	// walker.DomainProfiler.
+	DomainProfiles(domain string) (map[string]*walker.DomainProfile, error)
+
+	// SetDomainProfile stores the profile for the given subdomain of domain
+	// ("" for the domain itself). A nil profile removes it.
+	SetDomainProfile(domain string, subdomain string, profile *walker.DomainProfile) error
+
+	// BandwidthLimits returns the stored global and per-host bandwidth limits
+	// in bytes per second, or -1 for a limit that isn't set; see
+	// walker.BandwidthLimitStore.
+	BandwidthLimits() (global int64, perHost int64, err error)
+
+	// SetBandwidthLimits stores the global and per-host bandwidth limits. A
+	// negative limit is removed, so the fetchers use the configured one.
+	SetBandwidthLimits(global int64, perHost int64) error
+
+	// StoreHandlerError records an error the handler returned after fr was
+	// stored; see walker.HandlerErrorStore.
+	StoreHandlerError(fr *walker.FetchResults, err error)
+
 	// FindLink returns a LinkInfo matching the given URL. Arguments to this
 	// function are: (a) u is the url to find (b) collectContent, if true,
 	// indicates that Body and Headers field of LinkInfo will be populated.
@@ -43,6 +65,28 @@ type ModelDatastore interface {
 	// ListLinkHistorical gets the crawl history of a specific link
 	ListLinkHistorical(u *walker.URL) ([]*LinkInfo, error)
 
+	// NearDuplicates returns the groups of crawled links in domain whose
+	// latest fetches have SimHash fingerprints within maxDistance bits of
+	// the group's first link (see walker.SimHashClusters).
+	NearDuplicates(domain string, maxDistance int) ([][]*LinkInfo, error)
+
+	// TemplateGroups groups the links in domain by the structure fingerprint
+	// of their latest fetch, i.e. by the template the pages were built from.
+	// It returns the groups with at least minLinks links, largest first,
+	// each with up to samples of its links.
+	TemplateGroups(domain string, minLinks int, samples int) ([]*TemplateGroup, error)
+
+	// ListInlinks returns the stored links to u from other pages (see
+	// cassandra.store_edges), up to limit of them, or all of them if limit
+	// is not positive.
+	ListInlinks(u *walker.URL, limit int) ([]*Edge, error)
+
+	// ListOutlinks returns the stored links on the page u, like ListInlinks.
+	ListOutlinks(u *walker.URL, limit int) ([]*Edge, error)
+
+	// CountInlinks returns the number of stored links to u.
+	CountInlinks(u *walker.URL) (int, error)
+
 	// InsertLink inserts the given link into the database, adding it's domain
 	// if it does not exist. If excludeDomainReason is not empty, this domain
 	// will be excluded from crawling marked with the given reason.
@@ -86,6 +130,9 @@ type LinkInfo struct {
 	// Was this excluded by robots
 	RobotsExcluded bool
 
+	// Why robots excluded it (empty if it wasn't)
+	RobotsReason string
+
 	// URL this link redirected to if it was a redirect
 	RedirectedTo string
 
@@ -98,6 +145,35 @@ type LinkInfo struct {
 	// FNV hash of the contents
 	FnvFingerprint int64
 
+	// SimHash fingerprint of the page's text (see walker.SimHash), 0 if none
+	SimHash int64
+
+	// Fingerprint of the page's structure (see
+	// walker.FetchResults.StructFingerprint), 0 if none
+	StructFingerprint int64
+
+	// Number of requests made for this crawl; more than 1 means transient
+	// failures were retried, i.e. the link is flaky
+	Attempts int
+
+	// The error the handler returned for this fetch, if any (only set by
+	// ListLinkHistorical)
+	HandlerError string
+
+	// IP address of the server that returned the response, if known
+	RemoteIP string
+
+	// The page this link was last parsed from, or the link that redirected to
+	// it; empty if it was seeded
+	Referer string
+
+	// Encoding the page was decoded from, ex. "utf-8" (empty if it isn't
+	// HTML)
+	Encoding string
+
+	// The canonical URL the page gave, if any (see FetchResults.Canonical)
+	Canonical string
+
 	// Body of request (if configured to be stored)
 	Body string
 
@@ -105,6 +181,38 @@ type LinkInfo struct {
 	Headers http.Header
 }
 
+// TemplateGroup is a group of links whose pages share a structure fingerprint
+// (see ModelDatastore.TemplateGroups)
+type TemplateGroup struct {
+	// The structure fingerprint shared by the group
+	StructFingerprint int64
+
+	// Number of links in the group
+	NumLinks int
+
+	// Some of the links in the group
+	Links []*LinkInfo
+}
+
+// Edge is a link from one page to another, found when the first page was
+// parsed (see ModelDatastore.ListInlinks)
+type Edge struct {
+	// The page the link is on
+	Source *walker.URL
+
+	// The link
+	Target *walker.URL
+
+	// Text of the link, ex. the contents of the <a> element
+	Anchor string
+
+	// Values of the link's rel attribute, ex. ["nofollow"]
+	Rel []string
+
+	// When the page the link is on was fetched
+	Time time.Time
+}
+
 // DQ is a domain query struct used for getting domains from cassandra.
 // Zero-values mean use default behavior.
 type DQ struct {
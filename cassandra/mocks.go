@@ -18,6 +18,31 @@ func (ds *MockModelDatastore) ListLinkHistorical(u *walker.URL) ([]*LinkInfo, er
 	return args.Get(0).([]*LinkInfo), args.Error(1)
 }
 
+func (ds *MockModelDatastore) NearDuplicates(domain string, maxDistance int) ([][]*LinkInfo, error) {
+	args := ds.Mock.Called(domain, maxDistance)
+	return args.Get(0).([][]*LinkInfo), args.Error(1)
+}
+
+func (ds *MockModelDatastore) TemplateGroups(domain string, minLinks int, samples int) ([]*TemplateGroup, error) {
+	args := ds.Mock.Called(domain, minLinks, samples)
+	return args.Get(0).([]*TemplateGroup), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListInlinks(u *walker.URL, limit int) ([]*Edge, error) {
+	args := ds.Mock.Called(u, limit)
+	return args.Get(0).([]*Edge), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListOutlinks(u *walker.URL, limit int) ([]*Edge, error) {
+	args := ds.Mock.Called(u, limit)
+	return args.Get(0).([]*Edge), args.Error(1)
+}
+
+func (ds *MockModelDatastore) CountInlinks(u *walker.URL) (int, error) {
+	args := ds.Mock.Called(u)
+	return args.Int(0), args.Error(1)
+}
+
 func (ds *MockModelDatastore) InsertLink(link string, excludeDomainReason string) error {
 	args := ds.Mock.Called(link, excludeDomainReason)
 	return args.Error(0)
@@ -47,3 +72,27 @@ func (ds *MockModelDatastore) UpdateDomain(domain string, info *DomainInfo, cfg
 	args := ds.Mock.Called(domain, info, cfg)
 	return args.Error(0)
 }
+
+func (ds *MockModelDatastore) DomainProfiles(domain string) (map[string]*walker.DomainProfile, error) {
+	args := ds.Mock.Called(domain)
+	return args.Get(0).(map[string]*walker.DomainProfile), args.Error(1)
+}
+
+func (ds *MockModelDatastore) SetDomainProfile(domain string, subdomain string, profile *walker.DomainProfile) error {
+	args := ds.Mock.Called(domain, subdomain, profile)
+	return args.Error(0)
+}
+
+func (ds *MockModelDatastore) BandwidthLimits() (int64, int64, error) {
+	args := ds.Mock.Called()
+	return args.Get(0).(int64), args.Get(1).(int64), args.Error(2)
+}
+
+func (ds *MockModelDatastore) SetBandwidthLimits(global int64, perHost int64) error {
+	args := ds.Mock.Called(global, perHost)
+	return args.Error(0)
+}
+
+func (ds *MockModelDatastore) StoreHandlerError(fr *walker.FetchResults, err error) {
+	ds.Mock.Called(fr, err)
+}
@@ -37,6 +37,7 @@ import (
 	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	// allow http profile
 	_ "net/http/pprof"
@@ -45,6 +46,8 @@ import (
 	"github.com/iParadigms/walker"
 	"github.com/iParadigms/walker/cassandra"
 	"github.com/iParadigms/walker/console"
+	"github.com/iParadigms/walker/handlers"
+	"github.com/iParadigms/walker/metrics"
 	"github.com/iParadigms/walker/simplehandler"
 	"github.com/spf13/cobra"
 )
@@ -141,6 +144,47 @@ func initCommand() {
 	}
 }
 
+// serveMetrics starts an http listener for /metrics on Config.Metrics.Port,
+// for commands that don't run the console (which serves its own).
+func serveMetrics() {
+	if !walker.Config.Metrics.Enabled {
+		return
+	}
+	go func() {
+		port := walker.Config.Metrics.Port
+		log4go.Info("Serving metrics at :%d/metrics", port)
+		err := metrics.ListenAndServe(fmt.Sprintf(":%d", port))
+		if err != nil {
+			log4go.Error("Had problem listening for metrics handler: %v", err)
+		}
+	}()
+}
+
+// fetchHandler returns commander.Handler (or the default handler) as the
+// FetchManager should call it: isolated from panics and, if
+// fetcher.handler_workers is set, from a pool of workers. The returned func
+// must be called once the FetchManager has stopped.
+func fetchHandler() (walker.Handler, func()) {
+	if commander.Handler == nil {
+		commander.Handler = &simplehandler.Handler{}
+	}
+
+	fet := walker.Config.Fetcher
+	if fet.HandlerWorkers < 1 {
+		return handlers.Recover("handler", commander.Handler), func() {}
+	}
+	policy, err := handlers.ParseBackpressure(fet.HandlerBackpressure)
+	if err != nil {
+		// This won't happen b/c handler_backpressure is checked in Config
+		panic(err)
+	}
+	async := handlers.Async("handler", commander.Handler, fet.HandlerWorkers, fet.HandlerQueueSize, policy)
+	if store, ok := commander.Datastore.(walker.HandlerErrorStore); ok {
+		async.StoreErrorsIn(store)
+	}
+	return async, async.Close
+}
+
 func fatalf(format string, args ...interface{}) {
 	fmt.Printf(format, args...)
 	fmt.Println()
@@ -226,10 +270,16 @@ var readLinkCommand = &cobra.Command{
 			printf("CrawlTime:      %v\n", linfo.CrawlTime)
 			printf("Error:          %v", estring)
 			printf("RobotsExcluded: %v\n", linfo.RobotsExcluded)
+			printf("RobotsReason:   %v\n", linfo.RobotsReason)
 			printf("RedirectedTo:   %v\n", linfo.RedirectedTo)
 			printf("GetNow:         %v\n", linfo.GetNow)
 			printf("Mime:           %v\n", linfo.Mime)
 			printf("FnvFingerprint: %v\n", linfo.FnvFingerprint)
+			printf("Attempts:       %v\n", linfo.Attempts)
+			printf("RemoteIP:       %v\n", linfo.RemoteIP)
+			printf("Referer:        %v\n", linfo.Referer)
+			printf("Encoding:       %v\n", linfo.Encoding)
+			printf("Canonical:      %v\n", linfo.Canonical)
 			if linfo.Headers == nil {
 				printf("HEADERS:        <none>\n")
 			} else {
@@ -288,13 +338,10 @@ func init() {
 				commander.Dispatcher = &cassandra.Dispatcher{}
 			}
 
-			if commander.Handler == nil {
-				commander.Handler = &simplehandler.Handler{}
-			}
-
+			handler, closeHandler := fetchHandler()
 			manager := &walker.FetchManager{
 				Datastore: commander.Datastore,
-				Handler:   commander.Handler,
+				Handler:   handler,
 			}
 			go manager.Start()
 
@@ -309,6 +356,8 @@ func init() {
 
 			if !noConsole {
 				console.Start()
+			} else {
+				serveMetrics()
 			}
 
 			sig := make(chan os.Signal)
@@ -319,6 +368,7 @@ func init() {
 				commander.Dispatcher.StopDispatcher()
 			}
 			manager.Stop()
+			closeHandler()
 		},
 	}
 	crawlCommand.Flags().BoolVarP(&noConsole, "no-console", "C", false, "Do not start the console")
@@ -339,21 +389,20 @@ func init() {
 				commander.Dispatcher = &cassandra.Dispatcher{}
 			}
 
-			if commander.Handler == nil {
-				commander.Handler = &simplehandler.Handler{}
-			}
-
+			handler, closeHandler := fetchHandler()
 			manager := &walker.FetchManager{
 				Datastore: commander.Datastore,
-				Handler:   commander.Handler,
+				Handler:   handler,
 			}
 			go manager.Start()
+			serveMetrics()
 
 			sig := make(chan os.Signal)
 			signal.Notify(sig, syscall.SIGINT)
 			<-sig
 
 			manager.Stop()
+			closeHandler()
 		},
 	}
 	walkerCommand.AddCommand(fetchCommand)
@@ -374,6 +423,7 @@ func init() {
 					panic(err.Error())
 				}
 			}()
+			serveMetrics()
 
 			sig := make(chan os.Signal)
 			signal.Notify(sig, syscall.SIGINT)
@@ -385,6 +435,7 @@ func init() {
 	walkerCommand.AddCommand(dispatchCommand)
 
 	var seedURL string
+	var seedSitemap string
 	seedCommand := &cobra.Command{
 		Use:   "seed",
 		Short: "add a seed URL to the datastore",
@@ -394,7 +445,10 @@ func init() {
     - Adding any other link that needs to be crawled soon
 
 This command will insert the provided link and also add its domain to the
-crawl, regardless of the add_new_domains configuration setting.`,
+crawl, regardless of the add_new_domains configuration setting.
+
+With --sitemap, every URL listed in the sitemap (or sitemap index) is added
+instead, along with its sitemap hints.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			initCommand()
 
@@ -402,12 +456,16 @@ crawl, regardless of the add_new_domains configuration setting.`,
 			defer func() { walker.Config.Cassandra.AddNewDomains = orig }()
 			walker.Config.Cassandra.AddNewDomains = true
 
-			if seedURL == "" {
-				fatalf("Seed URL needed to execute; add on with --url/-u")
+			if seedURL == "" && seedSitemap == "" {
+				fatalf("Seed URL needed to execute; add on with --url/-u (or --sitemap/-s)")
 			}
-			u, err := walker.ParseAndNormalizeURL(seedURL)
-			if err != nil {
-				fatalf("Could not parse %v as a url: %v", seedURL, err)
+			var u *walker.URL
+			if seedURL != "" {
+				var err error
+				u, err = walker.ParseAndNormalizeURL(seedURL)
+				if err != nil {
+					fatalf("Could not parse %v as a url: %v", seedURL, err)
+				}
 			}
 
 			if commander.Datastore == nil {
@@ -418,10 +476,31 @@ crawl, regardless of the add_new_domains configuration setting.`,
 				commander.Datastore = ds
 			}
 
-			commander.Datastore.StoreParsedURL(u, nil)
+			if u != nil {
+				commander.Datastore.StoreParsedURL(u, nil)
+			}
+
+			if seedSitemap != "" {
+				timeout, err := time.ParseDuration(walker.Config.Fetcher.HTTPTimeout)
+				if err != nil {
+					// This shouldn't happen because HTTPTimeout is tested in assertConfigInvariants
+					panic(err)
+				}
+				count := 0
+				client := &http.Client{Timeout: timeout, Transport: walker.FilteredTransport(timeout)}
+				err = walker.ReadSitemaps(client, seedSitemap, 0, func(u *walker.URL) {
+					commander.Datastore.StoreParsedURL(u, nil)
+					count++
+				})
+				if err != nil {
+					fatalf("Failed reading sitemap: %v", err)
+				}
+				commander.Streams.Printf("Seeded %d URLs from %v\n", count, seedSitemap)
+			}
 		},
 	}
 	seedCommand.Flags().StringVarP(&seedURL, "url", "u", "", "URL to add as a seed")
+	seedCommand.Flags().StringVarP(&seedSitemap, "sitemap", "s", "", "URL of a sitemap whose URLs to add as seeds")
 	walkerCommand.AddCommand(seedCommand)
 
 	var outfile string
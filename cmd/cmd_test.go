@@ -322,6 +322,11 @@ func TestReadlinkCommand(t *testing.T) {
 		RedirectedTo:   "",
 		GetNow:         true,
 		Mime:           "text/html",
+		Attempts:       2,
+		RemoteIP:       "203.0.113.7",
+		Referer:        "http://test.com/index.html",
+		Encoding:       "utf-8",
+		Canonical:      "http://test.com/page1.html",
 		Body:           body,
 		Headers:        headers,
 	}
@@ -374,10 +379,16 @@ Error:
     with plenty of
     newlines and such           
 RobotsExcluded: false
+RobotsReason:   
 RedirectedTo:   
 GetNow:         true
 Mime:           text/html
 FnvFingerprint: 0
+Attempts:       2
+RemoteIP:       203.0.113.7
+Referer:        http://test.com/index.html
+Encoding:       utf-8
+Canonical:      http://test.com/page1.html
 HEADERS:
     baz: click
     baz: clack
@@ -409,10 +420,16 @@ Error:
     with plenty of
     newlines and such         
 RobotsExcluded: false
+RobotsReason:   
 RedirectedTo:   
 GetNow:         true
 Mime:           text/html
 FnvFingerprint: 0
+Attempts:       2
+RemoteIP:       203.0.113.7
+Referer:        http://test.com/index.html
+Encoding:       utf-8
+Canonical:      http://test.com/page1.html
 HEADERS:
     baz: click
     baz: clack
@@ -3,6 +3,7 @@ package walker
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"strings"
 	"time"
 
@@ -43,17 +44,44 @@ type ConfigStruct struct {
 		AcceptFormats            []string `yaml:"accept_formats"`
 		AcceptProtocols          []string `yaml:"accept_protocols"`
 		MaxHTTPContentSizeBytes  int64    `yaml:"max_http_content_size_bytes"`
+		TruncateOversizedBodies  bool     `yaml:"truncate_oversized_bodies"`
+		StreamNonHTML            bool     `yaml:"stream_non_html"`
+		AcceptEncodings          []string `yaml:"accept_encodings"`
+		MaxDecompressedSizeBytes int64    `yaml:"max_decompressed_size_bytes"`
 		IgnoreTags               []string `yaml:"ignore_tags"`
 		MaxLinksPerPage          int      `yaml:"max_links_per_page"`
 		NumSimultaneousFetchers  int      `yaml:"num_simultaneous_fetchers"`
+		BandwidthLimit           int64    `yaml:"bandwidth_limit"`
+		HostBandwidthLimit       int64    `yaml:"host_bandwidth_limit"`
 		BlacklistPrivateIPs      bool     `yaml:"blacklist_private_ips"`
+		AllowCIDRs               []string `yaml:"allow_cidrs"`
+		DenyCIDRs                []string `yaml:"deny_cidrs"`
+		MaxRedirects             int      `yaml:"max_redirects"`
+		CrossDomainRedirects     string   `yaml:"cross_domain_redirects"`
 		HTTPTimeout              string   `yaml:"http_timeout"`
+		HandlerWorkers           int      `yaml:"handler_workers"`
+		HandlerQueueSize         int      `yaml:"handler_queue_size"`
+		HandlerBackpressure      string   `yaml:"handler_backpressure"`
 		HonorMetaNoindex         bool     `yaml:"honor_meta_noindex"`
 		HonorMetaNofollow        bool     `yaml:"honor_meta_nofollow"`
+		ComputeSimHash           bool     `yaml:"compute_simhash"`
 		ExcludeLinkPatterns      []string `yaml:"exclude_link_patterns"`
 		IncludeLinkPatterns      []string `yaml:"include_link_patterns"`
 		DefaultCrawlDelay        string   `yaml:"default_crawl_delay"`
 		MaxCrawlDelay            string   `yaml:"max_crawl_delay"`
+		RobotsCacheTTL           string   `yaml:"robots_cache_ttl"`
+		RobotsUnreachableTTL     string   `yaml:"robots_unreachable_ttl"`
+		DiscoverSitemaps         bool     `yaml:"discover_sitemaps"`
+		SitemapRefreshInterval   string   `yaml:"sitemap_refresh_interval"`
+		MaxSitemapURLs           int      `yaml:"max_sitemap_urls"`
+		AdaptiveCrawlDelay       bool     `yaml:"adaptive_crawl_delay"`
+		MinBackoffCrawlDelay     string   `yaml:"min_backoff_crawl_delay"`
+		PerIPCrawlDelay          string   `yaml:"per_ip_crawl_delay"`
+		PerIPMaxConcurrency      int      `yaml:"per_ip_max_concurrency"`
+		MaxFetchAttempts         int      `yaml:"max_fetch_attempts"`
+		RetryErrors              []string `yaml:"retry_errors"`
+		RetryBackoff             string   `yaml:"retry_backoff"`
+		MaxRetryBackoff          string   `yaml:"max_retry_backoff"`
 		PurgeSidList             []string `yaml:"purge_sid_list"`
 		ActiveFetchersTTL        string   `yaml:"active_fetchers_ttl"`
 		ActiveFetchersCacheratio float32  `yaml:"active_fetchers_cacheratio"`
@@ -61,6 +89,9 @@ type ConfigStruct struct {
 		HTTPKeepAlive            string   `yaml:"http_keep_alive"`
 		HTTPKeepAliveThreshold   string   `yaml:"http_keep_alive_threshold"`
 		MaxPathLength            int      `yaml:"max_path_length"`
+		LinkFilters              []string `yaml:"link_filters"`
+
+		DomainProfiles map[string]DomainProfile `yaml:"domain_profiles"`
 	} `yaml:"fetcher"`
 
 	Dispatcher struct {
@@ -71,6 +102,8 @@ type ConfigStruct struct {
 		DispatchInterval           string  `yaml:"dispatch_interval"`
 		CorrectLinkNormalization   bool    `yaml:"correct_link_normalization"`
 		EmptyDispatchRetryInterval string  `yaml:"empty_dispatch_retry_interval"`
+		NearDuplicateDistance      int     `yaml:"near_duplicate_distance"`
+		SkipNonCanonical           bool    `yaml:"skip_non_canonical"`
 	} `yaml:"dispatcher"`
 
 	Cassandra struct {
@@ -89,8 +122,10 @@ type ConfigStruct struct {
 		AddedDomainsCacheSize int      `yaml:"added_domains_cache_size"`
 		StoreResponseBody     bool     `yaml:"store_response_body"`
 		StoreResponseHeaders  bool     `yaml:"store_response_headers"`
+		StoreEdges            bool     `yaml:"store_edges"`
 		NumQueryRetries       int      `yaml:"num_query_retries"`
 		DefaultDomainPriority int      `yaml:"default_domain_priority"`
+		MaxHandlerRetries     int      `yaml:"max_handler_retries"`
 
 		//TODO: Currently only exposing values needed for testing; should expose more?
 		//Consistency      Consistency
@@ -108,6 +143,11 @@ type ConfigStruct struct {
 		PublicFolder             string `yaml:"public_folder"`
 		MaxAllowedDomainPriority int    `yaml:"max_allowed_domain_priority"`
 	} `yaml:"console"`
+
+	Metrics struct {
+		Enabled bool `yaml:"enabled"`
+		Port    int  `yaml:"port"`
+	} `yaml:"metrics"`
 }
 
 // SetDefaultConfig resets the Config object to default values, regardless of
@@ -125,17 +165,44 @@ func SetDefaultConfig() {
 	Config.Fetcher.AcceptFormats = []string{"text/html", "text/*;"} //NOTE you can add quality factors by doing "text/html; q=0.4"
 	Config.Fetcher.AcceptProtocols = []string{"http", "https"}
 	Config.Fetcher.MaxHTTPContentSizeBytes = 20 * 1024 * 1024 // 20MB
+	Config.Fetcher.TruncateOversizedBodies = false
+	Config.Fetcher.StreamNonHTML = false
+	Config.Fetcher.AcceptEncodings = []string{"gzip", "deflate"}
+	Config.Fetcher.MaxDecompressedSizeBytes = 100 * 1024 * 1024 // 100MB
 	Config.Fetcher.IgnoreTags = []string{"script", "img", "link"}
 	Config.Fetcher.MaxLinksPerPage = 1000
 	Config.Fetcher.NumSimultaneousFetchers = 10
+	Config.Fetcher.BandwidthLimit = 0
+	Config.Fetcher.HostBandwidthLimit = 0
 	Config.Fetcher.BlacklistPrivateIPs = true
+	Config.Fetcher.AllowCIDRs = nil
+	Config.Fetcher.DenyCIDRs = nil
+	Config.Fetcher.MaxRedirects = 10
+	Config.Fetcher.CrossDomainRedirects = "follow"
 	Config.Fetcher.HTTPTimeout = "30s"
+	Config.Fetcher.HandlerWorkers = 0
+	Config.Fetcher.HandlerQueueSize = 100
+	Config.Fetcher.HandlerBackpressure = "block"
 	Config.Fetcher.HonorMetaNoindex = true
 	Config.Fetcher.HonorMetaNofollow = false
+	Config.Fetcher.ComputeSimHash = true
 	Config.Fetcher.ExcludeLinkPatterns = nil
 	Config.Fetcher.IncludeLinkPatterns = nil
 	Config.Fetcher.DefaultCrawlDelay = "1s"
 	Config.Fetcher.MaxCrawlDelay = "5m"
+	Config.Fetcher.RobotsCacheTTL = "24h"
+	Config.Fetcher.RobotsUnreachableTTL = "10m"
+	Config.Fetcher.DiscoverSitemaps = false
+	Config.Fetcher.SitemapRefreshInterval = "24h"
+	Config.Fetcher.MaxSitemapURLs = 50000
+	Config.Fetcher.AdaptiveCrawlDelay = true
+	Config.Fetcher.MinBackoffCrawlDelay = "1s"
+	Config.Fetcher.PerIPCrawlDelay = "0s"
+	Config.Fetcher.PerIPMaxConcurrency = 2
+	Config.Fetcher.MaxFetchAttempts = 3
+	Config.Fetcher.RetryErrors = []string{"dns", "refused", "timeout", "5xx"}
+	Config.Fetcher.RetryBackoff = "1s"
+	Config.Fetcher.MaxRetryBackoff = "30s"
 	Config.Fetcher.PurgeSidList = nil
 	Config.Fetcher.ActiveFetchersTTL = "15m"
 	Config.Fetcher.ActiveFetchersCacheratio = 0.75
@@ -143,6 +210,8 @@ func SetDefaultConfig() {
 	Config.Fetcher.HTTPKeepAlive = "always"
 	Config.Fetcher.HTTPKeepAliveThreshold = "15s"
 	Config.Fetcher.MaxPathLength = 2048
+	Config.Fetcher.LinkFilters = []string{"max_path_length", "link_patterns", "accept_protocols"}
+	Config.Fetcher.DomainProfiles = nil
 
 	Config.Dispatcher.MaxLinksPerSegment = 500
 	Config.Dispatcher.RefreshPercentage = 25
@@ -151,6 +220,8 @@ func SetDefaultConfig() {
 	Config.Dispatcher.DispatchInterval = "10s"
 	Config.Dispatcher.CorrectLinkNormalization = false
 	Config.Dispatcher.EmptyDispatchRetryInterval = "0s"
+	Config.Dispatcher.NearDuplicateDistance = 3
+	Config.Dispatcher.SkipNonCanonical = false
 
 	Config.Cassandra.Hosts = []string{"localhost"}
 	Config.Cassandra.Keyspace = "walker"
@@ -167,13 +238,18 @@ func SetDefaultConfig() {
 	Config.Cassandra.AddedDomainsCacheSize = 20000
 	Config.Cassandra.StoreResponseBody = false
 	Config.Cassandra.StoreResponseHeaders = false
+	Config.Cassandra.StoreEdges = false
 	Config.Cassandra.NumQueryRetries = 3
 	Config.Cassandra.DefaultDomainPriority = 1
+	Config.Cassandra.MaxHandlerRetries = 3
 
 	Config.Console.Port = 3000
 	Config.Console.TemplateDirectory = "console/templates"
 	Config.Console.PublicFolder = "console/public"
 	Config.Console.MaxAllowedDomainPriority = 100
+
+	Config.Metrics.Enabled = true
+	Config.Metrics.Port = 3001
 }
 
 // ReadConfigFile sets a new path to find the walker yaml config file and
@@ -217,6 +293,9 @@ func assertConfigInvariants() error {
 	if err != nil {
 		errs = append(errs, fmt.Sprintf("Dispatcher.EmptyDispatchRetryInterval failed to parse: %v", err))
 	}
+	if dis.NearDuplicateDistance > 64 {
+		errs = append(errs, "Dispatcher.NearDuplicateDistance must be at most 64")
+	}
 
 	fet := &Config.Fetcher
 	_, err = time.ParseDuration(fet.HTTPTimeout)
@@ -231,6 +310,24 @@ func assertConfigInvariants() error {
 	if err != nil {
 		errs = append(errs, err.Error())
 	}
+	for host, p := range fet.DomainProfiles {
+		if err := p.check(); err != nil {
+			errs = append(errs, fmt.Sprintf("Fetcher.DomainProfiles[%v]: %v", host, err))
+		}
+	}
+	for _, name := range fet.LinkFilters {
+		found := false
+		for _, known := range linkFilterNames {
+			if strings.ToLower(name) == known {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("Fetcher.LinkFilters: %q not one of (%s)",
+				name, strings.Join(linkFilterNames, ", ")))
+		}
+	}
 	afTTL, err := time.ParseDuration(fet.ActiveFetchersTTL)
 	if err != nil {
 		errs = append(errs, fmt.Sprintf("Fetcher.ActiveFetchersTTL failed to parse: %v", err))
@@ -250,6 +347,106 @@ func assertConfigInvariants() error {
 	if def > max {
 		errs = append(errs, "Consistency problem: MaxCrawlDelay > DefaultCrawlDealy")
 	}
+	_, err = time.ParseDuration(fet.RobotsCacheTTL)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("RobotsCacheTTL failed to parse: %v", err))
+	}
+	_, err = time.ParseDuration(fet.RobotsUnreachableTTL)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("RobotsUnreachableTTL failed to parse: %v", err))
+	}
+	_, err = time.ParseDuration(fet.SitemapRefreshInterval)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("SitemapRefreshInterval failed to parse: %v", err))
+	}
+	if fet.MaxSitemapURLs < 0 {
+		errs = append(errs, "Fetcher.MaxSitemapURLs must be >= 0")
+	}
+	_, err = time.ParseDuration(fet.MinBackoffCrawlDelay)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("MinBackoffCrawlDelay failed to parse: %v", err))
+	}
+	_, err = time.ParseDuration(fet.PerIPCrawlDelay)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("PerIPCrawlDelay failed to parse: %v", err))
+	}
+	if fet.PerIPMaxConcurrency < 0 {
+		errs = append(errs, "Fetcher.PerIPMaxConcurrency must be >= 0")
+	}
+	if fet.MaxFetchAttempts < 1 {
+		errs = append(errs, "Fetcher.MaxFetchAttempts must be >= 1")
+	}
+	for _, class := range fet.RetryErrors {
+		found := false
+		for _, c := range retryErrorClasses {
+			if strings.ToLower(class) == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("Fetcher.RetryErrors: %q not one of (%s)",
+				class, strings.Join(retryErrorClasses, ", ")))
+		}
+	}
+	for _, enc := range fet.AcceptEncodings {
+		if enc == "" || strings.ContainsAny(enc, ", \t;") {
+			errs = append(errs, fmt.Sprintf("Fetcher.AcceptEncodings: %q is not a content-coding name", enc))
+		}
+	}
+	for _, cidr := range fet.AllowCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Sprintf("Fetcher.AllowCIDRs: %v", err))
+		}
+	}
+	for _, cidr := range fet.DenyCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Sprintf("Fetcher.DenyCIDRs: %v", err))
+		}
+	}
+	if fet.BandwidthLimit < 0 {
+		errs = append(errs, "Fetcher.BandwidthLimit must be >= 0")
+	}
+	if fet.HostBandwidthLimit < 0 {
+		errs = append(errs, "Fetcher.HostBandwidthLimit must be >= 0")
+	}
+
+	if fet.MaxRedirects < 0 {
+		errs = append(errs, "Fetcher.MaxRedirects must be >= 0")
+	}
+	found := false
+	for _, policy := range crossDomainRedirectPolicies {
+		if strings.ToLower(fet.CrossDomainRedirects) == policy {
+			found = true
+			break
+		}
+	}
+	if !found {
+		errs = append(errs, fmt.Sprintf("Fetcher.CrossDomainRedirects: %q not one of (%s)",
+			fet.CrossDomainRedirects, strings.Join(crossDomainRedirectPolicies, ", ")))
+	}
+	if fet.HandlerWorkers < 0 {
+		errs = append(errs, "Fetcher.HandlerWorkers must be >= 0")
+	}
+	if fet.HandlerQueueSize < 0 {
+		errs = append(errs, "Fetcher.HandlerQueueSize must be >= 0")
+	}
+	switch strings.ToLower(fet.HandlerBackpressure) {
+	case "block", "drop":
+	default:
+		errs = append(errs, "Fetcher.HandlerBackpressure not one of (block, drop)")
+	}
+	if fet.MaxDecompressedSizeBytes < 1 {
+		errs = append(errs, "Fetcher.MaxDecompressedSizeBytes must be greater than 0")
+	}
+	_, err = time.ParseDuration(fet.RetryBackoff)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("RetryBackoff failed to parse: %v", err))
+	}
+	_, err = time.ParseDuration(fet.MaxRetryBackoff)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("MaxRetryBackoff failed to parse: %v", err))
+	}
 
 	switch strings.ToLower(fet.HTTPKeepAlive) {
 	case "always", "threshold", "never":
@@ -269,6 +466,9 @@ func assertConfigInvariants() error {
 	if cas.DefaultDomainPriority < 1 {
 		errs = append(errs, fmt.Sprintf("Cassandra.DefaultDomainPriority must be >= 1"))
 	}
+	if cas.MaxHandlerRetries < 0 {
+		errs = append(errs, "Cassandra.MaxHandlerRetries must be >= 0")
+	}
 
 	keeprat := Config.Fetcher.ActiveFetchersKeepratio
 	if keeprat < 0 || keeprat >= 1.0 {
@@ -282,6 +482,10 @@ func assertConfigInvariants() error {
 			" must choose X such that 0 <= X < 1")
 	}
 
+	if Config.Metrics.Enabled && (Config.Metrics.Port < 1 || Config.Metrics.Port > 65535) {
+		errs = append(errs, "Metrics.Port must be between 1 and 65535")
+	}
+
 	if len(errs) > 0 {
 		em := ""
 		for _, err := range errs {
@@ -316,6 +520,9 @@ func readConfig() error {
 	Config.Fetcher.AcceptProtocols = []string{}
 	Config.Fetcher.IgnoreTags = []string{}
 	Config.Fetcher.PurgeSidList = []string{}
+	Config.Fetcher.RetryErrors = []string{}
+	Config.Fetcher.AcceptEncodings = []string{}
+	Config.Fetcher.LinkFilters = []string{}
 
 	Config.Cassandra.Hosts = []string{}
 
@@ -342,6 +549,15 @@ func readConfig() error {
 	if len(fet.PurgeSidList) == 0 {
 		fet.PurgeSidList = []string{"jsessionid", "phpsessid", "aspsessionid"}
 	}
+	if len(fet.RetryErrors) == 0 {
+		fet.RetryErrors = []string{"dns", "refused", "timeout", "5xx"}
+	}
+	if len(fet.AcceptEncodings) == 0 {
+		fet.AcceptEncodings = []string{"gzip", "deflate"}
+	}
+	if len(fet.LinkFilters) == 0 {
+		fet.LinkFilters = []string{"max_path_length", "link_patterns", "accept_protocols"}
+	}
 
 	if len(Config.Cassandra.Hosts) == 0 {
 		Config.Cassandra.Hosts = []string{"localhost"}
@@ -91,3 +91,38 @@ func TestSequenceOverwrites(t *testing.T) {
 			Config.Cassandra.Hosts)
 	}
 }
+
+func TestParseDomainProfile(t *testing.T) {
+	p, err := ParseDomainProfile("user_agent: Partner Bot\ndefault_crawl_delay: 100ms\nexclude_link_patterns: [\"^/private\"]\n")
+	if err != nil {
+		t.Fatalf("Failed to parse profile: %v", err)
+	}
+	expected := &DomainProfile{
+		UserAgent:           "Partner Bot",
+		DefaultCrawlDelay:   "100ms",
+		ExcludeLinkPatterns: []string{"^/private"},
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("Profile mismatch\nGot:      %#v\nExpected: %#v", p, expected)
+	}
+
+	// String produces something ParseDomainProfile reads back
+	p2, err := ParseDomainProfile(p.String())
+	if err != nil || !reflect.DeepEqual(p2, p) {
+		t.Errorf("Expected %q to parse back to %#v, got %#v (%v)", p.String(), p, p2, err)
+	}
+
+	bad := []string{
+		"default_crawl_delay: soon",
+		"max_crawl_delay: 1 fortnight",
+		"exclude_link_patterns: [\"(\"]",
+		"max_http_content_size_bytes: -1",
+		"http_keep_alive: sometimes",
+		"user_agent: [not, a, string]",
+	}
+	for _, text := range bad {
+		if _, err := ParseDomainProfile(text); err == nil {
+			t.Errorf("Expected an error parsing profile %q", text)
+		}
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"code.google.com/p/log4go"
 	"github.com/gorilla/mux"
@@ -28,6 +30,12 @@ type dropdownElement struct {
 	Text string
 }
 
+// A domain profile as shown on the links page
+type profileElement struct {
+	Subdomain string
+	Profile   string
+}
+
 // Routes returns all the endpoints for console
 func Routes() []Route {
 	return []Route{
@@ -42,10 +50,14 @@ func Routes() []Route {
 		Route{Path: "/links/{domain}", Controller: LinksController},
 		Route{Path: "/links/{domain}/{seedURL}", Controller: LinksController},
 		Route{Path: "/historical/{url}", Controller: LinksHistoricalController},
+		Route{Path: "/duplicates/{domain}", Controller: DuplicatesController},
+		Route{Path: "/structure/{domain}", Controller: StructureController},
 		Route{Path: "/findLinks", Controller: FindLinksController},
 		Route{Path: "/filterLinks", Controller: FilterLinksController},
 		Route{Path: "/excludeToggle/{domain}/{direction}", Controller: ExcludeToggleController},
 		Route{Path: "/changePriority", Controller: ChangePriorityController},
+		Route{Path: "/changeProfile", Controller: ChangeProfileController},
+		Route{Path: "/bandwidth", Controller: BandwidthController},
 	}
 }
 
@@ -60,15 +72,19 @@ func HomeController(w http.ResponseWriter, req *http.Request) {
 // so that the previous button works correctly (see https://jira2.iparadigms.com/browse/TRN-134). The
 // same form is used to allow the user to reset the window-length (i.e. number of results per page).
 // The input arguments to the function are
-//   (a) The http request with the hidden form.
-//   (b) The Session pointer which holds client-side user data.
-//   (c) The isLinks toggle which controls which session variable to store the new page dimensions into. When
-//       isLinks is true the window is stored with Session.SetLinksPageWindowLength, otherwise it's stored with
-//       Session.SetListPageWindowLength
+//
+//	(a) The http request with the hidden form.
+//	(b) The Session pointer which holds client-side user data.
+//	(c) The isLinks toggle which controls which session variable to store the new page dimensions into. When
+//	    isLinks is true the window is stored with Session.SetLinksPageWindowLength, otherwise it's stored with
+//	    Session.SetListPageWindowLength
+//
 // The return value of this function is
-//   (a) the link that should be used for the Previous button href
-//   (b) the encoded previous list to be inserted in the hidden-form on server dispatch.
-//   (c) any errors that occur.
+//
+//	(a) the link that should be used for the Previous button href
+//	(b) the encoded previous list to be inserted in the hidden-form on server dispatch.
+//	(c) any errors that occur.
+//
 // It's also worth noting that, if the pageWindowLength field of the form is set, this method will
 // update the session to reflect the new windowLength.
 func processHiddenForm(req *http.Request, sess *Session, isLinks bool) (string, string, error) {
@@ -427,7 +443,7 @@ func AddLinkIndexController(w http.ResponseWriter, req *http.Request) {
 }
 
 // LinksController returns pages rooted at /links
-//IMPL NOTE: Why does linksController encode the seedURL in base32, rather than URL encode it?
+// IMPL NOTE: Why does linksController encode the seedURL in base32, rather than URL encode it?
 // The reason is that various components along the way are tripping on the appearance of the
 // seedURL argument. First, it appears that the browser is unencoding the link BEFORE submitting it
 // to the server. That looks like a problem with the browser to me. But in addition, the server appears
@@ -559,6 +575,25 @@ func LinksController(w http.ResponseWriter, req *http.Request) {
 		maxAllowedPrio = fmt.Sprintf("(max %d)", walker.Config.Console.MaxAllowedDomainPriority)
 	}
 
+	// list the domain profiles, the domain's own first
+	profileMap, err := DS.DomainProfiles(domain)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("DomainProfiles: %v", err))
+		return
+	}
+	subdoms := []string{}
+	for subdom := range profileMap {
+		subdoms = append(subdoms, subdom)
+	}
+	sort.Strings(subdoms)
+	profiles := []profileElement{}
+	for _, subdom := range subdoms {
+		profiles = append(profiles, profileElement{
+			Subdomain: subdom,
+			Profile:   profileMap[subdom].String(),
+		})
+	}
+
 	// grab any info in the flash
 	infos, errors := session.Flashes()
 
@@ -589,6 +624,9 @@ func LinksController(w http.ResponseWriter, req *http.Request) {
 
 		"MaxAllowedPrio": maxAllowedPrio,
 
+		"HasProfiles": len(profiles) > 0,
+		"Profiles":    profiles,
+
 		"HasInfoMessage":  len(infos) > 0,
 		"InfoMessage":     infos,
 		"HasErrorMessage": len(errors) > 0,
@@ -598,7 +636,12 @@ func LinksController(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
-// LinksHistoricalController returns pages rooted at /links
+// historicalInlinks is the number of links to a page its /historical page
+// lists
+const historicalInlinks = 100
+
+// LinksHistoricalController returns pages rooted at /links, with the crawl
+// history of a link and the pages known to link to it
 func LinksHistoricalController(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	url := vars["url"]
@@ -628,14 +671,194 @@ func LinksHistoricalController(w http.ResponseWriter, req *http.Request) {
 		replyServerError(w, fmt.Errorf("ListLinkHistorical - ToplevelDomainPlusOne (%v): %v", u, err))
 		return
 	}
+
+	// The referer is kept on the parsed link row
+	referer := ""
+	for _, linfo := range linfos {
+		if linfo.Referer != "" {
+			referer = linfo.Referer
+			break
+		}
+	}
+
+	// The canonical URL the page gave when it was last fetched, if it is
+	// another page
+	canonical := ""
+	if n := len(linfos); n > 0 && linfos[n-1].Canonical != u.String() {
+		canonical = linfos[n-1].Canonical
+	}
+
+	numInlinks, err := DS.CountInlinks(u)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("CountInlinks (%v): %v", u, err))
+		return
+	}
+	edges, err := DS.ListInlinks(u, historicalInlinks)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("ListInlinks (%v): %v", u, err))
+		return
+	}
+	type Inlink struct {
+		Source      string
+		HistoryPath string
+		Anchor      string
+		Rel         string
+		Time        time.Time
+	}
+	var inlinks []Inlink
+	for _, e := range edges {
+		inlinks = append(inlinks, Inlink{
+			Source:      e.Source.String(),
+			HistoryPath: "/historical/" + encode32(e.Source.String()),
+			Anchor:      e.Anchor,
+			Rel:         strings.Join(e.Rel, " "),
+			Time:        e.Time,
+		})
+	}
+
 	mp := map[string]interface{}{
-		"Domain":    domain,
-		"LinkTopic": u.String(),
-		"Linfos":    linfos,
+		"Domain":        domain,
+		"LinkTopic":     u.String(),
+		"Linfos":        linfos,
+		"Referer":       referer,
+		"RefererPath":   "/historical/" + encode32(referer),
+		"Canonical":     canonical,
+		"CanonicalPath": "/historical/" + encode32(canonical),
+		"NumInlinks":    numInlinks,
+		"Inlinks":       inlinks,
+		"NumMore":       numInlinks - len(inlinks),
+		"StoreEdges":    walker.Config.Cassandra.StoreEdges,
 	}
 	Render.HTML(w, http.StatusOK, "historical", mp)
 }
 
+// DuplicatesController returns pages rooted at /duplicates, listing the groups
+// of near-duplicate links in a domain (see walker.SimHash). The distance form
+// value overrides dispatcher.near_duplicate_distance.
+func DuplicatesController(w http.ResponseWriter, req *http.Request) {
+	domain := mux.Vars(req)["domain"]
+	if domain == "" {
+		replyServerError(w, fmt.Errorf("User failed to specify domain for duplicatesController"))
+		return
+	}
+
+	distance := walker.Config.Dispatcher.NearDuplicateDistance
+	if distance < 0 {
+		// Deprioritizing is off, show exact SimHash matches
+		distance = 0
+	}
+	if text := strings.TrimSpace(req.FormValue("distance")); text != "" {
+		d, err := strconv.Atoi(text)
+		if err != nil || d < 0 || d > 64 {
+			replyServerError(w, fmt.Errorf("Bad distance %q, expected a number of bits from 0 to 64", text))
+			return
+		}
+		distance = d
+	}
+
+	groups, err := DS.NearDuplicates(domain, distance)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("NearDuplicates: %v", err))
+		return
+	}
+
+	type DuplicateLink struct {
+		URL         string
+		HistoryPath string
+		Status      int
+		CrawlTime   time.Time
+		SimHash     string
+	}
+	var clusters [][]DuplicateLink
+	for _, group := range groups {
+		var cluster []DuplicateLink
+		for _, linfo := range group {
+			cluster = append(cluster, DuplicateLink{
+				URL:         linfo.URL.String(),
+				HistoryPath: "/historical/" + encode32(linfo.URL.String()),
+				Status:      linfo.Status,
+				CrawlTime:   linfo.CrawlTime,
+				SimHash:     fmt.Sprintf("%016x", uint64(linfo.SimHash)),
+			})
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	mp := map[string]interface{}{
+		"Domain":      domain,
+		"Distance":    distance,
+		"HasClusters": len(clusters) > 0,
+		"Clusters":    clusters,
+	}
+	Render.HTML(w, http.StatusOK, "duplicates", mp)
+}
+
+// structureSamples is the number of links the /structure page lists for each
+// template
+const structureSamples = 10
+
+// StructureController returns pages rooted at /structure, grouping a domain's
+// links by the template of their pages (their structure fingerprint), largest
+// groups first. Only groups with at least the min form value (default 2) links
+// are listed.
+func StructureController(w http.ResponseWriter, req *http.Request) {
+	domain := mux.Vars(req)["domain"]
+	if domain == "" {
+		replyServerError(w, fmt.Errorf("User failed to specify domain for structureController"))
+		return
+	}
+
+	minLinks := 2
+	if text := strings.TrimSpace(req.FormValue("min")); text != "" {
+		m, err := strconv.Atoi(text)
+		if err != nil || m < 1 {
+			replyServerError(w, fmt.Errorf("Bad minimum group size %q, expected a number of links > 0", text))
+			return
+		}
+		minLinks = m
+	}
+
+	groups, err := DS.TemplateGroups(domain, minLinks, structureSamples)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("TemplateGroups: %v", err))
+		return
+	}
+
+	type TemplateLink struct {
+		URL         string
+		HistoryPath string
+	}
+	type Template struct {
+		Fingerprint string
+		NumLinks    int
+		Links       []TemplateLink
+		NumMore     int
+	}
+	var templates []Template
+	for _, g := range groups {
+		t := Template{
+			Fingerprint: fmt.Sprintf("%016x", uint64(g.StructFingerprint)),
+			NumLinks:    g.NumLinks,
+			NumMore:     g.NumLinks - len(g.Links),
+		}
+		for _, linfo := range g.Links {
+			t.Links = append(t.Links, TemplateLink{
+				URL:         linfo.URL.String(),
+				HistoryPath: "/historical/" + encode32(linfo.URL.String()),
+			})
+		}
+		templates = append(templates, t)
+	}
+
+	mp := map[string]interface{}{
+		"Domain":       domain,
+		"MinLinks":     minLinks,
+		"HasTemplates": len(templates) > 0,
+		"Templates":    templates,
+	}
+	Render.HTML(w, http.StatusOK, "structure", mp)
+}
+
 // FindLinksController returns pages rooted at /findLinks
 func FindLinksController(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
@@ -824,6 +1047,127 @@ func ChangePriorityController(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// ChangeProfileController handles web-based changes to a domain (or
+// subdomain) profile. An empty profile removes it.
+func ChangeProfileController(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		replyServerError(w, err)
+		return
+	}
+
+	session, err := GetSession(w, req)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("GetSession failed: %v", err))
+		return
+	}
+
+	domain := req.Form.Get("domain")
+	if domain == "" {
+		replyServerError(w, fmt.Errorf("domain inexplicably is NOT in the hidden form"))
+		return
+	}
+	redirect := func() {
+		http.Redirect(w, req, fmt.Sprintf("/links/%s", domain), http.StatusFound)
+	}
+
+	// Accept either "blog" or "blog.example.com" for a subdomain
+	subdomain := strings.ToLower(strings.TrimSpace(req.Form.Get("subdomain")))
+	if subdomain == domain {
+		subdomain = ""
+	}
+	subdomain = strings.TrimSuffix(subdomain, "."+domain)
+
+	var profile *walker.DomainProfile
+	if text := req.Form.Get("profile"); strings.TrimSpace(text) != "" {
+		profile, err = walker.ParseDomainProfile(text)
+		if err != nil {
+			session.AddErrorFlash(fmt.Sprintf("Failed to parse profile: %v", err))
+			redirect()
+			return
+		}
+	}
+
+	err = DS.SetDomainProfile(domain, subdomain, profile)
+	if err != nil {
+		err = fmt.Errorf("SetDomainProfile failed: %v", err)
+		replyServerError(w, err)
+		return
+	}
+
+	redirect()
+	return
+}
+
+// BandwidthController returns the /bandwidth page, which shows and sets the
+// fetchers' bandwidth limits. A limit left empty is removed, so the fetchers
+// go back to the one in walker.yaml.
+func BandwidthController(w http.ResponseWriter, req *http.Request) {
+	mp := map[string]interface{}{
+		"ConfigGlobal":  walker.Config.Fetcher.BandwidthLimit,
+		"ConfigPerHost": walker.Config.Fetcher.HostBandwidthLimit,
+	}
+	render := func() {
+		global, perHost, err := DS.BandwidthLimits()
+		if err != nil {
+			replyServerError(w, fmt.Errorf("BandwidthLimits: %v", err))
+			return
+		}
+		// Limits that aren't set are shown empty
+		mp["Global"], mp["PerHost"] = "", ""
+		if global >= 0 {
+			mp["Global"] = strconv.FormatInt(global, 10)
+		}
+		if perHost >= 0 {
+			mp["PerHost"] = strconv.FormatInt(perHost, 10)
+		}
+		Render.HTML(w, http.StatusOK, "bandwidth", mp)
+	}
+
+	if req.Method != "POST" {
+		render()
+		return
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		replyServerError(w, err)
+		return
+	}
+
+	var errs []string
+	parseLimit := func(field string, name string) int64 {
+		text := strings.TrimSpace(req.Form.Get(field))
+		if text == "" {
+			return -1
+		}
+		limit, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || limit < 0 {
+			errs = append(errs, fmt.Sprintf("%v must be a number of bytes per second >= 0, not %q", name, text))
+			return -1
+		}
+		return limit
+	}
+	global := parseLimit("global", "Global limit")
+	perHost := parseLimit("perHost", "Per-host limit")
+	if len(errs) == 0 {
+		err = DS.SetBandwidthLimits(global, perHost)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Failed to set bandwidth limits: %v", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		mp["HasErrorMessage"] = true
+		mp["ErrorMessage"] = errs
+	} else {
+		mp["HasInfoMessage"] = true
+		mp["InfoMessage"] = []string{"Bandwidth limits set; fetchers pick them up within a few seconds"}
+	}
+	render()
+	return
+}
+
 // FilterLinksController returns pages rooted at /filterLinks
 func FilterLinksController(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
@@ -15,6 +15,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/iParadigms/walker"
 	"github.com/iParadigms/walker/cassandra"
+	"github.com/iParadigms/walker/metrics"
 )
 
 //
@@ -164,6 +165,9 @@ func Start() {
 		router := mux.NewRouter()
 		routes := Routes()
 		routes = append(routes, RestRoutes()...)
+		if walker.Config.Metrics.Enabled {
+			routes = append(routes, Route{Path: "/metrics", Controller: metrics.Handler().ServeHTTP})
+		}
 		for _, route := range routes {
 			log4go.Info("Registering path %s", route.Path)
 			router.HandleFunc(route.Path, buildControllerCounter(route.Controller))
@@ -2,14 +2,18 @@ package test
 
 import (
 	"bytes"
+	"encoding/base32"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/gorilla/mux"
@@ -113,6 +117,7 @@ func TestLayout(t *testing.T) {
 		"/findLinks":   "Find Links",
 		"/add":         "Add",
 		"/filterLinks": "Filter Links",
+		"/bandwidth":   "Bandwidth",
 	}
 	sub := doc.Find("nav ul li a")
 	if sub.Size() != len(mainLinks) {
@@ -347,6 +352,7 @@ func TestListLinksWeb(t *testing.T) {
 		"Unique Links Crawled",
 		"Unique Links Not Yet Crawled",
 		"Priority",
+		"Crawl Profiles",
 	}
 
 	sub = domainTable.Find("tr > td:nth-child(1)")
@@ -715,6 +721,9 @@ func TestListHistorical(t *testing.T) {
 		"Fetched On",
 		"Robots Excluded",
 		"Status",
+		"Attempts",
+		"Remote IP",
+		"Encoding",
 		"Error",
 	}
 	count := 0
@@ -734,8 +743,8 @@ func TestListHistorical(t *testing.T) {
 
 	tables.Find("tbody tr").Each(func(index int, sel *goquery.Selection) {
 		ncol := sel.Children().Size()
-		if ncol != 4 {
-			t.Fatalf("[.container table tbody tr] Wrong column count got %d, expected %d", ncol, 4)
+		if ncol != len(colHeaders) {
+			t.Fatalf("[.container table tbody tr] Wrong column count got %d, expected %d", ncol, len(colHeaders))
 		}
 	})
 }
@@ -1216,6 +1225,249 @@ func TestChangePriority(t *testing.T) {
 	}
 }
 
+func TestChangeProfile(t *testing.T) {
+	spoofData()
+
+	// profiles reads the Crawl Profiles value out of the links page
+	profiles := func() string {
+		doc, body, status := callController("http://localhost:3000/links/t1.com", "", "/links/{domain}",
+			console.LinksController)
+		if status != http.StatusOK {
+			t.Log(body)
+			t.Fatalf("TestChangeProfile bad status code got %d, expected %d", status, http.StatusOK)
+		}
+		sub := doc.Find(".container .row table tr").FilterFunction(func(index int, sel *goquery.Selection) bool {
+			return strings.Contains(sel.Find("td").First().Text(), "Crawl Profiles")
+		})
+		if sub.Size() < 1 {
+			t.Fatalf("Failed to find Crawl Profiles row")
+		}
+		return sub.Find("td:nth-child(2)").Text()
+	}
+
+	if p := profiles(); !strings.Contains(p, "none") {
+		t.Errorf("Expected no profiles initially, got %q", p)
+	}
+
+	rawBody := "domain=t1.com&subdomain=www.t1.com&profile=" +
+		url.QueryEscape("user_agent: Partner Bot\ndefault_crawl_delay: 100ms\n")
+	_, _, status := callController("http://localhost:3000/changeProfile", rawBody, "/changeProfile",
+		console.ChangeProfileController)
+	if status != http.StatusFound {
+		t.Fatalf("TestChangeProfile bad status code got %d, expected %d", status, http.StatusFound)
+	}
+
+	p := profiles()
+	if !strings.Contains(p, "www.t1.com") || !strings.Contains(p, "user_agent: Partner Bot") {
+		t.Errorf("Expected the www.t1.com profile to be shown, got %q", p)
+	}
+
+	// A bad profile is not stored
+	rawBody = "domain=t1.com&subdomain=www&profile=" + url.QueryEscape("default_crawl_delay: soon\n")
+	callController("http://localhost:3000/changeProfile", rawBody, "/changeProfile",
+		console.ChangeProfileController)
+	if p := profiles(); strings.Contains(p, "soon") {
+		t.Errorf("Expected the bad profile not to be stored, got %q", p)
+	}
+
+	// An empty profile removes it
+	rawBody = "domain=t1.com&subdomain=www&profile="
+	callController("http://localhost:3000/changeProfile", rawBody, "/changeProfile",
+		console.ChangeProfileController)
+	if p := profiles(); !strings.Contains(p, "none") {
+		t.Errorf("Expected the profile to be removed, got %q", p)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	spoofData()
+
+	// limits reads the limits shown in the bandwidth page's form
+	limits := func(doc *goquery.Document) (string, string) {
+		global, _ := doc.Find("#bandwidth-limits input[name=global]").Attr("value")
+		perHost, _ := doc.Find("#bandwidth-limits input[name=perHost]").Attr("value")
+		return global, perHost
+	}
+	post := func(rawBody string) *goquery.Document {
+		doc, body, status := callController("http://localhost:3000/bandwidth", rawBody, "/bandwidth",
+			console.BandwidthController)
+		if status != http.StatusOK {
+			t.Log(body)
+			t.Fatalf("TestBandwidth bad status code got %d, expected %d", status, http.StatusOK)
+		}
+		return doc
+	}
+
+	// Clear any limits left from other runs
+	post("global=&perHost=")
+	doc, _, _ := callController("http://localhost:3000/bandwidth", "", "/bandwidth",
+		console.BandwidthController)
+	if global, perHost := limits(doc); global != "" || perHost != "" {
+		t.Errorf("Expected no limits set, got %q and %q", global, perHost)
+	}
+
+	doc = post("global=1000000&perHost=50000")
+	if global, perHost := limits(doc); global != "1000000" || perHost != "50000" {
+		t.Errorf("Expected limits 1000000 and 50000, got %q and %q", global, perHost)
+	}
+	if doc.Find(".info-li").Size() != 1 {
+		t.Errorf("Expected a message that the limits were set")
+	}
+
+	// Bad limits are reported and nothing is changed
+	doc = post("global=lots&perHost=-5")
+	if doc.Find(".error-li").Size() != 2 {
+		t.Errorf("Expected an error for each bad limit, got %d", doc.Find(".error-li").Size())
+	}
+	if global, perHost := limits(doc); global != "1000000" || perHost != "50000" {
+		t.Errorf("Expected limits to be unchanged, got %q and %q", global, perHost)
+	}
+
+	// An empty limit is removed
+	doc = post("global=&perHost=50000")
+	if global, perHost := limits(doc); global != "" || perHost != "50000" {
+		t.Errorf("Expected only the per-host limit to be set, got %q and %q", global, perHost)
+	}
+	post("global=&perHost=")
+}
+
+func TestDuplicates(t *testing.T) {
+	spoofData()
+
+	fetched := map[string]int64{
+		"http://dup.com/a.html":     0x0f0f0f0f0f0f0f0f,
+		"http://dup.com/b.html":     0x0f0f0f0f0f0f0f0e,
+		"http://dup.com/c.html":     0x7070707070707070,
+		"http://www.dup.com/d.html": 0x0f0f0f0f0f0f0f08,
+	}
+	for link, simhash := range fetched {
+		console.DS.StoreURLFetchResults(&walker.FetchResults{
+			URL:       walker.MustParse(link),
+			FetchTime: time.Now(),
+			SimHash:   simhash,
+		})
+	}
+
+	// groups returns the links listed under each group heading
+	groups := func(distance string) [][]string {
+		link := "http://localhost:3000/duplicates/dup.com"
+		if distance != "" {
+			link += "?distance=" + distance
+		}
+		doc, body, status := callController(link, "", "/duplicates/{domain}", console.DuplicatesController)
+		if status != http.StatusOK {
+			t.Log(body)
+			t.Fatalf("TestDuplicates bad status code got %d, expected %d", status, http.StatusOK)
+		}
+		var got [][]string
+		doc.Find("#duplicate-clusters tbody tr").Each(func(i int, row *goquery.Selection) {
+			if row.HasClass("active") {
+				got = append(got, nil)
+				return
+			}
+			got[len(got)-1] = append(got[len(got)-1], strings.TrimSpace(row.Find("td a").Text()))
+		})
+		return got
+	}
+
+	expected := [][]string{
+		{"http://dup.com/a.html", "http://dup.com/b.html", "http://www.dup.com/d.html"},
+	}
+	if got := groups(""); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Duplicate groups mismatch\nGot:      %v\nExpected: %v", got, expected)
+	}
+
+	// d.html is 3 bits from a.html and 2 from b.html
+	expected = [][]string{
+		{"http://dup.com/a.html", "http://dup.com/b.html"},
+	}
+	if got := groups("1"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Duplicate groups mismatch at distance 1\nGot:      %v\nExpected: %v", got, expected)
+	}
+}
+
+func TestStructure(t *testing.T) {
+	spoofData()
+
+	fetched := map[string]int64{
+		"http://trap.com/calendar?day=1": 0x1234,
+		"http://trap.com/calendar?day=2": 0x1234,
+		"http://trap.com/calendar?day=3": 0x1234,
+		"http://trap.com/about.html":     0x5678,
+	}
+	for link, fp := range fetched {
+		console.DS.StoreURLFetchResults(&walker.FetchResults{
+			URL:               walker.MustParse(link),
+			FetchTime:         time.Now(),
+			StructFingerprint: fp,
+		})
+	}
+
+	doc, body, status := callController("http://localhost:3000/structure/trap.com", "",
+		"/structure/{domain}", console.StructureController)
+	if status != http.StatusOK {
+		t.Log(body)
+		t.Fatalf("TestStructure bad status code got %d, expected %d", status, http.StatusOK)
+	}
+	headings := doc.Find("#templates tbody tr.active")
+	if headings.Size() != 1 {
+		t.Fatalf("Expected 1 template shared by 2 or more links, got %d", headings.Size())
+	}
+	if heading := strings.Join(strings.Fields(headings.Text()), " "); heading != "3 links 0000000000001234" {
+		t.Errorf("Unexpected template heading %q", heading)
+	}
+	if n := doc.Find("#templates tbody tr a").Size(); n != 3 {
+		t.Errorf("Expected 3 links listed, got %d", n)
+	}
+
+	doc, _, _ = callController("http://localhost:3000/structure/trap.com?min=1", "",
+		"/structure/{domain}", console.StructureController)
+	if n := doc.Find("#templates tbody tr.active").Size(); n != 2 {
+		t.Errorf("Expected 2 templates with min=1, got %d", n)
+	}
+}
+
+func TestInlinks(t *testing.T) {
+	spoofData()
+
+	orig := walker.Config.Cassandra.StoreEdges
+	defer func() { walker.Config.Cassandra.StoreEdges = orig }()
+	walker.Config.Cassandra.StoreEdges = true
+
+	target := "http://linked.com/target.html"
+	sources := map[string]string{
+		"http://linked.com/a.html": "See the target",
+		"http://linked.com/b.html": "Target",
+	}
+	for source, anchor := range sources {
+		u := walker.MustParse(target)
+		u.Link = &walker.LinkHints{Text: anchor, Rel: []string{"nofollow"}}
+		console.DS.StoreParsedURL(u, &walker.FetchResults{
+			URL:       walker.MustParse(source),
+			FetchTime: time.Now(),
+		})
+	}
+
+	link := "http://localhost:3000/historical/" + base32.StdEncoding.EncodeToString([]byte(target))
+	doc, body, status := callController(link, "", "/historical/{url}", console.LinksHistoricalController)
+	if status != http.StatusOK {
+		t.Log(body)
+		t.Fatalf("TestInlinks bad status code got %d, expected %d", status, http.StatusOK)
+	}
+
+	got := map[string]string{}
+	doc.Find("#inlinks tbody tr").Each(func(i int, row *goquery.Selection) {
+		cols := row.Find("td")
+		got[strings.TrimSpace(cols.Eq(0).Text())] = strings.TrimSpace(cols.Eq(1).Text())
+		if rel := strings.TrimSpace(cols.Eq(2).Text()); rel != "nofollow" {
+			t.Errorf("Expected rel nofollow, got %q", rel)
+		}
+	})
+	if !reflect.DeepEqual(got, sources) {
+		t.Errorf("Inlinks mismatch\nGot:      %v\nExpected: %v", got, sources)
+	}
+}
+
 func TestSetPageLength(t *testing.T) {
 	spoofData()
 
@@ -0,0 +1,167 @@
+package walker
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// A response is considered slow (and the host overloaded) if it takes
+	// more than slowLatencyFactor times the fastest response seen from the
+	// host, and at least slowLatencyFloor.
+	slowLatencyFactor = 4
+	slowLatencyFloor  = time.Second
+
+	// Each healthy response shrinks the extra delay (the amount above the
+	// robots.txt delay) to recoverNumerator/recoverDenominator of its value.
+	recoverNumerator   = 3
+	recoverDenominator = 4
+
+	// Once the extra delay falls below recoverSnap we return to the
+	// robots.txt delay.
+	recoverSnap = 10 * time.Millisecond
+)
+
+// adaptiveDelay tracks the crawl delay a fetcher should use against the host
+// it is currently crawling. The delay grows when the server pushes back (429
+// or 503 responses, Retry-After headers, rising latency or connection errors)
+// and shrinks back toward the robots.txt (or default) delay as the host
+// recovers. It is never larger than max.
+type adaptiveDelay struct {
+	// If false, the robots.txt delay is always used
+	enabled bool
+
+	// The smallest delay used when backing off from a host whose robots.txt
+	// delay is shorter (often 0)
+	min time.Duration
+
+	// Cap on the delay (max_crawl_delay, see fetcher.setProfile)
+	max time.Duration
+
+	// The current adaptive delay; 0 means the robots.txt delay is used
+	delay time.Duration
+
+	// The fastest response seen from this host
+	fastest time.Duration
+}
+
+// reset forgets everything learned about the previous host.
+func (ad *adaptiveDelay) reset() {
+	ad.delay = 0
+	ad.fastest = 0
+}
+
+// effective returns the crawl delay to use, given base, the crawl delay
+// from robots.txt.
+func (ad *adaptiveDelay) effective(base time.Duration) time.Duration {
+	d := base
+	if ad.delay > d {
+		d = ad.delay
+	}
+	if d > ad.max {
+		d = ad.max
+	}
+	return d
+}
+
+// observe updates the delay based on the outcome of a fetch that took latency
+// to respond, and returns the new effective delay. base is the crawl delay
+// from robots.txt.
+func (ad *adaptiveDelay) observe(base time.Duration, fr *FetchResults, latency time.Duration) time.Duration {
+	if !ad.enabled {
+		return ad.effective(base)
+	}
+
+	// Only network failures and timeouts mean the server is struggling.
+	// Other errors (redirects we didn't follow, oversized or undecodable
+	// bodies) come from a server that answered fine, so they pace like any
+	// healthy response
+	failed := fr.FetchError != nil && retryClass(nil, fr.FetchError) != ""
+
+	cur := ad.effective(base)
+	switch {
+	case failed:
+		ad.delay = ad.backoff(cur)
+
+	case fr.Response == nil:
+		ad.recover(base)
+
+	case fr.Response.StatusCode == 429 || fr.Response.StatusCode == http.StatusServiceUnavailable:
+		if wait, ok := retryAfter(fr.Response, time.Now()); ok {
+			if wait < cur {
+				wait = cur
+			}
+			ad.delay = wait
+		} else {
+			ad.delay = ad.backoff(cur)
+		}
+
+	case ad.fastest > 0 && latency > slowLatencyFactor*ad.fastest && latency > slowLatencyFloor:
+		ad.delay = ad.backoff(cur)
+
+	default:
+		ad.recover(base)
+	}
+
+	if !failed && latency > 0 && (ad.fastest == 0 || latency < ad.fastest) {
+		ad.fastest = latency
+	}
+
+	return ad.effective(base)
+}
+
+// backoff returns the delay to use after the server pushed back while we
+// were waiting cur between requests.
+func (ad *adaptiveDelay) backoff(cur time.Duration) time.Duration {
+	next := 2 * cur
+	if next < ad.min {
+		next = ad.min
+	}
+	if next > ad.max {
+		next = ad.max
+	}
+	return next
+}
+
+// recover moves the delay back toward base.
+func (ad *adaptiveDelay) recover(base time.Duration) {
+	if ad.delay <= base {
+		ad.delay = 0
+		return
+	}
+	extra := (ad.delay - base) * recoverNumerator / recoverDenominator
+	if extra < recoverSnap {
+		ad.delay = 0
+	} else {
+		ad.delay = base + extra
+	}
+}
+
+// retryAfter parses the Retry-After header of res, which may be either a
+// number of seconds or an HTTP date. Returns false if the header is missing
+// or malformed.
+func retryAfter(res *http.Response, now time.Time) (time.Duration, bool) {
+	val := strings.TrimSpace(res.Header.Get("Retry-After"))
+	if val == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	when, err := http.ParseTime(val)
+	if err != nil {
+		return 0, false
+	}
+	wait := when.Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
@@ -9,6 +9,14 @@ import (
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/iParadigms/walker/metrics"
+)
+
+var (
+	hitsMetric = metrics.NewCounter("walker_dns_cache_hits_total",
+		"Dials that used a cached DNS resolution (or cached failure)")
+	missesMetric = metrics.NewCounter("walker_dns_cache_misses_total",
+		"Dials that had to resolve the host because it wasn't cached or had expired")
 )
 
 //TODO:
@@ -25,6 +33,16 @@ import (
 //
 // If the given wrappedDial is nil, net.Dial will be automatically used.
 func Dial(wrappedDial func(network, addr string) (net.Conn, error), maxEntries int) (func(network, addr string) (net.Conn, error), error) {
+	return DialObserved(wrappedDial, maxEntries, nil)
+}
+
+// DialObserved is like Dial, but also calls observe after every successful
+// connection with the address that was dialed and the address it resolved to
+// (for example "a.com:80" and "1.2.3.4:80"). This lets callers learn which
+// hosts share an IP without doing their own lookups.
+//
+// observe may be nil, and must be safe to call from multiple goroutines.
+func DialObserved(wrappedDial func(network, addr string) (net.Conn, error), maxEntries int, observe func(addr, resolvedAddr string)) (func(network, addr string) (net.Conn, error), error) {
 	if wrappedDial == nil {
 		wrappedDial = net.Dial
 	}
@@ -35,6 +53,7 @@ func Dial(wrappedDial func(network, addr string) (net.Conn, error), maxEntries i
 	c := &dnsCache{
 		wrappedDial: wrappedDial,
 		cache:       cache,
+		observe:     observe,
 	}
 	return c.cachingDial, nil
 }
@@ -45,6 +64,7 @@ type dnsCache struct {
 	wrappedDial func(network, address string) (net.Conn, error)
 	cache       *lru.Cache
 	mu          sync.RWMutex
+	observe     func(addr, resolvedAddr string)
 }
 
 type hostrecord struct {
@@ -61,11 +81,14 @@ func (c *dnsCache) cachingDial(network, addr string) (net.Conn, error) {
 		record := entry.(hostrecord)
 		lastQueryTime := record.lastQuery
 		if time.Since(lastQueryTime) > 5*time.Minute {
+			missesMetric.Inc()
 			c.mu.RUnlock()
 			c.cacheHost(network, addr)
 			c.mu.RLock()
 			entry, _ = c.cache.Get(mapEntryName)
 			record = entry.(hostrecord)
+		} else {
+			hitsMetric.Inc()
 		}
 		resolvedAddr := record.ipaddr
 		if record.blacklisted {
@@ -75,10 +98,15 @@ func (c *dnsCache) cachingDial(network, addr string) (net.Conn, error) {
 		}
 
 		c.mu.RUnlock()
-		return c.wrappedDial(network, resolvedAddr)
+		conn, err := c.wrappedDial(network, resolvedAddr)
+		if err == nil && c.observe != nil {
+			c.observe(addr, resolvedAddr)
+		}
+		return conn, err
 
 	}
 	c.mu.RUnlock()
+	missesMetric.Inc()
 	return c.cacheHost(network, addr)
 }
 
@@ -107,6 +135,9 @@ func (c *dnsCache) cacheHost(network, addr string) (net.Conn, error) {
 		lastQuery:   queryTime,
 	})
 	c.mu.Unlock()
+	if c.observe != nil {
+		c.observe(addr, remoteipaddr)
+	}
 	return newConn, nil
 
 }
@@ -116,3 +116,35 @@ func TestHostPushedOutOfCache(t *testing.T) {
 	cdial("tcp", "host3.com")
 	cdial("tcp", "host1.com")
 }
+
+func TestDialObserved(t *testing.T) {
+	addr := &MockAddr{}
+	addr.On("String").Return("1.2.3.4")
+
+	conn := &MockConn{}
+	conn.On("RemoteAddr").Return(addr)
+
+	dialer := &MockDialer{}
+	dialer.On("Dial", "tcp", "test.com").Return(conn, nil).Once()
+	dialer.On("Dial", "tcp", "1.2.3.4").Return(conn, nil).Once()
+
+	var observed []string
+	cdial, err := DialObserved(dialer.Dial, 2, func(addr, resolvedAddr string) {
+		observed = append(observed, addr+"->"+resolvedAddr)
+	})
+	if err != nil {
+		panic(err)
+	}
+	cdial("tcp", "test.com")
+	cdial("tcp", "test.com")
+
+	expected := []string{"test.com->1.2.3.4", "test.com->1.2.3.4"}
+	if len(observed) != len(expected) {
+		t.Fatalf("Expected observations %v, got %v", expected, observed)
+	}
+	for i := range expected {
+		if observed[i] != expected[i] {
+			t.Errorf("Expected observation %q, got %q", expected[i], observed[i])
+		}
+	}
+}
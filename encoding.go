@@ -0,0 +1,212 @@
+package walker
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"code.google.com/p/log4go"
+)
+
+// ContentDecoder returns a reader of the decoded contents of r, which has
+// been compressed with a particular Content-Encoding.
+type ContentDecoder func(r io.Reader) (io.ReadCloser, error)
+
+var contentDecodersMu sync.RWMutex
+
+var contentDecoders = map[string]ContentDecoder{
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": newDeflateReader,
+}
+
+// RegisterContentDecoder lets walker accept (see
+// Config.Fetcher.AcceptEncodings) and decode responses compressed with the
+// given Content-Encoding. gzip and deflate are built in. The Go standard
+// library has no brotli decoder, so to accept "br" a program embedding walker
+// has to register one before starting its FetchManager.
+func RegisterContentDecoder(encoding string, dec ContentDecoder) {
+	contentDecodersMu.Lock()
+	defer contentDecodersMu.Unlock()
+	contentDecoders[strings.ToLower(encoding)] = dec
+}
+
+func getContentDecoder(encoding string) ContentDecoder {
+	contentDecodersMu.RLock()
+	defer contentDecodersMu.RUnlock()
+	return contentDecoders[encoding]
+}
+
+// newDeflateReader decodes the "deflate" Content-Encoding. RFC 2616 says this
+// is zlib-wrapped deflate, but enough servers send raw deflate that we accept
+// both.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// acceptEncodingHeader returns the Accept-Encoding header value to send,
+// built from the configured encodings walker can actually decode. We always
+// send the header, since otherwise net/http silently negotiates and decodes
+// gzip itself and we couldn't count the bytes on the wire.
+func acceptEncodingHeader(encodings []string) string {
+	var accept []string
+	for _, enc := range encodings {
+		enc = strings.ToLower(enc)
+		if enc != "identity" && getContentDecoder(enc) == nil {
+			log4go.Warn("No decoder registered for Content-Encoding %q, not accepting it", enc)
+			continue
+		}
+		accept = append(accept, enc)
+	}
+	if len(accept) == 0 {
+		return "identity"
+	}
+	return strings.Join(accept, ", ")
+}
+
+// wireCounter counts the bytes read from a response body as received over
+// the wire. If max is positive, reading more than max bytes is an
+// errContentTooLarge.
+type wireCounter struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (wc *wireCounter) Read(p []byte) (int, error) {
+	n, err := wc.r.Read(p)
+	wc.n += int64(n)
+	if err == nil && wc.max > 0 && wc.n > wc.max {
+		err = errContentTooLarge
+	}
+	return n, err
+}
+
+// decodedBody replaces the body of every response we fetch. It decodes the
+// response's Content-Encoding (if any) and counts the bytes received over the
+// wire.
+//
+// The decoder is only created on the first Read, so that reading (for
+// example) a gzip header doesn't happen until the caller starts reading the
+// body.
+type decodedBody struct {
+	raw    io.ReadCloser
+	wire   *wireCounter
+	newDec ContentDecoder
+	dec    io.ReadCloser
+	err    error
+
+	// remoteIP is the IP address of the connection the response came over,
+	// or "" if the Transport didn't tell us
+	remoteIP string
+}
+
+// newDecodedBody wraps res.Body in a decodedBody. Responses with a
+// Content-Encoding are limited to maxWire bytes over the wire; decoded sizes
+// are left to the reader to limit. Returns an error (and closes the body) if
+// we have no decoder for the response's Content-Encoding.
+func newDecodedBody(res *http.Response, maxWire int64) (*decodedBody, error) {
+	db := &decodedBody{
+		raw:  res.Body,
+		wire: &wireCounter{r: res.Body},
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return db, nil
+	}
+	db.newDec = getContentDecoder(encoding)
+	if db.newDec == nil {
+		res.Body.Close()
+		return nil, fmt.Errorf("Unsupported Content-Encoding %q", encoding)
+	}
+	db.wire.max = maxWire
+
+	// Content-Length, if the server sent one, is the encoded length
+	res.ContentLength = -1
+	return db, nil
+}
+
+func (db *decodedBody) Read(p []byte) (int, error) {
+	if db.err != nil {
+		return 0, db.err
+	}
+	if db.newDec == nil {
+		return db.wire.Read(p)
+	}
+
+	if db.dec == nil {
+		db.dec, db.err = db.newDec(db.wire)
+		if db.err != nil {
+			if db.err == io.EOF {
+				// An empty body is as good as an empty encoded body
+				db.dec = ioutil.NopCloser(strings.NewReader(""))
+				db.err = nil
+			} else {
+				return 0, db.err
+			}
+		}
+	}
+	return db.dec.Read(p)
+}
+
+func (db *decodedBody) Close() error {
+	if db.dec != nil {
+		db.dec.Close()
+	}
+	return db.raw.Close()
+}
+
+// encoded returns true if the body is being decoded from a Content-Encoding.
+func (db *decodedBody) encoded() bool {
+	return db.newDec != nil
+}
+
+// wireBytes returns the number of bytes read from the wire so far.
+func (db *decodedBody) wireBytes() int64 {
+	return db.wire.n
+}
+
+// maxBodySize returns how many (decoded) bytes of res's body we are willing
+// to read: MaxDecompressedSizeBytes if it is compressed, otherwise
+// MaxHTTPContentSizeBytes (which a DomainProfile may override).
+func (f *fetcher) maxBodySize(res *http.Response) int64 {
+	if db, ok := res.Body.(*decodedBody); ok && db.encoded() {
+		return Config.Fetcher.MaxDecompressedSizeBytes
+	}
+	return f.profile.maxContentSize
+}
+
+// wireBytes returns how many bytes of body have been received over the wire
+// if body is a decodedBody, otherwise 0.
+func wireBytes(body io.Reader) int64 {
+	if db, ok := body.(*decodedBody); ok {
+		return db.wireBytes()
+	}
+	return 0
+}
+
+// bodyRemoteIP returns the IP address body was received from if body is a
+// decodedBody, otherwise "".
+func bodyRemoteIP(body io.Reader) string {
+	if db, ok := body.(*decodedBody); ok {
+		return db.remoteIP
+	}
+	return ""
+}
@@ -8,16 +8,18 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"code.google.com/p/go.net/context"
 	"code.google.com/p/log4go"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/iParadigms/walker/dnscache"
 	"github.com/iParadigms/walker/mimetools"
-	"github.com/temoto/robotstxt.go"
 )
 
 // NotYetCrawled is a convenience for time.Unix(0, 0), used as a crawl time in
@@ -39,7 +41,9 @@ type FetchResults struct {
 	// A list of redirects. During this request cycle, the first request URL is stored
 	// in URL. The second request (first redirect) is stored in RedirectedFrom[0]. And
 	// the Nth request (N-1 th redirect) will be stored in RedirectedFrom[N-2],
-	// and this is the URL that furnished the http.Response.
+	// and this is the URL that furnished the http.Response. If a redirect was
+	// not followed (see max_redirects and cross_domain_redirects) it is not
+	// in this list; FetchError says where it went instead.
 	RedirectedFrom []*URL
 
 	// Response object; nil if there was a FetchError or ExcludedByRobots is
@@ -64,21 +68,136 @@ type FetchResults struct {
 	// robots.txt rules
 	ExcludedByRobots bool
 
-	// True if the page was marked as 'noindex' via a <meta> tag. Whether it
-	// was crawled depends on the honor_meta_noindex configuration parameter
+	// Why the link is ExcludedByRobots: either a robots.txt rule disallows it,
+	// or robots.txt was unreachable (5xx responses or network errors), in
+	// which case nothing on the host is crawled until it can be fetched
+	RobotsReason string
+
+	// True if the page was marked as 'noindex' via a robots <meta> tag (or
+	// one named for our user agent). Whether it was crawled depends on the
+	// honor_meta_noindex configuration parameter
 	MetaNoIndex bool
 
-	// True if the page was marked as 'nofollow' via a <meta> tag. Whether it
-	// was crawled depends on the honor_meta_nofollow configuration parameter
+	// True if the page was marked as 'nofollow' via a robots <meta> tag (or
+	// one named for our user agent). Whether it was crawled depends on the
+	// honor_meta_nofollow configuration parameter
 	MetaNoFollow bool
 
+	// The robots directives of the page, from its X-Robots-Tag headers (for
+	// any content type) and, for HTML pages, its robots <meta> tags, including
+	// those addressed to our user agent by name. Unlike MetaNoIndex and
+	// MetaNoFollow, which only cover <meta> tags, these include the
+	// X-Robots-Tag header, and noarchive, nosnippet and unavailable_after. A
+	// noindex here keeps the page from the handler if honor_meta_noindex is
+	// set.
+	Robots RobotsDirectives
+
 	// The Content-Type of the fetched page.
 	MimeType string
 
+	// The canonical URL of the page, from a <link rel="canonical"> tag or,
+	// failing that, a Link response header with rel="canonical" (which works
+	// for PDFs and the like too); nil if neither was given. It may be the
+	// page's own URL. If it is another page, that page is stored to be
+	// crawled (see also dispatcher.skip_non_canonical).
+	Canonical *URL
+
+	// The links parsed out of an HTML page, made absolute, each with
+	// LinkHints saying how it appeared on the page (see URL.Link). This
+	// includes links that weren't stored to be crawled because a LinkFilter
+	// rejected them (ex. rel="nofollow" links, see link_filters).
+	Links []*URL
+
 	// Fingerprint computed with fnv algorithm (see hash/fnv in standard library)
 	FnvFingerprint int64
+
+	// SimHash fingerprint of the visible text of an HTML page (see SimHash),
+	// for finding near-duplicates; 0 if the page isn't HTML or
+	// compute_simhash is off.
+	SimHash int64
+
+	// Fingerprint of the structure of an HTML page: an fnv hash of its
+	// sequence of tags, without attributes, text or anything else. Pages built
+	// from the same template share it, unless their repeated parts (ex. lists
+	// of results) have different lengths. 0 if the page isn't HTML.
+	StructFingerprint int64
+
+	// The IP address of the server that returned Response, taken from the
+	// connection it came over. Empty if there was no response, or the
+	// FetchManager's Transport isn't an *http.Transport (which is what
+	// reports its connections).
+	RemoteIP string
+
+	// The character encoding an HTML page was decoded from, ex. "utf-8" or
+	// "windows-1252", as determined by its Content-Type header, <meta> tags
+	// or content. Empty if the page isn't HTML.
+	Encoding string
+
+	// The crawl delay in effect for this host after this fetch. This starts
+	// as the robots.txt (or default) crawl delay, but grows if the server
+	// pushes back (429 or 503 responses, Retry-After headers, rising latency
+	// or connection errors), and shrinks back as the host recovers. It is
+	// never larger than max_crawl_delay.
+	CrawlDelay time.Duration
+
+	// True if the body was longer than max_http_content_size_bytes and was
+	// cut off at that size (see truncate_oversized_bodies) rather than
+	// treated as a FetchError. The handler and FnvFingerprint only saw the
+	// first max_http_content_size_bytes bytes.
+	Truncated bool
+
+	// The number of requests made for this link. This is 1 unless transient
+	// failures were retried (see max_fetch_attempts), and 0 if no request
+	// was made (ex. ExcludedByRobots). Response and FetchError describe the
+	// final attempt.
+	Attempts int
+
+	// The size of the response body as received over the wire, and after
+	// decoding its Content-Encoding (see accept_encodings). The two are equal
+	// for uncompressed responses. DecodedBytes is the size of the body the
+	// handler saw (so it is capped if the body was Truncated).
+	WireBytes    int64
+	DecodedBytes int64
+
+	// The error the Handler returned, if it is a FallibleHandler and failed
+	// to handle this response. If IsRetryLater(HandlerError) the link should
+	// be fetched again soon.
+	HandlerError error
+
+	// True if the fetch was aborted because the FetchManager was stopped
+	// (see FetchManager.StopWithTimeout) before it could complete. An
+	// interrupted fetch is not an error; FetchError and Response will be nil
+	// and the link should be crawled again later.
+	Interrupted bool
+}
+
+// RetryLaterError is returned by a FallibleHandler that couldn't handle a
+// response for now (ex. because its storage is unavailable), so the link
+// should be fetched again soon.
+type RetryLaterError struct {
+	// Err says why the response couldn't be handled
+	Err error
+}
+
+func (e *RetryLaterError) Error() string {
+	return fmt.Sprintf("Retry later: %v", e.Err)
+}
+
+// RetryLater returns a RetryLaterError for err.
+func RetryLater(err error) error {
+	return &RetryLaterError{Err: err}
+}
+
+// IsRetryLater returns true if err is a RetryLaterError.
+func IsRetryLater(err error) bool {
+	_, ok := err.(*RetryLaterError)
+	return ok
 }
 
+// errFetchInterrupted is returned by fetcher.fetch when the request was
+// abandoned because the FetchManager's context was canceled.
+var errFetchInterrupted = fmt.Errorf("Fetch interrupted by FetchManager shutdown")
+
 // FetchManager configures and runs the crawl.
 //
 // The calling code must create a FetchManager, set a Datastore and handlers,
@@ -95,29 +214,71 @@ type FetchManager struct {
 	// testing.
 	Transport http.RoundTripper
 
-	// TransNoKeepAlive stores a RoundTripper with Keep-Alive set to 0 IF
-	// http_keep_alive == "threshold". Otherwise it's nil.
+	// TransNoKeepAlive stores a RoundTripper with Keep-Alive set to 0, used
+	// for hosts whose http_keep_alive (which a DomainProfile may override)
+	// says not to keep connections alive. If it's nil, one is created when
+	// Transport is nil too or http_keep_alive == "threshold"; otherwise
+	// Transport is used for every host.
 	TransNoKeepAlive http.RoundTripper
 
 	// Parsed duration of the string Config.Fetcher.HTTPKeepAliveThreshold
 	KeepAliveThreshold time.Duration
 
+	// LinkFilters can be set to override the chain of filters that decide
+	// which links found while crawling get stored. If nil, the chain
+	// configured by link_filters is used (see ConfiguredLinkFilters).
+	LinkFilters []LinkFilter
+
 	fetchers          []*fetcher
 	activeThreadsWait sync.WaitGroup
 	started           bool
 
-	// used to match Content-Type headers
-	acceptFormats *mimetools.Matcher
+	// profile holds the global settings fetchers use for a link unless a
+	// DomainProfile overrides them (see hostProfiles)
+	profile *crawlProfile
+
+	// the Accept-Encoding header we send, see acceptEncodingHeader
+	acceptEncoding string
 
-	defCrawlDelay time.Duration
-	maxCrawlDelay time.Duration
+	minBackoffCrawlDelay time.Duration
+
+	// robots caches robotsRules by origin ("scheme://host[:port]") for all
+	// fetchers. Entries are refreshed after robotsTTL, or
+	// robotsUnreachableTTL if robots.txt couldn't be fetched
+	robots               *lru.Cache
+	robotsTTL            time.Duration
+	robotsUnreachableTTL time.Duration
+
+	// sitemapsRead maps hosts to when their sitemaps were last read (see
+	// discover_sitemaps), which is repeated every sitemapRefresh
+	sitemapsRead   *lru.Cache
+	sitemapRefresh time.Duration
+
+	// redirects is how links are allowed to redirect, see max_redirects and
+	// cross_domain_redirects
+	redirects *redirectPolicy
+
+	// ipPoliteness limits how hard all fetchers together hit a single IP
+	ipPoliteness *ipPoliteness
+
+	// bandwidth holds the global and per-host read rate limits
+	bandwidth *bandwidthLimiter
+
+	// Parsed Config.Fetcher.RetryBackoff and MaxRetryBackoff
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
 
 	// how long to wait between Datastore.KeepAlive() calls.
 	activeFetcherHeartbeat time.Duration
 
-	// close this channel to kill the keep-alive thread
+	// close this channel to kill the keep-alive and bandwidth polling threads
 	keepAliveQuit chan struct{}
 
+	// ctx is canceled to abort any outstanding requests (and crawl-delay
+	// sleeps) in the fetchers; see StopWithTimeout
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	// If this flag is set, oneShot is set on each child fetcher
 	oneShot bool
 }
@@ -140,13 +301,26 @@ func (fm *FetchManager) run() {
 	}
 
 	var err error
-	fm.defCrawlDelay, err = time.ParseDuration(Config.Fetcher.DefaultCrawlDelay)
+	fm.profile = &crawlProfile{
+		userAgent:      Config.Fetcher.UserAgent,
+		acceptList:     Config.Fetcher.AcceptFormats,
+		maxContentSize: Config.Fetcher.MaxHTTPContentSizeBytes,
+		keepAlive:      strings.ToLower(Config.Fetcher.HTTPKeepAlive),
+	}
+
+	fm.profile.defCrawlDelay, err = time.ParseDuration(Config.Fetcher.DefaultCrawlDelay)
+	if err != nil {
+		// This won't happen b/c this duration is checked in Config
+		panic(err)
+	}
+
+	fm.profile.maxCrawlDelay, err = time.ParseDuration(Config.Fetcher.MaxCrawlDelay)
 	if err != nil {
 		// This won't happen b/c this duration is checked in Config
 		panic(err)
 	}
 
-	fm.maxCrawlDelay, err = time.ParseDuration(Config.Fetcher.MaxCrawlDelay)
+	fm.minBackoffCrawlDelay, err = time.ParseDuration(Config.Fetcher.MinBackoffCrawlDelay)
 	if err != nil {
 		// This won't happen b/c this duration is checked in Config
 		panic(err)
@@ -158,11 +332,82 @@ func (fm *FetchManager) run() {
 	}
 	fm.activeFetcherHeartbeat = time.Duration(float32(ttl) * Config.Fetcher.ActiveFetchersKeepratio)
 
-	fm.acceptFormats, err = mimetools.NewMatcher(Config.Fetcher.AcceptFormats)
+	fm.profile.acceptFormats, err = mimetools.NewMatcher(Config.Fetcher.AcceptFormats)
 	if err != nil {
 		panic(fmt.Errorf("mimetools.NewMatcher failed to initialize: %v", err))
 	}
 
+	fm.acceptEncoding = acceptEncodingHeader(Config.Fetcher.AcceptEncodings)
+
+	fm.robotsTTL, err = time.ParseDuration(Config.Fetcher.RobotsCacheTTL)
+	if err != nil {
+		// This won't happen b/c this duration is checked in Config
+		panic(err)
+	}
+
+	fm.robotsUnreachableTTL, err = time.ParseDuration(Config.Fetcher.RobotsUnreachableTTL)
+	if err != nil {
+		// This won't happen b/c this duration is checked in Config
+		panic(err)
+	}
+
+	fm.robots, err = lru.New(robotsCacheSize)
+	if err != nil {
+		panic(fmt.Errorf("Failed to create robots.txt cache: %v", err))
+	}
+
+	fm.sitemapRefresh, err = time.ParseDuration(Config.Fetcher.SitemapRefreshInterval)
+	if err != nil {
+		// This won't happen b/c this duration is checked in Config
+		panic(err)
+	}
+
+	fm.sitemapsRead, err = lru.New(robotsCacheSize)
+	if err != nil {
+		panic(fmt.Errorf("Failed to create sitemap cache: %v", err))
+	}
+
+	if fm.LinkFilters == nil {
+		fm.LinkFilters, err = ConfiguredLinkFilters()
+		if err != nil {
+			// This shouldn't happen b/c it's already been checked when loading config
+			panic(err)
+		}
+	}
+	fm.profile.linkFilters = fm.LinkFilters
+
+	fm.redirects = &redirectPolicy{
+		max:         Config.Fetcher.MaxRedirects,
+		crossDomain: strings.ToLower(Config.Fetcher.CrossDomainRedirects),
+	}
+
+	fm.retryBackoff, err = time.ParseDuration(Config.Fetcher.RetryBackoff)
+	if err != nil {
+		// This won't happen b/c this duration is checked in Config
+		panic(err)
+	}
+
+	fm.maxRetryBackoff, err = time.ParseDuration(Config.Fetcher.MaxRetryBackoff)
+	if err != nil {
+		// This won't happen b/c this duration is checked in Config
+		panic(err)
+	}
+
+	perIPCrawlDelay, err := time.ParseDuration(Config.Fetcher.PerIPCrawlDelay)
+	if err != nil {
+		// This won't happen b/c this duration is checked in Config
+		panic(err)
+	}
+	fm.ipPoliteness, err = newIPPoliteness(perIPCrawlDelay, Config.Fetcher.PerIPMaxConcurrency,
+		Config.Fetcher.MaxDNSCacheEntries)
+	if err != nil {
+		panic(fmt.Errorf("Failed to create per-IP politeness registry: %v", err))
+	}
+
+	fm.bandwidth = newBandwidthLimiter(Config.Fetcher.BandwidthLimit, Config.Fetcher.HostBandwidthLimit)
+
+	fm.ctx, fm.cancel = context.WithCancel(context.Background())
+
 	// Make sure that the initial KeepAlive work is done
 	err = fm.Datastore.KeepAlive()
 	if err != nil {
@@ -170,6 +415,7 @@ func (fm *FetchManager) run() {
 		log4go.Error(err.Error())
 		panic(err)
 	}
+	fm.pollBandwidthLimits()
 
 	// Create keep-alive thread
 	fm.keepAliveQuit = make(chan struct{})
@@ -190,6 +436,20 @@ func (fm *FetchManager) run() {
 		}
 	}()
 
+	// Create a thread to pick up bandwidth limits changed in the datastore
+	fm.activeThreadsWait.Add(1)
+	go func() {
+		for {
+			select {
+			case <-fm.keepAliveQuit:
+				fm.activeThreadsWait.Done()
+				return
+			case <-time.After(bandwidthPollInterval):
+			}
+			fm.pollBandwidthLimits()
+		}
+	}()
+
 	fm.started = true
 
 	timeout, err := time.ParseDuration(Config.Fetcher.HTTPTimeout)
@@ -204,6 +464,7 @@ func (fm *FetchManager) run() {
 		panic(err)
 	}
 
+	ownTransport := fm.Transport == nil
 	if fm.Transport == nil {
 		keepAlive := 30 * time.Second
 		if strings.ToLower(Config.Fetcher.HTTPKeepAlive) == "never" {
@@ -222,7 +483,10 @@ func (fm *FetchManager) run() {
 			TLSHandshakeTimeout: 10 * time.Second,
 		}
 	}
-	if fm.TransNoKeepAlive == nil && strings.ToLower(Config.Fetcher.HTTPKeepAlive) == "threshold" {
+	// Domain profiles can set http_keep_alive too, so unless we were given
+	// a Transport of our own we need both whatever the global setting is
+	if fm.TransNoKeepAlive == nil &&
+		(ownTransport || strings.ToLower(Config.Fetcher.HTTPKeepAlive) == "threshold") {
 		fm.TransNoKeepAlive = &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 			Dial: (&net.Dialer{
@@ -233,28 +497,36 @@ func (fm *FetchManager) run() {
 		}
 	}
 
+	// The IP filter goes under the DNS cache so that each address is checked
+	// when it is resolved, and blocked hosts are cached as failures
+	ipFilter := newIPFilter()
 	t, ok := fm.Transport.(*http.Transport)
 	if ok {
 		var err error
-		t.Dial, err = dnscache.Dial(t.Dial, Config.Fetcher.MaxDNSCacheEntries)
+		t.Dial, err = dnscache.DialObserved(ipFilter.wrap(t.Dial), Config.Fetcher.MaxDNSCacheEntries, fm.ipPoliteness.observe)
 		if err != nil {
 			// This should be a very rare panic
 			log4go.Error("Failed to construct dnscacheing Dialer for Transport: %v", err)
 			panic(err)
 		}
+		t.Proxy = ipFilter.wrapProxy(t.Proxy)
 	} else {
 		log4go.Info("Given an non-http Transport, not using dns caching")
+		if ipFilter.active() {
+			log4go.Warn("Given an non-http Transport, cannot enforce blacklist_private_ips or deny_cidrs")
+		}
 	}
 
 	if fm.TransNoKeepAlive != nil {
 		t, ok = fm.TransNoKeepAlive.(*http.Transport)
 		if ok {
-			t.Dial, err = dnscache.Dial(t.Dial, Config.Fetcher.MaxDNSCacheEntries)
+			t.Dial, err = dnscache.DialObserved(ipFilter.wrap(t.Dial), Config.Fetcher.MaxDNSCacheEntries, fm.ipPoliteness.observe)
 			if err != nil {
 				// This should be a very rare panic
 				log4go.Error("Failed to construct dnscacheing Dialer for TransNoKeepAlive: %v", err)
 				panic(err)
 			}
+			t.Proxy = ipFilter.wrapProxy(t.Proxy)
 		} else {
 			log4go.Info("Given a non-http TransNoKeepAlive, not using dns caching")
 		}
@@ -299,12 +571,29 @@ func (fm *FetchManager) oneShotRun() {
 	fm.oneShot = true
 	fm.run()
 	fm.activeThreadsWait.Wait()
+	fm.cancel()
 }
 
 // Stop notifies the fetchers to finish their current requests. It blocks until
 // all fetchers have finished.
 func (fm *FetchManager) Stop() {
 	log4go.Info("Stopping FetchManager")
+	fm.stop(0)
+}
+
+// StopWithTimeout notifies the fetchers to finish their current requests, the
+// same as Stop. If the fetchers have not finished after duration d, any
+// outstanding requests are aborted; those links are passed to
+// Datastore.StoreURLFetchResults with FetchResults.Interrupted set. It blocks
+// until all fetchers have finished.
+func (fm *FetchManager) StopWithTimeout(d time.Duration) {
+	log4go.Info("Stopping FetchManager (timeout %v)", d)
+	fm.stop(d)
+}
+
+// stop implements Stop and StopWithTimeout; a timeout of zero waits
+// indefinitely for the fetchers to finish.
+func (fm *FetchManager) stop(timeout time.Duration) {
 	if !fm.started {
 		panic("Cannot stop a FetchManager that has not been started")
 	}
@@ -312,7 +601,23 @@ func (fm *FetchManager) Stop() {
 		go f.stop()
 	}
 	close(fm.keepAliveQuit)
-	fm.activeThreadsWait.Wait()
+
+	finished := make(chan struct{})
+	go func() {
+		fm.activeThreadsWait.Wait()
+		close(finished)
+	}()
+
+	if timeout > 0 {
+		select {
+		case <-finished:
+		case <-time.After(timeout):
+			log4go.Info("Fetchers did not finish within %v, interrupting outstanding fetches", timeout)
+			fm.cancel()
+		}
+	}
+	<-finished
+	fm.cancel()
 }
 
 // fetcher encompasses one of potentially many fetchers the FetchManager may
@@ -322,25 +627,31 @@ type fetcher struct {
 	fm         *FetchManager
 	host       string
 	httpclient *http.Client
-	crawldelay time.Duration
+
+	// crawldelay adapts the crawl delay to how the current host is coping
+	crawldelay adaptiveDelay
+
+	// profile holds the settings for the link being crawled
+	profile *crawlProfile
 
 	// quit signals the fetcher to stop
 	quit chan struct{}
 
+	// ctx is canceled when outstanding requests should be aborted
+	ctx context.Context
+
 	// done receives when the fetcher has finished; this is necessary because
 	// the fetcher may need to clean up (ex. unclaim the current host) after
 	// reading from quit
 	done chan struct{}
 
-	excludeLink *regexp.Regexp
-	includeLink *regexp.Regexp
+	// retryOn holds the classes of transient failures to retry (see
+	// retryClass)
+	retryOn map[string]bool
 
-	// defRobots holds the robots.txt definition used if a host doesn't
-	// publish a robots.txt file on it's own.
-	defRobots *robotstxt.Group
-
-	// robotsMap maps host -> robots.txt definition to use
-	robotsMap map[string]*robotstxt.Group
+	// hostBandwidth meters reads from the current host against
+	// host_bandwidth_limit
+	hostBandwidth tokenBucket
 
 	// Where to read content pages into
 	readBuffer bytes.Buffer
@@ -387,32 +698,32 @@ func newFetcher(fm *FetchManager) *fetcher {
 
 	f := new(fetcher)
 	f.fm = fm
+	f.ctx = fm.ctx
 	f.httpclient = &http.Client{
 		Transport: fm.Transport,
 		Timeout:   timeout,
 	}
 	f.quit = make(chan struct{})
 	f.done = make(chan struct{})
-
-	if len(Config.Fetcher.ExcludeLinkPatterns) > 0 {
-		f.excludeLink, err = aggregateRegex(Config.Fetcher.ExcludeLinkPatterns, "exclude_link_patterns")
-		if err != nil {
-			// This shouldn't happen b/c it's already been checked when loading config
-			panic(err)
-		}
+	f.crawldelay = adaptiveDelay{
+		enabled: Config.Fetcher.AdaptiveCrawlDelay,
+		min:     fm.minBackoffCrawlDelay,
 	}
-
-	if len(Config.Fetcher.IncludeLinkPatterns) > 0 {
-		f.includeLink, err = aggregateRegex(Config.Fetcher.IncludeLinkPatterns, "include_link_patterns")
-		if err != nil {
-			// This shouldn't happen b/c it's already been checked when loading config
-			panic(err)
-		}
+	f.setProfile(fm.profile)
+	f.retryOn = map[string]bool{}
+	for _, class := range Config.Fetcher.RetryErrors {
+		f.retryOn[strings.ToLower(class)] = true
 	}
 
 	return f
 }
 
+// setProfile sets the settings the fetcher uses from now on.
+func (f *fetcher) setProfile(cp *crawlProfile) {
+	f.profile = cp
+	f.crawldelay.max = cp.maxCrawlDelay
+}
+
 // start blocks until the fetcher has completed by being told to quit.
 func (f *fetcher) start() {
 	log4go.Debug("Starting new fetcher")
@@ -448,61 +759,178 @@ func (f *fetcher) crawlNewHost() bool {
 		time.Sleep(time.Second)
 		return true
 	}
+	hostsClaimedMetric.Inc()
 	defer func() {
 		log4go.Info("Finished crawling %v, unclaiming", f.host)
 		f.fm.Datastore.UnclaimHost(f.host)
+		hostsUnclaimedMetric.Inc()
 	}()
 
 	if f.checkForBlacklisting(f.host) {
 		return true
 	}
 
-	// Set up robots map
-	log4go.Info("Crawling host: %v with crawl delay %v", f.host, f.crawldelay)
-	f.initializeRobotsMap(f.host)
+	f.crawldelay.reset()
+	f.hostBandwidth.reset()
+	profiles := f.fm.hostProfiles(f.host)
+	f.setProfile(profiles.domain)
+	log4go.Info("Crawling host: %v", f.host)
 
 	// Loop through the links
+	discovered := !Config.Fetcher.DiscoverSitemaps
 	for link := range f.fm.Datastore.LinksForHost(f.host) {
 		select {
 		case <-f.quit:
 			// Let the defer unclaim the host and the caller indicate that this
 			// goroutine is done
 			return false
+		case <-f.ctx.Done():
+			return false
 		default:
 		}
 
-		robots := f.fetchRobots(link.Host)
+		// Sitemaps are looked for over the scheme the host's links use
+		if !discovered {
+			discovered = true
+			if !f.discoverSitemaps(strings.ToLower(link.Scheme)) {
+				return false
+			}
+		}
+
+		f.setProfile(profiles.forLink(link))
+		robots := f.fetchRobots(link)
+		if robots == nil {
+			// Interrupted while fetching robots.txt
+			return false
+		}
 
 		shouldDelay, crawlDelayClockStart := f.fetchAndHandle(link, robots)
 		if shouldDelay {
 			// fetchTime is the last server GET (not counting robots.txt GET's). So
 			// delta represents the amount of the CrawlDelay that still needs to be
 			// waited
-			delta := robots.CrawlDelay - time.Now().Sub(crawlDelayClockStart)
+			delta := f.crawldelay.effective(robots.CrawlDelay) - time.Now().Sub(crawlDelayClockStart)
 			if delta > 0 {
-				time.Sleep(delta)
+				select {
+				case <-time.After(delta):
+				case <-f.quit:
+					return false
+				case <-f.ctx.Done():
+					return false
+				}
 			}
 		}
 	}
 	return true
 }
 
+// interrupted returns true if the fetcher's context has been canceled, i.e.
+// outstanding requests should be abandoned.
+func (f *fetcher) interrupted() bool {
+	select {
+	case <-f.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// storeInterrupted records that the fetch of fr.URL was aborted before it
+// could complete.
+func (f *fetcher) storeInterrupted(fr *FetchResults) {
+	log4go.Debug("Fetch of %v interrupted", fr.URL)
+	fr.Interrupted = true
+	fr.Response = nil
+	fr.FetchError = nil
+	f.fm.Datastore.StoreURLFetchResults(fr)
+}
+
 // fetchAndHandle takes care of fetching and processing a URL beginning to end.
 // Returns true if it did actually perform a fetch (even if it wasn't
 // successful), indicating that crawl-delay should be observed. Returns, also,
 // the time we start the clock for a return visit to the server.
-func (f *fetcher) fetchAndHandle(link *URL, robots *robotstxt.Group) (bool, time.Time) {
+func (f *fetcher) fetchAndHandle(link *URL, robots *robotsRules) (bool, time.Time) {
 	fr := &FetchResults{URL: link, FetchTime: NotYetCrawled}
 
 	if !robots.Test(link.RequestURI()) {
 		log4go.Debug("Not fetching due to robots rules: %v", link)
 		fr.ExcludedByRobots = true
+		fr.RobotsReason = robots.reason
+		robotsExcludedMetric.Inc()
+		fr.CrawlDelay = f.crawldelay.effective(robots.CrawlDelay)
 		f.fm.Datastore.StoreURLFetchResults(fr)
 		return false, time.Now()
 	}
 
-	fr.FetchTime = time.Now()
-	fr.Response, fr.RedirectedFrom, fr.FetchError = f.fetch(link)
+	var release func()
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+
+	for {
+		// Wait until link's IP can take another request; the slot is released
+		// once the body has been read (or we give up)
+		var ok bool
+		release, ok = f.fm.ipPoliteness.acquire(link.Host, f.ctx.Done())
+		if !ok {
+			f.storeInterrupted(fr)
+			return false, time.Now()
+		}
+
+		fr.FetchTime = time.Now()
+		fr.Attempts++
+		fr.Response, fr.RedirectedFrom, fr.FetchError = f.fetch(link, f.fm.redirects)
+		if fr.FetchError != nil && f.interrupted() {
+			f.storeInterrupted(fr)
+			return false, time.Now()
+		}
+		fetchesMetric.WithLabelValues(statusClass(fr.Response, fr.FetchError)).Inc()
+		fetchDurationMetric.Observe(time.Since(fr.FetchTime).Seconds())
+		fr.CrawlDelay = f.crawldelay.observe(robots.CrawlDelay, fr, time.Since(fr.FetchTime))
+
+		class := retryClass(fr.Response, fr.FetchError)
+		if class == "" || !f.retryOn[class] || fr.Attempts >= Config.Fetcher.MaxFetchAttempts {
+			break
+		}
+
+		// Every attempt counts against the crawl delay, so wait at least
+		// that long before trying again
+		wait := retryBackoff(fr.Attempts, f.fm.retryBackoff, f.fm.maxRetryBackoff)
+		if wait < fr.CrawlDelay {
+			wait = fr.CrawlDelay
+		}
+		log4go.Debug("Transient failure (%v) fetching %v on attempt %v, retrying in %v",
+			class, link, fr.Attempts, wait)
+		if fr.Response != nil {
+			fr.Response.Body.Close()
+		}
+		release()
+		release = nil
+
+		select {
+		case <-time.After(wait):
+			continue
+		case <-f.ctx.Done():
+			f.storeInterrupted(fr)
+			return false, time.Now()
+		case <-f.quit:
+		}
+
+		// We've been asked to stop, so record the last failure rather than
+		// retrying (the response body, if any, has already been closed)
+		log4go.Debug("Not retrying %v during shutdown", link)
+		f.fm.Datastore.StoreURLFetchResults(fr)
+		return true, time.Now()
+	}
+
+	if fr.Response != nil {
+		fr.RemoteIP = bodyRemoteIP(fr.Response.Body)
+	}
+
+	f.storeRedirectTargets(fr)
+
 	if fr.FetchError != nil {
 		log4go.Debug("Error fetching %v: %v", link, fr.FetchError)
 		f.fm.Datastore.StoreURLFetchResults(fr)
@@ -520,17 +948,34 @@ func (f *fetcher) fetchAndHandle(link *URL, robots *robotstxt.Group) (bool, time
 		// !f.isHandleable(fr.Response). BUT, then stored when we go back with
 		// a 304. By definition a 304 is never MetaNoIndex, and f.isHandleable
 		// always returns false. May need to address in the future.
-		f.fm.Handler.HandleResponse(fr)
+		f.handle(fr)
 
 		return true, time.Now()
 	}
 
+	if Config.Fetcher.StreamNonHTML && !isHTML(fr.Response) {
+		return f.streamAndHandle(fr, robots, release)
+	}
+
 	//
 	// Nab the body of the request, and compute fingerprint
 	//
-	fr.FetchError = f.fillReadBuffer(fr.Response.Body, fr.Response.Header)
-	if fr.FetchError != nil {
+	stopAbort := f.abortOnInterrupt(fr.Response.Body)
+	fr.Truncated, fr.FetchError = f.fillReadBuffer(fr.Response.Body, fr.Response.Header,
+		f.maxBodySize(fr.Response))
+	stopAbort()
+	fr.WireBytes = wireBytes(fr.Response.Body)
+	fr.DecodedBytes = int64(f.readBuffer.Len())
+	wireBytesMetric.Add(fr.WireBytes)
+	decodedBytesMetric.Add(fr.DecodedBytes)
+	fr.Response.Body.Close()
+	release()
+	if fr.FetchError != nil && f.interrupted() {
+		f.storeInterrupted(fr)
+		return false, time.Now()
+	} else if fr.FetchError != nil {
 		log4go.Debug("Error reading body of %v: %v", link, fr.FetchError)
+		fr.CrawlDelay = f.crawldelay.observe(robots.CrawlDelay, fr, time.Since(fr.FetchTime))
 		f.fm.Datastore.StoreURLFetchResults(fr)
 		return true, time.Now()
 	}
@@ -540,6 +985,8 @@ func (f *fetcher) fetchAndHandle(link *URL, robots *robotstxt.Group) (bool, time
 	crawlDelayClockStart := time.Now()
 
 	fr.MimeType = getMimeType(fr.Response)
+	fr.Canonical = linkHeaderCanonical(fr.Response, responseURL(fr))
+	fr.Robots = robotsHeaderDirectives(fr.Response, robotsAgentName(f.profile.userAgent))
 
 	// Replace the response body so the handler can read it.
 	fr.Response.Body = ioutil.NopCloser(bytes.NewReader(f.readBuffer.Bytes()))
@@ -560,10 +1007,18 @@ func (f *fetcher) fetchAndHandle(link *URL, robots *robotstxt.Group) (bool, time
 	if isHTML(fr.Response) {
 		log4go.Fine("Reading and parsing as HTML (%v)", link)
 		f.parseLinks(f.readBuffer.Bytes(), fr)
+		if Config.Fetcher.ComputeSimHash {
+			var err error
+			fr.SimHash, err = simhashHTML(f.readBuffer.Bytes())
+			if err != nil {
+				log4go.Debug("Failed to compute SimHash of %v: %v", link, err)
+			}
+		}
 	}
+	f.storeCanonical(fr)
 
-	if !(Config.Fetcher.HonorMetaNoindex && fr.MetaNoIndex) && f.isHandleable(fr.Response) {
-		f.fm.Handler.HandleResponse(fr)
+	if !(Config.Fetcher.HonorMetaNoindex && fr.Robots.NoIndex) && f.isHandleable(fr.Response) {
+		f.handle(fr)
 	}
 
 	//TODO: Wrap the reader and check for read error here
@@ -572,188 +1027,291 @@ func (f *fetcher) fetchAndHandle(link *URL, robots *robotstxt.Group) (bool, time
 	return true, crawlDelayClockStart
 }
 
+// handle passes fr to the handler, recording any error a FallibleHandler
+// returns in fr.HandlerError.
+func (f *fetcher) handle(fr *FetchResults) {
+	fh, ok := f.fm.Handler.(FallibleHandler)
+	if !ok {
+		f.fm.Handler.HandleResponse(fr)
+		return
+	}
+	fr.HandlerError = fh.TryHandleResponse(fr)
+	if fr.HandlerError != nil {
+		retry := IsRetryLater(fr.HandlerError)
+		log4go.Warn("Handler failed for %v (retry later: %v): %v", fr.URL, retry, fr.HandlerError)
+		handlerFailuresMetric.WithLabelValues(fmt.Sprintf("%v", retry)).Inc()
+	}
+}
+
+// streamAndHandle passes a (non-HTML) response straight to the handler,
+// reading the body through a size-limited reader rather than buffering it,
+// and computing the fingerprint as it streams. The body is not stored, even if
+// cassandra.store_response_body is set. release frees the IP politeness slot
+// once the body has been read. Returns the same values as fetchAndHandle.
+func (f *fetcher) streamAndHandle(fr *FetchResults, robots *robotsRules, release func()) (bool, time.Time) {
+	link := fr.URL
+	fr.MimeType = getMimeType(fr.Response)
+	fr.Canonical = linkHeaderCanonical(fr.Response, responseURL(fr))
+	fr.Robots = robotsHeaderDirectives(fr.Response, robotsAgentName(f.profile.userAgent))
+
+	origBody := fr.Response.Body
+	max := f.maxBodySize(fr.Response)
+	truncate := Config.Fetcher.TruncateOversizedBodies
+	if fr.Response.ContentLength > max && !truncate {
+		origBody.Close()
+		release()
+		fr.FetchError = errContentTooLarge
+		log4go.Debug("Error reading body of %v: %v", link, fr.FetchError)
+		fr.CrawlDelay = f.crawldelay.observe(robots.CrawlDelay, fr, time.Since(fr.FetchTime))
+		f.fm.Datastore.StoreURLFetchResults(fr)
+		return true, time.Now()
+	}
+
+	body := newLimitedBody(ioutil.NopCloser(f.throttle(origBody)), max, truncate)
+	fr.Response.Body = body
+
+	stopAbort := f.abortOnInterrupt(origBody)
+	if !(Config.Fetcher.HonorMetaNoindex && fr.Robots.NoIndex) && f.isHandleable(fr.Response) {
+		log4go.Fine("Streaming %v to handler", link)
+		f.handle(fr)
+	}
+	fr.FetchError = body.finish()
+	stopAbort()
+	origBody.Close()
+	release()
+
+	fr.FnvFingerprint = body.fingerprint()
+	fr.Truncated = body.truncated
+	fr.WireBytes = wireBytes(origBody)
+	fr.DecodedBytes = body.size()
+	wireBytesMetric.Add(fr.WireBytes)
+	decodedBytesMetric.Add(fr.DecodedBytes)
+	if fr.FetchError != nil && f.interrupted() {
+		f.storeInterrupted(fr)
+		return false, time.Now()
+	} else if fr.FetchError != nil {
+		log4go.Debug("Error reading body of %v: %v", link, fr.FetchError)
+		fr.CrawlDelay = f.crawldelay.observe(robots.CrawlDelay, fr, time.Since(fr.FetchTime))
+		f.fm.Datastore.StoreURLFetchResults(fr)
+		return true, time.Now()
+	}
+
+	crawlDelayClockStart := time.Now()
+	f.storeCanonical(fr)
+	log4go.Fine("Storing fetch results for %v", link)
+	f.fm.Datastore.StoreURLFetchResults(fr)
+	return true, crawlDelayClockStart
+}
+
 //
 // fillReadBuffer will fill up readBuffer with the contents of reader. Any
 // problems with the read will be returned in an error; including (and
-// importantly) if the content size would exceed MaxHTTPContentSizeBytes.
+// importantly) if the content size would exceed max (see maxBodySize). If
+// Config.Fetcher.TruncateOversizedBodies is set, oversized content is instead
+// cut off at max and truncated is returned true.
 //
-func (f *fetcher) fillReadBuffer(reader io.Reader, headers http.Header) error {
+func (f *fetcher) fillReadBuffer(reader io.Reader, headers http.Header, max int64) (truncated bool, err error) {
 	f.readBuffer.Reset()
+	truncate := Config.Fetcher.TruncateOversizedBodies
 	lenArr, lenOk := headers["Content-Length"]
 	if lenOk && len(lenArr) > 0 {
+		// Content-Length is the size on the wire, so compare it to
+		// MaxHTTPContentSizeBytes even if the body is compressed
 		var size int64
 		n, err := fmt.Sscanf(lenArr[0], "%d", &size)
 		if n != 1 || err != nil || size < 0 {
 			log4go.Error("Failed to process Content-Length: %v", err)
-		} else if size > Config.Fetcher.MaxHTTPContentSizeBytes {
-			return fmt.Errorf("Content size exceeded MaxHTTPContentSizeBytes")
+		} else if size > f.profile.maxContentSize && !truncate {
+			return false, errContentTooLarge
+		} else if size > max {
+			f.readBuffer.Grow(int(max))
 		} else {
 			f.readBuffer.Grow(int(size))
 		}
 	}
 
-	limitReader := io.LimitReader(reader, Config.Fetcher.MaxHTTPContentSizeBytes+1)
+	limitReader := io.LimitReader(f.throttle(reader), max+1)
 	n, err := f.readBuffer.ReadFrom(limitReader)
-	if err != nil {
-		return err
-	} else if n > Config.Fetcher.MaxHTTPContentSizeBytes {
-		return fmt.Errorf("Content size exceeded MaxHTTPContentSizeBytes")
+	if err == errContentTooLarge && truncate {
+		// A compressed body went over MaxHTTPContentSizeBytes on the wire;
+		// keep what we decoded before that
+		return true, nil
+	} else if err != nil {
+		return false, err
+	} else if n > max && !truncate {
+		return false, errContentTooLarge
+	} else if n > max {
+		f.readBuffer.Truncate(int(max))
+		return true, nil
 	}
 
-	return nil
+	return false, nil
 }
 
+// resetTransport picks the transport for requests made before the crawl delay
+// is known (i.e. for robots.txt), following the http_keep_alive of the
+// fetcher's profile.
 func (f *fetcher) resetTransport() {
-	if f.fm.TransNoKeepAlive != nil {
-		f.httpclient.Transport = f.fm.TransNoKeepAlive
-	}
+	f.useKeepAlive(f.profile.keepAlive == "always")
 }
 
+// setTransportFromCrawlDelay picks the transport for requests to a host with
+// the given crawl delay, following the http_keep_alive of the fetcher's
+// profile.
 func (f *fetcher) setTransportFromCrawlDelay(crawlDelay time.Duration) {
-	if f.fm.TransNoKeepAlive != nil {
-		if crawlDelay > f.fm.KeepAliveThreshold {
-			f.httpclient.Transport = f.fm.TransNoKeepAlive
-		} else {
-			f.httpclient.Transport = f.fm.Transport
-		}
+	switch f.profile.keepAlive {
+	case "never":
+		f.useKeepAlive(false)
+	case "threshold":
+		f.useKeepAlive(crawlDelay <= f.fm.KeepAliveThreshold)
+	default:
+		f.useKeepAlive(true)
 	}
 }
 
-// initializeRobotsMap inits the robotsMap system
-func (f *fetcher) initializeRobotsMap(host string) {
-
-	// Set default robots
-	rdata, _ := robotstxt.FromBytes([]byte("User-agent: *\n"))
-	f.defRobots = rdata.FindGroup(Config.Fetcher.UserAgent)
-	f.defRobots.CrawlDelay = f.fm.defCrawlDelay
-
-	// try read $host/robots.txt. Failure to GET, will just returns
-	// f.defRobots before call
-	f.resetTransport()
-	f.robotsMap = map[string]*robotstxt.Group{}
-	f.defRobots = f.getRobots(host)
-	f.robotsMap[host] = f.defRobots
-	f.setTransportFromCrawlDelay(f.defRobots.CrawlDelay)
-}
-
-// fetchRobots is a caching version of getRobots
-func (f *fetcher) fetchRobots(host string) *robotstxt.Group {
-	rob, robOk := f.robotsMap[host]
-	if !robOk {
-		f.resetTransport()
-		rob = f.getRobots(host)
-		f.robotsMap[host] = rob
+// useKeepAlive switches the fetcher to the FetchManager's Transport, or if
+// keepAlive is false to its TransNoKeepAlive (if it has one).
+func (f *fetcher) useKeepAlive(keepAlive bool) {
+	if keepAlive || f.fm.TransNoKeepAlive == nil {
+		f.httpclient.Transport = f.fm.Transport
+	} else {
+		f.httpclient.Transport = f.fm.TransNoKeepAlive
 	}
-	f.setTransportFromCrawlDelay(rob.CrawlDelay)
-	return rob
 }
 
-// getRobots will return the robotstxt.Group for the given host, or the
-// default robotstxt.Group if the host doesn't support robots.txt
-func (f *fetcher) getRobots(host string) *robotstxt.Group {
-
-	u := &URL{
-		URL: &url.URL{
-			Scheme: "http",
-			Host:   host,
-			Path:   "robots.txt",
-		},
-		LastCrawled: NotYetCrawled, //explicitly set this so that fetcher.fetch won't send If-Modified-Since
+// abortOnInterrupt closes body if the fetcher's context is canceled while it
+// is being read, so that the read fails rather than waiting on the server.
+// The returned function must be called once reading has finished.
+func (f *fetcher) abortOnInterrupt(body io.Closer) func() {
+	// Close the Transport's own body, which may be closed while it is being
+	// read, rather than a decoder reading from it
+	if db, ok := body.(*decodedBody); ok {
+		body = db.raw
 	}
-
-	res, _, err := f.fetch(u)
-	gotRobots := err == nil && res.StatusCode >= 200 && res.StatusCode < 300
-	if !gotRobots {
-		if err != nil {
-			log4go.Debug("Could not fetch %v, assuming there is no robots.txt (error: %v)", u, err)
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-finished:
+		case <-f.ctx.Done():
+			body.Close()
 		}
-		return f.defRobots
-	}
-
-	robots, err := robotstxt.FromResponse(res)
-	res.Body.Close()
-	if err != nil {
-		log4go.Debug("Error parsing robots.txt (%v) assuming there is no robots.txt: %v", u, err)
-		return f.defRobots
-	}
-
-	grp := robots.FindGroup(Config.Fetcher.UserAgent)
-	max := f.fm.maxCrawlDelay
-	if grp.CrawlDelay > max {
-		grp.CrawlDelay = max
-	}
-
-	return grp
+	}()
+	return func() { close(finished) }
 }
 
-func (f *fetcher) fetch(u *URL) (*http.Response, []*URL, error) {
+// fetch GETs the given URL, following redirects as allowed by redirects. If a
+// redirect isn't followed the error is a *RedirectError, returned along with
+// the redirects that were followed. If the fetcher's context is canceled
+// before a response arrives the request is abandoned and errFetchInterrupted
+// is returned.
+func (f *fetcher) fetch(u *URL, redirects *redirectPolicy) (*http.Response, []*URL, error) {
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed to create new request object for %v): %v", u, err)
 	}
 
-	req.Header.Set("User-Agent", Config.Fetcher.UserAgent)
-	req.Header.Set("Accept", strings.Join(Config.Fetcher.AcceptFormats, ","))
-	if !u.LastCrawled.Equal(NotYetCrawled) {
+	req.Header.Set("User-Agent", f.profile.userAgent)
+	req.Header.Set("Accept", strings.Join(f.profile.acceptList, ","))
+	req.Header.Set("Accept-Encoding", f.fm.acceptEncoding)
+	if u.ETag != "" {
+		req.Header.Set("If-None-Match", u.ETag)
+	}
+	if u.LastModified != "" {
+		// Prefer echoing the server's own Last-Modified value back, since
+		// some servers only compare it as an opaque string
+		req.Header.Set("If-Modified-Since", u.LastModified)
+	} else if !u.LastCrawled.Equal(NotYetCrawled) {
 		// Date format used is RFC1123 as specified by
 		// http://www.w3.org/Protocols/rfc2616/rfc2616-sec3.html#sec3.3.1
 		req.Header.Set("If-Modified-Since", u.LastCrawled.Format(time.RFC1123))
 	}
 	log4go.Debug("Sending request: %+v", req)
 
+	// The request is tied to the fetcher's context, so canceling it aborts
+	// the request wherever it is (http.Client copies requests, so
+	// Transport.CancelRequest on ours wouldn't). The trace notes the address
+	// of each connection the request (and its redirects) goes over, so the
+	// final response's is known; only an *http.Transport reports them.
+	var remoteAddr string
+	req = req.WithContext(httptrace.WithClientTrace(f.ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			remoteAddr = ""
+			if ip := remoteIP(info.Conn); ip != nil {
+				remoteAddr = ip.String()
+			}
+		},
+	}))
+
+	// Use a copy of the client so that an abandoned request can't race with
+	// the CheckRedirect of the next one
 	var redirectedFrom []*URL
-	f.httpclient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		redirectedFrom = append(redirectedFrom, &URL{URL: req.URL})
-		return nil
-	}
+	client := *f.httpclient
+	client.CheckRedirect = redirects.checkRedirect(u, &redirectedFrom)
 
-	res, err := f.httpclient.Do(req)
-	if err != nil {
-		return nil, nil, err
+	type result struct {
+		res *http.Response
+		err error
 	}
-	return res, redirectedFrom, nil
-}
+	results := make(chan result, 1)
+	go func() {
+		res, err := client.Do(req)
+		results <- result{res, err}
+	}()
 
-// shouldStoreParsedLink returns true if the argument URL should
-// be stored in datastore. The link can (currently) be rejected
-// because
-//   (*) it's not in the AcceptProtocols
-//   (*) if the path matches exclude_link_patterns and doesn't match include_link_patterns.
-//   (*) the link's path is longer than (the positive) Config.Fetcher.MaxPathLength variable
-//
-func (f *fetcher) shouldStoreParsedLink(u *URL) bool {
-	path := u.RequestURI()
-	if Config.Fetcher.MaxPathLength > 0 && len(path) > Config.Fetcher.MaxPathLength {
-		return false
-	}
+	select {
+	case r := <-results:
+		if ue, ok := r.err.(*url.Error); ok {
+			if re, ok := ue.Err.(*RedirectError); ok {
+				return nil, redirectedFrom, re
+			}
+		}
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+		body, err := newDecodedBody(r.res, f.profile.maxContentSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		body.remoteIP = remoteAddr
+		r.res.Body = body
+		return r.res, redirectedFrom, nil
 
-	include := !(f.excludeLink != nil && f.excludeLink.MatchString(path)) ||
-		(f.includeLink != nil && f.includeLink.MatchString(path))
-	if !include {
-		return false
+	case <-f.ctx.Done():
+		go func() {
+			// Clean up after the request if it does eventually return
+			r := <-results
+			if r.err == nil {
+				r.res.Body.Close()
+			}
+		}()
+		return nil, nil, errFetchInterrupted
 	}
+}
 
-	for _, f := range Config.Fetcher.AcceptProtocols {
-		if u.Scheme == f {
-			return true
+// shouldStoreParsedLink returns true if the argument URL, found while
+// fetching source, should be stored in datastore: that is, if every filter in
+// the FetchManager's LinkFilters accepts it.
+func (f *fetcher) shouldStoreParsedLink(u *URL, source *FetchResults) bool {
+	for _, lf := range f.profile.linkFilters {
+		if ok, reason := lf.FilterLink(u, source); !ok {
+			log4go.Fine("Not storing link %v: %v", u, reason)
+			linksRejectedMetric.WithLabelValues(reason).Inc()
+			return false
 		}
 	}
-
-	return false
+	return true
 }
 
 // checkForBlacklisting returns true if this site is blacklisted or should be
 // blacklisted. If we detect that this site should be blacklisted, this
-// function will call the datastore appropriately.
+// function will exclude it in the datastore (if it is a HostExcluder) so it
+// isn't dispatched again.
 //
 // One example of blacklisting is detection of IP addresses that resolve to
-// localhost or other bad IP ranges.
-//
-// TODO: since different subdomains my resolve to different IPs, find a way to
-// check this for every HTTP fetch without extraneous connections or fetching
-// data we aren't going to care about
-// TODO: write back to the database that this domain has been blacklisted so we
-// don't just keep re-dispatching it
+// localhost or other bad IP ranges. The Transport's Dial refuses to connect to
+// those on every fetch (see ipFilter), so subdomains and redirects are covered
+// too; this just catches the common case of a whole domain resolving to one
+// before we bother crawling it.
 func (f *fetcher) checkForBlacklisting(host string) bool {
 	t, ok := f.fm.Transport.(*http.Transport)
 	if !ok {
@@ -763,24 +1321,28 @@ func (f *fetcher) checkForBlacklisting(host string) bool {
 	}
 
 	conn, err := t.Dial("tcp", net.JoinHostPort(host, "80"))
-	if err != nil {
+	if err == nil {
+		conn.Close()
+		return false
+	}
+	blerr, ok := err.(*BlacklistedAddrError)
+	if !ok {
 		// Don't simply blacklist because we couldn't connect; the TLD+1 may
 		// not work but subdomains may work
 		log4go.Debug("Could not connect to host (%v, %v) to check blacklisting", host, err)
 		return false
 	}
-	defer conn.Close()
 
-	if Config.Fetcher.BlacklistPrivateIPs && isPrivateAddr(conn.RemoteAddr().String()) {
-		log4go.Debug("Host (%v) resolved to private IP address, blacklisting", host)
-		return true
+	log4go.Info("Host (%v) resolved to %v, blacklisting", host, blerr.IP)
+	if ex, ok := f.fm.Datastore.(HostExcluder); ok {
+		ex.ExcludeHost(host, fmt.Sprintf("resolved to blacklisted IP %v (%v)", blerr.IP, blerr.Reason))
 	}
-	return false
+	return true
 }
 
 func (f *fetcher) isHandleable(r *http.Response) bool {
 	for _, ct := range r.Header["Content-Type"] {
-		matched, err := f.fm.acceptFormats.Match(ct)
+		matched, err := f.profile.acceptFormats.Match(ct)
 		if err == nil && matched {
 			return true
 		}
@@ -3,11 +3,19 @@
 package walker
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -32,6 +40,10 @@ type LinkSpec struct {
 	// The time last crawled for this link
 	lastCrawled time.Time
 
+	// The ETag and Last-Modified values from the last crawl of this link
+	etag         string
+	lastModified string
+
 	// The response the mock server should deliver for this url
 	response *MockResponse
 
@@ -61,6 +73,10 @@ type TestSpec struct {
 	// return ANY links
 	hasNoLinks bool
 
+	// This should be true if any hosts are expected to be excluded (see
+	// HostExcluder)
+	excludesHosts bool
+
 	// This should be true, if an explicit transport should NOT be
 	// provided to the FetchManager during initialization
 	suppressTransport bool
@@ -74,6 +90,26 @@ type TestSpec struct {
 
 	// true means do not mock a remote server during this particular test
 	suppressMockServer bool
+
+	// If non-zero, runFetcherTimed stops the FetchManager with
+	// StopWithTimeout(stopTimeout) rather than Stop()
+	stopTimeout time.Duration
+
+	// If set, the handler is a FallibleHandler returning handlerErrors[link]
+	// for each link it handles
+	handlerErrors map[string]error
+}
+
+// fallibleMockHandler makes a MockHandler a FallibleHandler, returning the
+// error in errs for each link.
+type fallibleMockHandler struct {
+	*MockHandler
+	errs map[string]error
+}
+
+func (h *fallibleMockHandler) TryHandleResponse(fr *FetchResults) error {
+	h.MockHandler.HandleResponse(fr)
+	return h.errs[fr.URL.String()]
 }
 
 //
@@ -239,6 +275,8 @@ func runFetcherTimed(test TestSpec, duration time.Duration, t *testing.T) TestRe
 				if link.lastCrawled != zero {
 					u.LastCrawled = link.lastCrawled
 				}
+				u.ETag = link.etag
+				u.LastModified = link.lastModified
 				urls = append(urls, u)
 			}
 
@@ -252,6 +290,10 @@ func runFetcherTimed(test TestSpec, duration time.Duration, t *testing.T) TestRe
 		ds.On("UnclaimHost", host.domain).Return()
 
 	}
+	if test.excludesHosts {
+		ds.On("ExcludeHost", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return()
+	}
+
 	// This last call will make ClaimNewHost return "" on each subsequent call,
 	// which will put the fetcher to sleep.
 	ds.On("ClaimNewHost").Return("")
@@ -273,6 +315,9 @@ func runFetcherTimed(test TestSpec, duration time.Duration, t *testing.T) TestRe
 		Handler:   h,
 		Transport: transport,
 	}
+	if test.handlerErrors != nil {
+		manager.Handler = &fallibleMockHandler{MockHandler: h, errs: test.handlerErrors}
+	}
 
 	if test.transNoKeepAlive != nil {
 		manager.TransNoKeepAlive = test.transNoKeepAlive
@@ -284,7 +329,11 @@ func runFetcherTimed(test TestSpec, duration time.Duration, t *testing.T) TestRe
 	} else {
 		go manager.Start()
 		time.Sleep(duration)
-		manager.Stop()
+		if test.stopTimeout > 0 {
+			manager.StopWithTimeout(test.stopTimeout)
+		} else {
+			manager.Stop()
+		}
 	}
 
 	if !test.suppressMockServer {
@@ -764,7 +813,8 @@ func TestStillCrawlWhenDomainUnreachable(t *testing.T) {
 	Config.Fetcher.BlacklistPrivateIPs = true
 
 	tests := TestSpec{
-		hasNoLinks: true,
+		hasNoLinks:    true,
+		excludesHosts: true,
 		hosts: []DomainSpec{
 			singleLinkDomainSpec("http://private.com/page1.html", nil),
 			singleLinkDomainSpec("http://a1234567890bcde.com/page1.html", nil),
@@ -779,6 +829,166 @@ func TestStillCrawlWhenDomainUnreachable(t *testing.T) {
 
 	results.assertExpectations(t)
 	results.datastore.AssertNotCalled(t, "LinksForHost", "private.com")
+	results.datastore.AssertCalled(t, "ExcludeHost", "private.com", mock.AnythingOfType("string"))
+}
+
+func TestBlacklistedRedirect(t *testing.T) {
+	origBlacklist := Config.Fetcher.BlacklistPrivateIPs
+	origAllow := Config.Fetcher.AllowCIDRs
+	defer func() {
+		Config.Fetcher.BlacklistPrivateIPs = origBlacklist
+		Config.Fetcher.AllowCIDRs = origAllow
+	}()
+	Config.Fetcher.BlacklistPrivateIPs = true
+	// Our mock server is on localhost
+	Config.Fetcher.AllowCIDRs = []string{"127.0.0.0/8", "::1/128"}
+
+	tests := TestSpec{
+		hosts: []DomainSpec{
+			singleLinkDomainSpec("http://a.com/page1.html", &MockResponse{
+				Status:  http.StatusFound,
+				Headers: http.Header{"Location": []string{"http://169.254.169.254/latest/meta-data/"}},
+			}),
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 StoreURLFetchResults call, got %v", len(frs))
+	}
+	fr := frs[0]
+	if fr.FetchError == nil || !strings.Contains(fr.FetchError.Error(), "169.254.169.254") {
+		t.Errorf("Expected the redirect to 169.254.169.254 to be refused, got FetchError %v", fr.FetchError)
+	}
+	if len(results.handlerCalls()) != 0 {
+		t.Errorf("Did not expect any handler calls for a blacklisted redirect")
+	}
+	results.datastore.AssertNotCalled(t, "ExcludeHost", "a.com", mock.AnythingOfType("string"))
+}
+
+func TestIPFilter(t *testing.T) {
+	fl := &ipFilter{
+		blockPrivate: true,
+		allow:        []*net.IPNet{parseCIDR("10.1.0.0/16")},
+		deny:         []*net.IPNet{parseCIDR("203.0.113.0/24"), parseCIDR("10.1.2.0/24")},
+	}
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+		{"127.0.0.1", true},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"192.168.1.1", true},
+		{"100.64.0.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::", true},
+		{"fd00:ec2::254", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"64:ff9b::a00:1", true},      // NAT64 of 10.0.0.1
+		{"64:ff9b::5db8:d822", false}, // NAT64 of 93.184.216.34
+		{"2002:c0a8:101::1", true},    // 6to4 of 192.168.1.1
+		{"10.1.0.1", false},           // allowed
+		{"10.1.2.3", true},            // denied wins over allowed
+		{"203.0.113.7", true},         // denied
+	}
+	for _, tst := range tests {
+		ip := net.ParseIP(tst.ip)
+		if ip == nil {
+			t.Fatalf("Bad test IP %v", tst.ip)
+		}
+		if blocked := fl.blocked(ip) != ""; blocked != tst.blocked {
+			t.Errorf("Expected blocked = %v for %v, got %v", tst.blocked, tst.ip, blocked)
+		}
+	}
+
+	fl.blockPrivate = false
+	if reason := fl.blocked(net.ParseIP("127.0.0.1")); reason != "" {
+		t.Errorf("Expected 127.0.0.1 not to be blocked without blockPrivate, got %q", reason)
+	}
+	if reason := fl.blocked(net.ParseIP("203.0.113.7")); reason == "" {
+		t.Errorf("Expected deny CIDRs to be blocked without blockPrivate")
+	}
+
+	dialed := false
+	dial := fl.wrap(func(network, addr string) (net.Conn, error) {
+		dialed = true
+		return nil, fmt.Errorf("should not dial")
+	})
+	_, err := dial("tcp", "203.0.113.7:80")
+	if _, ok := err.(*BlacklistedAddrError); !ok {
+		t.Errorf("Expected a BlacklistedAddrError dialing a denied IP, got %v", err)
+	}
+	if dialed {
+		t.Errorf("Expected a denied IP literal not to be dialed at all")
+	}
+}
+
+func TestFilteredTransport(t *testing.T) {
+	orig := Config.Fetcher.BlacklistPrivateIPs
+	defer func() { Config.Fetcher.BlacklistPrivateIPs = orig }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	Config.Fetcher.BlacklistPrivateIPs = true
+	client := &http.Client{Transport: FilteredTransport(time.Second)}
+	_, err := client.Get(server.URL)
+	if uerr, ok := err.(*url.Error); !ok {
+		t.Errorf("Expected a url.Error fetching from loopback, got %v", err)
+	} else if _, ok := uerr.Err.(*BlacklistedAddrError); !ok {
+		t.Errorf("Expected a BlacklistedAddrError fetching from loopback, got %v", uerr.Err)
+	}
+
+	Config.Fetcher.BlacklistPrivateIPs = false
+	client = &http.Client{Transport: FilteredTransport(time.Second)}
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected to fetch from loopback without blacklist_private_ips, got %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestIPFilterProxy(t *testing.T) {
+	fl := &ipFilter{blockPrivate: true, deny: []*net.IPNet{parseCIDR("203.0.113.0/24")}}
+	proxyURL, _ := url.Parse("http://93.184.216.34:3128")
+	proxy := fl.wrapProxy(func(req *http.Request) (*url.URL, error) {
+		if req.URL.Host == "direct.com" {
+			return nil, nil
+		}
+		return proxyURL, nil
+	})
+
+	tests := []struct {
+		link    string
+		proxied bool
+	}{
+		{"http://127.0.0.1/", false},
+		{"http://[::1]:8080/", false},
+		{"http://203.0.113.7/", false},
+		{"http://localhost/", false},
+		{"http://93.184.216.34/", true},
+		{"http://direct.com/", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.link, nil)
+		got, err := proxy(req)
+		if proxied := got != nil; proxied != test.proxied {
+			t.Errorf("Expected proxied = %v for %v, got %v (%v)", test.proxied, test.link, got, err)
+		}
+		if test.link != "http://direct.com/" && !test.proxied {
+			if _, ok := err.(*BlacklistedAddrError); !ok {
+				t.Errorf("Expected a BlacklistedAddrError proxying %v, got %v", test.link, err)
+			}
+		}
+	}
 }
 
 func TestFetcherCreatesTransport(t *testing.T) {
@@ -822,7 +1032,7 @@ func TestRedirects(t *testing.T) {
 	}
 
 	tests := TestSpec{
-		hasParsedLinks: false,
+		hasParsedLinks: true,
 		transport:      &roundTriper,
 		hosts:          singleLinkDomainSpecArr(link(1), nil),
 	}
@@ -848,10 +1058,145 @@ func TestRedirects(t *testing.T) {
 		t.Errorf("RedirectedFrom[0] mismatch, got %q, expected %q", fr.RedirectedFrom[1].String(), link(3))
 	}
 
+	// Redirect targets are stored as links in their own right
+	expected := map[string]bool{link(2): true, link(3): true}
+	parsed, _ := results.dsStoreParsedURLCalls()
+	for _, u := range parsed {
+		if !expected[u.String()] {
+			t.Errorf("Unexpected StoreParsedURL call for %v", u)
+		}
+		delete(expected, u.String())
+	}
+	for l := range expected {
+		t.Errorf("Expected StoreParsedURL call for redirect target %v", l)
+	}
+
 	results.assertExpectations(t)
 
 }
 
+func TestRedirectPolicy(t *testing.T) {
+	origMax := Config.Fetcher.MaxRedirects
+	origCross := Config.Fetcher.CrossDomainRedirects
+	defer func() {
+		Config.Fetcher.MaxRedirects = origMax
+		Config.Fetcher.CrossDomainRedirects = origCross
+	}()
+
+	tests := []struct {
+		tag          string
+		maxRedirects int
+		crossDomain  string
+
+		// first is redirected to each of these in turn, the last one
+		// responds with a page
+		redirects []string
+
+		expectedRedirectedFrom []string
+		// the redirect that wasn't followed, "" if all were
+		expectedUnfollowed string
+		expectedStored     []string
+	}{
+		{
+			tag:                    "follow",
+			maxRedirects:           10,
+			crossDomain:            "follow",
+			redirects:              []string{"http://b.com/page1.html"},
+			expectedRedirectedFrom: []string{"http://b.com/page1.html"},
+			expectedStored:         []string{"http://b.com/page1.html"},
+		},
+		{
+			tag:                    "record",
+			maxRedirects:           10,
+			crossDomain:            "record",
+			redirects:              []string{"http://www.a.com/page2.html", "http://b.com/page1.html"},
+			expectedRedirectedFrom: []string{"http://www.a.com/page2.html"},
+			expectedUnfollowed:     "http://b.com/page1.html",
+			expectedStored:         []string{"http://www.a.com/page2.html", "http://b.com/page1.html"},
+		},
+		{
+			tag:                "refuse",
+			maxRedirects:       10,
+			crossDomain:        "refuse",
+			redirects:          []string{"http://b.com/page1.html"},
+			expectedUnfollowed: "http://b.com/page1.html",
+		},
+		{
+			tag:                    "max_redirects",
+			maxRedirects:           1,
+			crossDomain:            "follow",
+			redirects:              []string{"http://a.com/page2.html", "http://a.com/page3.html"},
+			expectedRedirectedFrom: []string{"http://a.com/page2.html"},
+			expectedUnfollowed:     "http://a.com/page3.html",
+			expectedStored:         []string{"http://a.com/page2.html", "http://a.com/page3.html"},
+		},
+	}
+
+	first := "http://a.com/page1.html"
+	for _, tst := range tests {
+		Config.Fetcher.MaxRedirects = tst.maxRedirects
+		Config.Fetcher.CrossDomainRedirects = tst.crossDomain
+
+		roundTripper := mapRoundTrip{Responses: map[string]*http.Response{}}
+		from := first
+		for _, to := range tst.redirects {
+			roundTripper.Responses[from] = response307(to)
+			from = to
+		}
+		roundTripper.Responses[from] = response200()
+
+		spec := TestSpec{
+			hasParsedLinks: true,
+			transport:      &roundTripper,
+			hosts:          singleLinkDomainSpecArr(first, nil),
+		}
+		results := runFetcher(spec, t)
+
+		frs := results.dsStoreURLFetchResultsCalls()
+		if len(frs) != 1 {
+			t.Errorf("%v: expected 1 StoreURLFetchResults call, got %v", tst.tag, len(frs))
+			continue
+		}
+		fr := frs[0]
+
+		var redirectedFrom []string
+		for _, u := range fr.RedirectedFrom {
+			redirectedFrom = append(redirectedFrom, u.String())
+		}
+		if fmt.Sprint(redirectedFrom) != fmt.Sprint(tst.expectedRedirectedFrom) {
+			t.Errorf("%v: expected RedirectedFrom %v, got %v", tst.tag, tst.expectedRedirectedFrom, redirectedFrom)
+		}
+
+		re, ok := fr.FetchError.(*RedirectError)
+		if tst.expectedUnfollowed == "" {
+			if fr.FetchError != nil {
+				t.Errorf("%v: expected no FetchError, got %v", tst.tag, fr.FetchError)
+			}
+			if len(results.handlerCalls()) != 1 {
+				t.Errorf("%v: expected the page to be handled", tst.tag)
+			}
+		} else if !ok {
+			t.Errorf("%v: expected a RedirectError, got %v", tst.tag, fr.FetchError)
+		} else {
+			if re.Target.String() != tst.expectedUnfollowed {
+				t.Errorf("%v: expected unfollowed redirect to %v, got %v", tst.tag, tst.expectedUnfollowed, re.Target)
+			}
+			if len(results.handlerCalls()) != 0 {
+				t.Errorf("%v: expected no handler calls", tst.tag)
+			}
+		}
+
+		var stored []string
+		parsed, _ := results.dsStoreParsedURLCalls()
+		for _, u := range parsed {
+			stored = append(stored, u.String())
+		}
+		if fmt.Sprint(stored) != fmt.Sprint(tst.expectedStored) {
+			t.Errorf("%v: expected redirect targets %v to be stored, got %v", tst.tag, tst.expectedStored, stored)
+		}
+	}
+}
+
 func TestHrefWithSpace(t *testing.T) {
 	testPage := "http://t.com/page1.html"
 	const html_with_href_space = `<!DOCTYPE html>
@@ -956,10 +1301,12 @@ func TestHTTPTimeout(t *testing.T) {
 			canceled[k] = true
 		}
 
+		// A robots.txt that times out is unreachable, so the pages
+		// themselves are never requested
 		expected := map[string]bool{
-			"http://t1.com/page1.html": true,
-			"http://t2.com/page1.html": true,
-			"http://t3.com/page1.html": true,
+			"http://t1.com/robots.txt": true,
+			"http://t2.com/robots.txt": true,
+			"http://t3.com/robots.txt": true,
 		}
 
 		for k := range expected {
@@ -1083,6 +1430,103 @@ func TestMetaNos(t *testing.T) {
 	}
 }
 
+func TestRobotsDirectives(t *testing.T) {
+	origHonorNoindex := Config.Fetcher.HonorMetaNoindex
+	origAcceptFormats := Config.Fetcher.AcceptFormats
+	origStream := Config.Fetcher.StreamNonHTML
+	defer func() {
+		Config.Fetcher.HonorMetaNoindex = origHonorNoindex
+		Config.Fetcher.AcceptFormats = origAcceptFormats
+		Config.Fetcher.StreamNonHTML = origStream
+	}()
+	Config.Fetcher.HonorMetaNoindex = true
+	Config.Fetcher.AcceptFormats = []string{"text/html", "application/pdf"}
+	Config.Fetcher.StreamNonHTML = true
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url: "http://a.com/noindex.pdf",
+						response: &MockResponse{
+							ContentType: "application/pdf",
+							Headers:     http.Header{"X-Robots-Tag": []string{"noindex, NoArchive"}},
+						},
+					},
+					LinkSpec{
+						url:      "http://a.com/index.pdf",
+						response: &MockResponse{ContentType: "application/pdf"},
+					},
+					LinkSpec{
+						url: "http://a.com/agent.html",
+						response: &MockResponse{
+							Body: `<html><head><meta name="Walker" content="none"></head>
+<body><a href="/agent-link.html">link</a></body></html>`,
+						},
+					},
+					LinkSpec{
+						url: "http://a.com/other.html",
+						response: &MockResponse{
+							Headers: http.Header{"X-Robots-Tag": []string{
+								"otherbot: noindex, nofollow",
+								"walker: nosnippet",
+								"unavailable_after: Friday, 25-Jun-10 15:00:00 UTC",
+							}},
+							Body: `<html><head><meta name="otherbot" content="noindex"></head>
+<body><a href="/other-link.html">link</a></body></html>`,
+						},
+					},
+					LinkSpec{
+						url: "http://a.com/nofollow.html",
+						response: &MockResponse{
+							Headers: http.Header{"X-Robots-Tag": []string{"nofollow"}},
+							Body:    `<html><body><a href="/nofollow-link.html">link</a></body></html>`,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	directives := map[string]RobotsDirectives{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		directives[fr.URL.Path] = fr.Robots
+	}
+	expected := map[string]RobotsDirectives{
+		"/noindex.pdf":   RobotsDirectives{NoIndex: true, NoArchive: true},
+		"/index.pdf":     RobotsDirectives{},
+		"/agent.html":    RobotsDirectives{NoIndex: true, NoFollow: true},
+		"/other.html":    RobotsDirectives{NoSnippet: true, UnavailableAfter: time.Date(2010, 6, 25, 15, 0, 0, 0, time.UTC)},
+		"/nofollow.html": RobotsDirectives{NoFollow: true},
+	}
+	if !reflect.DeepEqual(directives, expected) {
+		t.Errorf("Robots directives mismatch\nGot:      %+v\nExpected: %+v", directives, expected)
+	}
+
+	handled := map[string]bool{}
+	for _, fr := range results.handlerCalls() {
+		handled[fr.URL.Path] = true
+	}
+	expectedHandled := map[string]bool{
+		"/index.pdf":     true,
+		"/other.html":    true,
+		"/nofollow.html": true,
+	}
+	if !reflect.DeepEqual(handled, expectedHandled) {
+		t.Errorf("Handled pages mismatch\nGot:      %v\nExpected: %v", handled, expectedHandled)
+	}
+
+	links, _ := results.dsStoreParsedURLCalls()
+	if len(links) != 1 || links[0].Path != "/other-link.html" {
+		t.Errorf("Expected only /other-link.html to be stored, got %v", links)
+	}
+}
+
 func TestFetchManagerFastShutdown(t *testing.T) {
 	tests := TestSpec{
 		hasParsedLinks: false,
@@ -1129,6 +1573,71 @@ func TestFetchManagerFastShutdown(t *testing.T) {
 	results.assertExpectations(t)
 }
 
+func TestStopWithTimeout(t *testing.T) {
+	// The server never answers the page, and notes when the fetcher hangs up
+	hungUp := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			hungUp <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+	transport := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, server.Listener.Addr().String())
+		},
+	}
+
+	tests := TestSpec{
+		hasParsedLinks:     false,
+		transport:          transport,
+		suppressMockServer: true,
+		stopTimeout:        100 * time.Millisecond,
+		hosts: []DomainSpec{
+			singleLinkDomainSpec("http://test.com/page1.html", nil),
+		},
+	}
+
+	start := time.Now()
+	results := runFetcherTimed(tests, 250*time.Millisecond, t)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("StopWithTimeout took %v to return, expected it to abort the fetch", elapsed)
+	}
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 StoreURLFetchResults call, got %d", len(frs))
+	}
+	fr := frs[0]
+	if fr.URL.String() != "http://test.com/page1.html" {
+		t.Errorf("Got unexpected StoreURLFetchResults call for %v", fr.URL)
+	}
+	if !fr.Interrupted {
+		t.Errorf("Expected fetch of %v to be marked Interrupted", fr.URL)
+	}
+	if fr.FetchError != nil {
+		t.Errorf("Expected no FetchError for an interrupted fetch, got %v", fr.FetchError)
+	}
+	if len(results.handlerCalls()) != 0 {
+		t.Errorf("Expected no handler calls for an interrupted fetch")
+	}
+
+	// http_timeout is far off, so only aborting the request closes its
+	// connection this soon
+	select {
+	case <-hungUp:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the outstanding request's connection to be closed")
+	}
+	results.datastore.AssertCalled(t, "UnclaimHost", "test.com")
+}
+
 func TestObjectEmbedIframeTags(t *testing.T) {
 	origHonorNoindex := Config.Fetcher.HonorMetaNoindex
 	origHonorNofollow := Config.Fetcher.HonorMetaNofollow
@@ -1243,96 +1752,442 @@ func TestPathInclusion(t *testing.T) {
 
 }
 
-func TestMaxCrawlDelay(t *testing.T) {
-	// The approach to this test is simple. Set a very high Crawl-delay from
-	// the host, and set a small MaxCrawlDelay in config. Then only allow the
-	// fetcher to run long enough to get all the links IF the fetcher is honoring
-	// the MaxCrawlDelay
-	origDefaultCrawlDelay := Config.Fetcher.DefaultCrawlDelay
-	origMaxCrawlDelay := Config.Fetcher.MaxCrawlDelay
+func TestAdaptiveCrawlDelay(t *testing.T) {
+	origAdaptive := Config.Fetcher.AdaptiveCrawlDelay
 	defer func() {
-		Config.Fetcher.DefaultCrawlDelay = origDefaultCrawlDelay
-		Config.Fetcher.MaxCrawlDelay = origMaxCrawlDelay
+		Config.Fetcher.AdaptiveCrawlDelay = origAdaptive
 	}()
-	Config.Fetcher.MaxCrawlDelay = "100ms" //compare this with the Crawl-delay below
-	Config.Fetcher.DefaultCrawlDelay = "0s"
+	Config.Fetcher.AdaptiveCrawlDelay = true
 
 	tests := TestSpec{
-		hasParsedLinks: true,
+		hasParsedLinks: false,
 		hosts: []DomainSpec{
 			DomainSpec{
 				domain: "a.com",
 				links: []LinkSpec{
 					LinkSpec{
-						url: "http://a.com/robots.txt",
+						url: "http://a.com/page1.html",
 						response: &MockResponse{
-							Body: "User-agent: *\nCrawl-delay: 120\n", // this is 120 seconds, compare to MaxCrawlDelay above
+							Status:  503,
+							Headers: http.Header{"Retry-After": []string{"1"}},
 						},
-						robots: true,
-					},
-					LinkSpec{
-						url: "http://a.com/page1.html",
 					},
 					LinkSpec{
 						url: "http://a.com/page2.html",
 					},
-					LinkSpec{
-						url: "http://a.com/page3.html",
-					},
 				},
 			},
 		},
 	}
 
-	results := runFetcherTimed(tests, time.Second, t)
-
-	expectedPages := map[string]bool{
-		"/page1.html": true,
-		"/page2.html": true,
-		"/page3.html": true,
-	}
+	results := runFetcher(tests, t)
 
+	frs := map[string]*FetchResults{}
 	for _, fr := range results.dsStoreURLFetchResultsCalls() {
-		domain, err := fr.URL.ToplevelDomainPlusOne()
-		if err != nil {
-			panic(err)
-		}
-		path := fr.URL.RequestURI()
-		if domain != "a.com" {
-			t.Fatalf("Domain mismatch -- this shouldn't happen")
-		}
-		if !expectedPages[path] {
-			t.Errorf("Path mistmatch, didn't find path %q in expectedPages", path)
-		} else {
-			delete(expectedPages, path)
-		}
+		frs[fr.URL.RequestURI()] = fr
 	}
-
-	for path := range expectedPages {
-		t.Errorf("Didn't find expected page %q in mock data store", path)
+	fr1, fr2 := frs["/page1.html"], frs["/page2.html"]
+	if fr1 == nil || fr2 == nil {
+		t.Fatalf("Expected both pages to be fetched, got %v", frs)
 	}
 
+	if fr1.CrawlDelay != time.Second {
+		t.Errorf("Expected Retry-After to set the crawl delay to 1s, got %v", fr1.CrawlDelay)
+	}
+	if gap := fr2.FetchTime.Sub(fr1.FetchTime); gap < time.Second {
+		t.Errorf("Expected the fetcher to wait the Retry-After time between fetches, waited %v", gap)
+	}
+	if fr2.CrawlDelay >= time.Second {
+		t.Errorf("Expected the crawl delay to recover after a healthy response, got %v", fr2.CrawlDelay)
+	}
 }
 
-func TestFnvFingerprint(t *testing.T) {
-	html := `<!DOCTYPE html>
-<html>
-<head>
-<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
-<title>No Links</title>
-</head>
-<div>
-	Roses are red, violets are blue, golang is the bomb, aint it so true!
-</div>
-</html>`
-	tests := TestSpec{
+func TestAdaptiveCrawlDelayIgnoresRedirectErrors(t *testing.T) {
+	origAdaptive := Config.Fetcher.AdaptiveCrawlDelay
+	origDefaultCrawlDelay := Config.Fetcher.DefaultCrawlDelay
+	origMinBackoff := Config.Fetcher.MinBackoffCrawlDelay
+	origCross := Config.Fetcher.CrossDomainRedirects
+	defer func() {
+		Config.Fetcher.AdaptiveCrawlDelay = origAdaptive
+		Config.Fetcher.DefaultCrawlDelay = origDefaultCrawlDelay
+		Config.Fetcher.MinBackoffCrawlDelay = origMinBackoff
+		Config.Fetcher.CrossDomainRedirects = origCross
+	}()
+	Config.Fetcher.AdaptiveCrawlDelay = true
+	Config.Fetcher.DefaultCrawlDelay = "0s"
+	Config.Fetcher.MinBackoffCrawlDelay = "1s"
+	Config.Fetcher.CrossDomainRedirects = "refuse"
+
+	// The server answers promptly with a redirect we don't follow, which is
+	// no reason to slow down
+	first := "http://a.com/page1.html"
+	roundTripper := mapRoundTrip{Responses: map[string]*http.Response{
+		first: response307("http://b.com/page1.html"),
+	}}
+	spec := TestSpec{
 		hasParsedLinks: true,
-		hosts:          singleLinkDomainSpecArr("http://a.com/page1.html", &MockResponse{Body: html}),
+		transport:      &roundTripper,
+		hosts:          singleLinkDomainSpecArr(first, nil),
 	}
+	results := runFetcher(spec, t)
 
-	results := runFetcher(tests, t)
-
-	fnv := fnv.New64()
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 StoreURLFetchResults call, got %v", len(frs))
+	}
+	fr := frs[0]
+	if _, ok := fr.FetchError.(*RedirectError); !ok {
+		t.Fatalf("Expected a RedirectError, got %v", fr.FetchError)
+	}
+	if fr.CrawlDelay != 0 {
+		t.Errorf("Expected an unfollowed redirect to leave the crawl delay at 0, got %v", fr.CrawlDelay)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{" 5 ", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"Thu, 01 Jan 2015 00:00:30 GMT", 30 * time.Second, true},
+		{"Wed, 31 Dec 2014 23:00:00 GMT", 0, true},
+	}
+	for _, test := range tests {
+		res := &http.Response{Header: http.Header{}}
+		if test.header != "" {
+			res.Header.Set("Retry-After", test.header)
+		}
+		wait, ok := retryAfter(res, now)
+		if ok != test.ok || wait != test.expected {
+			t.Errorf("retryAfter(%q) = %v, %v; expected %v, %v",
+				test.header, wait, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	origAttempts := Config.Fetcher.MaxFetchAttempts
+	origBackoff := Config.Fetcher.RetryBackoff
+	defer func() {
+		Config.Fetcher.MaxFetchAttempts = origAttempts
+		Config.Fetcher.RetryBackoff = origBackoff
+	}()
+	Config.Fetcher.MaxFetchAttempts = 3
+	Config.Fetcher.RetryBackoff = "10ms"
+
+	tests := TestSpec{
+		hasParsedLinks: false,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://a.com/flaky.html",
+						response: &MockResponse{Status: 500},
+					},
+					LinkSpec{
+						url:      "http://a.com/missing.html",
+						response: &MockResponse{Status: 404},
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	expected := map[string]int{
+		"/flaky.html":   3, // 5XX responses are retried
+		"/missing.html": 1, // but 404's are not
+	}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		path := fr.URL.RequestURI()
+		if fr.Attempts != expected[path] {
+			t.Errorf("Expected %v attempts for %v, got %v", expected[path], path, fr.Attempts)
+		}
+		delete(expected, path)
+	}
+	for path := range expected {
+		t.Errorf("Expected %v to be stored", path)
+	}
+
+	if _, err := results.server.Headers("GET", "http://a.com/flaky.html", 2); err != nil {
+		t.Errorf("Expected 3 requests for /flaky.html: %v", err)
+	}
+	if _, err := results.server.Headers("GET", "http://a.com/flaky.html", 3); err == nil {
+		t.Errorf("Expected only 3 requests for /flaky.html")
+	}
+}
+
+func TestRetryClass(t *testing.T) {
+	tests := []struct {
+		status   int
+		err      error
+		expected string
+	}{
+		{200, nil, ""},
+		{404, nil, ""},
+		{500, nil, "5xx"},
+		{503, nil, "5xx"},
+		{0, &net.DNSError{Err: "no such host", Name: "a.com"}, ""},
+		{0, &net.DNSError{Err: "server misbehaving", Name: "a.com", IsTimeout: true}, "dns"},
+		{0, &url.Error{Op: "Get", URL: "http://a.com/", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, "refused"},
+		{0, &net.OpError{Op: "read", Err: syscall.ECONNRESET}, ""},
+		{0, fmt.Errorf("Some other error"), ""},
+	}
+	for _, test := range tests {
+		var res *http.Response
+		if test.err == nil {
+			res = &http.Response{StatusCode: test.status}
+		}
+		if class := retryClass(res, test.err); class != test.expected {
+			t.Errorf("retryClass(%v, %v) = %q, expected %q", test.status, test.err, class, test.expected)
+		}
+	}
+}
+
+func TestIPPoliteness(t *testing.T) {
+	p, err := newIPPoliteness(100*time.Millisecond, 1, 10)
+	if err != nil {
+		t.Fatalf("Failed to create ipPoliteness: %v", err)
+	}
+	lookups := map[string]int{}
+	p.lookup = func(host string) ([]string, error) {
+		lookups[host]++
+		if host == "new.com" {
+			return []string{"1.2.3.4"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	p.observe("a.com:80", "1.2.3.4:80")
+	p.observe("b.com:80", "1.2.3.4:80")
+	p.observe("c.com:80", "5.6.7.8:80")
+
+	if ip := p.ip("c.com:80"); ip != "5.6.7.8" {
+		t.Errorf("Expected c.com to resolve to 5.6.7.8, got %q", ip)
+	}
+	if ip := p.ip("d.com"); ip != "" {
+		t.Errorf("Expected no IP for a host we haven't connected to, got %q", ip)
+	}
+
+	start := time.Now()
+	releaseA, ok := p.acquire("a.com", nil)
+	if !ok {
+		t.Fatalf("Expected to acquire a.com")
+	}
+
+	// c.com is on a different IP so shouldn't wait
+	releaseC, _ := p.acquire("c.com", nil)
+	releaseC()
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Acquiring a host on a different IP took %v", elapsed)
+	}
+
+	// b.com shares a.com's IP, so has to wait for a.com to be released
+	acquiredB := make(chan time.Time)
+	go func() {
+		releaseB, _ := p.acquire("b.com", nil)
+		acquiredB <- time.Now()
+		releaseB()
+	}()
+	time.Sleep(200 * time.Millisecond)
+	releasedA := time.Now()
+	releaseA()
+	if gotB := <-acquiredB; gotB.Before(releasedA) {
+		t.Errorf("b.com was acquired while a.com (same IP) was still active")
+	}
+
+	// The minimum gap between requests to an IP is observed
+	releaseA, _ = p.acquire("a.com", nil)
+	releaseA()
+	start = time.Now()
+	releaseB, _ := p.acquire("b.com", nil)
+	releaseB()
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected to wait the per-IP crawl delay, waited %v", elapsed)
+	}
+
+	// Hosts not connected to yet are looked up, canceled waits give up, and
+	// hosts that can't be resolved aren't limited
+	releaseA, _ = p.acquire("a.com", nil)
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, ok := p.acquire("b.com", cancel); ok {
+		t.Errorf("Expected acquire to give up when canceled")
+	}
+	if _, ok := p.acquire("new.com:80", cancel); ok {
+		t.Errorf("Expected a host looked up to a.com's IP to be limited with it")
+	}
+	if ip := p.ip("new.com"); ip != "1.2.3.4" {
+		t.Errorf("Expected new.com's lookup to be remembered, got %q", ip)
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := p.acquire("unknown.com", cancel); !ok {
+			t.Errorf("Expected hosts that can't be resolved to not be limited")
+		}
+	}
+	if lookups["new.com"] != 1 || lookups["unknown.com"] != 1 || lookups["a.com"] != 0 {
+		t.Errorf("Expected only hosts not seen before to be looked up, once each, got %v", lookups)
+	}
+	releaseA()
+}
+
+func TestRemoteIP(t *testing.T) {
+	// Connections to port 8080 report a different IP than those to port 80.
+	// Once the second port has been dialed, t1.com's first connection is
+	// still reused for /page3.html, and RemoteIP must be its IP.
+	transport := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			_, port, _ := net.SplitHostPort(addr)
+			conn, err := fakeDial(network, "localhost:80")
+			if err != nil {
+				return nil, err
+			}
+			ip := "203.0.113.7"
+			if port == "8080" {
+				ip = "203.0.113.8"
+			}
+			return &addrConn{Conn: conn, addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 80}}, nil
+		},
+	}
+	tests := TestSpec{
+		hasParsedLinks: true,
+		transport:      transport,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://t1.com/page1.html",
+						response: &MockResponse{Body: "<html>no links</html>"},
+					},
+					LinkSpec{
+						url:      "http://t1.com:8080/page2.html",
+						response: &MockResponse{Body: "<html>no links</html>"},
+					},
+					LinkSpec{
+						url:      "http://t1.com/page3.html",
+						response: &MockResponse{Body: "<html>no links</html>"},
+					},
+				},
+			},
+		},
+	}
+	results := runFetcher(tests, t)
+
+	expected := map[string]string{
+		"http://t1.com/page1.html":      "203.0.113.7",
+		"http://t1.com:8080/page2.html": "203.0.113.8",
+		"http://t1.com/page3.html":      "203.0.113.7",
+	}
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != len(expected) {
+		t.Fatalf("Expected %v StoreURLFetchResults calls, got %v", len(expected), len(frs))
+	}
+	for _, fr := range frs {
+		if ip := expected[fr.URL.String()]; fr.RemoteIP != ip {
+			t.Errorf("Expected RemoteIP %q for %v, got %q", ip, fr.URL, fr.RemoteIP)
+		}
+	}
+}
+
+func TestMaxCrawlDelay(t *testing.T) {
+	// The approach to this test is simple. Set a very high Crawl-delay from
+	// the host, and set a small MaxCrawlDelay in config. Then only allow the
+	// fetcher to run long enough to get all the links IF the fetcher is honoring
+	// the MaxCrawlDelay
+	origDefaultCrawlDelay := Config.Fetcher.DefaultCrawlDelay
+	origMaxCrawlDelay := Config.Fetcher.MaxCrawlDelay
+	defer func() {
+		Config.Fetcher.DefaultCrawlDelay = origDefaultCrawlDelay
+		Config.Fetcher.MaxCrawlDelay = origMaxCrawlDelay
+	}()
+	Config.Fetcher.MaxCrawlDelay = "100ms" //compare this with the Crawl-delay below
+	Config.Fetcher.DefaultCrawlDelay = "0s"
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url: "http://a.com/robots.txt",
+						response: &MockResponse{
+							Body: "User-agent: *\nCrawl-delay: 120\n", // this is 120 seconds, compare to MaxCrawlDelay above
+						},
+						robots: true,
+					},
+					LinkSpec{
+						url: "http://a.com/page1.html",
+					},
+					LinkSpec{
+						url: "http://a.com/page2.html",
+					},
+					LinkSpec{
+						url: "http://a.com/page3.html",
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcherTimed(tests, time.Second, t)
+
+	expectedPages := map[string]bool{
+		"/page1.html": true,
+		"/page2.html": true,
+		"/page3.html": true,
+	}
+
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		domain, err := fr.URL.ToplevelDomainPlusOne()
+		if err != nil {
+			panic(err)
+		}
+		path := fr.URL.RequestURI()
+		if domain != "a.com" {
+			t.Fatalf("Domain mismatch -- this shouldn't happen")
+		}
+		if !expectedPages[path] {
+			t.Errorf("Path mistmatch, didn't find path %q in expectedPages", path)
+		} else {
+			delete(expectedPages, path)
+		}
+	}
+
+	for path := range expectedPages {
+		t.Errorf("Didn't find expected page %q in mock data store", path)
+	}
+
+}
+
+func TestFnvFingerprint(t *testing.T) {
+	html := `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<title>No Links</title>
+</head>
+<div>
+	Roses are red, violets are blue, golang is the bomb, aint it so true!
+</div>
+</html>`
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts:          singleLinkDomainSpecArr("http://a.com/page1.html", &MockResponse{Body: html}),
+	}
+
+	results := runFetcher(tests, t)
+
+	fnv := fnv.New64()
 	fnv.Write([]byte(html))
 	fp := int64(fnv.Sum64())
 
@@ -1360,9 +2215,25 @@ func TestFnvFingerprint(t *testing.T) {
 	}
 }
 
-func TestIfModifiedSince(t *testing.T) {
-	link := "http://a.com/page1.html"
-	lastCrawled := time.Now()
+func TestSimHash(t *testing.T) {
+	var words []string
+	for i := 0; i < 300; i++ {
+		words = append(words, fmt.Sprintf("word%d", i))
+	}
+	text := strings.Join(words, " ")
+	page := func(script string, stamp string, body string) string {
+		return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+<title>Near duplicates</title>
+<script>%s</script>
+<style>div { color: red; }</style>
+</head>
+<div>%s</div>
+<p>Updated %s</p>
+</html>`, script, body, stamp)
+	}
+
 	tests := TestSpec{
 		hasParsedLinks: true,
 		hosts: []DomainSpec{
@@ -1370,9 +2241,20 @@ func TestIfModifiedSince(t *testing.T) {
 				domain: "a.com",
 				links: []LinkSpec{
 					LinkSpec{
-						url:         "http://a.com/page1.html",
-						response:    &MockResponse{Status: 304},
-						lastCrawled: lastCrawled,
+						url:      "http://a.com/page1.html",
+						response: &MockResponse{Body: page("var ad = 1;", "10:31", text)},
+					},
+					LinkSpec{
+						url:      "http://a.com/page2.html",
+						response: &MockResponse{Body: page("var ad = 2; var other = 3;", "11:02", text)},
+					},
+					LinkSpec{
+						url:      "http://a.com/page3.html",
+						response: &MockResponse{Body: page("var ad = 1;", "10:31", "something else entirely")},
+					},
+					LinkSpec{
+						url:      "http://a.com/page4.txt",
+						response: &MockResponse{ContentType: "text/plain", Body: text},
 					},
 				},
 			},
@@ -1381,56 +2263,1011 @@ func TestIfModifiedSince(t *testing.T) {
 
 	results := runFetcher(tests, t)
 
-	//
-	// Did the server see the header
-	//
-	headers, err := results.server.Headers("GET", link, -1)
-	if err != nil {
-		t.Fatalf("results.server.rs.Headers failed %v", err)
+	hashes := map[string]int64{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		hashes[fr.URL.RequestURI()] = fr.SimHash
 	}
-	mod, modOk := headers["If-Modified-Since"]
-	if !modOk {
-		t.Fatalf("Failed to find If-Modified-Since in request header for link %q", link)
-	} else if lm := lastCrawled.Format(time.RFC1123); lm != mod[0] {
-		t.Errorf("If-Modified-Since has bad format, got %q, expected %q", mod[0], lm)
+	if len(hashes) != 4 {
+		t.Fatalf("Expected 4 fetches stored, got %v", hashes)
 	}
-
-	//
-	// Did the data store get called correctly
-	//
-	count := 0
-	for _, fr := range results.dsStoreURLFetchResultsCalls() {
-		count++
-		if fr.URL.String() != link {
-			t.Errorf("DS URL link mismatch: got %q, expected %q", fr.URL.String(), link)
-		}
-		if fr.Response.StatusCode != 304 {
-			t.Errorf("DS StatusCode mismatch: got %d, expected %d", fr.Response.StatusCode, 304)
-		}
+	if hashes["/page1.html"] == 0 || hashes["/page3.html"] == 0 {
+		t.Errorf("Expected SimHashes for HTML pages, got %v", hashes)
 	}
-	if count < 1 {
-		t.Errorf("Expected to find DS call, but didn't")
+	if hashes["/page4.txt"] != 0 {
+		t.Errorf("Expected no SimHash for a non-HTML page, got %x", hashes["/page4.txt"])
+	}
+	if d := HammingDistance(hashes["/page1.html"], hashes["/page2.html"]); d > 6 {
+		t.Errorf("Expected pages only differing by scripts and a timestamp within 6 bits, got %d", d)
+	}
+	if d := HammingDistance(hashes["/page1.html"], hashes["/page3.html"]); d <= 6 {
+		t.Errorf("Expected pages with different text to be more than 6 bits apart, got %d", d)
 	}
 
-	//
-	// Did the handler get called
-	//
-	count = 0
-	for _, fr := range results.dsStoreURLFetchResultsCalls() {
-		count++
-		if fr.URL.String() != link {
-			t.Errorf("Handler URL link mismatch: got %q, expected %q", fr.URL.String(), link)
-		}
-		if fr.Response.StatusCode != 304 {
-			t.Errorf("Handler StatusCode mismatch: got %d, expected %d", fr.Response.StatusCode, 304)
-		}
+	clusters := SimHashClusters([]int64{
+		hashes["/page1.html"], hashes["/page3.html"], hashes["/page2.html"], hashes["/page4.txt"], 0,
+	}, 6)
+	if len(clusters) != 1 || len(clusters[0]) != 2 || clusters[0][0] != 0 || clusters[0][1] != 2 {
+		t.Errorf("Expected page1 and page2 clustered, got %v", clusters)
 	}
-	if count < 1 {
-		t.Errorf("Expected to find Handler call, but didn't")
+
+	// Groups don't chain: c is 3 bits from b, but 6 from a, the
+	// representative of b's group
+	a := int64(0x0f0f0f0f0f0f0f0f)
+	b := a ^ 0x7
+	c := b ^ 0x70
+	clusters = SimHashClusters([]int64{a, b, c}, 3)
+	if len(clusters) != 1 || len(clusters[0]) != 2 || clusters[0][0] != 0 || clusters[0][1] != 1 {
+		t.Errorf("Expected only a and b clustered, got %v", clusters)
+	}
+
+	// A fingerprint joins the nearest representative: 4 bits from a, 3 from d
+	d := a ^ 0x7f
+	clusters = SimHashClusters([]int64{a, d, a ^ 0x0f}, 4)
+	if len(clusters) != 1 || len(clusters[0]) != 2 || clusters[0][0] != 1 || clusters[0][1] != 2 {
+		t.Errorf("Expected the last fingerprint to join d, got %v", clusters)
 	}
 }
 
-func TestNestedRobots(t *testing.T) {
+func TestStructFingerprint(t *testing.T) {
+	page := func(class string, title string, items ...string) string {
+		list := ""
+		for _, item := range items {
+			list += fmt.Sprintf("<li><a href=\"/%s.html\">%s</a></li>", item, item)
+		}
+		return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head><title>%s</title></head>
+<body class="%s"><br/><ul>%s</ul></body>
+</html>`, title, class, list)
+	}
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://a.com/search?q=1",
+						response: &MockResponse{Body: page("results", "Search 1", "x", "y")},
+					},
+					LinkSpec{
+						url:      "http://a.com/search?q=2",
+						response: &MockResponse{Body: page("other", "Search 2", "z", "w")},
+					},
+					LinkSpec{
+						url:      "http://a.com/search?q=3",
+						response: &MockResponse{Body: page("results", "Search 3", "x", "y", "z")},
+					},
+					LinkSpec{
+						url:      "http://a.com/page.txt",
+						response: &MockResponse{ContentType: "text/plain", Body: page("results", "Search 1", "x", "y")},
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	fps := map[string]int64{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		fps[fr.URL.RequestURI()] = fr.StructFingerprint
+	}
+	if len(fps) != 4 {
+		t.Fatalf("Expected 4 fetches stored, got %v", fps)
+	}
+	if fps["/search?q=1"] == 0 {
+		t.Errorf("Expected a structure fingerprint for an HTML page")
+	}
+	if fps["/search?q=1"] != fps["/search?q=2"] {
+		t.Errorf("Expected pages only differing by text and attributes to share a structure fingerprint")
+	}
+	if fps["/search?q=1"] == fps["/search?q=3"] {
+		t.Errorf("Expected pages with different tags to have different structure fingerprints")
+	}
+	if fps["/page.txt"] != 0 {
+		t.Errorf("Expected no structure fingerprint for a non-HTML page, got %x", fps["/page.txt"])
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url: "http://a.com/header.html",
+						response: &MockResponse{
+							ContentType: "text/html; charset=windows-1252",
+							Body:        "<html><body><a href=\"/caf\xe9.html\">caf\xe9</a></body></html>",
+						},
+					},
+					LinkSpec{
+						url: "http://a.com/meta.html",
+						response: &MockResponse{
+							Body: `<html><head><meta charset="utf-8"></head><body>Hi</body></html>`,
+						},
+					},
+					LinkSpec{
+						url:      "http://a.com/page.txt",
+						response: &MockResponse{ContentType: "text/plain", Body: "plain"},
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	encodings := map[string]string{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		encodings[fr.URL.RequestURI()] = fr.Encoding
+	}
+	expected := map[string]string{
+		"/header.html": "windows-1252",
+		"/meta.html":   "utf-8",
+		"/page.txt":    "",
+	}
+	for path, enc := range expected {
+		if encodings[path] != enc {
+			t.Errorf("Expected encoding %q for %v, got %q", enc, path, encodings[path])
+		}
+	}
+
+	// The link was decoded according to the Content-Type header
+	links, _ := results.dsStoreParsedURLCalls()
+	found := false
+	for _, u := range links {
+		if u.Path == "/caf\u00e9.html" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the windows-1252 link to be parsed as /caf\u00e9.html, got %v", links)
+	}
+}
+
+func TestAnchorText(t *testing.T) {
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url: "http://a.com/page.html",
+						response: &MockResponse{
+							Body: `<html><body>
+<a rel="NoFollow  ugc" href="/x.html">Hello
+	<b>world</b> </a>
+<a href="/y.html">Unclosed <a href="/z.html">Next</a>
+<a href="/empty.html"></a>
+<a href="/fr.html" hreflang="fr" type="text/html">Français</a>
+<embed src="/movie.swf">
+<object data="/doc.pdf"></object>
+<iframe src="/frame.html"></iframe>
+<meta http-equiv="refresh" content="5; url=/refresh.html">
+</body></html>`,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	type hints struct {
+		tag, attr, text, rel, hreflang, typ string
+	}
+	got := map[string]hints{}
+	links, _ := results.dsStoreParsedURLCalls()
+	for _, u := range links {
+		if u.Link == nil {
+			t.Errorf("Expected link hints for %v", u)
+			continue
+		}
+		l := u.Link
+		got[u.Path] = hints{l.Tag, l.Attr, l.Text, strings.Join(l.Rel, ","), l.Hreflang, l.Type}
+	}
+	expected := map[string]hints{
+		"/x.html":       {"a", "href", "Hello world", "nofollow,ugc", "", ""},
+		"/y.html":       {"a", "href", "Unclosed", "", "", ""},
+		"/z.html":       {"a", "href", "Next", "", "", ""},
+		"/empty.html":   {"a", "href", "", "", "", ""},
+		"/fr.html":      {"a", "href", "Français", "", "fr", "text/html"},
+		"/movie.swf":    {"embed", "src", "", "", "", ""},
+		"/doc.pdf":      {"object", "data", "", "", "", ""},
+		"/frame.html":   {"iframe", "src", "", "", "", ""},
+		"/refresh.html": {"meta", "content", "", "", "", ""},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Link hints mismatch\nGot:      %v\nExpected: %v", got, expected)
+	}
+}
+
+func TestBaseAndCanonical(t *testing.T) {
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url: "http://a.com/dir/page.html",
+						response: &MockResponse{
+							Body: `<html><head>
+<base target="_blank">
+<base href="/base/">
+<base href="/ignored/">
+<link rel="canonical" href="canon.html">
+<link rel="alternate" hreflang="de" href="de.html">
+<link rel="stylesheet" href="style.css">
+</head><body><a href="x.html">X</a></body></html>`,
+						},
+					},
+					LinkSpec{
+						url: "http://a.com/self.html",
+						response: &MockResponse{
+							Body: `<html><head><link rel="canonical" href="/self.html"></head></html>`,
+						},
+					},
+					LinkSpec{
+						url: "http://a.com/doc.pdf",
+						response: &MockResponse{
+							ContentType: "application/pdf",
+							Headers: http.Header{"Link": []string{
+								`</prev.pdf>; rel="prev", <http://a.com/doc.html>; rel="canonical"`,
+							}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	canonicals := map[string]string{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		canonicals[fr.URL.Path] = ""
+		if fr.Canonical != nil {
+			canonicals[fr.URL.Path] = fr.Canonical.String()
+		}
+	}
+	expectedCanonicals := map[string]string{
+		"/dir/page.html": "http://a.com/base/canon.html",
+		"/self.html":     "http://a.com/self.html",
+		"/doc.pdf":       "http://a.com/doc.html",
+	}
+	if !reflect.DeepEqual(canonicals, expectedCanonicals) {
+		t.Errorf("Canonical mismatch\nGot:      %v\nExpected: %v", canonicals, expectedCanonicals)
+	}
+
+	// Links resolve against <base href>, and canonical pages other than the
+	// page itself are stored along with hreflang alternates
+	type hints struct {
+		tag, attr, rel, hreflang string
+	}
+	got := map[string]hints{}
+	links, _ := results.dsStoreParsedURLCalls()
+	for _, u := range links {
+		got[u.String()] = hints{u.Link.Tag, u.Link.Attr, strings.Join(u.Link.Rel, ","), u.Link.Hreflang}
+	}
+	expected := map[string]hints{
+		"http://a.com/base/x.html":     {"a", "href", "", ""},
+		"http://a.com/base/de.html":    {"link", "href", "alternate", "de"},
+		"http://a.com/base/canon.html": {"link", "href", "canonical", ""},
+		"http://a.com/doc.html":        {"", "Link", "canonical", ""},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Stored links mismatch\nGot:      %v\nExpected: %v", got, expected)
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	link := "http://a.com/page1.html"
+	lastCrawled := time.Now()
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:         "http://a.com/page1.html",
+						response:    &MockResponse{Status: 304},
+						lastCrawled: lastCrawled,
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	//
+	// Did the server see the header
+	//
+	headers, err := results.server.Headers("GET", link, -1)
+	if err != nil {
+		t.Fatalf("results.server.rs.Headers failed %v", err)
+	}
+	mod, modOk := headers["If-Modified-Since"]
+	if !modOk {
+		t.Fatalf("Failed to find If-Modified-Since in request header for link %q", link)
+	} else if lm := lastCrawled.Format(time.RFC1123); lm != mod[0] {
+		t.Errorf("If-Modified-Since has bad format, got %q, expected %q", mod[0], lm)
+	}
+
+	//
+	// Did the data store get called correctly
+	//
+	count := 0
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		count++
+		if fr.URL.String() != link {
+			t.Errorf("DS URL link mismatch: got %q, expected %q", fr.URL.String(), link)
+		}
+		if fr.Response.StatusCode != 304 {
+			t.Errorf("DS StatusCode mismatch: got %d, expected %d", fr.Response.StatusCode, 304)
+		}
+	}
+	if count < 1 {
+		t.Errorf("Expected to find DS call, but didn't")
+	}
+
+	//
+	// Did the handler get called
+	//
+	count = 0
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		count++
+		if fr.URL.String() != link {
+			t.Errorf("Handler URL link mismatch: got %q, expected %q", fr.URL.String(), link)
+		}
+		if fr.Response.StatusCode != 304 {
+			t.Errorf("Handler StatusCode mismatch: got %d, expected %d", fr.Response.StatusCode, 304)
+		}
+	}
+	if count < 1 {
+		t.Errorf("Expected to find Handler call, but didn't")
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	link := "http://a.com/page1.html"
+	etag := `"abc123"`
+	lastModified := "Wed, 21 Oct 2015 07:28:00 GMT"
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:          link,
+						response:     &MockResponse{Status: 304},
+						lastCrawled:  time.Now(),
+						etag:         etag,
+						lastModified: lastModified,
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	headers, err := results.server.Headers("GET", link, -1)
+	if err != nil {
+		t.Fatalf("results.server.rs.Headers failed %v", err)
+	}
+	if got := headers.Get("If-None-Match"); got != etag {
+		t.Errorf("If-None-Match mismatch, got %q, expected %q", got, etag)
+	}
+	// The server's own Last-Modified should be preferred to our crawl time
+	if got := headers.Get("If-Modified-Since"); got != lastModified {
+		t.Errorf("If-Modified-Since mismatch, got %q, expected %q", got, lastModified)
+	}
+}
+
+func TestNestedRobots(t *testing.T) {
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url: "http://dom.com/robots.txt",
+						response: &MockResponse{
+							Body: "User-agent: *\n",
+						},
+						robots: true,
+					},
+
+					LinkSpec{
+						url:    "http://ok.dom.com/robots.txt",
+						robots: true,
+					},
+
+					LinkSpec{
+						url: "http://blocked.dom.com/robots.txt",
+						response: &MockResponse{
+							Body: "User-agent: *\nDisallow: /\n",
+						},
+						robots: true,
+					},
+
+					LinkSpec{
+						url: "http://dom.com/page1.html",
+					},
+
+					LinkSpec{
+						url: "http://ok.dom.com/page1.html",
+					},
+
+					LinkSpec{
+						url: "http://blocked.dom.com/page1.html",
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	//
+	// Now check that the correct requests where made
+	//
+	testRes := []struct {
+		link    string
+		fetched bool
+	}{
+		{"http://notinvolved.com/page1.html", false},
+
+		{"http://dom.com/robots.txt", true},
+		{"http://ok.dom.com/robots.txt", true},
+		{"http://blocked.dom.com/robots.txt", true},
+
+		{"http://dom.com/page1.html", true},
+		{"http://ok.dom.com/page1.html", true},
+		{"http://blocked.dom.com/page1.html", false},
+	}
+
+	for _, tst := range testRes {
+		req := results.server.Requested("GET", tst.link)
+		if tst.fetched && !req {
+			t.Errorf("Expected to have requested link %q, but didn't", tst.link)
+		} else if !tst.fetched && req {
+			t.Errorf("Expected NOT to have requested link %q, but did", tst.link)
+		}
+	}
+}
+
+func TestRobotsStatusHandling(t *testing.T) {
+	tests := TestSpec{
+		hasParsedLinks: false,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://a.com/robots.txt",
+						response: &MockResponse{Status: 503},
+						robots:   true,
+					},
+					LinkSpec{
+						url: "http://a.com/page1.html",
+					},
+				},
+			},
+			DomainSpec{
+				domain: "b.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url: "http://b.com/robots.txt",
+						response: &MockResponse{
+							Body: "User-agent: *\nDisallow: /private\n",
+						},
+						robots: true,
+					},
+					LinkSpec{
+						url: "http://b.com/private.html",
+					},
+					LinkSpec{
+						url: "http://b.com/public.html",
+					},
+					LinkSpec{
+						// Nothing listens on this port, so its robots.txt
+						// is unreachable
+						url: "http://b.com:8080/public.html",
+					},
+				},
+			},
+			DomainSpec{
+				domain: "c.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://c.com/robots.txt",
+						response: &MockResponse{Status: 404},
+						robots:   true,
+					},
+					LinkSpec{
+						url: "http://c.com/page1.html",
+					},
+					LinkSpec{
+						// Rules for b.com should come from the cache
+						url: "http://b.com:80/other.html",
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	expected := map[string]struct {
+		excluded bool
+		reason   string
+	}{
+		"http://a.com/page1.html":       {true, "robots.txt unreachable (503 Service Unavailable)"},
+		"http://b.com/private.html":     {true, robotsDisallowed},
+		"http://b.com/public.html":      {false, ""},
+		"http://b.com:8080/public.html": {true, ""},
+		"http://c.com/page1.html":       {false, ""},
+		"http://b.com:80/other.html":    {false, ""},
+	}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		exp, ok := expected[fr.URL.String()]
+		if !ok {
+			t.Errorf("Unexpected link stored: %v", fr.URL)
+			continue
+		}
+		delete(expected, fr.URL.String())
+
+		if fr.ExcludedByRobots != exp.excluded {
+			t.Errorf("ExcludedByRobots mismatch for %v, got %v, expected %v",
+				fr.URL, fr.ExcludedByRobots, exp.excluded)
+		}
+		if exp.reason != "" && fr.RobotsReason != exp.reason {
+			t.Errorf("RobotsReason mismatch for %v, got %q, expected %q", fr.URL, fr.RobotsReason, exp.reason)
+		}
+		if exp.excluded && !strings.Contains(fr.RobotsReason, "robots.txt") {
+			t.Errorf("Expected a RobotsReason for %v, got %q", fr.URL, fr.RobotsReason)
+		}
+	}
+	for link := range expected {
+		t.Errorf("Expected %v to be stored", link)
+	}
+
+	if _, err := results.server.Headers("GET", "http://b.com/robots.txt", 1); err == nil {
+		t.Errorf("Expected http://b.com/robots.txt to be fetched only once")
+	}
+}
+
+func TestRobotsTooManyRedirects(t *testing.T) {
+	// robots.txt redirects 6 times, one more than we follow, to a file that
+	// would disallow everything. So robots.txt is unavailable: anything may
+	// be crawled.
+	roundTripper := mapRoundTrip{Responses: map[string]*http.Response{
+		"http://a.com/robots.txt": response307("http://a.com/r1"),
+		"http://a.com/r6":         responseBody("text/plain", "User-agent: *\nDisallow: /\n"),
+		"http://a.com/page1.html": response200(),
+	}}
+	for i := 1; i < 6; i++ {
+		roundTripper.Responses[fmt.Sprintf("http://a.com/r%d", i)] = response307(fmt.Sprintf("http://a.com/r%d", i+1))
+	}
+	tests := TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTripper,
+		hosts:          singleLinkDomainSpecArr("http://a.com/page1.html", nil),
+	}
+
+	results := runFetcher(tests, t)
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 StoreURLFetchResults call, got %v", len(frs))
+	}
+	if frs[0].ExcludedByRobots {
+		t.Errorf("Expected %v not to be excluded by robots.txt, got reason %q", frs[0].URL, frs[0].RobotsReason)
+	}
+	if frs[0].Response == nil || frs[0].Response.StatusCode != 200 {
+		t.Errorf("Expected %v to be fetched", frs[0].URL)
+	}
+}
+
+func TestRobotsOrigin(t *testing.T) {
+	tests := []struct {
+		link   string
+		scheme string
+		host   string
+	}{
+		{"http://a.com/page.html", "http", "a.com"},
+		{"http://a.com:80/page.html", "http", "a.com"},
+		{"http://a.com:443/page.html", "http", "a.com:443"},
+		{"https://A.com:443/page.html", "https", "a.com"},
+		{"https://a.com:8443/page.html", "https", "a.com:8443"},
+	}
+	for _, tst := range tests {
+		scheme, host := robotsOrigin(MustParse(tst.link))
+		if scheme != tst.scheme || host != tst.host {
+			t.Errorf("robotsOrigin(%q) = %q, %q, expected %q, %q",
+				tst.link, scheme, host, tst.scheme, tst.host)
+		}
+	}
+}
+
+func TestRobotsForProfile(t *testing.T) {
+	f := &fetcher{fm: &FetchManager{robotsTTL: time.Hour}}
+	rules := f.newRobotsRules(`User-agent: partnerbot
+Crawl-delay: 10
+Disallow: /partner
+
+User-agent: *
+Crawl-delay: 60
+Disallow: /private
+`)
+	walker := &crawlProfile{userAgent: "Walker", maxCrawlDelay: 30 * time.Second}
+	partner := &crawlProfile{userAgent: "PartnerBot", maxCrawlDelay: 5 * time.Second}
+
+	// The cached rules are read under each profile in turn; applying one must
+	// not change what the other sees
+	for i := 0; i < 2; i++ {
+		w := rules.forProfile(walker)
+		if w.Test("/private") || !w.Test("/partner") {
+			t.Errorf("Expected the * group for %q", walker.userAgent)
+		}
+		if w.CrawlDelay != 30*time.Second {
+			t.Errorf("Expected crawl delay 30s for %q, got %v", walker.userAgent, w.CrawlDelay)
+		}
+
+		p := rules.forProfile(partner)
+		if p.Test("/partner") || !p.Test("/private") {
+			t.Errorf("Expected the partnerbot group for %q", partner.userAgent)
+		}
+		if p.CrawlDelay != 5*time.Second {
+			t.Errorf("Expected crawl delay 5s for %q, got %v", partner.userAgent, p.CrawlDelay)
+		}
+	}
+
+	// Without robots.txt each profile gets its own default_crawl_delay
+	none := f.noRobots()
+	for _, cp := range []*crawlProfile{
+		&crawlProfile{userAgent: "Walker", defCrawlDelay: time.Second, maxCrawlDelay: time.Minute},
+		&crawlProfile{userAgent: "Walker", defCrawlDelay: 3 * time.Second, maxCrawlDelay: time.Minute},
+	} {
+		if d := none.forProfile(cp).CrawlDelay; d != cp.defCrawlDelay {
+			t.Errorf("Expected default crawl delay %v, got %v", cp.defCrawlDelay, d)
+		}
+	}
+}
+
+func TestStreamNonHTML(t *testing.T) {
+	origSize := Config.Fetcher.MaxHTTPContentSizeBytes
+	origStream := Config.Fetcher.StreamNonHTML
+	origTruncate := Config.Fetcher.TruncateOversizedBodies
+	defer func() {
+		Config.Fetcher.MaxHTTPContentSizeBytes = origSize
+		Config.Fetcher.StreamNonHTML = origStream
+		Config.Fetcher.TruncateOversizedBodies = origTruncate
+	}()
+	Config.Fetcher.MaxHTTPContentSizeBytes = 10
+	Config.Fetcher.StreamNonHTML = true
+
+	for _, truncate := range []bool{true, false} {
+		Config.Fetcher.TruncateOversizedBodies = truncate
+
+		tests := TestSpec{
+			hasParsedLinks: true,
+			hosts: []DomainSpec{
+				DomainSpec{
+					domain: "a.com",
+					links: []LinkSpec{
+						LinkSpec{
+							url: "http://a.com/small.txt",
+							response: &MockResponse{
+								Body:        "012345",
+								ContentType: "text/plain",
+							},
+						},
+						LinkSpec{
+							url: "http://a.com/large.txt",
+							response: &MockResponse{
+								Body:        "0123456789abcdef",
+								ContentType: "text/plain",
+							},
+						},
+					},
+				},
+			},
+		}
+
+		results := runFetcher(tests, t)
+
+		handled := map[string]string{}
+		for _, fr := range results.handlerCalls() {
+			body, err := ioutil.ReadAll(fr.Response.Body)
+			if err != nil {
+				t.Fatalf("Failed to read handled body: %v", err)
+			}
+			handled[fr.URL.RequestURI()] = string(body)
+		}
+
+		frs := map[string]*FetchResults{}
+		for _, fr := range results.dsStoreURLFetchResultsCalls() {
+			frs[fr.URL.RequestURI()] = fr
+		}
+
+		small := frs["/small.txt"]
+		if small == nil || small.FetchError != nil || small.Truncated {
+			t.Errorf("Expected /small.txt to be streamed without error, got %+v", small)
+		} else if small.FnvFingerprint != fnvFingerprint("012345") {
+			t.Errorf("Bad fingerprint for /small.txt")
+		}
+		if handled["/small.txt"] != "012345" {
+			t.Errorf("Expected handler to stream /small.txt, got %q", handled["/small.txt"])
+		}
+
+		large := frs["/large.txt"]
+		if large == nil {
+			t.Fatalf("Expected /large.txt to be stored")
+		}
+		if truncate {
+			if !large.Truncated || large.FetchError != nil {
+				t.Errorf("Expected /large.txt to be truncated, got Truncated %v, FetchError %v",
+					large.Truncated, large.FetchError)
+			}
+			if large.FnvFingerprint != fnvFingerprint("0123456789") {
+				t.Errorf("Expected fingerprint of the truncated body for /large.txt")
+			}
+			if handled["/large.txt"] != "0123456789" {
+				t.Errorf("Expected handler to see truncated /large.txt, got %q", handled["/large.txt"])
+			}
+		} else {
+			if large.Truncated || large.FetchError == nil {
+				t.Errorf("Expected /large.txt to fail, got Truncated %v, FetchError %v",
+					large.Truncated, large.FetchError)
+			}
+			if _, ok := handled["/large.txt"]; ok {
+				t.Errorf("Expected handler not to be called for oversized /large.txt")
+			}
+		}
+	}
+}
+
+func TestTruncateOversizedBodies(t *testing.T) {
+	origSize := Config.Fetcher.MaxHTTPContentSizeBytes
+	origTruncate := Config.Fetcher.TruncateOversizedBodies
+	defer func() {
+		Config.Fetcher.MaxHTTPContentSizeBytes = origSize
+		Config.Fetcher.TruncateOversizedBodies = origTruncate
+	}()
+	Config.Fetcher.MaxHTTPContentSizeBytes = 10
+	Config.Fetcher.TruncateOversizedBodies = true
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: singleLinkDomainSpecArr("http://a.com/page1.html", &MockResponse{
+			Body:        "<html>0123456789</html>",
+			ContentType: "text/html",
+		}),
+	}
+
+	results := runFetcher(tests, t)
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 StoreURLFetchResults call, got %d", len(frs))
+	}
+	if !frs[0].Truncated || frs[0].FetchError != nil {
+		t.Errorf("Expected page to be truncated, got Truncated %v, FetchError %v",
+			frs[0].Truncated, frs[0].FetchError)
+	}
+	if frs[0].FnvFingerprint != fnvFingerprint("<html>0123") {
+		t.Errorf("Expected fingerprint of the truncated body")
+	}
+	if len(results.handlerCalls()) != 1 {
+		t.Errorf("Expected the truncated page to be handled")
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	origMax := Config.Fetcher.MaxDecompressedSizeBytes
+	defer func() {
+		Config.Fetcher.MaxDecompressedSizeBytes = origMax
+	}()
+	Config.Fetcher.MaxDecompressedSizeBytes = 1000
+
+	page := "<html><div>" + strings.Repeat("compressible ", 50) + "</div></html>"
+	bomb := strings.Repeat("0", 5000)
+	gzPage := gzipString(page)
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url: "http://a.com/page.html",
+						response: &MockResponse{
+							Body:    gzPage,
+							Headers: http.Header{"Content-Encoding": []string{"gzip"}},
+						},
+					},
+					LinkSpec{
+						url: "http://a.com/bomb.html",
+						response: &MockResponse{
+							Body:    gzipString(bomb),
+							Headers: http.Header{"Content-Encoding": []string{"gzip"}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	headers, err := results.server.Headers("GET", "http://a.com/page.html", -1)
+	if err != nil {
+		t.Fatalf("results.server.Headers failed %v", err)
+	}
+	if got := headers.Get("Accept-Encoding"); got != "gzip, deflate" {
+		t.Errorf("Accept-Encoding mismatch, got %q, expected %q", got, "gzip, deflate")
+	}
+
+	frs := map[string]*FetchResults{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		frs[fr.URL.RequestURI()] = fr
+	}
+
+	fr := frs["/page.html"]
+	if fr == nil {
+		t.Fatalf("Expected /page.html to be stored")
+	}
+	if fr.FetchError != nil {
+		t.Fatalf("Unexpected FetchError for /page.html: %v", fr.FetchError)
+	}
+	if fr.FnvFingerprint != fnvFingerprint(page) {
+		t.Errorf("Expected fingerprint of the decoded body")
+	}
+	if fr.WireBytes != int64(len(gzPage)) {
+		t.Errorf("WireBytes mismatch, got %v, expected %v", fr.WireBytes, len(gzPage))
+	}
+	if fr.DecodedBytes != int64(len(page)) {
+		t.Errorf("DecodedBytes mismatch, got %v, expected %v", fr.DecodedBytes, len(page))
+	}
+
+	fr = frs["/bomb.html"]
+	if fr == nil {
+		t.Fatalf("Expected /bomb.html to be stored")
+	}
+	if fr.FetchError != errContentTooLarge {
+		t.Errorf("Expected errContentTooLarge for /bomb.html, got %v", fr.FetchError)
+	}
+}
+
+func gzipString(s string) string {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(s))
+	w.Close()
+	return b.String()
+}
+
+func TestParseSitemap(t *testing.T) {
+	sitemap := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url>
+		<loc>http://a.com/page1.html</loc>
+		<lastmod>2015-01-02</lastmod>
+		<changefreq>Daily</changefreq>
+		<priority>0.8</priority>
+	</url>
+	<url>
+		<loc> http://a.com/page2.html </loc>
+		<lastmod>2015-01-02T03:04:05+00:00</lastmod>
+	</url>
+	<url>
+		<loc>/relative.html</loc>
+	</url>
+</urlset>`
+	index := `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap>
+		<loc>http://a.com/sitemap1.xml.gz</loc>
+		<lastmod>2015-01-02</lastmod>
+	</sitemap>
+</sitemapindex>`
+
+	var urls []*URL
+	err := ParseSitemap(strings.NewReader(gzipString(sitemap)),
+		func(u *URL) error {
+			urls = append(urls, u)
+			return nil
+		},
+		func(u *URL) error {
+			t.Errorf("Unexpected sitemap %v in urlset", u)
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("ParseSitemap failed: %v", err)
+	}
+	if len(urls) != 2 {
+		t.Fatalf("Expected 2 urls, got %v", urls)
+	}
+	expected := []struct {
+		link string
+		SitemapHints
+	}{
+		{"http://a.com/page1.html", SitemapHints{time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC), "daily", 0.8}},
+		{"http://a.com/page2.html", SitemapHints{time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC), "", 0.5}},
+	}
+	for i, exp := range expected {
+		u := urls[i]
+		if u.String() != exp.link {
+			t.Errorf("Expected url %v, got %v", exp.link, u)
+		}
+		if u.Sitemap == nil {
+			t.Errorf("Expected sitemap hints for %v", u)
+			continue
+		}
+		if !u.Sitemap.LastMod.Equal(exp.LastMod) || u.Sitemap.ChangeFreq != exp.ChangeFreq ||
+			u.Sitemap.Priority != exp.Priority {
+			t.Errorf("Sitemap hints mismatch for %v, got %+v, expected %+v", u, *u.Sitemap, exp.SitemapHints)
+		}
+	}
+
+	var sitemaps []*URL
+	err = ParseSitemap(strings.NewReader(index),
+		func(u *URL) error {
+			t.Errorf("Unexpected url %v in sitemapindex", u)
+			return nil
+		},
+		func(u *URL) error {
+			sitemaps = append(sitemaps, u)
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("ParseSitemap failed: %v", err)
+	}
+	if len(sitemaps) != 1 || sitemaps[0].String() != "http://a.com/sitemap1.xml.gz" {
+		t.Errorf("Expected sitemap http://a.com/sitemap1.xml.gz, got %v", sitemaps)
+	}
+
+	// Gzipped sitemaps may only decompress to max_decompressed_size_bytes
+	origMax := Config.Fetcher.MaxDecompressedSizeBytes
+	defer func() {
+		Config.Fetcher.MaxDecompressedSizeBytes = origMax
+	}()
+	Config.Fetcher.MaxDecompressedSizeBytes = int64(len(sitemap))
+	err = ParseSitemap(strings.NewReader(gzipString(sitemap)),
+		func(u *URL) error { return nil }, func(u *URL) error { return nil })
+	if err != nil {
+		t.Errorf("Expected a sitemap of exactly max_decompressed_size_bytes to parse, got %v", err)
+	}
+	Config.Fetcher.MaxDecompressedSizeBytes = int64(len(sitemap)) - 1
+	err = ParseSitemap(strings.NewReader(gzipString(sitemap)),
+		func(u *URL) error { return nil }, func(u *URL) error { return nil })
+	if err != errSitemapTooLarge {
+		t.Errorf("Expected errSitemapTooLarge for an oversized gzipped sitemap, got %v", err)
+	}
+}
+
+func TestDiscoverSitemaps(t *testing.T) {
+	orig := Config.Fetcher.DiscoverSitemaps
+	defer func() {
+		Config.Fetcher.DiscoverSitemaps = orig
+	}()
+	Config.Fetcher.DiscoverSitemaps = true
+
 	tests := TestSpec{
 		hasParsedLinks: true,
 		hosts: []DomainSpec{
@@ -1438,36 +3275,39 @@ func TestNestedRobots(t *testing.T) {
 				domain: "a.com",
 				links: []LinkSpec{
 					LinkSpec{
-						url: "http://dom.com/robots.txt",
+						url: "http://a.com/robots.txt",
 						response: &MockResponse{
-							Body: "User-agent: *\n",
+							Body: "User-agent: *\nDisallow: /private\nSitemap: http://a.com/sitemap_index.xml\n",
 						},
 						robots: true,
 					},
-
 					LinkSpec{
-						url:    "http://ok.dom.com/robots.txt",
+						url: "http://a.com/sitemap_index.xml",
+						response: &MockResponse{
+							ContentType: "application/xml",
+							Body: `<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap><loc>http://a.com/sitemap1.xml.gz</loc></sitemap>
+</sitemapindex>`,
+						},
 						robots: true,
 					},
-
 					LinkSpec{
-						url: "http://blocked.dom.com/robots.txt",
+						url: "http://a.com/sitemap1.xml.gz",
 						response: &MockResponse{
-							Body: "User-agent: *\nDisallow: /\n",
+							ContentType: "application/x-gzip",
+							Body: gzipString(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>http://a.com/from-sitemap.html</loc><priority>0.9</priority></url>
+	<url><loc>http://www.a.com/also-from-sitemap.html</loc></url>
+	<url><loc>http://other.com/elsewhere.html</loc></url>
+</urlset>`),
 						},
 						robots: true,
 					},
-
-					LinkSpec{
-						url: "http://dom.com/page1.html",
-					},
-
-					LinkSpec{
-						url: "http://ok.dom.com/page1.html",
-					},
-
 					LinkSpec{
-						url: "http://blocked.dom.com/page1.html",
+						url: "http://a.com/page1.html",
+						response: &MockResponse{
+							Body: "<html>no links</html>",
+						},
 					},
 				},
 			},
@@ -1476,34 +3316,72 @@ func TestNestedRobots(t *testing.T) {
 
 	results := runFetcher(tests, t)
 
-	//
-	// Now check that the correct requests where made
-	//
-	testRes := []struct {
-		link    string
-		fetched bool
-	}{
-		{"http://notinvolved.com/page1.html", false},
+	expected := map[string]float64{
+		"http://a.com/from-sitemap.html":          0.9,
+		"http://www.a.com/also-from-sitemap.html": 0.5,
+	}
+	parsed, frs := results.dsStoreParsedURLCalls()
+	for i, u := range parsed {
+		priority, ok := expected[u.String()]
+		if !ok {
+			t.Errorf("Unexpected StoreParsedURL call for %v", u)
+			continue
+		}
+		delete(expected, u.String())
+		if u.Sitemap == nil || u.Sitemap.Priority != priority {
+			t.Errorf("Expected sitemap priority %v for %v, got %+v", priority, u, u.Sitemap)
+		}
+		if frs[i].URL.String() != "http://a.com/sitemap1.xml.gz" {
+			t.Errorf("Expected %v to come from http://a.com/sitemap1.xml.gz, got %v", u, frs[i].URL)
+		}
+	}
+	for link := range expected {
+		t.Errorf("Expected StoreParsedURL call for %v", link)
+	}
 
-		{"http://dom.com/robots.txt", true},
-		{"http://ok.dom.com/robots.txt", true},
-		{"http://blocked.dom.com/robots.txt", true},
+	if results.server.Requested("GET", "http://a.com/sitemap.xml") {
+		t.Errorf("Expected /sitemap.xml not to be requested when robots.txt lists sitemaps")
+	}
+}
 
-		{"http://dom.com/page1.html", true},
-		{"http://ok.dom.com/page1.html", true},
-		{"http://blocked.dom.com/page1.html", false},
+func TestDiscoverSitemapsScheme(t *testing.T) {
+	orig := Config.Fetcher.DiscoverSitemaps
+	defer func() {
+		Config.Fetcher.DiscoverSitemaps = orig
+	}()
+	Config.Fetcher.DiscoverSitemaps = true
+
+	// b.com is only served over https, so its sitemaps have to be looked for
+	// there
+	roundTripper := mapRoundTrip{Responses: map[string]*http.Response{
+		"https://b.com/robots.txt": responseBody("text/plain",
+			"User-agent: *\nSitemap: https://b.com/sitemap.xml\n"),
+		"https://b.com/sitemap.xml": responseBody("application/xml",
+			`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>https://b.com/from-sitemap.html</loc></url>
+</urlset>`),
+		"https://b.com/page1.html": responseBody("text/html", "<html>no links</html>"),
+	}}
+	tests := TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTripper,
+		hosts:          singleLinkDomainSpecArr("https://b.com/page1.html", nil),
 	}
 
-	for _, tst := range testRes {
-		req := results.server.Requested("GET", tst.link)
-		if tst.fetched && !req {
-			t.Errorf("Expected to have requested link %q, but didn't", tst.link)
-		} else if !tst.fetched && req {
-			t.Errorf("Expected NOT to have requested link %q, but did", tst.link)
-		}
+	results := runFetcher(tests, t)
+
+	parsed, _ := results.dsStoreParsedURLCalls()
+	if len(parsed) != 1 || parsed[0].String() != "https://b.com/from-sitemap.html" {
+		t.Errorf("Expected StoreParsedURL call for https://b.com/from-sitemap.html only, got %v", parsed)
 	}
 }
 
+func fnvFingerprint(s string) int64 {
+	h := fnv.New64()
+	h.Write([]byte(s))
+	return int64(h.Sum64())
+}
+
 func TestMaxContentSize(t *testing.T) {
 	orig := Config.Fetcher.MaxHTTPContentSizeBytes
 	defer func() {
@@ -1737,6 +3615,56 @@ func TestKeepAliveThreshold(t *testing.T) {
 	}
 }
 
+func TestKeepAliveProfile(t *testing.T) {
+	origKeepAlive := Config.Fetcher.HTTPKeepAlive
+	origSimul := Config.Fetcher.NumSimultaneousFetchers
+	origProfiles := Config.Fetcher.DomainProfiles
+	defer func() {
+		Config.Fetcher.HTTPKeepAlive = origKeepAlive
+		Config.Fetcher.NumSimultaneousFetchers = origSimul
+		Config.Fetcher.DomainProfiles = origProfiles
+	}()
+	Config.Fetcher.HTTPKeepAlive = "always"
+	Config.Fetcher.NumSimultaneousFetchers = 1
+	Config.Fetcher.DomainProfiles = map[string]DomainProfile{
+		"b.com": DomainProfile{HTTPKeepAlive: "never"},
+	}
+
+	transport := getRecordingTransport("transport")
+	transNoKeepAlive := getRecordingTransport("transNoKeepAlive")
+
+	tests := TestSpec{
+		hasParsedLinks:   false,
+		transport:        transport,
+		transNoKeepAlive: transNoKeepAlive,
+		hosts: []DomainSpec{
+			singleLinkDomainSpec("http://a.com/page1.html", nil),
+			singleLinkDomainSpec("http://b.com/page1.html", nil),
+		},
+	}
+
+	runFetcher(tests, t)
+
+	// a.com keeps the global setting, b.com's profile turns keep-alive off
+	// (for robots.txt too)
+	used := map[string]string{}
+	for _, v := range transport.Record {
+		used[v] = "transport"
+	}
+	for _, v := range transNoKeepAlive.Record {
+		used[v] = "transNoKeepAlive"
+	}
+	expected := map[string]string{
+		"http://a.com/robots.txt": "transport",
+		"http://a.com/page1.html": "transport",
+		"http://b.com/robots.txt": "transNoKeepAlive",
+		"http://b.com/page1.html": "transNoKeepAlive",
+	}
+	if !reflect.DeepEqual(used, expected) {
+		t.Errorf("Transport mismatch\nGot:      %v\nExpected: %v", used, expected)
+	}
+}
+
 func TestMaxPathLength(t *testing.T) {
 	orig := Config.Fetcher.MaxPathLength
 	defer func() {
@@ -1787,6 +3715,170 @@ func TestMaxPathLength(t *testing.T) {
 	}
 }
 
+func TestLinkFilters(t *testing.T) {
+	orig := Config.Fetcher.LinkFilters
+	defer func() {
+		Config.Fetcher.LinkFilters = orig
+	}()
+	Config.Fetcher.LinkFilters = []string{"same_domain", "accept_protocols", "nofollow"}
+
+	const html string = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<title>Title</title>
+</head>
+<body>
+	<div id="menu">
+		<a href="/page1.html">yes</a>
+		<a href="http://sub.t1.com/page2.html">yes</a>
+		<a href="http://t2.com/page3.html">no</a>
+		<a href="ftp://t1.com/page4.html">no</a>
+		<a href="/page5.html" rel="external NOFOLLOW">no</a>
+	</div>
+</body>
+</html>`
+
+	otherDomain := linksRejectedMetric.WithLabelValues("other_domain").Value()
+	protocol := linksRejectedMetric.WithLabelValues("protocol").Value()
+	nofollow := linksRejectedMetric.WithLabelValues("nofollow").Value()
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/target.html", &MockResponse{Body: html}),
+	}
+
+	results := runFetcher(tests, t)
+
+	expected := map[string]bool{
+		"http://t1.com/page1.html":     true,
+		"http://sub.t1.com/page2.html": true,
+	}
+
+	ulst, _ := results.dsStoreParsedURLCalls()
+	for _, u := range ulst {
+		if expected[u.String()] {
+			delete(expected, u.String())
+		} else {
+			t.Errorf("StoreParsedURL mismatch found unexpected link %q", u.String())
+		}
+	}
+	for e := range expected {
+		t.Errorf("StoreParsedURL expected to see %q, but didn't", e)
+	}
+
+	if n := linksRejectedMetric.WithLabelValues("other_domain").Value() - otherDomain; n != 1 {
+		t.Errorf("Expected 1 link rejected as other_domain, got %v", n)
+	}
+	if n := linksRejectedMetric.WithLabelValues("protocol").Value() - protocol; n != 1 {
+		t.Errorf("Expected 1 link rejected as protocol, got %v", n)
+	}
+	if n := linksRejectedMetric.WithLabelValues("nofollow").Value() - nofollow; n != 1 {
+		t.Errorf("Expected 1 link rejected as nofollow, got %v", n)
+	}
+
+	// The handler still sees every link
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 || len(frs[0].Links) != 5 {
+		t.Fatalf("Expected one fetch with 5 links, got %v", frs)
+	}
+	if l := frs[0].Links[4]; l.String() != "http://t1.com/page5.html" || !l.Link.HasRel("nofollow") {
+		t.Errorf("Expected the last link to be the nofollow one, got %v (%+v)", l, l.Link)
+	}
+}
+
+func TestDomainProfiles(t *testing.T) {
+	orig := Config.Fetcher.DomainProfiles
+	defer func() {
+		Config.Fetcher.DomainProfiles = orig
+	}()
+	Config.Fetcher.DomainProfiles = map[string]DomainProfile{
+		"t1.com": DomainProfile{UserAgent: "Partner Bot"},
+		"sub.t1.com": DomainProfile{
+			ExcludeLinkPatterns: []string{`^/skip`},
+			AcceptFormats:       []string{"text/html", "application/pdf"},
+		},
+	}
+
+	const html string = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<title>Title</title>
+</head>
+<body>
+	<div id="menu">
+		<a href="/skip.html">skipped on sub.t1.com</a>
+		<a href="/keep.html">yes</a>
+	</div>
+</body>
+</html>`
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://t1.com/page1.html",
+						response: &MockResponse{Body: html},
+					},
+					LinkSpec{
+						url:      "http://sub.t1.com/page2.html",
+						response: &MockResponse{Body: html},
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	// The subdomain inherits the domain's user agent
+	for _, link := range []string{"http://t1.com/page1.html", "http://sub.t1.com/page2.html"} {
+		headers, err := results.server.Headers("GET", link, -1)
+		if err != nil {
+			t.Fatalf("results.server.Headers failed %v", err)
+		}
+		if ua := headers.Get("User-Agent"); ua != "Partner Bot" {
+			t.Errorf("Expected User-Agent %q for %v, got %q", "Partner Bot", link, ua)
+		}
+	}
+
+	// The subdomain's accept_formats are sent to the server
+	acceptHeaders := map[string]string{
+		"http://t1.com/page1.html":     strings.Join(Config.Fetcher.AcceptFormats, ","),
+		"http://sub.t1.com/page2.html": "text/html,application/pdf",
+	}
+	for link, expectedAccept := range acceptHeaders {
+		headers, err := results.server.Headers("GET", link, -1)
+		if err != nil {
+			t.Fatalf("results.server.Headers failed %v", err)
+		}
+		if accept := headers.Get("Accept"); accept != expectedAccept {
+			t.Errorf("Expected Accept %q for %v, got %q", expectedAccept, link, accept)
+		}
+	}
+
+	expected := map[string]bool{
+		"http://t1.com/skip.html":     true,
+		"http://t1.com/keep.html":     true,
+		"http://sub.t1.com/keep.html": true,
+	}
+	ulst, _ := results.dsStoreParsedURLCalls()
+	for _, u := range ulst {
+		if expected[u.String()] {
+			delete(expected, u.String())
+		} else {
+			t.Errorf("StoreParsedURL mismatch found unexpected link %q", u.String())
+		}
+	}
+	for e := range expected {
+		t.Errorf("StoreParsedURL expected to see %q, but didn't", e)
+	}
+}
+
 func TestParseHttpEquiv(t *testing.T) {
 	const html string = `<!DOCTYPE html>
 <html>
@@ -1878,3 +3970,112 @@ func TestBugTrn210(t *testing.T) {
 		t.Errorf("Failed to find link %v", link)
 	}
 }
+
+func TestBandwidthLimits(t *testing.T) {
+	bl := newBandwidthLimiter(1000, 500)
+	if global, perHost := bl.limits(); global != 1000 || perHost != 500 {
+		t.Errorf("Expected limits (1000, 500), got (%v, %v)", global, perHost)
+	}
+
+	// Changing both limits at once applies both
+	bl.setLimits(2000, 700)
+	if global, perHost := bl.limits(); global != 2000 || perHost != 700 {
+		t.Errorf("Expected limits (2000, 700), got (%v, %v)", global, perHost)
+	}
+
+	bl.setLimits(2000, 0)
+	if global, perHost := bl.limits(); global != 2000 || perHost != 0 {
+		t.Errorf("Expected limits (2000, 0), got (%v, %v)", global, perHost)
+	}
+}
+
+func TestHostBandwidthLimit(t *testing.T) {
+	orig := Config.Fetcher.HostBandwidthLimit
+	defer func() {
+		Config.Fetcher.HostBandwidthLimit = orig
+	}()
+	Config.Fetcher.HostBandwidthLimit = 20000
+
+	// The first second's worth is read right away, so the remaining 40000
+	// bytes should take about 2 seconds
+	body := strings.Repeat("a", 30000)
+	tests := TestSpec{
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://t1.com/page1.html",
+						response: &MockResponse{Body: body},
+					},
+					LinkSpec{
+						url:      "http://t1.com/page2.html",
+						response: &MockResponse{Body: body},
+					},
+				},
+			},
+		},
+	}
+
+	start := time.Now()
+	runFetcher(tests, t)
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("Expected reading 60000 bytes at 20000 bytes/sec to take about 2s, took %v", elapsed)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	retryErr := RetryLater(fmt.Errorf("storage unavailable"))
+	tests := TestSpec{
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://t1.com/ok.html",
+						response: &MockResponse{Body: "<html>ok</html>"},
+					},
+					LinkSpec{
+						url:      "http://t1.com/bad.html",
+						response: &MockResponse{Body: "<html>bad</html>"},
+					},
+					LinkSpec{
+						url:      "http://t1.com/retry.html",
+						response: &MockResponse{Body: "<html>retry</html>"},
+					},
+				},
+			},
+		},
+		handlerErrors: map[string]error{
+			"http://t1.com/bad.html":   fmt.Errorf("can't handle this"),
+			"http://t1.com/retry.html": retryErr,
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	expected := map[string]error{
+		"http://t1.com/ok.html":    nil,
+		"http://t1.com/bad.html":   tests.handlerErrors["http://t1.com/bad.html"],
+		"http://t1.com/retry.html": retryErr,
+	}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		link := fr.URL.String()
+		exp, ok := expected[link]
+		if !ok {
+			t.Errorf("Unexpected StoreURLFetchResults call for %v", link)
+			continue
+		}
+		delete(expected, link)
+		if fr.HandlerError != exp {
+			t.Errorf("Expected HandlerError %v for %v, got %v", exp, link, fr.HandlerError)
+		}
+		if IsRetryLater(fr.HandlerError) != (link == "http://t1.com/retry.html") {
+			t.Errorf("Expected only %v to be retried later, got %v for %v", "http://t1.com/retry.html",
+				IsRetryLater(fr.HandlerError), link)
+		}
+	}
+	for link := range expected {
+		t.Errorf("Expected StoreURLFetchResults to be called for %v", link)
+	}
+}
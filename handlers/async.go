@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+)
+
+// Backpressure says what an AsyncHandler does with a response when its queue
+// is full.
+type Backpressure int
+
+const (
+	// Block makes the fetcher wait for room in the queue, so a slow handler
+	// slows the crawl down rather than losing responses
+	Block Backpressure = iota
+
+	// Drop discards the response (counting it in walker_handler_dropped_total),
+	// so the fetchers never wait on the handler. TryHandleResponse returns a
+	// RetryLaterError for it, so the link is fetched again soon.
+	Drop
+)
+
+// ParseBackpressure returns the Backpressure named by s ("block" or "drop").
+func ParseBackpressure(s string) (Backpressure, error) {
+	switch strings.ToLower(s) {
+	case "block":
+		return Block, nil
+	case "drop":
+		return Drop, nil
+	}
+	return Block, fmt.Errorf("Unknown backpressure policy %q, expected block or drop", s)
+}
+
+// AsyncHandler passes responses to another handler from a pool of worker
+// goroutines, so the fetchers don't wait for it. Use Async to create one, and
+// Close it once the FetchManager has stopped.
+type AsyncHandler struct {
+	name   string
+	h      walker.Handler
+	policy Backpressure
+	queue  chan *walker.FetchResults
+
+	// errs, if set, records errors the handler returns
+	errs walker.HandlerErrorStore
+
+	// mu guards closed; HandleResponse holds it for reading while it sends
+	// to queue, so queue isn't closed under it
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// Async returns a handler that queues up to queueSize responses for h, which
+// is called from workers goroutines. When the queue is full, policy decides
+// whether the fetcher waits or the response is dropped. name identifies h in
+// logs and metrics.
+//
+// The body of each response is read into memory before it is queued, since
+// the fetcher reuses its buffers (or closes the connection) once
+// HandleResponse returns, so this also applies to bodies fetcher.stream_non_html
+// would otherwise stream. h gets its own copy of the FetchResults.
+func Async(name string, h walker.Handler, workers int, queueSize int, policy Backpressure) *AsyncHandler {
+	if workers < 1 {
+		workers = 1
+	}
+	a := &AsyncHandler{
+		name:   name,
+		h:      h,
+		policy: policy,
+		queue:  make(chan *walker.FetchResults, queueSize),
+	}
+	a.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go a.work()
+	}
+	return a
+}
+
+// HandleResponse queues fr for the handler. After Close, the handler is
+// called directly instead.
+func (a *AsyncHandler) HandleResponse(fr *walker.FetchResults) {
+	a.TryHandleResponse(fr)
+}
+
+// StoreErrorsIn has errors from the handler, which come after the fetch
+// results were stored, recorded in store as well as logged. It must be called
+// before the AsyncHandler is given any responses.
+func (a *AsyncHandler) StoreErrorsIn(store walker.HandlerErrorStore) {
+	a.errs = store
+}
+
+// TryHandleResponse is HandleResponse, returning a RetryLaterError if fr was
+// dropped (or its body couldn't be read). Errors from the handler itself are
+// logged and counted, but not returned, since it runs later; see
+// StoreErrorsIn.
+func (a *AsyncHandler) TryHandleResponse(fr *walker.FetchResults) error {
+	c := *fr
+	if fr.Response != nil {
+		res := *fr.Response
+		c.Response = &res
+	}
+	body, err := bufferBody(&c)
+	if err != nil {
+		log4go.Error("Failed to read body of %v for handler %v: %v", fr.URL, a.name, err)
+		return walker.RetryLater(fmt.Errorf("Failed to read body: %v", err))
+	}
+	// Leave the body readable for anything handling fr after this
+	resetBody(fr, body)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return handle(a.name, a.h, &c)
+	}
+
+	if a.policy == Drop {
+		select {
+		case a.queue <- &c:
+			handlerQueueMetric.Add(1)
+		default:
+			log4go.Debug("Handler %v queue full, dropping %v", a.name, fr.URL)
+			handlerDroppedMetric.WithLabelValues(a.name).Inc()
+			return walker.RetryLater(fmt.Errorf("Handler %v queue full", a.name))
+		}
+		return nil
+	}
+	a.queue <- &c
+	handlerQueueMetric.Add(1)
+	return nil
+}
+
+// Close stops taking new responses and waits for the queued ones to be
+// handled.
+func (a *AsyncHandler) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+	a.workers.Wait()
+}
+
+func (a *AsyncHandler) work() {
+	defer a.workers.Done()
+	for fr := range a.queue {
+		handlerQueueMetric.Add(-1)
+		if err := handle(a.name, a.h, fr); err != nil {
+			log4go.Error("Handler %v failed for %v: %v", a.name, fr.URL, err)
+			if a.errs != nil {
+				a.errs.StoreHandlerError(fr, err)
+			}
+		}
+	}
+}
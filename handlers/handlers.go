@@ -0,0 +1,288 @@
+/*
+Package handlers provides walker.Handlers built out of other handlers, so a
+crawl can pass its responses through several handlers, only to some of them,
+or off the fetchers' goroutines:
+
+	warc, _ := warchandler.NewHandler("warcs")
+	index := handlers.Async("index", &MyIndexer{}, 8, 1000, handlers.Block)
+	h := handlers.FanOut(
+		warc,
+		handlers.Route(handlers.MimeType("text/html"), index),
+	)
+
+Each handler FanOut and Async call is isolated: if it panics, the panic is
+logged and counted in walker_handler_errors_total (see the metrics package)
+rather than taking down the fetcher. Wrap a handler in Recover to get the same
+protection, and a name for the metrics, anywhere else.
+
+The handlers returned here are walker.FallibleHandlers, passing on the errors
+of any FallibleHandlers they call (a panic is an error too), so failures are
+recorded on the link. An Async handler can't wait for the result, so it only
+reports responses it had to drop, as retry later; errors from the handler it
+wraps are recorded through a walker.HandlerErrorStore given to StoreErrorsIn
+(the cassandra datastore is one).
+*/
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+	"github.com/iParadigms/walker/metrics"
+	"github.com/iParadigms/walker/mimetools"
+)
+
+var (
+	handlerErrorsMetric = metrics.NewCounterVec("walker_handler_errors_total",
+		`Handler calls that failed, by handler and reason ("panic", "error" or "retry")`, "handler", "reason")
+	handlerDroppedMetric = metrics.NewCounterVec("walker_handler_dropped_total",
+		"Responses an Async handler dropped because its queue was full", "handler")
+	handlerQueueMetric = metrics.NewGauge("walker_handler_queue_length",
+		"Responses waiting in the queues of Async handlers")
+)
+
+// HandlerFunc adapts a function to a walker.Handler.
+type HandlerFunc func(fr *walker.FetchResults)
+
+// HandleResponse calls f(fr).
+func (f HandlerFunc) HandleResponse(fr *walker.FetchResults) {
+	f(fr)
+}
+
+// handle calls h, recovering from (and counting) any panic, and returns the
+// error h returned if it is a walker.FallibleHandler. name identifies h in
+// logs and metrics.
+func handle(name string, h walker.Handler, fr *walker.FetchResults) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := make([]byte, 4096)
+			stack = stack[:runtime.Stack(stack, false)]
+			log4go.Error("Handler %v panicked handling %v: %v\n%s", name, fr.URL, r, stack)
+			handlerErrorsMetric.WithLabelValues(name, "panic").Inc()
+			err = fmt.Errorf("Handler %v panicked: %v", name, r)
+		}
+	}()
+
+	fh, ok := h.(walker.FallibleHandler)
+	if !ok {
+		h.HandleResponse(fr)
+		return nil
+	}
+	err = fh.TryHandleResponse(fr)
+	if walker.IsRetryLater(err) {
+		handlerErrorsMetric.WithLabelValues(name, "retry").Inc()
+	} else if err != nil {
+		handlerErrorsMetric.WithLabelValues(name, "error").Inc()
+	}
+	return err
+}
+
+// handlerName names h for logs and metrics
+func handlerName(h walker.Handler) string {
+	if r, ok := h.(*recovered); ok {
+		return r.name
+	}
+	return fmt.Sprintf("%T", h)
+}
+
+// bufferBody reads the response body of fr into memory, if there is one, so
+// it can be read more than once (see resetBody). Returns nil if fr has no
+// body.
+func bufferBody(fr *walker.FetchResults) ([]byte, error) {
+	if fr.Response == nil || fr.Response.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(fr.Response.Body)
+	fr.Response.Body.Close()
+	resetBody(fr, body)
+	return body, err
+}
+
+// resetBody gives fr a new Response.Body reading body (if fr has a Response).
+func resetBody(fr *walker.FetchResults, body []byte) {
+	if fr.Response != nil {
+		fr.Response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+}
+
+// recovered is the Handler Recover returns
+type recovered struct {
+	name string
+	h    walker.Handler
+}
+
+// Recover returns a Handler that calls h, logging and counting any panic
+// rather than letting it stop the fetcher. name identifies h in logs and the
+// walker_handler_errors_total metric.
+func Recover(name string, h walker.Handler) walker.Handler {
+	return &recovered{name: name, h: h}
+}
+
+func (r *recovered) HandleResponse(fr *walker.FetchResults) {
+	r.TryHandleResponse(fr)
+}
+
+func (r *recovered) TryHandleResponse(fr *walker.FetchResults) error {
+	return handle(r.name, r.h, fr)
+}
+
+// fanOut is the Handler FanOut returns
+type fanOut []walker.Handler
+
+// FanOut returns a Handler that passes each response to every one of hs, in
+// order. The body is read into memory once, and each handler reads it from
+// the start. A handler that panics or fails doesn't stop the others being
+// called.
+//
+// If any of hs fail, FanOut's TryHandleResponse returns their errors, as a
+// RetryLaterError if any of them asked to retry later. Note that retrying
+// passes the link to all of hs again.
+func FanOut(hs ...walker.Handler) walker.Handler {
+	return fanOut(hs)
+}
+
+func (hs fanOut) HandleResponse(fr *walker.FetchResults) {
+	hs.TryHandleResponse(fr)
+}
+
+func (hs fanOut) TryHandleResponse(fr *walker.FetchResults) error {
+	body, err := bufferBody(fr)
+	if err != nil {
+		log4go.Error("Failed to read body of %v for handlers: %v", fr.URL, err)
+		return walker.RetryLater(fmt.Errorf("Failed to read body: %v", err))
+	}
+
+	var errs []error
+	retry := false
+	for _, h := range hs {
+		resetBody(fr, body)
+		if err := handle(handlerName(h), h, fr); err != nil {
+			errs = append(errs, err)
+			retry = retry || walker.IsRetryLater(err)
+		}
+	}
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	err = fmt.Errorf("%v", strings.Join(msgs, "; "))
+	if retry {
+		return walker.RetryLater(err)
+	}
+	return err
+}
+
+// Predicate chooses which responses a handler passed to Route sees.
+type Predicate func(fr *walker.FetchResults) bool
+
+// route is the Handler Route returns
+type route struct {
+	p Predicate
+	h walker.Handler
+}
+
+// Route returns a Handler that passes responses to h only if p returns true
+// for them.
+func Route(p Predicate, h walker.Handler) walker.Handler {
+	return &route{p: p, h: h}
+}
+
+func (r *route) HandleResponse(fr *walker.FetchResults) {
+	r.TryHandleResponse(fr)
+}
+
+func (r *route) TryHandleResponse(fr *walker.FetchResults) error {
+	if !r.p(fr) {
+		return nil
+	}
+	if fh, ok := r.h.(walker.FallibleHandler); ok {
+		return fh.TryHandleResponse(fr)
+	}
+	r.h.HandleResponse(fr)
+	return nil
+}
+
+// MimeType returns a Predicate matching responses whose Content-Type matches
+// one of mediaTypes, which may use wildcards (ex. "text/*"; see mimetools).
+// It panics if a media type can't be parsed.
+func MimeType(mediaTypes ...string) Predicate {
+	mm, err := mimetools.NewMatcher(mediaTypes)
+	if err != nil {
+		panic(fmt.Sprintf("handlers.MimeType: %v", err))
+	}
+	return func(fr *walker.FetchResults) bool {
+		if fr.Response == nil {
+			return false
+		}
+		ctypes := fr.Response.Header["Content-Type"]
+		if fr.MimeType != "" {
+			ctypes = []string{fr.MimeType}
+		}
+		for _, ct := range ctypes {
+			if ok, err := mm.Match(ct); err == nil && ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// StatusRange returns a Predicate matching responses with a status code from
+// min to max, inclusive; ex. StatusRange(200, 299) for successes.
+func StatusRange(min, max int) Predicate {
+	return func(fr *walker.FetchResults) bool {
+		return fr.Response != nil && fr.Response.StatusCode >= min && fr.Response.StatusCode <= max
+	}
+}
+
+// Domain returns a Predicate matching links on any of domains or their
+// subdomains.
+func Domain(domains ...string) Predicate {
+	lower := make([]string, len(domains))
+	for i, d := range domains {
+		lower[i] = strings.ToLower(d)
+	}
+	return func(fr *walker.FetchResults) bool {
+		host := strings.ToLower(fr.URL.Host)
+		if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		for _, d := range lower {
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not returns a Predicate matching what p doesn't.
+func Not(p Predicate) Predicate {
+	return func(fr *walker.FetchResults) bool {
+		return !p(fr)
+	}
+}
+
+// All returns a Predicate matching responses every one of ps matches.
+func All(ps ...Predicate) Predicate {
+	return func(fr *walker.FetchResults) bool {
+		for _, p := range ps {
+			if !p(fr) {
+				return false
+			}
+		}
+		return true
+	}
+}
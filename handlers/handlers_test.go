@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+func fetchResults(link string, status int, mime string, body string) *walker.FetchResults {
+	return &walker.FetchResults{
+		URL:      walker.MustParse(link),
+		MimeType: mime,
+		Response: &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": []string{mime}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		},
+	}
+}
+
+// recorder is a Handler recording the links and bodies it sees
+type recorder struct {
+	mu     sync.Mutex
+	links  []string
+	bodies []string
+}
+
+func (r *recorder) HandleResponse(fr *walker.FetchResults) {
+	body, _ := ioutil.ReadAll(fr.Response.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.links = append(r.links, fr.URL.String())
+	r.bodies = append(r.bodies, string(body))
+}
+
+func (r *recorder) seen() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.links...)
+}
+
+func TestFanOut(t *testing.T) {
+	r1, r2 := &recorder{}, &recorder{}
+	panicker := HandlerFunc(func(fr *walker.FetchResults) {
+		panic("bad handler")
+	})
+	h := FanOut(r1, Recover("panicker", panicker), panicker, r2)
+
+	h.HandleResponse(fetchResults("http://test.com/page1.html", 200, "text/html", "<html>1</html>"))
+
+	for i, r := range []*recorder{r1, r2} {
+		if len(r.bodies) != 1 || r.bodies[0] != "<html>1</html>" {
+			t.Errorf("Handler %d expected to read the whole body, got %q", i, r.bodies)
+		}
+	}
+	if n := handlerErrorsMetric.WithLabelValues("panicker", "panic").Value(); n != 1 {
+		t.Errorf("Expected 1 panic counted for the named handler, got %d", n)
+	}
+	if n := handlerErrorsMetric.WithLabelValues("handlers.HandlerFunc", "panic").Value(); n != 1 {
+		t.Errorf("Expected 1 panic counted for the unnamed handler, got %d", n)
+	}
+}
+
+// failer is a FallibleHandler returning err
+type failer struct {
+	err error
+}
+
+func (f *failer) HandleResponse(fr *walker.FetchResults) {
+	f.TryHandleResponse(fr)
+}
+
+func (f *failer) TryHandleResponse(fr *walker.FetchResults) error {
+	return f.err
+}
+
+func TestFanOutErrors(t *testing.T) {
+	tests := []struct {
+		hs    []walker.Handler
+		err   string
+		retry bool
+	}{
+		{[]walker.Handler{&recorder{}, &failer{}}, "", false},
+		{[]walker.Handler{&failer{fmt.Errorf("bad")}, &recorder{}}, "bad", false},
+		{
+			[]walker.Handler{
+				Recover("bad", &failer{fmt.Errorf("bad")}),
+				&failer{walker.RetryLater(fmt.Errorf("busy"))},
+			},
+			"Retry later: bad; Retry later: busy",
+			true,
+		},
+		{
+			[]walker.Handler{Route(Domain("test.com"), &failer{walker.RetryLater(fmt.Errorf("busy"))})},
+			"Retry later: busy",
+			true,
+		},
+		{[]walker.Handler{Route(Domain("other.com"), &failer{fmt.Errorf("bad")})}, "", false},
+	}
+	for i, test := range tests {
+		err := FanOut(test.hs...).(walker.FallibleHandler).TryHandleResponse(
+			fetchResults("http://test.com/page.html", 200, "text/html", ""))
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("Test %d: expected no error, got %v", i, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("Test %d: expected error %q, got %v", i, test.err, err)
+		}
+		if walker.IsRetryLater(err) != test.retry {
+			t.Errorf("Test %d: expected IsRetryLater %v for %v", i, test.retry, err)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		p        Predicate
+		expected []string
+	}{
+		{MimeType("text/*"), []string{"http://test.com/page.html", "http://sub.other.com/missing.txt"}},
+		{StatusRange(200, 299), []string{"http://test.com/page.html", "http://other.com/doc.pdf", "http://notother.com/"}},
+		{Domain("Other.com"), []string{"http://other.com/doc.pdf", "http://sub.other.com/missing.txt"}},
+		{All(Domain("other.com"), Not(StatusRange(200, 299))), []string{"http://sub.other.com/missing.txt"}},
+	}
+	for i, test := range tests {
+		r := &recorder{}
+		h := Route(test.p, r)
+		h.HandleResponse(fetchResults("http://test.com/page.html", 200, "text/html", ""))
+		h.HandleResponse(fetchResults("http://other.com/doc.pdf", 200, "application/pdf", ""))
+		h.HandleResponse(fetchResults("http://sub.other.com/missing.txt", 404, "text/plain", ""))
+		h.HandleResponse(fetchResults("http://notother.com/", 200, "application/json", ""))
+
+		seen := r.seen()
+		if len(seen) != len(test.expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, test.expected, seen)
+			continue
+		}
+		for j := range seen {
+			if seen[j] != test.expected[j] {
+				t.Errorf("Test %d: expected %v, got %v", i, test.expected, seen)
+				break
+			}
+		}
+	}
+}
+
+func TestAsync(t *testing.T) {
+	r := &recorder{}
+	a := Async("async", r, 2, 10, Block)
+
+	links := []string{"http://test.com/1", "http://test.com/2", "http://test.com/3"}
+	for _, link := range links {
+		fr := fetchResults(link, 200, "text/html", link)
+		a.HandleResponse(fr)
+
+		// The caller can still read the body, and the handler has its own
+		body, _ := ioutil.ReadAll(fr.Response.Body)
+		if string(body) != link {
+			t.Errorf("Expected the body to be readable after queueing, got %q", body)
+		}
+	}
+	a.Close()
+
+	if seen := r.seen(); len(seen) != len(links) {
+		t.Errorf("Expected all %d queued responses handled by Close, got %v", len(links), seen)
+	}
+	for i, body := range r.bodies {
+		if body != r.links[i] {
+			t.Errorf("Expected body %q, got %q", r.links[i], body)
+		}
+	}
+}
+
+// errorStore is a walker.HandlerErrorStore recording the errors it's given,
+// by link
+type errorStore struct {
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+func (s *errorStore) StoreHandlerError(fr *walker.FetchResults, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs[fr.URL.String()] = err
+}
+
+func TestAsyncStoresErrors(t *testing.T) {
+	store := &errorStore{errs: map[string]error{}}
+	retry := walker.RetryLater(fmt.Errorf("busy"))
+	h := HandlerFunc(func(fr *walker.FetchResults) {
+		if fr.URL.Path == "/panic" {
+			panic("bad handler")
+		}
+	})
+	a := Async("async", FanOut(h, &failer{retry}), 1, 10, Block)
+	a.StoreErrorsIn(store)
+
+	for _, link := range []string{"http://test.com/ok", "http://test.com/panic"} {
+		if err := a.TryHandleResponse(fetchResults(link, 200, "text/html", "")); err != nil {
+			t.Errorf("Expected no error queueing %v, got %v", link, err)
+		}
+	}
+	a.Close()
+
+	if err := store.errs["http://test.com/ok"]; !walker.IsRetryLater(err) {
+		t.Errorf("Expected the handler's retry later error stored, got %v", err)
+	}
+	if err := store.errs["http://test.com/panic"]; err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Errorf("Expected the handler's panic stored, got %v", err)
+	}
+}
+
+func TestAsyncDrop(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	r := &recorder{}
+	slow := HandlerFunc(func(fr *walker.FetchResults) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		r.HandleResponse(fr)
+	})
+	a := Async("dropper", slow, 1, 1, Drop)
+
+	// One response is being handled and one is queued; the rest are dropped
+	a.HandleResponse(fetchResults("http://test.com/1", 200, "text/html", ""))
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the worker to start")
+	}
+	for i, link := range []string{"http://test.com/2", "http://test.com/3", "http://test.com/4"} {
+		err := a.TryHandleResponse(fetchResults(link, 200, "text/html", ""))
+		if dropped := walker.IsRetryLater(err); dropped != (i > 0) {
+			t.Errorf("Expected only dropped responses to be retried later, got %v for %v", err, link)
+		}
+	}
+	close(release)
+	a.Close()
+
+	if seen := r.seen(); len(seen) != 2 {
+		t.Errorf("Expected 2 responses handled, got %v", seen)
+	}
+	if n := handlerDroppedMetric.WithLabelValues("dropper").Value(); n != 2 {
+		t.Errorf("Expected 2 dropped responses counted, got %d", n)
+	}
+}
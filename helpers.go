@@ -62,6 +62,17 @@ func getFakeTransport() http.RoundTripper {
 	}
 }
 
+// addrConn is a connection that reports addr as its remote address, whatever
+// it is actually connected to.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (ac *addrConn) RemoteAddr() net.Addr {
+	return ac.addr
+}
+
 //
 // RecordingTransport counts how many times the Dial routine is called
 //
@@ -299,6 +310,20 @@ func response200() *http.Response {
 	}
 }
 
+// responseBody returns a 200 response of contentType with the given body.
+func responseBody(contentType, body string) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.0",
+		ProtoMajor:    1,
+		ProtoMinor:    0,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: -1,
+	}
+}
+
 // mapRoundTrip maps input links --> http.Response. See TestRedirects for example.
 type mapRoundTrip struct {
 	Responses map[string]*http.Response
@@ -11,6 +11,26 @@ type Handler interface {
 	HandleResponse(res *FetchResults)
 }
 
+// FallibleHandler can be implemented by a Handler that can fail to handle a
+// response, for example because the storage it writes to is down. If the
+// FetchManager's Handler implements it, TryHandleResponse is called instead of
+// HandleResponse, and a returned error is stored with the fetch results (see
+// FetchResults.HandlerError).
+//
+// Returning a RetryLaterError (see RetryLater) asks for the link to be fetched
+// again soon: the Datastore should requeue it ahead of its normal refresh,
+// though it may give up after a few retries in a row (the cassandra datastore
+// stops after cassandra.max_handler_retries).
+// Any other error is just recorded, since handling the same response again
+// would fail the same way.
+type FallibleHandler interface {
+	Handler
+
+	// TryHandleResponse handles res like HandleResponse, returning an error if
+	// it couldn't.
+	TryHandleResponse(res *FetchResults) error
+}
+
 // Datastore defines the interface for an object to be used as walker's datastore.
 //
 // Note that this is for link and metadata storage required to make walker
@@ -37,10 +57,12 @@ type Datastore interface {
 	StoreURLFetchResults(fr *FetchResults)
 
 	// StoreParsedURL stores a URL parsed out of a page (i.e. a URL we may not
-	// have crawled yet). `u` is the URL to store. `fr` is the FetchResults
-	// object for the fetch from which we got the URL, for any context the
-	// datastore may want. A datastore implementation should handle `fr` being
-	// nil, so links can be seeded without a fetch having occurred.
+	// have crawled yet). `u` is the URL to store; if it was parsed out of a
+	// page, u.Link describes how it appeared there (see LinkHints). `fr` is
+	// the FetchResults object for the fetch from which we got the URL, for
+	// any context the datastore may want. A datastore implementation should
+	// handle `fr` being nil, so links can be seeded without a fetch having
+	// occurred.
 	//
 	// URLs passed to StoreParsedURL should be absolute.
 	//
@@ -57,6 +79,46 @@ type Datastore interface {
 	Close()
 }
 
+// HostExcluder can be implemented by a Datastore that is able to stop a host
+// from being crawled again. The fetchers use it when they find a host should
+// never be crawled, for example because it resolves to a private IP address.
+// Datastores that don't implement it will keep handing out such hosts, and
+// the fetchers will keep skipping them.
+type HostExcluder interface {
+	// ExcludeHost marks the (claimed) host as excluded from the crawl, giving
+	// a reason.
+	ExcludeHost(host string, reason string)
+}
+
+// DomainProfiler can be implemented by a Datastore that stores DomainProfiles,
+// so that per-domain crawl settings can be changed without restarting the
+// fetchers. The fetchers read the profiles each time they claim a host.
+type DomainProfiler interface {
+	// DomainProfiles returns the profiles stored for domain (a TLD+1) and its
+	// subdomains, keyed by subdomain ("" for the domain itself).
+	DomainProfiles(domain string) (map[string]*DomainProfile, error)
+}
+
+// BandwidthLimitStore can be implemented by a Datastore that stores bandwidth
+// limits, so they can be changed while the fetchers run. The FetchManager
+// reads them every few seconds.
+type BandwidthLimitStore interface {
+	// BandwidthLimits returns the stored global and per-host limits, in bytes
+	// per second (0 for no limit). A negative value means no limit is stored,
+	// and bandwidth_limit or host_bandwidth_limit from walker.yaml is used.
+	BandwidthLimits() (global int64, perHost int64, err error)
+}
+
+// HandlerErrorStore can be implemented by a Datastore to record errors from a
+// handler that runs after the fetch results were stored, as one wrapped by
+// handlers.Async does. Otherwise those errors are only logged.
+type HandlerErrorStore interface {
+	// StoreHandlerError records err, returned by the handler for fr, on the
+	// crawl fr describes, as StoreURLFetchResults would have if err had been
+	// fr.HandlerError (so a RetryLaterError requeues the link).
+	StoreHandlerError(fr *FetchResults, err error)
+}
+
 // Dispatcher defines the calls a dispatcher should respond to. A dispatcher
 // would typically be paired with a particular Datastore, and not all Datastore
 // implementations may need a Dispatcher.
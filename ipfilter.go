@@ -0,0 +1,256 @@
+package walker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// privateNetworks are the ranges blocked by blacklist_private_ips: addresses
+// that aren't on the public internet, where a crawler has no business
+// connecting (and where a malicious page could point it at internal
+// services).
+var privateNetworks = []*net.IPNet{
+	parseCIDR("0.0.0.0/8"),      // "this" network
+	parseCIDR("10.0.0.0/8"),     // private
+	parseCIDR("100.64.0.0/10"),  // carrier-grade NAT (and some cloud metadata services)
+	parseCIDR("127.0.0.0/8"),    // loopback
+	parseCIDR("169.254.0.0/16"), // link-local, including the 169.254.169.254 metadata service
+	parseCIDR("172.16.0.0/12"),  // private
+	parseCIDR("192.0.0.0/24"),   // IETF protocol assignments
+	parseCIDR("192.168.0.0/16"), // private
+	parseCIDR("198.18.0.0/15"),  // benchmarking
+	parseCIDR("224.0.0.0/4"),    // multicast
+	parseCIDR("240.0.0.0/4"),    // reserved, including broadcast
+	parseCIDR("::/128"),         // unspecified
+	parseCIDR("::1/128"),        // loopback
+	parseCIDR("fc00::/7"),       // unique local, including the fd00:ec2::254 metadata service
+	parseCIDR("fe80::/10"),      // link-local
+	parseCIDR("fec0::/10"),      // site-local (deprecated)
+	parseCIDR("ff00::/8"),       // multicast
+}
+
+// IPv6 ranges that embed an IPv4 address, which is checked as well
+var (
+	nat64Network = parseCIDR("64:ff9b::/96") // the IPv4 address is the last 4 bytes
+	sixToFourNet = parseCIDR("2002::/16")    // the IPv4 address is bytes 2-5
+)
+
+// parseCIDR is a convenience for creating our static private IPNet ranges
+func parseCIDR(netstring string) *net.IPNet {
+	_, network, err := net.ParseCIDR(netstring)
+	if err != nil {
+		panic(err.Error())
+	}
+	return network
+}
+
+// embeddedIPv4 returns the IPv4 address carried by a NAT64 or 6to4 address,
+// or nil if ip isn't one.
+func embeddedIPv4(ip net.IP) net.IP {
+	ip16 := ip.To16()
+	switch {
+	case ip.To4() != nil || ip16 == nil:
+		return nil
+	case nat64Network.Contains(ip16):
+		return net.IPv4(ip16[12], ip16[13], ip16[14], ip16[15])
+	case sixToFourNet.Contains(ip16):
+		return net.IPv4(ip16[2], ip16[3], ip16[4], ip16[5])
+	}
+	return nil
+}
+
+// BlacklistedAddrError is the error returned when walker refuses to connect
+// to an address because of blacklist_private_ips or deny_cidrs.
+type BlacklistedAddrError struct {
+	// Addr is the address being dialed (host:port)
+	Addr string
+
+	// IP is the blacklisted address it resolved to
+	IP net.IP
+
+	// Reason is why IP is blacklisted
+	Reason string
+}
+
+func (e *BlacklistedAddrError) Error() string {
+	return fmt.Sprintf("Refusing to connect to %v: %v is %v", e.Addr, e.IP, e.Reason)
+}
+
+// ipFilter decides which IP addresses fetchers may connect to. An address in
+// deny is always blocked. Otherwise an address in allow is permitted, and
+// anything else is blocked if it is in privateNetworks and blockPrivate is
+// set.
+type ipFilter struct {
+	blockPrivate bool
+	allow        []*net.IPNet
+	deny         []*net.IPNet
+}
+
+// newIPFilter builds the ipFilter configured by blacklist_private_ips,
+// allow_cidrs and deny_cidrs.
+func newIPFilter() *ipFilter {
+	fl := &ipFilter{blockPrivate: Config.Fetcher.BlacklistPrivateIPs}
+	// parseCIDR won't panic b/c these CIDRs are checked in Config
+	for _, cidr := range Config.Fetcher.AllowCIDRs {
+		fl.allow = append(fl.allow, parseCIDR(cidr))
+	}
+	for _, cidr := range Config.Fetcher.DenyCIDRs {
+		fl.deny = append(fl.deny, parseCIDR(cidr))
+	}
+	return fl
+}
+
+// active returns true if the filter could block anything at all.
+func (fl *ipFilter) active() bool {
+	return fl.blockPrivate || len(fl.deny) > 0
+}
+
+// blocked returns why ip may not be connected to, or "" if it may.
+func (fl *ipFilter) blocked(ip net.IP) string {
+	if embedded := embeddedIPv4(ip); embedded != nil {
+		if reason := fl.blocked(embedded); reason != "" {
+			return reason
+		}
+	}
+	if networkContains(fl.deny, ip) {
+		return "in deny_cidrs"
+	}
+	if networkContains(fl.allow, ip) {
+		return ""
+	}
+	if fl.blockPrivate && networkContains(privateNetworks, ip) {
+		return "a private address"
+	}
+	return ""
+}
+
+func networkContains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a *BlacklistedAddrError if ip, which addr resolved to, may
+// not be connected to.
+func (fl *ipFilter) check(addr string, ip net.IP) error {
+	if reason := fl.blocked(ip); reason != "" {
+		return &BlacklistedAddrError{Addr: addr, IP: ip, Reason: reason}
+	}
+	return nil
+}
+
+// wrap returns a dial function that calls dial and refuses to connect to
+// blocked addresses. Since it is the Transport's dial, this is enforced on
+// every connection walker makes, including redirects and every subdomain,
+// and checking the address actually connected to means DNS rebinding can't
+// get around it. IP literals are checked before dialing, so we don't even
+// open a connection to them.
+//
+// Note that if a proxy is configured the connection is to the proxy, so it
+// has to be allowed (see allow_cidrs) if it is on a private network; the
+// target host is checked by wrapProxy instead.
+func (fl *ipFilter) wrap(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = net.Dial
+	}
+	if !fl.active() {
+		return dial
+	}
+	return func(network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				if err := fl.check(addr, ip); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(conn)
+		if ip == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Refusing to connect to %v: could not determine its IP address from %v",
+				addr, conn.RemoteAddr())
+		}
+		if err := fl.check(addr, ip); err != nil {
+			conn.Close()
+			log4go.Debug("%v", err)
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// wrapProxy returns a Transport.Proxy function that calls proxy, and if the
+// request is going through a proxy, resolves the host it is for and refuses
+// the request if any of its addresses are blocked (or it can't be resolved),
+// since the dial function only sees the proxy's address. The proxy does its
+// own lookup, so unlike wrap this can't rule out DNS rebinding.
+func (fl *ipFilter) wrapProxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	if proxy == nil || !fl.active() {
+		return proxy
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+
+		host := strings.Trim(stripPort(req.URL.Host), "[]")
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			ips, err = net.LookupIP(host)
+			if err != nil {
+				return nil, fmt.Errorf("Refusing to proxy a request to %v: %v", req.URL.Host, err)
+			}
+		}
+		for _, ip := range ips {
+			if err := fl.check(req.URL.Host, ip); err != nil {
+				log4go.Debug("%v", err)
+				return nil, err
+			}
+		}
+		return proxyURL, nil
+	}
+}
+
+// FilteredTransport returns a Transport that, like the fetchers', refuses to
+// connect to addresses blocked by blacklist_private_ips or deny_cidrs, with
+// timeout for each connection. Use it for requests made outside a
+// FetchManager, ex. with ReadSitemaps.
+func FilteredTransport(timeout time.Duration) *http.Transport {
+	fl := newIPFilter()
+	return &http.Transport{
+		Proxy:               fl.wrapProxy(http.ProxyFromEnvironment),
+		Dial:                fl.wrap((&net.Dialer{Timeout: timeout}).Dial),
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// remoteIP returns the IP address conn is connected to, or nil if it can't
+// tell.
+func remoteIP(conn net.Conn) net.IP {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	host := conn.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return net.ParseIP(strings.Trim(host, "[]"))
+}
@@ -0,0 +1,179 @@
+package walker
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// ipPruneSize is how many IPs ipPoliteness tracks before it starts forgetting
+// idle ones.
+const ipPruneSize = 1000
+
+// ipPoliteness is a process-wide politeness registry keyed by resolved IP.
+// Fetchers crawl one TLD+1 at a time, but many domains can live on the same
+// (shared hosting) IP, so ipPoliteness makes sure all fetchers in a
+// FetchManager together keep at least minGap between the start of requests to
+// an IP, and have no more than maxConcurrent requests outstanding against it.
+//
+// It learns host -> IP mappings from the dnscache dialer (see observe), and
+// looks up hosts it hasn't seen yet, so the limits apply from the first
+// request to a host.
+type ipPoliteness struct {
+	minGap        time.Duration
+	maxConcurrent int
+
+	// hosts maps host -> IP, as last seen by the dialer or looked up; "" if
+	// the lookup failed
+	hosts *lru.Cache
+
+	// lookup resolves a host that isn't in hosts yet
+	lookup func(host string) ([]string, error)
+
+	mu  sync.Mutex
+	ips map[string]*ipState
+
+	// changed is closed (and replaced) whenever a request is released, to
+	// wake up anybody waiting to acquire
+	changed chan struct{}
+}
+
+type ipState struct {
+	active    int
+	lastStart time.Time
+}
+
+func newIPPoliteness(minGap time.Duration, maxConcurrent int, maxHosts int) (*ipPoliteness, error) {
+	hosts, err := lru.New(maxHosts)
+	if err != nil {
+		return nil, err
+	}
+	return &ipPoliteness{
+		minGap:        minGap,
+		maxConcurrent: maxConcurrent,
+		hosts:         hosts,
+		lookup:        net.LookupHost,
+		ips:           map[string]*ipState{},
+		changed:       make(chan struct{}),
+	}, nil
+}
+
+// observe records that addr (host:port) resolved to resolvedAddr (ip:port).
+// It is meant to be passed to dnscache.DialObserved.
+func (p *ipPoliteness) observe(addr, resolvedAddr string) {
+	p.hosts.Add(stripPort(addr), stripPort(resolvedAddr))
+}
+
+// ip returns the IP host (or host:port) last resolved to, or "" if it hasn't
+// been resolved.
+func (p *ipPoliteness) ip(host string) string {
+	val, ok := p.hosts.Get(stripPort(host))
+	if !ok {
+		return ""
+	}
+	return val.(string)
+}
+
+// resolve returns the IP of host (or host:port), looking it up if the dialer
+// hasn't connected to it yet. It returns "" if host can't be resolved, in
+// which case the request will fail to connect anyway.
+func (p *ipPoliteness) resolve(host string) string {
+	host = stripPort(host)
+	if val, ok := p.hosts.Get(host); ok {
+		return val.(string)
+	}
+
+	ip := ""
+	addrs, err := p.lookup(host)
+	if err == nil && len(addrs) > 0 {
+		ip = addrs[0]
+	}
+	// Remember failures too, so they aren't looked up for every request; the
+	// dialer replaces the entry if it does connect
+	p.hosts.Add(host, ip)
+	return ip
+}
+
+// acquire blocks until a request to host may start without violating the
+// limits of host's IP. It returns a function that must be called when the
+// request is done, or false if cancel was closed while waiting.
+func (p *ipPoliteness) acquire(host string, cancel <-chan struct{}) (func(), bool) {
+	if p.minGap <= 0 && p.maxConcurrent <= 0 {
+		return func() {}, true
+	}
+	ip := p.resolve(host)
+	if ip == "" {
+		return func() {}, true
+	}
+
+	for {
+		p.mu.Lock()
+		st, ok := p.ips[ip]
+		if !ok {
+			if len(p.ips) >= ipPruneSize {
+				p.prune()
+			}
+			st = &ipState{}
+			p.ips[ip] = st
+		}
+
+		var timer <-chan time.Time
+		if p.maxConcurrent <= 0 || st.active < p.maxConcurrent {
+			wait := p.minGap - time.Since(st.lastStart)
+			if wait <= 0 {
+				st.active++
+				st.lastStart = time.Now()
+				p.mu.Unlock()
+				return p.releaser(ip), true
+			}
+			timer = time.After(wait)
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-timer:
+		case <-changed:
+		case <-cancel:
+			return nil, false
+		}
+	}
+}
+
+// releaser returns an idempotent function that releases a request to ip.
+func (p *ipPoliteness) releaser(ip string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			if st, ok := p.ips[ip]; ok && st.active > 0 {
+				st.active--
+			}
+			close(p.changed)
+			p.changed = make(chan struct{})
+			p.mu.Unlock()
+		})
+	}
+}
+
+// prune forgets IPs with no outstanding requests whose minGap has passed.
+// p.mu must be held.
+func (p *ipPoliteness) prune() {
+	for ip, st := range p.ips {
+		if st.active == 0 && time.Since(st.lastStart) >= p.minGap {
+			delete(p.ips, ip)
+		}
+	}
+}
+
+// stripPort returns the host portion of a host:port pair, or hostport
+// unchanged if it has no port.
+func stripPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
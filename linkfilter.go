@@ -0,0 +1,147 @@
+package walker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LinkFilter decides whether a link found while crawling (in a page, a
+// sitemap or a redirect) should be stored in the datastore. The FetchManager
+// runs links through a chain of filters, in order, and stores them only if
+// every filter accepts them.
+type LinkFilter interface {
+	// FilterLink returns true if u, found while fetching source, should be
+	// stored. If not, reason briefly says why (ex. "path_too_long"); it is
+	// used to count rejections in walker_links_rejected_total, so it should
+	// come from a small fixed set rather than include u itself.
+	FilterLink(u *URL, source *FetchResults) (accept bool, reason string)
+}
+
+// Names of the built-in filters available in Config.Fetcher.LinkFilters
+const (
+	linkFilterMaxPathLength   = "max_path_length"
+	linkFilterLinkPatterns    = "link_patterns"
+	linkFilterAcceptProtocols = "accept_protocols"
+	linkFilterSameDomain      = "same_domain"
+	linkFilterNofollow        = "nofollow"
+)
+
+var linkFilterNames = []string{
+	linkFilterMaxPathLength,
+	linkFilterLinkPatterns,
+	linkFilterAcceptProtocols,
+	linkFilterSameDomain,
+	linkFilterNofollow,
+}
+
+// ConfiguredLinkFilters returns the chain of filters named in
+// Config.Fetcher.LinkFilters, each set up from the config keys it uses. This
+// is the chain a FetchManager uses unless its LinkFilters are set, so it can
+// be used to add custom filters to the configured ones.
+func ConfiguredLinkFilters() ([]LinkFilter, error) {
+	var filters []LinkFilter
+	for _, name := range Config.Fetcher.LinkFilters {
+		switch strings.ToLower(name) {
+		case linkFilterMaxPathLength:
+			filters = append(filters, &MaxPathLengthFilter{Max: Config.Fetcher.MaxPathLength})
+
+		case linkFilterLinkPatterns:
+			exclude, err := aggregateRegex(Config.Fetcher.ExcludeLinkPatterns, "exclude_link_patterns")
+			if err != nil {
+				return nil, err
+			}
+			include, err := aggregateRegex(Config.Fetcher.IncludeLinkPatterns, "include_link_patterns")
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, &LinkPatternFilter{Exclude: exclude, Include: include})
+
+		case linkFilterAcceptProtocols:
+			filters = append(filters, &ProtocolFilter{Protocols: Config.Fetcher.AcceptProtocols})
+
+		case linkFilterSameDomain:
+			filters = append(filters, &SameDomainFilter{})
+
+		case linkFilterNofollow:
+			filters = append(filters, &NofollowFilter{})
+
+		default:
+			return nil, fmt.Errorf("Unknown link filter %q, must be one of (%s)",
+				name, strings.Join(linkFilterNames, ", "))
+		}
+	}
+	return filters, nil
+}
+
+// MaxPathLengthFilter rejects links whose path (including the query) is
+// longer than Max. This helps avoid cycles where a page links to itself with
+// a slightly longer, and hence distinct, URL. Max <= 0 accepts every link.
+type MaxPathLengthFilter struct {
+	Max int
+}
+
+// FilterLink implements LinkFilter
+func (lf *MaxPathLengthFilter) FilterLink(u *URL, source *FetchResults) (bool, string) {
+	if lf.Max > 0 && len(u.RequestURI()) > lf.Max {
+		return false, "path_too_long"
+	}
+	return true, ""
+}
+
+// LinkPatternFilter rejects links whose path (including the query) matches
+// Exclude, unless it also matches Include. Either may be nil.
+type LinkPatternFilter struct {
+	Exclude *regexp.Regexp
+	Include *regexp.Regexp
+}
+
+// FilterLink implements LinkFilter
+func (lf *LinkPatternFilter) FilterLink(u *URL, source *FetchResults) (bool, string) {
+	path := u.RequestURI()
+	if lf.Exclude != nil && lf.Exclude.MatchString(path) &&
+		!(lf.Include != nil && lf.Include.MatchString(path)) {
+		return false, "excluded_pattern"
+	}
+	return true, ""
+}
+
+// ProtocolFilter rejects links whose scheme isn't one of Protocols.
+type ProtocolFilter struct {
+	Protocols []string
+}
+
+// FilterLink implements LinkFilter
+func (lf *ProtocolFilter) FilterLink(u *URL, source *FetchResults) (bool, string) {
+	for _, p := range lf.Protocols {
+		if u.Scheme == p {
+			return true, ""
+		}
+	}
+	return false, "protocol"
+}
+
+// SameDomainFilter rejects links to a different TLD+1 than the URL they were
+// found on, keeping the crawl to the domains already in it.
+type SameDomainFilter struct{}
+
+// FilterLink implements LinkFilter
+func (lf *SameDomainFilter) FilterLink(u *URL, source *FetchResults) (bool, string) {
+	if source == nil || source.URL == nil || sameDomain(u, source.URL) {
+		return true, ""
+	}
+	return false, "other_domain"
+}
+
+// NofollowFilter rejects links marked rel="nofollow" on the page they were
+// found on (see LinkHints). Links found in sitemaps and redirects have no rel,
+// so are accepted.
+type NofollowFilter struct{}
+
+// FilterLink implements LinkFilter
+func (lf *NofollowFilter) FilterLink(u *URL, source *FetchResults) (bool, string) {
+	if u.Link.HasRel("nofollow") {
+		return false, "nofollow"
+	}
+	return true, ""
+}
@@ -0,0 +1,61 @@
+package walker
+
+import (
+	"net/http"
+
+	"github.com/iParadigms/walker/metrics"
+)
+
+// Fetcher metrics, served at /metrics (see the metrics package)
+var (
+	fetchesMetric = metrics.NewCounterVec("walker_fetches_total",
+		`HTTP requests made for links, by status class (2xx, 3xx, 4xx, 5xx) or "error"`, "status")
+	fetchDurationMetric = metrics.NewHistogram("walker_fetch_duration_seconds",
+		"Time from sending a request for a link until its response headers arrive",
+		[]float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60})
+	wireBytesMetric = metrics.NewCounter("walker_fetch_wire_bytes_total",
+		"Response body bytes received over the wire")
+	decodedBytesMetric = metrics.NewCounter("walker_fetch_decoded_bytes_total",
+		"Response body bytes read after decoding any Content-Encoding")
+	robotsExcludedMetric = metrics.NewCounter("walker_robots_excluded_total",
+		"Links not fetched because robots.txt excluded them")
+	parseErrorsMetric = metrics.NewCounter("walker_parse_errors_total",
+		"HTML pages that failed to parse")
+	linksStoredMetric = metrics.NewCounterVec("walker_links_stored_total",
+		"Links passed to Datastore.StoreParsedURL, by where they were found (page, sitemap, redirect or canonical)", "source")
+	linksRejectedMetric = metrics.NewCounterVec("walker_links_rejected_total",
+		"Links not stored because a link filter rejected them, by reason", "reason")
+	hostsClaimedMetric = metrics.NewCounter("walker_hosts_claimed_total",
+		"Hosts claimed by fetchers")
+	hostsUnclaimedMetric = metrics.NewCounter("walker_hosts_unclaimed_total",
+		"Hosts unclaimed by fetchers after crawling them")
+	handlerFailuresMetric = metrics.NewCounterVec("walker_handler_failures_total",
+		`Responses a FallibleHandler failed to handle, by whether it asked to retry later ("true" or "false")`, "retry")
+	bandwidthLimitMetric = metrics.NewGauge("walker_bandwidth_limit_bytes_per_second",
+		"Current limit on the bytes per second all fetchers together read (0 for none)")
+	hostBandwidthLimitMetric = metrics.NewGauge("walker_host_bandwidth_limit_bytes_per_second",
+		"Current limit on the bytes per second read from a single host (0 for none)")
+	throttledFetchersMetric = metrics.NewGauge("walker_bandwidth_throttled_fetchers",
+		"Fetchers currently waiting on a bandwidth limit")
+	throttleWaitMetric = metrics.NewHistogram("walker_bandwidth_throttle_wait_seconds",
+		"Time fetchers waited on a bandwidth limit, each time they were throttled",
+		[]float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10})
+)
+
+// statusClass returns the walker_fetches_total status label for the outcome
+// of a fetch.
+func statusClass(res *http.Response, err error) string {
+	switch {
+	case err != nil || res == nil:
+		return "error"
+	case res.StatusCode >= 500:
+		return "5xx"
+	case res.StatusCode >= 400:
+		return "4xx"
+	case res.StatusCode >= 300:
+		return "3xx"
+	case res.StatusCode >= 200:
+		return "2xx"
+	}
+	return "1xx"
+}
@@ -0,0 +1,352 @@
+/*
+Package metrics implements the counters, gauges and histograms walker uses to report
+on a crawl, and serves them in the Prometheus text format (see
+http://prometheus.io/docs/instrumenting/exposition_formats/).
+
+Metrics register themselves when they are created, so they are usually
+package variables:
+
+	var fetches = metrics.NewCounterVec("walker_fetches_total", "HTTP fetches made", "status")
+
+	func fetch() {
+		...
+		fetches.WithLabelValues("2xx").Inc()
+	}
+
+Handler serves every registered metric. The console serves it at /metrics,
+and commands that don't run the console can use ListenAndServe.
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default histogram buckets, in seconds; they suit
+// durations from a few milliseconds to a minute.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// metric is anything that can be registered and written out.
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics map[string]metric
+}{metrics: map[string]metric{}}
+
+// register adds m to the registry under name. Registering the same name twice
+// is a programming error, so it panics.
+func register(name string, m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %v registered twice", name))
+	}
+	registry.metrics[name] = m
+}
+
+// WriteText writes every registered metric to w in the Prometheus text
+// format, sorted by name.
+func WriteText(w io.Writer) {
+	registry.Lock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, registry.metrics[name])
+	}
+	registry.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler returns an http.Handler serving every registered metric.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteText(w)
+	})
+}
+
+// ListenAndServe serves Handler at /metrics on addr (ex. ":3001"). Like
+// http.ListenAndServe it only returns if the server fails.
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+//
+// Counters
+//
+
+// Counter is a count that only goes up.
+type Counter struct {
+	v uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add adds n to the counter. Negative values are ignored, since counters
+// can't go down.
+func (c *Counter) Add(n int64) {
+	if n > 0 {
+		atomic.AddUint64(&c.v, uint64(n))
+	}
+}
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+type namedCounter struct {
+	*Counter
+	name string
+	help string
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := namedCounter{Counter: &Counter{}, name: name, help: help}
+	register(name, c)
+	return c.Counter
+}
+
+func (c namedCounter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// CounterVec is a set of counters with the same name, told apart by the
+// values of their labels.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu       sync.RWMutex
+	counters map[string]*labeledCounter
+}
+
+type labeledCounter struct {
+	Counter
+	values []string
+}
+
+// NewCounterVec creates and registers a set of counters with the given
+// label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		counters: map[string]*labeledCounter{},
+	}
+	register(name, cv)
+	return cv
+}
+
+// WithLabelValues returns the counter for the given label values, which must
+// be given in the order of the labels passed to NewCounterVec.
+func (cv *CounterVec) WithLabelValues(values ...string) *Counter {
+	if len(values) != len(cv.labels) {
+		panic(fmt.Sprintf("metric %v has labels %v, got values %v", cv.name, cv.labels, values))
+	}
+	key := strings.Join(values, "\xff")
+
+	cv.mu.RLock()
+	c, ok := cv.counters[key]
+	cv.mu.RUnlock()
+	if ok {
+		return &c.Counter
+	}
+
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	c, ok = cv.counters[key]
+	if !ok {
+		c = &labeledCounter{values: append([]string{}, values...)}
+		cv.counters[key] = c
+	}
+	return &c.Counter
+}
+
+func (cv *CounterVec) write(w io.Writer) {
+	writeHeader(w, cv.name, cv.help, "counter")
+
+	cv.mu.RLock()
+	keys := make([]string, 0, len(cv.counters))
+	for key := range cv.counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	counters := make([]*labeledCounter, 0, len(keys))
+	for _, key := range keys {
+		counters = append(counters, cv.counters[key])
+	}
+	cv.mu.RUnlock()
+
+	for _, c := range counters {
+		fmt.Fprintf(w, "%s%s %d\n", cv.name, formatLabels(cv.labels, c.values), c.Value())
+	}
+}
+
+//
+// Gauges
+//
+
+// Gauge is a value that can go up and down, like the number of requests in
+// flight.
+type Gauge struct {
+	v int64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+// Add adds n (which may be negative) to the gauge.
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+type namedGauge struct {
+	*Gauge
+	name string
+	help string
+}
+
+// NewGauge creates and registers a gauge.
+func NewGauge(name, help string) *Gauge {
+	g := namedGauge{Gauge: &Gauge{}, name: name, help: help}
+	register(name, g)
+	return g.Gauge
+}
+
+func (g namedGauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.Value())
+}
+
+//
+// Histograms
+//
+
+// Histogram counts observations (usually durations in seconds) in buckets.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64 // counts[i] is the number of observations <= buckets[i]
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates and registers a histogram with the given bucket upper
+// bounds, which must be in increasing order (DefBuckets suits most
+// durations).
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metric %v buckets are not sorted: %v", name, buckets))
+	}
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	register(name, h)
+	return h
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Count returns the number of observations so far.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	counts := append([]uint64{}, h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(upper), counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+}
+
+//
+// Text format helpers
+//
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, names[i], labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
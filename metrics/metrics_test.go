@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsText(t *testing.T) {
+	c := NewCounter("test_counter_total", "A counter")
+	c.Inc()
+	c.Add(2)
+	c.Add(-5)
+
+	cv := NewCounterVec("test_labeled_total", "A labeled\ncounter", "status", "kind")
+	cv.WithLabelValues("2xx", "html").Add(3)
+	cv.WithLabelValues("5xx", `say "hi"`).Inc()
+	cv.WithLabelValues("2xx", "html").Inc()
+
+	g := NewGauge("test_gauge", "A gauge")
+	g.Set(5)
+	g.Add(-7)
+
+	h := NewHistogram("test_duration_seconds", "A histogram", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	WriteText(&buf)
+	text := buf.String()
+
+	expected := []string{
+		"# HELP test_counter_total A counter\n# TYPE test_counter_total counter\ntest_counter_total 3\n",
+		"# HELP test_labeled_total A labeled\\ncounter\n# TYPE test_labeled_total counter\n" +
+			"test_labeled_total{status=\"2xx\",kind=\"html\"} 4\n" +
+			"test_labeled_total{status=\"5xx\",kind=\"say \\\"hi\\\"\"} 1\n",
+		"# HELP test_gauge A gauge\n# TYPE test_gauge gauge\ntest_gauge -2\n",
+		"# TYPE test_duration_seconds histogram\n" +
+			"test_duration_seconds_bucket{le=\"0.1\"} 1\n" +
+			"test_duration_seconds_bucket{le=\"1\"} 2\n" +
+			"test_duration_seconds_bucket{le=\"+Inf\"} 3\n" +
+			"test_duration_seconds_sum 2.55\n" +
+			"test_duration_seconds_count 3\n",
+	}
+	for _, exp := range expected {
+		if !strings.Contains(text, exp) {
+			t.Errorf("Expected metrics text to contain\n%v\ngot\n%v", exp, text)
+		}
+	}
+
+	// Sorted by name
+	if strings.Index(text, "test_counter_total") > strings.Index(text, "test_duration_seconds") ||
+		strings.Index(text, "test_duration_seconds") > strings.Index(text, "test_labeled_total") {
+		t.Errorf("Expected metrics sorted by name, got\n%v", text)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	NewCounter("test_handler_total", "Served by the handler").Inc()
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected text/plain metrics, got Content-Type %q", ct)
+	}
+	if !strings.Contains(string(body), "test_handler_total 1\n") {
+		t.Errorf("Expected test_handler_total in metrics, got\n%s", body)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	NewCounter("test_twice_total", "Registered twice")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering a metric name twice to panic")
+		}
+	}()
+	NewCounter("test_twice_total", "Registered twice")
+}
@@ -51,6 +51,11 @@ func (ds *MockDatastore) LinksForHost(domain string) <-chan *URL {
 	return ch
 }
 
+// ExcludeHost implements walker.HostExcluder interface
+func (ds *MockDatastore) ExcludeHost(host string, reason string) {
+	ds.Mock.Called(host, reason)
+}
+
 // KeepAlive implements walker.Datastore interface
 func (ds *MockDatastore) KeepAlive() error {
 	ds.Mock.Called()
@@ -220,6 +225,11 @@ func (s *MockHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		res.ContentType = "text/html"
 	}
 
+	for key, values := range res.Headers {
+		for _, v := range values {
+			w.Header().Add(key, v)
+		}
+	}
 	w.Header().Set("Content-Type", res.ContentType)
 	if res.ContentLength != 0 {
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", res.ContentLength))
@@ -3,8 +3,8 @@ package walker
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
 	"mime"
-	"net"
 	"net/http"
 	"regexp"
 	"strings"
@@ -14,31 +14,169 @@ import (
 	"code.google.com/p/log4go"
 )
 
+// LinkHints describes how a link appeared on the page it was parsed from.
+// parseHTML attaches them to every URL it returns (see URL.Link), so they
+// reach the datastore and the handler with the link.
+type LinkHints struct {
+	// Tag and Attr are the element and attribute the link was found in, ex.
+	// "a" and "href", or "meta" and "content" for a <meta> refresh. A
+	// canonical URL given in a Link response header has an empty Tag and Attr
+	// "Link".
+	Tag  string
+	Attr string
+
+	// Text is the text of the <a> element, with runs of whitespace collapsed
+	// to single spaces (empty for other elements)
+	Text string
+
+	// Rel holds the values of the rel attribute, lowercased, ex.
+	// ["nofollow", "ugc"]
+	Rel []string
+
+	// Hreflang and Type are the hreflang and type attributes, i.e. the
+	// language and the media type of the linked resource, if given
+	Hreflang string
+	Type     string
+}
+
+// HasRel returns true if rel is one of h's rel values. h may be nil.
+func (h *LinkHints) HasRel(rel string) bool {
+	if h == nil {
+		return false
+	}
+	for _, r := range h.Rel {
+		if r == rel {
+			return true
+		}
+	}
+	return false
+}
+
 // parseLinks tries to parse the http response in the given FetchResults for
 // links and stores them in the datastore.
 func (f *fetcher) parseLinks(body []byte, fr *FetchResults) {
-	outlinks, noindex, nofollow, err := parseHTML(body)
+	contentType := fr.Response.Header.Get("Content-Type")
+	page, err := parseHTML(body, contentType, robotsAgentName(f.profile.userAgent))
 	if err != nil {
 		log4go.Debug("error parsing HTML for page %v: %v", fr.URL, err)
+		parseErrorsMetric.Inc()
 		return
 	}
+	fr.StructFingerprint = page.structFP
+	_, fr.Encoding, _ = charset.DetermineEncoding(body, contentType)
 
-	if noindex {
+	if page.robots.NoIndex {
 		fr.MetaNoIndex = true
 		log4go.Fine("Page has noindex meta tag: %v", fr.URL)
 	}
-	if nofollow {
+	if page.robots.NoFollow {
 		fr.MetaNoFollow = true
 		log4go.Fine("Page has nofollow meta tag: %v", fr.URL)
 	}
+	if fr.Robots.NoFollow {
+		// An X-Robots-Tag header covers the whole page, unlike a <meta> tag
+		// (which only covers the links after it)
+		log4go.Fine("Page has nofollow X-Robots-Tag header: %v", fr.URL)
+		page.links = nil
+	}
+	fr.Robots.merge(page.robots)
+
+	// Relative links resolve against the URL the page came from, unless it
+	// has a <base href>
+	base := responseURL(fr)
+	if page.base != nil {
+		page.base.MakeAbsolute(base)
+		base = page.base
+	}
+	if page.canonical != nil {
+		page.canonical.MakeAbsolute(base)
+		fr.Canonical = page.canonical
+	}
 
-	for _, outlink := range outlinks {
-		outlink.MakeAbsolute(fr.URL)
-		if f.shouldStoreParsedLink(outlink) {
+	for _, outlink := range page.links {
+		outlink.MakeAbsolute(base)
+		fr.Links = append(fr.Links, outlink)
+		if f.shouldStoreParsedLink(outlink, fr) {
 			log4go.Fine("Storing parsed link: %v", outlink)
 			f.fm.Datastore.StoreParsedURL(outlink, fr)
+			linksStoredMetric.WithLabelValues("page").Inc()
+		}
+	}
+}
+
+// storeCanonical passes the canonical URL of fr's page (see
+// FetchResults.Canonical) to Datastore.StoreParsedURL, unless it is the page
+// itself, so that the canonical page gets crawled.
+func (f *fetcher) storeCanonical(fr *FetchResults) {
+	if fr.Canonical == nil || fr.Robots.NoFollow {
+		return
+	}
+	if fr.Canonical.String() == responseURL(fr).String() {
+		return
+	}
+	u := fr.Canonical.Clone()
+	if f.shouldStoreParsedLink(u, fr) {
+		log4go.Fine("Storing canonical link: %v", u)
+		f.fm.Datastore.StoreParsedURL(u, fr)
+		linksStoredMetric.WithLabelValues("canonical").Inc()
+	}
+}
+
+// linkHeaderCanonical returns the target of the rel="canonical" link in the
+// Link headers of r (see RFC 5988), made absolute against base, or nil if
+// there is none. Ex.
+//     Link: <http://www.example.com/white-paper.pdf>; rel="canonical"
+func linkHeaderCanonical(r *http.Response, base *URL) *URL {
+	for _, header := range r.Header["Link"] {
+		for header != "" {
+			start := strings.Index(header, "<")
+			end := strings.Index(header, ">")
+			if start < 0 || end < start {
+				break
+			}
+			target := header[start+1 : end]
+			header = header[end+1:]
+
+			// The parameters of this link run up to the next one
+			params := header
+			if next := strings.Index(header, "<"); next >= 0 {
+				params = header[:next]
+				header = header[next:]
+			} else {
+				header = ""
+			}
+
+			var rel string
+			for _, param := range strings.Split(params, ";") {
+				kv := strings.SplitN(param, "=", 2)
+				if len(kv) == 2 && strings.ToLower(strings.TrimSpace(kv[0])) == "rel" {
+					rel = strings.Trim(strings.TrimSpace(kv[1]), `",`)
+				}
+			}
+			hints := &LinkHints{Attr: "Link", Rel: strings.Fields(strings.ToLower(rel))}
+			if !hints.HasRel("canonical") {
+				continue
+			}
+			u, err := ParseAndNormalizeURL(strings.TrimSpace(target))
+			if err != nil {
+				log4go.Debug("Failed to parse canonical Link header %q: %v", target, err)
+				continue
+			}
+			u.MakeAbsolute(base)
+			u.Link = hints
+			return u
 		}
 	}
+	return nil
+}
+
+// responseURL returns the URL that furnished fr.Response: the last URL it was
+// redirected to, if any, or else fr.URL.
+func responseURL(fr *FetchResults) *URL {
+	if n := len(fr.RedirectedFrom); n > 0 {
+		return fr.RedirectedFrom[n-1]
+	}
+	return fr.URL
 }
 
 // getIncludedTags gets a map of tags we should check for outlinks. It uses
@@ -65,19 +203,56 @@ func getIncludedTags() map[string]bool {
 	return tags
 }
 
-// parseHTML processes the html stored in content.
-// It returns:
-//     (a) a list of `links` on the page
-//     (b) a boolean metaNoindex to note if <meta name="ROBOTS" content="noindex"> was found
-//     (c) a boolean metaNofollow indicating if <meta name="ROBOTS" content="nofollow"> was found
-func parseHTML(body []byte) (links []*URL, metaNoindex bool, metaNofollow bool, err error) {
-	utf8Reader, err := charset.NewReader(bytes.NewReader(body), "text/html")
+// htmlPage is what parseHTML finds on a page.
+type htmlPage struct {
+	// The links on the page, each with LinkHints (see URL.Link). They are
+	// not yet made absolute.
+	links []*URL
+
+	// robots holds the directives of the page's robots <meta> tags, ex.
+	// <meta name="ROBOTS" content="noindex">
+	robots RobotsDirectives
+
+	// structFP is the structure fingerprint of the page (see
+	// FetchResults.StructFingerprint)
+	structFP int64
+
+	// base is the href of the first <base> tag, and canonical that of the
+	// first <link rel="canonical">; nil if the page has none. Neither is
+	// made absolute.
+	base      *URL
+	canonical *URL
+}
+
+// parseHTML processes the html stored in content, decoding it according to
+// contentType (the Content-Type header of the response) or its <meta> tags,
+// and returns what it found in an htmlPage. Robots <meta> tags are those named
+// "robots" or agent (see robotsAgentName).
+func parseHTML(body []byte, contentType string, agent string) (*htmlPage, error) {
+	utf8Reader, err := charset.NewReader(bytes.NewReader(body), contentType)
 	if err != nil {
-		return
+		return nil, err
 	}
 	tokenizer := html.NewTokenizer(utf8Reader)
 
 	tags := getIncludedTags()
+	page := &htmlPage{}
+
+	// The structure fingerprint hashes the sequence of start and end tags,
+	// without attributes or anything between them
+	structHash := fnv.New64()
+
+	// anchor is the link of the <a> element we are in, if any, whose text is
+	// collected in anchorText
+	var anchor *URL
+	var anchorText bytes.Buffer
+	endAnchor := func() {
+		if anchor != nil {
+			anchor.Link.Text = strings.Join(strings.Fields(anchorText.String()), " ")
+			anchor = nil
+		}
+		anchorText.Reset()
+	}
 
 	for {
 		tokenType := tokenizer.Next()
@@ -85,36 +260,76 @@ func parseHTML(body []byte) (links []*URL, metaNoindex bool, metaNofollow bool,
 		case html.ErrorToken:
 			//TODO: should use tokenizer.Err() to see if this is io.EOF
 			//      (meaning success) or an actual error
-			return
+			endAnchor()
+			page.structFP = int64(structHash.Sum64())
+			return page, nil
+		case html.TextToken:
+			if anchor != nil {
+				anchorText.Write(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			tagNameB, _ := tokenizer.TagName()
+			structHash.Write([]byte("</"))
+			structHash.Write(tagNameB)
+			if string(tagNameB) == "a" {
+				endAnchor()
+			}
 		case html.StartTagToken, html.SelfClosingTagToken:
 			tagNameB, hasAttrs := tokenizer.TagName()
+			structHash.Write([]byte("<"))
+			structHash.Write(tagNameB)
 			tagName := string(tagNameB)
-			if hasAttrs && tags[tagName] {
+
+			// <base> and <link> are read even if ignore_tags includes them:
+			// the only <link>s we take are the canonical URL and the
+			// hreflang alternates (translations) of the page, not
+			// stylesheets, icons and the like
+			if hasAttrs && tagName == "base" {
+				if page.base == nil {
+					page.base = parseBaseAttrs(tokenizer)
+				}
+			} else if hasAttrs && tagName == "link" {
+				ln := parseLinkAttrs(tokenizer)
+				if ln == nil {
+					break
+				}
+				if ln.Link.HasRel("canonical") {
+					if page.canonical == nil {
+						page.canonical = ln
+					}
+				} else if ln.Link.HasRel("alternate") && ln.Link.Hreflang != "" && !page.robots.NoFollow {
+					page.links = append(page.links, ln)
+				}
+			} else if hasAttrs && tags[tagName] {
 				switch tagName {
 				case "a":
-					if !metaNofollow {
-						links = parseAnchorAttrs(tokenizer, links)
+					endAnchor()
+					if !page.robots.NoFollow {
+						n := len(page.links)
+						page.links = parseAnchorAttrs(tokenizer, page.links)
+						if len(page.links) > n && tokenType == html.StartTagToken {
+							anchor = page.links[n]
+						}
 					}
 
 				case "embed":
-					if !metaNofollow {
-						links = parseObjectOrEmbed(tokenizer, links, true)
+					if !page.robots.NoFollow {
+						page.links = parseObjectOrEmbed(tokenizer, page.links, true)
 					}
 
 				case "iframe":
-					links = parseIframe(tokenizer, links, metaNofollow)
+					page.links = parseIframe(tokenizer, page.links, page.robots.NoFollow, agent)
 
 				case "meta":
-					var isRobots, index, follow bool
-					links, isRobots, index, follow = parseMetaAttrs(tokenizer, links)
-					if isRobots {
-						metaNoindex = metaNoindex || index
-						metaNofollow = metaNofollow || follow
+					var name, content string
+					page.links, name, content = parseMetaAttrs(tokenizer, page.links)
+					if name == "robots" || (name == agent && agent != "") {
+						page.robots.parse(content)
 					}
 
 				case "object":
-					if !metaNofollow {
-						links = parseObjectOrEmbed(tokenizer, links, false)
+					if !page.robots.NoFollow {
+						page.links = parseObjectOrEmbed(tokenizer, page.links, false)
 					}
 
 				}
@@ -138,33 +353,37 @@ func parseObjectOrEmbed(tokenizer *html.Tokenizer, links []*URL, isEmbed bool) [
 			label = "parseObjectAttrs"
 		}
 		log4go.Debug("%s encountered an error: %v", label, err)
+	} else if isEmbed {
+		ln.Link = &LinkHints{Tag: "embed", Attr: "src"}
+		links = append(links, ln)
 	} else {
+		ln.Link = &LinkHints{Tag: "object", Attr: "data"}
 		links = append(links, ln)
 	}
 
 	return links
 }
 
-// parseIframe takes 3 arguments
+// parseIframe takes 4 arguments
 // (a) tokenizer
 // (b) list of links already collected
 // (c) a flag indicating if the parser is currently in a nofollow state
+// (d) the agent name robots <meta> tags may use (see parseHTML)
 // and returns a possibly extended list of links.
-func parseIframe(tokenizer *html.Tokenizer, inLinks []*URL, metaNofollow bool) (links []*URL) {
+func parseIframe(tokenizer *html.Tokenizer, inLinks []*URL, metaNofollow bool, agent string) (links []*URL) {
 	links = inLinks
 	docsrc, body, err := parseIframeAttrs(tokenizer)
 	if err != nil {
 		return
 	} else if docsrc {
-		var nlinks []*URL
-		var nNofollow bool
-		nlinks, _, nNofollow, err = parseHTML([]byte(body))
+		var npage *htmlPage
+		npage, err = parseHTML([]byte(body), "text/html; charset=utf-8", agent)
 		if err != nil {
 			log4go.Error("parseEmbed failed to parse docsrc: %v", err)
 			return
 		}
-		if !Config.Fetcher.HonorMetaNofollow || !(nNofollow || metaNofollow) {
-			links = append(links, nlinks...)
+		if !Config.Fetcher.HonorMetaNofollow || !(npage.robots.NoFollow || metaNofollow) {
+			links = append(links, npage.links...)
 		}
 	} else { //!docsrc
 		if !metaNofollow {
@@ -174,6 +393,7 @@ func parseIframe(tokenizer *html.Tokenizer, inLinks []*URL, metaNofollow bool) (
 				log4go.Error("parseEmbed failed to parse src: %v", err)
 				return
 			}
+			u.Link = &LinkHints{Tag: "iframe", Attr: "src"}
 			links = append(links, u)
 		}
 	}
@@ -185,29 +405,24 @@ func parseIframe(tokenizer *html.Tokenizer, inLinks []*URL, metaNofollow bool) (
 var contentWordBytes = []byte("content")
 var dataWordBytes = []byte("data")
 var nameWordBytes = []byte("name")
-var noindexWordBytes = []byte("noindex")
-var nofollowWordBytes = []byte("nofollow")
-var robotsWordBytes = []byte("robots")
 var srcWordBytes = []byte("src")
 var srcdocWordBytes = []byte("srcdoc")
 var httpEquivWordBytes = []byte("http-equiv")
 var refreshWordBytes = []byte("refresh")
 var metaRefreshPattern = regexp.MustCompile(`^\s*\d+;\s*url=(.*)`)
 
-func parseMetaAttrs(tokenizer *html.Tokenizer, in_links []*URL) (links []*URL, isRobots bool, noIndex bool, noFollow bool) {
+// parseMetaAttrs reads the current <meta> token, adding the link of a <meta>
+// refresh to in_links. It returns the new link slice, and the tag's name
+// (lowercased) and content, so the caller can tell robots tags.
+func parseMetaAttrs(tokenizer *html.Tokenizer, in_links []*URL) (links []*URL, name string, content string) {
 	links = in_links
-	var content, httpEquiv []byte
+	var httpEquiv []byte
 	for {
 		key, val, moreAttr := tokenizer.TagAttr()
 		if bytes.Compare(key, nameWordBytes) == 0 {
-			name := bytes.ToLower(val)
-			isRobots = bytes.Compare(name, robotsWordBytes) == 0
+			name = strings.ToLower(strings.TrimSpace(string(val)))
 		} else if bytes.Compare(key, contentWordBytes) == 0 {
-			content = bytes.ToLower(val)
-			// This will match ill-formatted contents like "noindexnofollow",
-			// but I don't expect that to be a big deal.
-			noIndex = bytes.Contains(content, noindexWordBytes)
-			noFollow = bytes.Contains(content, nofollowWordBytes)
+			content = string(val)
 		} else if bytes.Compare(key, httpEquivWordBytes) == 0 {
 			httpEquiv = bytes.ToLower(val)
 		}
@@ -216,15 +431,16 @@ func parseMetaAttrs(tokenizer *html.Tokenizer, in_links []*URL) (links []*URL, i
 		}
 	}
 
-	if bytes.Compare(httpEquiv, refreshWordBytes) == 0 && content != nil {
-		results := metaRefreshPattern.FindSubmatch(content)
+	if bytes.Compare(httpEquiv, refreshWordBytes) == 0 && content != "" {
+		results := metaRefreshPattern.FindStringSubmatch(strings.ToLower(content))
 		if results != nil {
-			link := strings.TrimSpace(string(results[1]))
+			link := strings.TrimSpace(results[1])
 			u, err := ParseAndNormalizeURL(link)
 			if err != nil {
 				log4go.Error("parseMetaAttrs failed to parse url for %q: %v", link, err)
 
 			} else {
+				u.Link = &LinkHints{Tag: "meta", Attr: "content"}
 				links = append(links, u)
 			}
 		}
@@ -297,18 +513,90 @@ func parseIframeAttrs(tokenizer *html.Tokenizer) (srcdoc bool, body string, err
 func parseAnchorAttrs(tokenizer *html.Tokenizer, links []*URL) []*URL {
 	//TODO: rework this to be cleaner, passing in `links` to be appended to
 	//isn't great
+	var href, rel string
+	hasHref := false
+	hints := &LinkHints{Tag: "a", Attr: "href"}
 	for {
 		key, val, moreAttr := tokenizer.TagAttr()
-		if bytes.Compare(key, []byte("href")) == 0 {
-			u, err := ParseAndNormalizeURL(strings.TrimSpace(string(val)))
-			if err == nil {
-				links = append(links, u)
+		switch string(key) {
+		case "href":
+			href = string(val)
+			hasHref = true
+		case "rel":
+			rel = string(val)
+		case "hreflang":
+			hints.Hreflang = strings.TrimSpace(string(val))
+		case "type":
+			hints.Type = strings.TrimSpace(string(val))
+		}
+		if !moreAttr {
+			break
+		}
+	}
+	if !hasHref {
+		return links
+	}
+	u, err := ParseAndNormalizeURL(strings.TrimSpace(href))
+	if err != nil {
+		return links
+	}
+	hints.Rel = strings.Fields(strings.ToLower(rel))
+	u.Link = hints
+	return append(links, u)
+}
+
+// parseBaseAttrs returns the href of the current <base> token, or nil if it
+// has none (ex. <base target="_blank">).
+func parseBaseAttrs(tokenizer *html.Tokenizer) *URL {
+	for {
+		key, val, moreAttr := tokenizer.TagAttr()
+		if string(key) == "href" {
+			u, err := ParseURL(strings.TrimSpace(string(val)))
+			if err != nil {
+				log4go.Debug("parseBaseAttrs failed to parse href %q: %v", val, err)
+				return nil
 			}
+			return u
+		}
+		if !moreAttr {
+			return nil
+		}
+	}
+}
+
+// parseLinkAttrs returns the href of the current <link> token, with its rel,
+// hreflang and type in its LinkHints, or nil if it has no (valid) href.
+func parseLinkAttrs(tokenizer *html.Tokenizer) *URL {
+	var href, rel string
+	hasHref := false
+	hints := &LinkHints{Tag: "link", Attr: "href"}
+	for {
+		key, val, moreAttr := tokenizer.TagAttr()
+		switch string(key) {
+		case "href":
+			href = string(val)
+			hasHref = true
+		case "rel":
+			rel = string(val)
+		case "hreflang":
+			hints.Hreflang = strings.TrimSpace(string(val))
+		case "type":
+			hints.Type = strings.TrimSpace(string(val))
 		}
 		if !moreAttr {
-			return links
+			break
 		}
 	}
+	if !hasHref {
+		return nil
+	}
+	u, err := ParseAndNormalizeURL(strings.TrimSpace(href))
+	if err != nil {
+		return nil
+	}
+	hints.Rel = strings.Fields(strings.ToLower(rel))
+	u.Link = hints
+	return u
 }
 
 // getMimeType attempts to get the mime type (i.e. "Content-Type") from the
@@ -337,41 +625,3 @@ func isHTML(r *http.Response) bool {
 	}
 	return false
 }
-
-var privateNetworks = []*net.IPNet{
-	parseCIDR("10.0.0.0/8"),
-	parseCIDR("192.168.0.0/16"),
-	parseCIDR("172.16.0.0/12"),
-	parseCIDR("127.0.0.0/8"),
-}
-
-// parseCIDR is a convenience for creating our static private IPNet ranges
-func parseCIDR(netstring string) *net.IPNet {
-	_, network, err := net.ParseCIDR(netstring)
-	if err != nil {
-		panic(err.Error())
-	}
-	return network
-}
-
-// isPrivateAddr determines whether the input address belongs to any of the
-// private networks specified in privateNetworkStrings. It returns an error
-// if the input string does not represent an IP address.
-func isPrivateAddr(addr string) bool {
-	// Remove the port number if there is one
-	if index := strings.LastIndex(addr, ":"); index != -1 {
-		addr = addr[:index]
-	}
-
-	thisIP := net.ParseIP(addr)
-	if thisIP == nil {
-		log4go.Error("Failed to parse as IP address: %v", addr)
-		return false
-	}
-	for _, network := range privateNetworks {
-		if network.Contains(thisIP) {
-			return true
-		}
-	}
-	return false
-}
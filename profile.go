@@ -0,0 +1,236 @@
+package walker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker/mimetools"
+	"gopkg.in/yaml.v2"
+)
+
+// DomainProfile overrides Config.Fetcher settings for the links of one domain
+// or subdomain, for example to crawl a partner faster or with a custom user
+// agent. Zero values (empty strings and lists, or 0) leave the global setting
+// in place.
+//
+// Profiles come from domain_profiles in walker.yaml and, if the Datastore is
+// a DomainProfiler, from the datastore, whose settings take precedence. A
+// subdomain's profile is applied on top of its domain's.
+type DomainProfile struct {
+	UserAgent               string   `yaml:"user_agent,omitempty"`
+	DefaultCrawlDelay       string   `yaml:"default_crawl_delay,omitempty"`
+	MaxCrawlDelay           string   `yaml:"max_crawl_delay,omitempty"`
+	AcceptFormats           []string `yaml:"accept_formats,omitempty"`
+	ExcludeLinkPatterns     []string `yaml:"exclude_link_patterns,omitempty"`
+	IncludeLinkPatterns     []string `yaml:"include_link_patterns,omitempty"`
+	MaxHTTPContentSizeBytes int64    `yaml:"max_http_content_size_bytes,omitempty"`
+	HTTPKeepAlive           string   `yaml:"http_keep_alive,omitempty"`
+}
+
+// ParseDomainProfile parses a DomainProfile from yaml, using the same keys as
+// the fetcher section of walker.yaml (ex. "user_agent: Partner Bot"), and
+// checks its values.
+func ParseDomainProfile(text string) (*DomainProfile, error) {
+	p := &DomainProfile{}
+	err := yaml.Unmarshal([]byte(text), p)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal yaml: %v", err)
+	}
+	err = p.check()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// String returns the profile as yaml, in the form ParseDomainProfile reads.
+func (p *DomainProfile) String() string {
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		// Can't happen, the struct only holds strings and numbers
+		panic(err)
+	}
+	return string(data)
+}
+
+// check returns an error describing every invalid setting in the profile.
+func (p *DomainProfile) check() error {
+	var errs []string
+	if p.DefaultCrawlDelay != "" {
+		if _, err := time.ParseDuration(p.DefaultCrawlDelay); err != nil {
+			errs = append(errs, fmt.Sprintf("default_crawl_delay failed to parse: %v", err))
+		}
+	}
+	if p.MaxCrawlDelay != "" {
+		if _, err := time.ParseDuration(p.MaxCrawlDelay); err != nil {
+			errs = append(errs, fmt.Sprintf("max_crawl_delay failed to parse: %v", err))
+		}
+	}
+	if len(p.AcceptFormats) > 0 {
+		if _, err := mimetools.NewMatcher(p.AcceptFormats); err != nil {
+			errs = append(errs, fmt.Sprintf("accept_formats: %v", err))
+		}
+	}
+	if _, err := aggregateRegex(p.ExcludeLinkPatterns, "exclude_link_patterns"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if _, err := aggregateRegex(p.IncludeLinkPatterns, "include_link_patterns"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if p.MaxHTTPContentSizeBytes < 0 {
+		errs = append(errs, "max_http_content_size_bytes must be >= 0")
+	}
+	switch strings.ToLower(p.HTTPKeepAlive) {
+	case "", "always", "threshold", "never":
+	default:
+		errs = append(errs, "http_keep_alive not one of (always, threshold, never)")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// crawlProfile holds the parsed settings a fetcher uses for a link: the
+// global configuration with any DomainProfiles applied.
+type crawlProfile struct {
+	userAgent      string
+	defCrawlDelay  time.Duration
+	maxCrawlDelay  time.Duration
+	acceptFormats  *mimetools.Matcher
+	acceptList     []string // acceptFormats as given, for the Accept header
+	maxContentSize int64
+	keepAlive      string // http_keep_alive, lowercased
+	linkFilters    []LinkFilter
+}
+
+// apply returns a copy of cp with the settings of p (which may be nil)
+// overriding its own.
+func (cp *crawlProfile) apply(p *DomainProfile) (*crawlProfile, error) {
+	if p == nil {
+		return cp, nil
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	n := *cp
+	if p.UserAgent != "" {
+		n.userAgent = p.UserAgent
+	}
+	if p.DefaultCrawlDelay != "" {
+		n.defCrawlDelay, _ = time.ParseDuration(p.DefaultCrawlDelay)
+	}
+	if p.MaxCrawlDelay != "" {
+		n.maxCrawlDelay, _ = time.ParseDuration(p.MaxCrawlDelay)
+	}
+	if len(p.AcceptFormats) > 0 {
+		n.acceptFormats, _ = mimetools.NewMatcher(p.AcceptFormats)
+		n.acceptList = p.AcceptFormats
+	}
+	if p.MaxHTTPContentSizeBytes > 0 {
+		n.maxContentSize = p.MaxHTTPContentSizeBytes
+	}
+	if p.HTTPKeepAlive != "" {
+		n.keepAlive = strings.ToLower(p.HTTPKeepAlive)
+	}
+	if len(p.ExcludeLinkPatterns) > 0 || len(p.IncludeLinkPatterns) > 0 {
+		// Replace the chain's LinkPatternFilter (or add one)
+		exclude, _ := aggregateRegex(p.ExcludeLinkPatterns, "exclude_link_patterns")
+		include, _ := aggregateRegex(p.IncludeLinkPatterns, "include_link_patterns")
+		patterns := &LinkPatternFilter{Exclude: exclude, Include: include}
+
+		n.linkFilters = nil
+		replaced := false
+		for _, lf := range cp.linkFilters {
+			if _, ok := lf.(*LinkPatternFilter); ok {
+				lf = patterns
+				replaced = true
+			}
+			n.linkFilters = append(n.linkFilters, lf)
+		}
+		if !replaced {
+			n.linkFilters = append(n.linkFilters, patterns)
+		}
+	}
+	return &n, nil
+}
+
+// hostProfiles holds the crawl profiles for the links of a claimed domain.
+type hostProfiles struct {
+	// domain is used for the domain and any subdomains without a profile
+	domain *crawlProfile
+
+	// subdomains holds the profiles of subdomains that have their own
+	subdomains map[string]*crawlProfile
+}
+
+// forLink returns the profile to use for u.
+func (hp *hostProfiles) forLink(u *URL) *crawlProfile {
+	if len(hp.subdomains) > 0 {
+		_, subdom, err := u.TLDPlusOneAndSubdomain()
+		if err == nil {
+			if cp, ok := hp.subdomains[subdom]; ok {
+				return cp
+			}
+		}
+	}
+	return hp.domain
+}
+
+// hostProfiles resolves the crawl profiles for domain (which the caller has
+// claimed) from domain_profiles and, if the Datastore is a DomainProfiler, the
+// datastore. Invalid profiles are logged and ignored.
+func (fm *FetchManager) hostProfiles(domain string) *hostProfiles {
+	// DomainProfiles from each source, keyed by subdomain ("" for the domain)
+	var sources []map[string]*DomainProfile
+
+	fromConfig := map[string]*DomainProfile{}
+	for host, p := range Config.Fetcher.DomainProfiles {
+		p := p
+		host = strings.ToLower(host)
+		if host == domain {
+			fromConfig[""] = &p
+		} else if strings.HasSuffix(host, "."+domain) {
+			fromConfig[strings.TrimSuffix(host, "."+domain)] = &p
+		}
+	}
+	sources = append(sources, fromConfig)
+
+	if dp, ok := fm.Datastore.(DomainProfiler); ok {
+		fromDatastore, err := dp.DomainProfiles(domain)
+		if err != nil {
+			log4go.Error("Failed to read domain profiles for %v, using defaults: %v", domain, err)
+		} else {
+			sources = append(sources, fromDatastore)
+		}
+	}
+
+	apply := func(cp *crawlProfile, subdom string) *crawlProfile {
+		for _, profiles := range sources {
+			n, err := cp.apply(profiles[subdom])
+			if err != nil {
+				log4go.Error("Ignoring bad domain profile for %v (subdomain %q): %v", domain, subdom, err)
+				continue
+			}
+			cp = n
+		}
+		return cp
+	}
+
+	hp := &hostProfiles{
+		domain:     apply(fm.profile, ""),
+		subdomains: map[string]*crawlProfile{},
+	}
+	for _, profiles := range sources {
+		for subdom := range profiles {
+			if subdom != "" && hp.subdomains[subdom] == nil {
+				hp.subdomains[subdom] = apply(hp.domain, subdom)
+			}
+		}
+	}
+	return hp
+}
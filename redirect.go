@@ -0,0 +1,112 @@
+package walker
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"code.google.com/p/log4go"
+)
+
+// Values of Config.Fetcher.CrossDomainRedirects
+const (
+	redirectFollow = "follow" // follow redirects to other domains
+	redirectRecord = "record" // record the target as a link but don't follow
+	redirectRefuse = "refuse" // don't follow or record the target
+)
+
+var crossDomainRedirectPolicies = []string{redirectFollow, redirectRecord, redirectRefuse}
+
+// redirectPolicy is how fetch follows redirects.
+type redirectPolicy struct {
+	// max is how many redirects to follow
+	max int
+
+	// crossDomain is one of crossDomainRedirectPolicies, saying what to do
+	// about redirects to a different TLD+1 than the URL being fetched
+	crossDomain string
+}
+
+// defaultRedirects is the policy for fetches that aren't links in a segment,
+// like robots.txt and sitemaps. It's the same as net/http's default.
+var defaultRedirects = &redirectPolicy{max: 10, crossDomain: redirectFollow}
+
+// robotsRedirects is the policy for fetching robots.txt: RFC 9309 asks for at
+// least five redirects to be followed, and robots.txt is unavailable if it
+// takes more.
+var robotsRedirects = &redirectPolicy{max: 5, crossDomain: redirectFollow}
+
+// RedirectError is the FetchError when a redirect isn't followed because of
+// max_redirects or cross_domain_redirects.
+type RedirectError struct {
+	// Target is the URL we were redirected to
+	Target *URL
+
+	// Refused is true if Target should not be crawled either
+	Refused bool
+
+	// Reason says why the redirect wasn't followed
+	Reason string
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("Did not follow redirect to %v: %v", e.Target, e.Reason)
+}
+
+// checkRedirect returns a CheckRedirect function for an http.Client
+// fetching u, which enforces the policy and appends each redirect it allows
+// to *redirectedFrom.
+func (p *redirectPolicy) checkRedirect(u *URL, redirectedFrom *[]*URL) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		target := &URL{URL: req.URL}
+		if len(via) > p.max {
+			return &RedirectError{
+				Target: target,
+				Reason: fmt.Sprintf("stopped after %v redirects", p.max),
+			}
+		}
+		if p.crossDomain != redirectFollow && !sameDomain(u, target) {
+			return &RedirectError{
+				Target:  target,
+				Refused: p.crossDomain == redirectRefuse,
+				Reason:  "redirects to another domain are not followed (cross_domain_redirects: " + p.crossDomain + ")",
+			}
+		}
+		*redirectedFrom = append(*redirectedFrom, target)
+		return nil
+	}
+}
+
+// sameDomain returns true if a and b have the same TLD+1 (or, if that can't
+// be determined, for example for IP addresses, the same host).
+func sameDomain(a, b *URL) bool {
+	adom, aerr := a.ToplevelDomainPlusOne()
+	bdom, berr := b.ToplevelDomainPlusOne()
+	if aerr != nil || berr != nil {
+		return strings.ToLower(a.Host) == strings.ToLower(b.Host)
+	}
+	return adom == bdom
+}
+
+// storeRedirectTargets passes the URLs that fr's link redirected to (whether
+// or not we followed them, unless they were refused) to
+// Datastore.StoreParsedURL, so they get crawled as links in their own right.
+// This way a site that moves to a new domain gets crawled there.
+func (f *fetcher) storeRedirectTargets(fr *FetchResults) {
+	targets := append([]*URL{}, fr.RedirectedFrom...)
+	if re, ok := fr.FetchError.(*RedirectError); ok && !re.Refused {
+		targets = append(targets, re.Target)
+	}
+	for _, target := range targets {
+		u, err := ParseAndNormalizeURL(target.String())
+		if err != nil {
+			log4go.Debug("Not storing redirect target %v: %v", target, err)
+			continue
+		}
+		if f.shouldStoreParsedLink(u, fr) {
+			log4go.Fine("Storing redirect target: %v", u)
+			f.fm.Datastore.StoreParsedURL(u, fr)
+			linksStoredMetric.WithLabelValues("redirect").Inc()
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package walker
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Classes of transient fetch failures that may be retried, as listed in
+// Config.Fetcher.RetryErrors
+const (
+	retryDNS     = "dns"     // temporary DNS failures
+	retryRefused = "refused" // connection refused
+	retryTimeout = "timeout" // connect, request or read timeouts
+	retry5XX     = "5xx"     // 5XX HTTP responses
+)
+
+var retryErrorClasses = []string{retryDNS, retryRefused, retryTimeout, retry5XX}
+
+// retryClass returns which of the retryErrorClasses the outcome of a fetch
+// falls into, or "" if it is not a transient failure.
+func retryClass(res *http.Response, err error) string {
+	if err == nil {
+		if res != nil && res.StatusCode >= 500 && res.StatusCode < 600 {
+			return retry5XX
+		}
+		return ""
+	}
+	return errorClass(err)
+}
+
+func errorClass(err error) string {
+	switch e := err.(type) {
+	case *url.Error:
+		return errorClass(e.Err)
+
+	case *net.DNSError:
+		if e.Temporary() || e.Timeout() {
+			return retryDNS
+		}
+		return ""
+
+	case *net.OpError:
+		if e.Timeout() {
+			return retryTimeout
+		}
+		if e.Op == "dial" && isConnRefused(e.Err) {
+			return retryRefused
+		}
+		return errorClass(e.Err)
+	}
+
+	// Catches the http.Client timeout among others
+	if t, ok := err.(interface {
+		Timeout() bool
+	}); ok && t.Timeout() {
+		return retryTimeout
+	}
+	return ""
+}
+
+func isConnRefused(err error) bool {
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
+
+// retryBackoff returns how long to wait before making attempt number
+// attempt+1, after attempt failed. The wait grows exponentially from base up
+// to max, with jitter so that fetchers don't retry in lock step.
+func retryBackoff(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Pick uniformly from [d/2, d]
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
@@ -0,0 +1,202 @@
+package walker
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/temoto/robotstxt.go"
+)
+
+// robotsCacheSize is how many origins' robots.txt rules the FetchManager
+// keeps around
+const robotsCacheSize = 10000
+
+// robotsMaxSize is how much of a robots.txt file we read. RFC 9309 requires
+// parsing at least 500 KiB; anything past that can be ignored.
+const robotsMaxSize = 500 * 1024
+
+// robotsDisallowed is the RobotsReason for links excluded by a robots.txt
+// rule
+const robotsDisallowed = "disallowed by robots.txt"
+
+// robotsRules are the robots.txt rules for one origin (scheme, host and port).
+// The FetchManager's robots cache keeps them for every domain profile, without
+// Group; forProfile picks the group and crawl delay for a fetcher's profile.
+type robotsRules struct {
+	*robotstxt.Group
+
+	// data is the parsed robots.txt
+	data *robotstxt.RobotsData
+
+	// defaultDelay is true if robots.txt was missing or unreachable, so
+	// default_crawl_delay applies instead of the file's Crawl-delay
+	defaultDelay bool
+
+	// reason is the FetchResults.RobotsReason for links these rules exclude
+	reason string
+
+	// unreachable is true if these rules disallow everything because
+	// robots.txt could not be fetched
+	unreachable bool
+
+	// expires is when robots.txt should be fetched again
+	expires time.Time
+
+	// sitemaps lists the Sitemap: URLs in robots.txt
+	sitemaps []string
+}
+
+// robotsOrigin returns the scheme and host (including the port, unless it
+// is the default for the scheme) that link's robots.txt is served from.
+func robotsOrigin(link *URL) (scheme, host string) {
+	scheme = strings.ToLower(link.Scheme)
+	host = strings.ToLower(link.Host)
+	switch scheme {
+	case "http":
+		host = strings.TrimSuffix(host, ":80")
+	case "https":
+		host = strings.TrimSuffix(host, ":443")
+	}
+	return scheme, host
+}
+
+// newRobotsRules parses robots.txt content into rules.
+func (f *fetcher) newRobotsRules(txt string) *robotsRules {
+	data, err := robotstxt.FromBytes([]byte(txt))
+	if err != nil {
+		log4go.Debug("Error parsing robots.txt, assuming there is no robots.txt: %v", err)
+		return f.noRobots()
+	}
+	return &robotsRules{
+		data:     data,
+		reason:   robotsDisallowed,
+		expires:  time.Now().Add(f.fm.robotsTTL),
+		sitemaps: data.Sitemaps,
+	}
+}
+
+// noRobots returns the rules used when a host has no robots.txt: everything
+// is allowed, with default_crawl_delay.
+func (f *fetcher) noRobots() *robotsRules {
+	rules := f.newRobotsRules("User-agent: *\n")
+	rules.defaultDelay = true
+	return rules
+}
+
+// forProfile returns the rules as they apply under profile cp: the group for
+// its user agent, with the file's crawl delay capped at max_crawl_delay (or
+// default_crawl_delay if there was no usable robots.txt).
+func (r *robotsRules) forProfile(cp *crawlProfile) *robotsRules {
+	// Copy the group, FindGroup returns the one shared by every profile
+	grp := *r.data.FindGroup(cp.userAgent)
+	if r.defaultDelay {
+		grp.CrawlDelay = cp.defCrawlDelay
+	} else if grp.CrawlDelay > cp.maxCrawlDelay {
+		grp.CrawlDelay = cp.maxCrawlDelay
+	}
+	rules := *r
+	rules.Group = &grp
+	return &rules
+}
+
+// fetchRobots returns the robots.txt rules for link under the fetcher's
+// current profile, fetching them if they are not in the FetchManager's robots
+// cache or have expired. Returns nil if the fetcher was interrupted.
+func (f *fetcher) fetchRobots(link *URL) *robotsRules {
+	scheme, host := robotsOrigin(link)
+	key := scheme + "://" + host
+
+	var rules *robotsRules
+	if cached, ok := f.fm.robots.Get(key); ok {
+		rules = cached.(*robotsRules)
+	}
+	if rules == nil || time.Now().After(rules.expires) {
+		f.resetTransport()
+		rules = f.getRobots(scheme, host, rules)
+		if rules == nil {
+			return nil
+		}
+		f.fm.robots.Add(key, rules)
+	}
+	rules = rules.forProfile(f.profile)
+	f.setTransportFromCrawlDelay(rules.CrawlDelay)
+	return rules
+}
+
+// getRobots fetches and parses robots.txt from the given origin, following
+// RFC 9309:
+//   (*) 2xx: the rules in the file apply
+//   (*) 4xx, or more than 5 redirects: robots.txt is unavailable, so
+//       anything may be crawled
+//   (*) 429, 5xx or a network error: robots.txt is unreachable, so nothing
+//       may be crawled until we can fetch it. If we have stale rules that
+//       were fetched successfully we keep using those instead.
+// Returns nil if the fetcher was interrupted.
+func (f *fetcher) getRobots(scheme, host string, stale *robotsRules) *robotsRules {
+	u := &URL{
+		URL: &url.URL{
+			Scheme: scheme,
+			Host:   host,
+			Path:   "/robots.txt",
+		},
+		LastCrawled: NotYetCrawled, //explicitly set this so that fetcher.fetch won't send If-Modified-Since
+	}
+
+	res, _, err := f.fetch(u, robotsRedirects)
+	if re, ok := err.(*RedirectError); ok {
+		log4go.Debug("Did not follow redirects for %v, assuming there is no robots.txt: %v", u, re)
+		return f.noRobots()
+	} else if err != nil {
+		if f.interrupted() {
+			return nil
+		}
+		log4go.Debug("Could not fetch %v, disallowing all links (error: %v)", u, err)
+		return f.unreachableRobots(err.Error(), stale)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		txt, err := ioutil.ReadAll(io.LimitReader(res.Body, robotsMaxSize))
+		if err != nil {
+			if f.interrupted() {
+				return nil
+			}
+			log4go.Debug("Could not read %v, disallowing all links (error: %v)", u, err)
+			return f.unreachableRobots(err.Error(), stale)
+		}
+		return f.newRobotsRules(string(txt))
+
+	case res.StatusCode == 429 || res.StatusCode >= 500: // 429 Too Many Requests
+		log4go.Debug("Got %v fetching %v, disallowing all links", res.Status, u)
+		return f.unreachableRobots(res.Status, stale)
+
+	default:
+		log4go.Debug("Got %v fetching %v, assuming there is no robots.txt", res.Status, u)
+		return f.noRobots()
+	}
+}
+
+// unreachableRobots returns the rules to use when robots.txt could not be
+// fetched because of problem: stale (with a fresh expiry) if it was
+// fetched successfully, otherwise rules disallowing everything. Either way we
+// try again after robots_unreachable_ttl.
+func (f *fetcher) unreachableRobots(problem string, stale *robotsRules) *robotsRules {
+	expires := time.Now().Add(f.fm.robotsUnreachableTTL)
+	if stale != nil && !stale.unreachable {
+		rules := *stale
+		rules.expires = expires
+		return &rules
+	}
+
+	rules := f.newRobotsRules("User-agent: *\nDisallow: /\n")
+	rules.defaultDelay = true
+	rules.reason = "robots.txt unreachable (" + problem + ")"
+	rules.unreachable = true
+	rules.expires = expires
+	return rules
+}
@@ -0,0 +1,149 @@
+package walker
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RobotsDirectives are the indexing directives a page gives crawlers, in
+// <meta name="robots"> tags, <meta> tags named for our user agent (ex. <meta
+// name="walker">, see robotsAgentName) and X-Robots-Tag response headers. The
+// header works for every content type, PDFs and images included.
+type RobotsDirectives struct {
+	// The page should not be indexed ("noindex" or "none"). Whether walker
+	// still handles it depends on honor_meta_noindex.
+	NoIndex bool
+
+	// The links on the page should not be followed ("nofollow" or "none")
+	NoFollow bool
+
+	// No cached copy of the page should be shown ("noarchive")
+	NoArchive bool
+
+	// No snippet of the page should be shown in search results ("nosnippet")
+	NoSnippet bool
+
+	// The page should not be shown in search results after this time
+	// ("unavailable_after: <date>"); zero if not given
+	UnavailableAfter time.Time
+}
+
+// merge adds the directives of other to d; the earliest UnavailableAfter wins.
+func (d *RobotsDirectives) merge(other RobotsDirectives) {
+	d.NoIndex = d.NoIndex || other.NoIndex
+	d.NoFollow = d.NoFollow || other.NoFollow
+	d.NoArchive = d.NoArchive || other.NoArchive
+	d.NoSnippet = d.NoSnippet || other.NoSnippet
+	if !other.UnavailableAfter.IsZero() &&
+		(d.UnavailableAfter.IsZero() || other.UnavailableAfter.Before(d.UnavailableAfter)) {
+		d.UnavailableAfter = other.UnavailableAfter
+	}
+}
+
+// parse adds the directives listed in content, the content of a robots
+// <meta> tag or an X-Robots-Tag header, to d. Directives are case
+// insensitive, separated by commas (or, leniently, spaces); unknown ones are
+// ignored. Ex.
+//     noindex, nofollow
+//     unavailable_after: 25 Jun 2010 15:00:00 PST
+func (d *RobotsDirectives) parse(content string) {
+	parts := strings.Split(content, ",")
+	for i := 0; i < len(parts); i++ {
+		part := strings.TrimSpace(parts[i])
+		if kv := strings.SplitN(part, ":", 2); len(kv) == 2 &&
+			strings.ToLower(strings.TrimSpace(kv[0])) == "unavailable_after" {
+			date := strings.TrimSpace(kv[1])
+			t, ok := parseUnavailableAfter(date)
+			if !ok && i+1 < len(parts) {
+				// Dates like "Friday, 25-Jun-10 15:00:00 PST" have a comma
+				// of their own
+				t, ok = parseUnavailableAfter(date + "," + parts[i+1])
+				if ok {
+					i++
+				}
+			}
+			if ok {
+				d.merge(RobotsDirectives{UnavailableAfter: t})
+			}
+			continue
+		}
+
+		for _, directive := range strings.Fields(strings.ToLower(part)) {
+			switch directive {
+			case "noindex":
+				d.NoIndex = true
+			case "nofollow":
+				d.NoFollow = true
+			case "none":
+				d.NoIndex = true
+				d.NoFollow = true
+			case "noarchive":
+				d.NoArchive = true
+			case "nosnippet":
+				d.NoSnippet = true
+			}
+		}
+	}
+}
+
+// unavailableAfterFormats are the date formats parseUnavailableAfter accepts.
+// Google documents RFC 822, RFC 850 and ISO 8601; sites use all sorts.
+var unavailableAfterFormats = []string{
+	time.RFC850,
+	time.RFC1123,
+	time.RFC1123Z,
+	time.RFC822,
+	time.RFC822Z,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2 Jan 2006 15:04:05 MST",
+	"2-Jan-2006 15:04:05 MST",
+	"Monday, 2-Jan-2006 15:04:05 MST",
+}
+
+// parseUnavailableAfter parses the date of an unavailable_after directive.
+func parseUnavailableAfter(date string) (time.Time, bool) {
+	date = strings.TrimSpace(date)
+	for _, format := range unavailableAfterFormats {
+		if t, err := time.Parse(format, date); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// robotsHeaderDirectives parses the X-Robots-Tag headers of r. A header can
+// name the crawler it is for (ex. "X-Robots-Tag: otherbot: noindex"); those
+// are only applied if the name is agent, the product token of our user
+// agent (see robotsAgentName).
+func robotsHeaderDirectives(r *http.Response, agent string) RobotsDirectives {
+	var d RobotsDirectives
+	for _, header := range r.Header["X-Robots-Tag"] {
+		if kv := strings.SplitN(header, ":", 2); len(kv) == 2 {
+			// The colon may also be that of an unavailable_after directive
+			name := strings.ToLower(strings.TrimSpace(kv[0]))
+			if name != "unavailable_after" && !strings.ContainsAny(name, ", ") {
+				if name != agent {
+					continue
+				}
+				header = kv[1]
+			}
+		}
+		d.parse(header)
+	}
+	return d
+}
+
+// robotsAgentName returns the product token of userAgent, lowercased, ex.
+// "walker" for "Walker (http://github.com/iParadigms/walker)" or
+// "mybot" for "MyBot/1.0". Pages address us by it in <meta> tags and
+// X-Robots-Tag headers, like in robots.txt.
+func robotsAgentName(userAgent string) string {
+	name := strings.TrimSpace(userAgent)
+	if i := strings.IndexAny(name, " /("); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(name)
+}
@@ -0,0 +1,223 @@
+package walker
+
+import (
+	"bytes"
+	"hash/fnv"
+	"strings"
+	"unicode"
+
+	"code.google.com/p/go.net/html"
+	"code.google.com/p/go.net/html/charset"
+)
+
+// simhashShingleSize is the number of consecutive words hashed together as
+// one SimHash feature
+const simhashShingleSize = 3
+
+// SimHash computes a 64-bit SimHash fingerprint of text. Unlike the fnv
+// fingerprint, similar texts get similar fingerprints: the number of bits two
+// fingerprints differ by (see HammingDistance) grows with how much the texts
+// differ, so pages that only differ by, say, a timestamp or an ad are a few
+// bits apart. The features hashed are overlapping runs of words, ignoring case
+// and punctuation. Returns 0 for text with no words.
+func SimHash(text string) int64 {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) == 0 {
+		return 0
+	}
+
+	n := simhashShingleSize
+	if len(words) < n {
+		n = len(words)
+	}
+	var v [64]int
+	h := fnv.New64a()
+	for i := 0; i+n <= len(words); i++ {
+		h.Reset()
+		h.Write([]byte(strings.Join(words[i:i+n], " ")))
+		sum := h.Sum64()
+		for b := uint(0); b < 64; b++ {
+			if sum&(1<<b) != 0 {
+				v[b]++
+			} else {
+				v[b]--
+			}
+		}
+	}
+
+	var fp uint64
+	for b := uint(0); b < 64; b++ {
+		if v[b] > 0 {
+			fp |= 1 << b
+		}
+	}
+	return int64(fp)
+}
+
+// HammingDistance returns the number of bits a and b differ by.
+func HammingDistance(a, b int64) int {
+	x := uint64(a ^ b)
+	n := 0
+	for x != 0 {
+		x &= x - 1
+		n++
+	}
+	return n
+}
+
+// simhashBucketSize is the most representatives (see SimHashClusters) kept in
+// one bucket of a block table. A site's pages can share blocks by the
+// thousand, so past this many a fingerprint is only compared with the first
+// ones; that keeps clustering close to linear in the number of fingerprints,
+// at the cost of maybe missing some near-duplicates on such sites.
+const simhashBucketSize = 64
+
+// simhashMaxPairBlocks is the most blocks simhashTables pairs up. With more,
+// the blocks are too short for pairs to make much smaller buckets than single
+// blocks do, and there are a lot more tables.
+const simhashMaxPairBlocks = 16
+
+// simhashTables returns the masks of the block tables that find fingerprints
+// within maxDistance bits of each other, as in "Detecting Near-Duplicates for
+// Web Crawling" (Manku et al.). The 64 bits are split into maxDistance+2
+// blocks; two fingerprints that close agree on at least two of them, so each
+// table is keyed by the bits of one pair of blocks and near-duplicates match
+// exactly in at least one table. At large distances the bits are instead
+// split into maxDistance+1 blocks, one per table.
+func simhashTables(maxDistance int) []uint64 {
+	n := maxDistance + 2
+	pairs := n <= simhashMaxPairBlocks
+	if !pairs {
+		n = maxDistance + 1
+	}
+	blocks := make([]uint64, n)
+	for b := range blocks {
+		lo, hi := uint(64*b/n), uint(64*(b+1)/n)
+		blocks[b] = (1<<(hi-lo) - 1) << lo
+	}
+	if !pairs {
+		return blocks
+	}
+
+	var masks []uint64
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			masks = append(masks, blocks[i]|blocks[j])
+		}
+	}
+	return masks
+}
+
+// SimHashClusters groups fingerprints that are near-duplicates of one
+// another. Going through hashes in order, a fingerprint joins the group of the
+// nearest representative within maxDistance bits of it, or if there is none
+// becomes the representative of a new group. So every member of a group is
+// within maxDistance bits of its first member, rather than a series of small
+// differences chaining pages that have little in common into one group.
+// It returns the indexes into hashes of each group with more than one member,
+// in order of their first member. Zero fingerprints (no SimHash) are never
+// grouped.
+func SimHashClusters(hashes []int64, maxDistance int) [][]int {
+	if maxDistance < 0 {
+		return nil
+	}
+	if maxDistance >= 64 {
+		// Every fingerprint is within 64 bits of every other
+		var all []int
+		for i, h := range hashes {
+			if h != 0 {
+				all = append(all, i)
+			}
+		}
+		if len(all) < 2 {
+			return nil
+		}
+		return [][]int{all}
+	}
+
+	// Only representatives go in the tables, and only they are compared
+	type tableKey struct {
+		table int
+		bits  uint64
+	}
+	masks := simhashTables(maxDistance)
+	buckets := map[tableKey][]int{}
+
+	var clusters [][]int
+	clusterOf := map[int]int{} // representative -> index into clusters
+	for i, h := range hashes {
+		if h == 0 {
+			continue
+		}
+
+		rep, best := -1, maxDistance+1
+		for t, mask := range masks {
+			for _, j := range buckets[tableKey{t, uint64(h) & mask}] {
+				if d := HammingDistance(h, hashes[j]); d < best || (d == best && j < rep) {
+					rep, best = j, d
+				}
+			}
+		}
+		if rep >= 0 {
+			c := clusterOf[rep]
+			clusters[c] = append(clusters[c], i)
+			continue
+		}
+
+		clusterOf[i] = len(clusters)
+		clusters = append(clusters, []int{i})
+		for t, mask := range masks {
+			key := tableKey{t, uint64(h) & mask}
+			if len(buckets[key]) < simhashBucketSize {
+				buckets[key] = append(buckets[key], i)
+			}
+		}
+	}
+
+	var dups [][]int
+	for _, c := range clusters {
+		if len(c) > 1 {
+			dups = append(dups, c)
+		}
+	}
+	return dups
+}
+
+// simhashHTML returns the SimHash of the visible text of an HTML page, i.e.
+// its text outside of scripts, styles and similar.
+func simhashHTML(body []byte) (int64, error) {
+	utf8Reader, err := charset.NewReader(bytes.NewReader(body), "text/html")
+	if err != nil {
+		return 0, err
+	}
+	tokenizer := html.NewTokenizer(utf8Reader)
+
+	var text bytes.Buffer
+	hidden := ""
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return SimHash(text.String()), nil
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "noscript", "template":
+				if hidden == "" {
+					hidden = string(name)
+				}
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == hidden {
+				hidden = ""
+			}
+		case html.TextToken:
+			if hidden == "" {
+				text.Write(tokenizer.Text())
+				text.WriteByte(' ')
+			}
+		}
+	}
+}
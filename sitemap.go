@@ -0,0 +1,395 @@
+package walker
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// SitemapHints holds what a sitemap (see http://www.sitemaps.org/protocol.html)
+// says about one of the URLs it lists. The datastore can use them to decide
+// when to crawl the URL.
+type SitemapHints struct {
+	// LastMod is when the page last changed, or the zero time if the sitemap
+	// didn't say
+	LastMod time.Time
+
+	// ChangeFreq is how often the page is likely to change: "always",
+	// "hourly", "daily", "weekly", "monthly", "yearly", "never", or "" if the
+	// sitemap didn't say
+	ChangeFreq string
+
+	// Priority is the priority of the URL relative to others on the site,
+	// from 0.0 to 1.0. Defaults to 0.5.
+	Priority float64
+}
+
+// maxSitemapIndexDepth is how deep we follow sitemap indexes. The protocol
+// doesn't allow an index to list other indexes, but this protects us from
+// sites that do anyway (or loop).
+const maxSitemapIndexDepth = 2
+
+// errSitemapLimit is used to stop parsing once we have enough URLs
+var errSitemapLimit = fmt.Errorf("Reached maximum number of sitemap URLs")
+
+// errSitemapStopped is used to stop reading sitemaps when the fetcher is told
+// to stop
+var errSitemapStopped = fmt.Errorf("Stopped reading sitemaps")
+
+// errSitemapTooLarge is returned by ParseSitemap for gzipped sitemaps larger
+// than Config.Fetcher.MaxDecompressedSizeBytes once decompressed
+var errSitemapTooLarge = fmt.Errorf("Sitemap exceeded MaxDecompressedSizeBytes once decompressed")
+
+// w3cDateFormats are the W3C Datetime formats sitemaps use for lastmod
+var w3cDateFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+type sitemapEntry struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod"`
+	ChangeFreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+
+// hints returns the SitemapHints of a <url> entry.
+func (e *sitemapEntry) hints() *SitemapHints {
+	h := &SitemapHints{
+		ChangeFreq: strings.ToLower(strings.TrimSpace(e.ChangeFreq)),
+		Priority:   0.5,
+	}
+	lastmod := strings.TrimSpace(e.LastMod)
+	for _, format := range w3cDateFormats {
+		if t, err := time.Parse(format, lastmod); err == nil {
+			h.LastMod = t
+			break
+		}
+	}
+	if p, err := strconv.ParseFloat(strings.TrimSpace(e.Priority), 64); err == nil && p >= 0 && p <= 1 {
+		h.Priority = p
+	}
+	return h
+}
+
+// ParseSitemap reads a sitemap or sitemap index from r, which may be
+// gzipped (in which case it may decompress to at most
+// max_decompressed_size_bytes). It calls foundURL for each <url> listed in a sitemap, with the
+// URL's Sitemap hints set, and foundSitemap for each <sitemap> listed in an
+// index. Entries that aren't absolute http(s) URLs are skipped. If either
+// callback returns an error, parsing stops and that error is returned.
+func ParseSitemap(r io.Reader, foundURL func(*URL) error, foundSitemap func(*URL) error) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("Failed to read gzipped sitemap: %v", err)
+		}
+		defer gz.Close()
+		r = &decompressedLimit{r: gz, remaining: Config.Fetcher.MaxDecompressedSizeBytes}
+	} else {
+		r = br
+	}
+
+	decoder := xml.NewDecoder(r)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		} else if err == errSitemapTooLarge {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("Failed to parse sitemap: %v", err)
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || (start.Name.Local != "url" && start.Name.Local != "sitemap") {
+			continue
+		}
+		var entry sitemapEntry
+		if err := decoder.DecodeElement(&entry, &start); err == errSitemapTooLarge {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("Failed to parse sitemap: %v", err)
+		}
+		u, err := ParseAndNormalizeURL(strings.TrimSpace(entry.Loc))
+		if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+			log4go.Fine("Skipping bad sitemap loc %q", entry.Loc)
+			continue
+		}
+
+		if start.Name.Local == "url" {
+			u.Sitemap = entry.hints()
+			err = foundURL(u)
+		} else {
+			err = foundSitemap(u)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decompressedLimit reads from a gzipped sitemap until remaining bytes have
+// been read, then fails with errSitemapTooLarge if there is more.
+type decompressedLimit struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (dl *decompressedLimit) Read(p []byte) (int, error) {
+	if dl.remaining <= 0 {
+		// We've hit the limit, see if there is anything past it
+		var one [1]byte
+		if n, err := io.ReadAtLeast(dl.r, one[:], 1); n == 0 {
+			return 0, err
+		}
+		return 0, errSitemapTooLarge
+	}
+
+	if int64(len(p)) > dl.remaining {
+		p = p[:dl.remaining]
+	}
+	n, err := dl.r.Read(p)
+	dl.remaining -= int64(n)
+	return n, err
+}
+
+// walkSitemaps reads the sitemaps at locs, and those listed by any sitemap
+// indexes among them, calling found with each URL listed along with the
+// sitemap that listed it. get fetches the sitemap at a URL. It stops after
+// maxURLs URLs (if maxURLs is positive), or if get returns errStop (which is
+// then returned). Other errors reading individual sitemaps are logged and
+// skipped.
+func walkSitemaps(locs []*URL, maxURLs int, get func(*URL) (io.ReadCloser, error),
+	found func(u *URL, sitemap *URL), errStop error) error {
+
+	seen := map[string]bool{}
+	count := 0
+	var walk func(loc *URL, depth int) error
+	walk = func(loc *URL, depth int) error {
+		if seen[loc.String()] {
+			return nil
+		}
+		seen[loc.String()] = true
+
+		body, err := get(loc)
+		if err != nil {
+			if err == errStop {
+				return err
+			}
+			log4go.Debug("Failed to fetch sitemap %v: %v", loc, err)
+			return nil
+		}
+		var indexed []*URL
+		err = ParseSitemap(body,
+			func(u *URL) error {
+				if maxURLs > 0 && count >= maxURLs {
+					return errSitemapLimit
+				}
+				count++
+				found(u, loc)
+				return nil
+			},
+			func(u *URL) error {
+				indexed = append(indexed, u)
+				return nil
+			})
+		body.Close()
+		if err == errSitemapLimit {
+			return err
+		} else if err != nil {
+			log4go.Debug("Error reading sitemap %v: %v", loc, err)
+		}
+
+		if depth >= maxSitemapIndexDepth {
+			return nil
+		}
+		for _, u := range indexed {
+			if err := walk(u, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, loc := range locs {
+		err := walk(loc, 1)
+		if err == errSitemapLimit {
+			log4go.Info("Stopped reading sitemaps after %v URLs", count)
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSitemaps fetches the sitemap (or sitemap index) at loc with client and
+// calls found with every URL it lists (following sitemap indexes), up to
+// maxURLs if maxURLs is positive. Each URL's Sitemap hints are set. It is
+// meant for seeding a crawl (see `walker seed --sitemap`); fetchers discover
+// sitemaps on their own if discover_sitemaps is set. Give client a
+// FilteredTransport to keep it off the addresses the fetchers avoid.
+func ReadSitemaps(client *http.Client, loc string, maxURLs int, found func(*URL)) error {
+	u, err := ParseAndNormalizeURL(loc)
+	if err != nil {
+		return fmt.Errorf("Could not parse sitemap url %v: %v", loc, err)
+	}
+
+	// Only failing to fetch loc itself is an error, problems with the
+	// sitemaps it indexes are just logged
+	var topErr error
+	get := func(sitemap *URL) (io.ReadCloser, error) {
+		body, err := getSitemap(client, sitemap)
+		if err != nil && sitemap == u {
+			topErr = fmt.Errorf("Failed to fetch sitemap %v: %v", sitemap, err)
+		}
+		return body, err
+	}
+
+	err = walkSitemaps([]*URL{u}, maxURLs, get, func(u *URL, sitemap *URL) { found(u) }, nil)
+	if err != nil {
+		return err
+	}
+	return topErr
+}
+
+func getSitemap(client *http.Client, u *URL) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", Config.Fetcher.UserAgent)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("Got %v", res.Status)
+	}
+	return res.Body, nil
+}
+
+// sitemapBody is the body of a sitemap being read by a fetcher, limited to
+// max_decompressed_size_bytes. Closing it releases the IP politeness slot.
+type sitemapBody struct {
+	io.Reader
+	body    io.ReadCloser
+	release func()
+}
+
+func (sb *sitemapBody) Close() error {
+	err := sb.body.Close()
+	sb.release()
+	return err
+}
+
+// discoverSitemaps reads the sitemaps of the host being crawled, passing the
+// URLs they list on that domain to Datastore.StoreParsedURL. The sitemaps are
+// the Sitemap: lines of the host's robots.txt (fetched over scheme), or
+// /sitemap.xml if there are none. Once they have been read they aren't read
+// again for sitemap_refresh_interval. Returns false if the fetcher was told to
+// stop while reading them.
+func (f *fetcher) discoverSitemaps(scheme string) bool {
+	now := time.Now()
+	if last, ok := f.fm.sitemapsRead.Get(f.host); ok && now.Sub(last.(time.Time)) < f.fm.sitemapRefresh {
+		return true
+	}
+
+	robots := f.fetchRobots(&URL{URL: &url.URL{Scheme: scheme, Host: f.host, Path: "/"}})
+	if robots == nil {
+		return false
+	}
+
+	var locs []*URL
+	for _, loc := range robots.sitemaps {
+		u, err := ParseAndNormalizeURL(loc)
+		if err != nil {
+			log4go.Debug("Skipping bad Sitemap %q in robots.txt for %v: %v", loc, f.host, err)
+			continue
+		}
+		locs = append(locs, u)
+	}
+	if len(locs) == 0 {
+		if !robots.Test("/sitemap.xml") {
+			// If robots.txt was unreachable try again next time
+			if !robots.unreachable {
+				f.fm.sitemapsRead.Add(f.host, now)
+			}
+			return true
+		}
+		locs = append(locs, &URL{
+			URL:         &url.URL{Scheme: scheme, Host: f.host, Path: "/sitemap.xml"},
+			LastCrawled: NotYetCrawled,
+		})
+	}
+
+	first := true
+	get := func(u *URL) (io.ReadCloser, error) {
+		// Sitemaps are fetched as politely as any other page
+		if !first {
+			select {
+			case <-time.After(f.crawldelay.effective(robots.CrawlDelay)):
+			case <-f.quit:
+				return nil, errSitemapStopped
+			case <-f.ctx.Done():
+				return nil, errSitemapStopped
+			}
+		}
+		first = false
+
+		release, ok := f.fm.ipPoliteness.acquire(u.Host, f.ctx.Done())
+		if !ok {
+			return nil, errSitemapStopped
+		}
+		res, _, err := f.fetch(u, defaultRedirects)
+		if err != nil {
+			release()
+			if f.interrupted() {
+				return nil, errSitemapStopped
+			}
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			release()
+			return nil, fmt.Errorf("Got %v", res.Status)
+		}
+		return &sitemapBody{
+			Reader:  io.LimitReader(res.Body, Config.Fetcher.MaxDecompressedSizeBytes),
+			body:    res.Body,
+			release: release,
+		}, nil
+	}
+
+	found := func(u *URL, sitemap *URL) {
+		source := &FetchResults{URL: sitemap, FetchTime: NotYetCrawled}
+		dom, _, err := u.TLDPlusOneAndSubdomain()
+		if err != nil || dom != f.host || !f.shouldStoreParsedLink(u, source) {
+			return
+		}
+		f.fm.Datastore.StoreParsedURL(u, source)
+		linksStoredMetric.WithLabelValues("sitemap").Inc()
+	}
+
+	log4go.Info("Reading sitemaps for %v: %v", f.host, locs)
+	if walkSitemaps(locs, Config.Fetcher.MaxSitemapURLs, get, found, errSitemapStopped) != nil {
+		return false
+	}
+	f.fm.sitemapsRead.Add(f.host, now)
+	return true
+}
@@ -21,6 +21,21 @@ type URL struct {
 	// LastCrawled is the last time we crawled this URL, for example to use a
 	// Last-Modified header.
 	LastCrawled time.Time
+
+	// ETag and LastModified are the validators (ETag and Last-Modified
+	// response headers) the server returned the last time we crawled this
+	// URL, if any. They are sent back as If-None-Match and If-Modified-Since
+	// on recrawl so the server can reply 304 Not Modified.
+	ETag         string
+	LastModified string
+
+	// Sitemap holds the hints from the sitemap this URL was listed in, or is
+	// nil if it wasn't found in a sitemap (see discover_sitemaps)
+	Sitemap *SitemapHints
+
+	// Link describes how this URL appeared on the page it was parsed from, or
+	// is nil if it wasn't parsed out of a page
+	Link *LinkHints
 }
 
 // CreateURL creates a walker URL from values usually pulled out of the
@@ -137,8 +152,12 @@ func (u *URL) Clone() *URL {
 	}
 
 	return &URL{
-		URL:         &nurl,
-		LastCrawled: u.LastCrawled,
+		URL:          &nurl,
+		LastCrawled:  u.LastCrawled,
+		ETag:         u.ETag,
+		LastModified: u.LastModified,
+		Sitemap:      u.Sitemap,
+		Link:         u.Link,
 	}
 }
 
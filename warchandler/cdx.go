@@ -0,0 +1,66 @@
+package warchandler
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cdxHeader is the first line of each CDX file, naming its fields: the
+// canonicalized URL key, timestamp, original URL, mime type, status code,
+// payload digest, redirect, meta tags, compressed record length, offset and
+// WARC file name.
+const cdxHeader = " CDX N b a m s k r M S V g\n"
+
+// cdxTimeFormat is the 14 digit timestamp CDX files and Wayback URLs use
+const cdxTimeFormat = "20060102150405"
+
+// cdxLine returns the CDX line for a record of the WARC file called filename,
+// which starts at offset and is length bytes long (compressed).
+func cdxLine(u *url.URL, date time.Time, mime string, status int, payloadDigest string,
+	length int64, offset int64, filename string) string {
+
+	if i := strings.Index(mime, ";"); i >= 0 {
+		mime = mime[:i]
+	}
+	mime = strings.TrimSpace(mime)
+	if mime == "" {
+		mime = "-"
+	}
+	return fmt.Sprintf("%s %s %s %s %d %s - - %d %d %s\n",
+		surt(u), date.UTC().Format(cdxTimeFormat), cdxEscape(u.String()), cdxEscape(mime), status,
+		strings.TrimPrefix(payloadDigest, "sha1:"), length, offset, filename)
+}
+
+// surt returns the Sort-friendly URI Reordering Transform of u, the key CDX
+// files are sorted by: the host's labels reversed and comma separated (without
+// a leading "www"), then ")" and the lower cased path and query. For example
+// http://www.Example.com/A?b=1 becomes "com,example)/a?b=1".
+func surt(u *url.URL) string {
+	host := strings.ToLower(u.Host)
+	port := ""
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		host, port = host[:i], host[i+1:]
+		if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+			port = ""
+		}
+	}
+	host = strings.TrimPrefix(host, "www.")
+
+	labels := strings.Split(host, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	key := strings.Join(labels, ",")
+	if port != "" {
+		key += ":" + port
+	}
+
+	return cdxEscape(key + ")" + strings.ToLower(u.RequestURI()))
+}
+
+// cdxEscape makes s safe for a space separated CDX field.
+func cdxEscape(s string) string {
+	return strings.Replace(s, " ", "%20", -1)
+}
@@ -0,0 +1,333 @@
+/*
+Package warchandler provides a walker handler that archives fetches as WARC
+files (ISO 28500), the format web archives and Wayback-style replay tools read.
+
+Each fetch is written as a response record (or a revisit record, see
+Handler.HandleResponse) and the request record that produced it, each record
+compressed as its own gzip member. Files are rotated once they reach
+MaxFileSize, and each WARC file gets a CDX index of its response and revisit
+records alongside it. The CDX lines are written in crawl order; sort them
+(ex. `LC_ALL=C sort`) before handing them to tools that expect sorted CDX.
+*/
+package warchandler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// DefaultMaxFileSize is the size WARC files are rotated at unless
+// Handler.MaxFileSize is set; the standard recommends 1GB.
+const DefaultMaxFileSize = 1 << 30
+
+// revisitCacheSize is how many URLs the Handler remembers the last archived
+// response for, to write revisit records when they come up again
+const revisitCacheSize = 100000
+
+// Handler implements walker.FallibleHandler, writing WARC files. Use NewHandler to
+// create one, and Close it when the FetchManager has stopped.
+type Handler struct {
+	// Dir is the directory WARC and CDX files are written to
+	Dir string
+
+	// Prefix starts the name of each WARC file, which is followed by the time
+	// the file was started and a sequence number, ex.
+	// walker-20150102150405-00000.warc.gz
+	Prefix string
+
+	// MaxFileSize is the size in bytes after which a new WARC file is started
+	MaxFileSize int64
+
+	mu sync.Mutex
+
+	// The current WARC file and its CDX file, nil if none is open
+	out     *os.File
+	cdx     *os.File
+	name    string
+	written int64
+	seq     int
+
+	// archived holds an *archived for recently archived URLs
+	archived *lru.Cache
+}
+
+// archived describes the last response record written for a URL
+type archived struct {
+	recordID       string
+	targetURI      string
+	date           time.Time
+	fnvFingerprint int64
+	payloadDigest  string
+}
+
+// NewHandler creates a Handler writing to dir, creating it if needed.
+func NewHandler(dir string) (*Handler, error) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create WARC directory: %v", err)
+	}
+	cache, err := lru.New(revisitCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{
+		Dir:         dir,
+		Prefix:      "walker",
+		MaxFileSize: DefaultMaxFileSize,
+		archived:    cache,
+	}, nil
+}
+
+// HandleResponse archives fr, if a response was received. It writes:
+//
+//   - a revisit record, instead of a response, for a 304 Not Modified, or if
+//     the body is unchanged (the same FnvFingerprint) since the URL was last
+//     archived by this Handler. Revisits refer to the earlier response record
+//     where there is one.
+//   - a response record for anything else, including error statuses. If the
+//     body was Truncated the record is marked with WARC-Truncated.
+//     Response and revisit records carry the server's WARC-IP-Address, if
+//     the fetcher knows it.
+//   - a request record for the request that produced the response.
+//   - if the link redirected, a metadata record listing the URLs it was
+//     redirected from. The other records are for the URL that responded.
+//
+// The body is read in full; Response.Body is replaced so that it can be read
+// again afterwards.
+func (h *Handler) HandleResponse(fr *walker.FetchResults) {
+	if err := h.TryHandleResponse(fr); err != nil {
+		log4go.Error("Failed to archive %v: %v", fr.URL, err)
+	}
+}
+
+// TryHandleResponse is HandleResponse, returning a RetryLaterError if the
+// body couldn't be read or the records couldn't be written, so the link is
+// fetched (and archived) again soon.
+func (h *Handler) TryHandleResponse(fr *walker.FetchResults) error {
+	if fr.Response == nil || fr.ExcludedByRobots || fr.FetchError != nil || fr.Interrupted {
+		return nil
+	}
+	res := fr.Response
+
+	target := fr.URL
+	if n := len(fr.RedirectedFrom); n > 0 {
+		target = fr.RedirectedFrom[n-1]
+	}
+	date := fr.FetchTime
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	notModified := res.StatusCode == http.StatusNotModified
+	var payload []byte
+	if !notModified && res.Body != nil {
+		var err error
+		payload, err = ioutil.ReadAll(res.Body)
+		if err != nil {
+			return walker.RetryLater(fmt.Errorf("Failed to read body: %v", err))
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	}
+	payloadDigest := digest(payload)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var prev *archived
+	if v, ok := h.archived.Get(target.String()); ok {
+		prev = v.(*archived)
+	}
+
+	var resRec *record
+	switch {
+	case notModified:
+		resRec = newRecord(revisitType, date)
+		resRec.set("WARC-Profile", serverNotModifiedProfile)
+		resRec.block = responseHeaders(res, -1)
+	case prev != nil && (prev.payloadDigest == payloadDigest ||
+		(fr.FnvFingerprint != 0 && prev.fnvFingerprint == fr.FnvFingerprint)):
+		resRec = newRecord(revisitType, date)
+		resRec.set("WARC-Profile", identicalPayloadProfile)
+		resRec.block = responseHeaders(res, len(payload))
+	default:
+		resRec = newRecord(responseType, date)
+		resRec.block = append(responseHeaders(res, len(payload)), payload...)
+		prev = nil
+	}
+	resRec.set("WARC-Target-URI", target.String())
+	resRec.set("Content-Type", "application/http; msgtype=response")
+	if fr.RemoteIP != "" {
+		resRec.set("WARC-IP-Address", fr.RemoteIP)
+	}
+	if prev != nil {
+		resRec.set("WARC-Refers-To", prev.recordID)
+		resRec.set("WARC-Refers-To-Target-URI", prev.targetURI)
+		resRec.set("WARC-Refers-To-Date", prev.date.UTC().Format(warcDateFormat))
+	}
+	if !notModified {
+		resRec.set("WARC-Payload-Digest", payloadDigest)
+	} else if prev != nil {
+		payloadDigest = prev.payloadDigest
+	} else {
+		payloadDigest = "-"
+	}
+	if fr.Truncated && resRec.get("WARC-Type") == responseType {
+		resRec.set("WARC-Truncated", "length")
+	}
+	resRec.set("WARC-Block-Digest", digest(resRec.block))
+
+	records := []*record{resRec}
+	if res.Request != nil {
+		reqRec := newRecord(requestType, date)
+		reqRec.set("WARC-Target-URI", target.String())
+		reqRec.set("WARC-Concurrent-To", resRec.get("WARC-Record-ID"))
+		reqRec.set("Content-Type", "application/http; msgtype=request")
+		reqRec.block = requestBlock(res.Request)
+		reqRec.set("WARC-Block-Digest", digest(reqRec.block))
+		records = append(records, reqRec)
+	}
+	if n := len(fr.RedirectedFrom); n > 0 {
+		meta := newRecord(metadataType, date)
+		meta.set("WARC-Target-URI", target.String())
+		meta.set("WARC-Concurrent-To", resRec.get("WARC-Record-ID"))
+		meta.set("Content-Type", "application/warc-fields")
+		buf := &bytes.Buffer{}
+		from := append([]*walker.URL{fr.URL}, fr.RedirectedFrom[:n-1]...)
+		for _, u := range from {
+			fmt.Fprintf(buf, "redirected-from: %v\r\n", u)
+		}
+		meta.block = buf.Bytes()
+		records = append(records, meta)
+	}
+
+	for i, r := range records {
+		offset, length, err := h.write(r)
+		if err != nil {
+			h.close()
+			return walker.RetryLater(fmt.Errorf("Failed to write WARC record: %v", err))
+		}
+		if i == 0 {
+			mime := res.Header.Get("Content-Type")
+			if r.get("WARC-Type") == revisitType {
+				mime = "warc/revisit"
+			}
+			line := cdxLine(target.URL, date, mime, res.StatusCode, payloadDigest, length, offset, h.name)
+			if _, err := h.cdx.WriteString(line); err != nil {
+				log4go.Error("Failed to write CDX line for %v: %v", target, err)
+			}
+		}
+	}
+
+	if resRec.get("WARC-Type") == responseType {
+		h.archived.Add(target.String(), &archived{
+			recordID:       resRec.get("WARC-Record-ID"),
+			targetURI:      target.String(),
+			date:           date,
+			fnvFingerprint: fr.FnvFingerprint,
+			payloadDigest:  payloadDigest,
+		})
+	}
+
+	if h.written >= h.MaxFileSize {
+		h.close()
+	}
+	return nil
+}
+
+// Close closes the current WARC file (a new one is started if HandleResponse
+// is called again).
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.close()
+}
+
+// write writes r to the current WARC file, starting one if needed, and returns
+// the offset and (compressed) length of the record.
+func (h *Handler) write(r *record) (offset int64, length int64, err error) {
+	if h.out == nil {
+		err = h.open()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	err = r.writeTo(buf)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset = h.written
+	n, err := h.out.Write(buf.Bytes())
+	h.written += int64(n)
+	return offset, int64(n), err
+}
+
+// open starts a new WARC file and its CDX file, and writes the warcinfo
+// record.
+func (h *Handler) open() error {
+	name := fmt.Sprintf("%s-%s-%05d.warc.gz", h.Prefix, time.Now().UTC().Format(cdxTimeFormat), h.seq)
+	h.seq++
+
+	out, err := os.OpenFile(filepath.Join(h.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	cdxName := strings.TrimSuffix(name, ".warc.gz") + ".cdx"
+	cdx, err := os.OpenFile(filepath.Join(h.Dir, cdxName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	log4go.Info("Writing WARC file %v", name)
+	h.out, h.cdx, h.name, h.written = out, cdx, name, 0
+
+	_, err = h.cdx.WriteString(cdxHeader)
+	if err != nil {
+		h.close()
+		return err
+	}
+
+	info := newRecord(warcinfoType, time.Now())
+	info.set("WARC-Filename", name)
+	info.set("Content-Type", "application/warc-fields")
+	info.block = []byte(fmt.Sprintf("software: walker\r\n"+
+		"format: WARC File Format 1.0\r\n"+
+		"conformsTo: http://bibnum.bnf.fr/WARC/WARC_ISO_28500_version1_latestdraft.pdf\r\n"+
+		"robots: obey\r\n"+
+		"http-header-user-agent: %s\r\n", walker.Config.Fetcher.UserAgent))
+	_, _, err = h.write(info)
+	if err != nil {
+		h.close()
+		return err
+	}
+	return nil
+}
+
+// close closes the current WARC and CDX files, if any.
+func (h *Handler) close() error {
+	if h.out == nil {
+		return nil
+	}
+	err := h.out.Close()
+	if cerr := h.cdx.Close(); err == nil {
+		err = cerr
+	}
+	h.out, h.cdx = nil, nil
+	if err != nil {
+		log4go.Error("Failed to close WARC file %v: %v", h.name, err)
+	}
+	return err
+}
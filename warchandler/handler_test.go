@@ -0,0 +1,335 @@
+package warchandler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+// testRecord is a WARC record read back from a file
+type testRecord struct {
+	headers http.Header
+	block   string
+}
+
+// readRecord reads one gzip member holding a WARC record from r.
+func readRecord(t *testing.T, r io.Reader) testRecord {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("Failed to open gzip member: %v", err)
+	}
+	gz.Multistream(false)
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Failed to read gzip member: %v", err)
+	}
+
+	br := bufio.NewReader(bytes.NewReader(data))
+	version, _ := br.ReadString('\n')
+	if version != "WARC/1.0\r\n" {
+		t.Fatalf("Expected a WARC/1.0 record, got %q", version)
+	}
+	rec := testRecord{headers: http.Header{}}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read record headers: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		rec.headers.Add(parts[0], parts[1])
+	}
+	rest, _ := ioutil.ReadAll(br)
+	length, _ := strconv.Atoi(rec.headers.Get("Content-Length"))
+	if len(rest) != length+4 || !strings.HasSuffix(string(rest), "\r\n\r\n") {
+		t.Fatalf("Record block is %d bytes, expected Content-Length %d and a trailing CRLFCRLF",
+			len(rest), length)
+	}
+	rec.block = string(rest[:length])
+	return rec
+}
+
+// readRecords reads every record of the WARC file at path.
+func readRecords(t *testing.T, path string) []testRecord {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read WARC file: %v", err)
+	}
+	var records []testRecord
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		records = append(records, readRecord(t, r))
+	}
+	return records
+}
+
+func warcFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.warc.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func fetchResults(link string, status int, body string, header http.Header) *walker.FetchResults {
+	u := walker.MustParse(link)
+	if header == nil {
+		header = http.Header{"Content-Type": []string{"text/html"}}
+	}
+	return &walker.FetchResults{
+		URL:       u,
+		FetchTime: time.Date(2015, 1, 2, 15, 4, 5, 0, time.UTC),
+		Response: &http.Response{
+			Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+			StatusCode: status,
+			Proto:      "HTTP/1.1",
+			Header:     header,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request: &http.Request{
+				Method: "GET",
+				URL:    u.URL,
+				Proto:  "HTTP/1.1",
+				Header: http.Header{"User-Agent": []string{"Walker"}},
+				Host:   u.Host,
+			},
+		},
+	}
+}
+
+func newTestHandler(t *testing.T) (*Handler, string) {
+	dir, err := ioutil.TempDir("", "warchandler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandler(dir)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	return h, dir
+}
+
+func TestWARCRecords(t *testing.T) {
+	h, dir := newTestHandler(t)
+	defer os.RemoveAll(dir)
+
+	header := http.Header{
+		"Content-Type":     []string{"text/html"},
+		"Content-Encoding": []string{"gzip"},
+		"Content-Length":   []string{"12"},
+	}
+	fr := fetchResults("http://test.com/b.html", 200, "<html>stuff</html>", header)
+	fr.URL = walker.MustParse("http://test.com/a.html")
+	fr.RedirectedFrom = []*walker.URL{walker.MustParse("http://test.com/b.html")}
+	fr.RemoteIP = "203.0.113.7"
+	h.HandleResponse(fr)
+	h.Close()
+
+	// The body can still be read afterwards
+	body, _ := ioutil.ReadAll(fr.Response.Body)
+	if string(body) != "<html>stuff</html>" {
+		t.Errorf("Expected the body to be readable after archiving, got %q", body)
+	}
+
+	files := warcFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 WARC file, got %v", files)
+	}
+	records := readRecords(t, files[0])
+	var types []string
+	for _, r := range records {
+		types = append(types, r.headers.Get("WARC-Type"))
+	}
+	if strings.Join(types, ",") != "warcinfo,response,request,metadata" {
+		t.Fatalf("Unexpected record types %v", types)
+	}
+
+	res := records[1]
+	if uri := res.headers.Get("WARC-Target-URI"); uri != "http://test.com/b.html" {
+		t.Errorf("Expected the response to be for the URL redirected to, got %q", uri)
+	}
+	if ip := res.headers.Get("WARC-IP-Address"); ip != "203.0.113.7" {
+		t.Errorf("Expected WARC-IP-Address of the server, got %q", ip)
+	}
+	if date := res.headers.Get("WARC-Date"); date != "2015-01-02T15:04:05Z" {
+		t.Errorf("Expected WARC-Date of the fetch time, got %q", date)
+	}
+	if d := res.headers.Get("WARC-Block-Digest"); d != digest([]byte(res.block)) {
+		t.Errorf("WARC-Block-Digest %q does not match the block", d)
+	}
+	if !strings.HasPrefix(res.block, "HTTP/1.1 200 OK\r\n") ||
+		!strings.HasSuffix(res.block, "\r\n\r\n<html>stuff</html>") {
+		t.Errorf("Unexpected response block %q", res.block)
+	}
+	if !strings.Contains(res.block, "X-Archive-Orig-Content-Encoding: gzip\r\n") ||
+		!strings.Contains(res.block, "Content-Length: 18\r\n") {
+		t.Errorf("Expected Content-Encoding to be renamed and Content-Length fixed, got %q", res.block)
+	}
+
+	req := records[2]
+	if req.headers.Get("WARC-Concurrent-To") != res.headers.Get("WARC-Record-ID") {
+		t.Errorf("Expected the request record to refer to the response")
+	}
+	if !strings.HasPrefix(req.block, "GET /b.html HTTP/1.1\r\nHost: test.com\r\nUser-Agent: Walker\r\n") {
+		t.Errorf("Unexpected request block %q", req.block)
+	}
+
+	if meta := records[3].block; meta != "redirected-from: http://test.com/a.html\r\n" {
+		t.Errorf("Unexpected metadata block %q", meta)
+	}
+}
+
+func TestWARCRevisits(t *testing.T) {
+	h, dir := newTestHandler(t)
+	defer os.RemoveAll(dir)
+
+	h.HandleResponse(fetchResults("http://test.com/", 200, "<html>same</html>", nil))
+	h.HandleResponse(fetchResults("http://test.com/", 200, "<html>same</html>", nil))
+	h.HandleResponse(fetchResults("http://test.com/", 304, "", nil))
+	h.HandleResponse(fetchResults("http://test.com/", 200, "<html>changed</html>", nil))
+	h.Close()
+
+	records := readRecords(t, warcFiles(t, dir)[0])
+	var responses []testRecord
+	for _, r := range records {
+		if typ := r.headers.Get("WARC-Type"); typ == "response" || typ == "revisit" {
+			responses = append(responses, r)
+		}
+	}
+	if len(responses) != 4 {
+		t.Fatalf("Expected 4 response or revisit records, got %d", len(responses))
+	}
+
+	first := responses[0].headers
+	tests := []struct {
+		typ     string
+		profile string
+		refers  bool
+	}{
+		{"response", "", false},
+		{"revisit", identicalPayloadProfile, true},
+		{"revisit", serverNotModifiedProfile, true},
+		{"response", "", false},
+	}
+	for i, test := range tests {
+		headers := responses[i].headers
+		if typ := headers.Get("WARC-Type"); typ != test.typ {
+			t.Errorf("Record %d: expected type %q, got %q", i, test.typ, typ)
+		}
+		if profile := headers.Get("WARC-Profile"); profile != test.profile {
+			t.Errorf("Record %d: expected profile %q, got %q", i, test.profile, profile)
+		}
+		refers := headers.Get("WARC-Refers-To")
+		if test.refers && refers != first.Get("WARC-Record-ID") {
+			t.Errorf("Record %d: expected to refer to the first response, got %q", i, refers)
+		} else if !test.refers && refers != "" {
+			t.Errorf("Record %d: expected no WARC-Refers-To, got %q", i, refers)
+		}
+	}
+	if strings.Contains(responses[1].block, "same") {
+		t.Errorf("Expected the revisit not to hold the body, got %q", responses[1].block)
+	}
+}
+
+func TestWARCRotationAndCDX(t *testing.T) {
+	h, dir := newTestHandler(t)
+	defer os.RemoveAll(dir)
+	h.MaxFileSize = 1
+
+	h.HandleResponse(fetchResults("http://www.Test.com/A.html?b=1", 200, "<html>a</html>", nil))
+	h.HandleResponse(fetchResults("http://test.com:8080/b.html", 404, "not found", nil))
+	h.Close()
+
+	files := warcFiles(t, dir)
+	if len(files) != 2 {
+		t.Fatalf("Expected each fetch to rotate to a new WARC file, got %v", files)
+	}
+
+	expected := []string{
+		"com,test)/a.html?b=1 20150102150405 http://www.Test.com/A.html?b=1 text/html 200",
+		"com,test:8080)/b.html 20150102150405 http://test.com:8080/b.html text/html 404",
+	}
+	for i, file := range files {
+		cdx, err := ioutil.ReadFile(strings.TrimSuffix(file, ".warc.gz") + ".cdx")
+		if err != nil {
+			t.Fatalf("Failed to read CDX file: %v", err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(cdx), "\n"), "\n")
+		if len(lines) != 2 || lines[0] != strings.TrimSuffix(cdxHeader, "\n") {
+			t.Fatalf("Expected a CDX header and one line, got %q", cdx)
+		}
+		fields := strings.Split(lines[1], " ")
+		if strings.Join(fields[:5], " ") != expected[i] {
+			t.Errorf("CDX line mismatch\nGot:      %v\nExpected: %v", lines[1], expected[i])
+		}
+		if fields[10] != filepath.Base(file) {
+			t.Errorf("Expected CDX file name %q, got %q", filepath.Base(file), fields[10])
+		}
+
+		// The offset and length locate the response record
+		length, _ := strconv.ParseInt(fields[8], 10, 64)
+		offset, _ := strconv.ParseInt(fields[9], 10, 64)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read WARC file: %v", err)
+		}
+		rec := readRecord(t, bytes.NewReader(data[offset:offset+length]))
+		if typ := rec.headers.Get("WARC-Type"); typ != "response" {
+			t.Errorf("Expected the CDX line to point at a response record, got %q", typ)
+		}
+		if d := "sha1:" + fields[5]; d != rec.headers.Get("WARC-Payload-Digest") {
+			t.Errorf("CDX digest %q doesn't match the record's %q", d, rec.headers.Get("WARC-Payload-Digest"))
+		}
+	}
+}
+
+// errReader fails every read
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("connection reset")
+}
+
+func TestWARCRetryLater(t *testing.T) {
+	h, dir := newTestHandler(t)
+	defer os.RemoveAll(dir)
+
+	fr := fetchResults("http://test.com/a.html", 200, "", nil)
+	fr.Response.Body = ioutil.NopCloser(errReader{})
+	if err := h.TryHandleResponse(fr); !walker.IsRetryLater(err) {
+		t.Errorf("Expected a retry later error for an unreadable body, got %v", err)
+	}
+
+	// The WARC file can't be created while the directory is gone
+	os.RemoveAll(dir)
+	err := h.TryHandleResponse(fetchResults("http://test.com/b.html", 200, "<html>b</html>", nil))
+	if !walker.IsRetryLater(err) {
+		t.Errorf("Expected a retry later error for a failed write, got %v", err)
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	err = h.TryHandleResponse(fetchResults("http://test.com/b.html", 200, "<html>b</html>", nil))
+	if err != nil {
+		t.Errorf("Expected archiving to succeed once the directory is back, got %v", err)
+	}
+	h.Close()
+	if files := warcFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected one WARC file, got %v", files)
+	}
+}
@@ -0,0 +1,163 @@
+package warchandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WARC record types written by the Handler
+const (
+	warcinfoType = "warcinfo"
+	requestType  = "request"
+	responseType = "response"
+	revisitType  = "revisit"
+	metadataType = "metadata"
+)
+
+// Revisit profiles (WARC 1.0, section 6.7.2)
+const (
+	identicalPayloadProfile  = "http://netpreserve.org/warc/1.0/revisit/identical-payload-digest"
+	serverNotModifiedProfile = "http://netpreserve.org/warc/1.0/revisit/server-not-modified"
+)
+
+// warcDateFormat is the W3C-ISO8601 form the WARC-Date header uses
+const warcDateFormat = "2006-01-02T15:04:05Z"
+
+// record is a single WARC record: its named header fields (in the order they
+// are written) and its content block.
+type record struct {
+	fields [][2]string
+	block  []byte
+}
+
+// newRecord starts a record of the given type, with a new WARC-Record-ID.
+func newRecord(warcType string, date time.Time) *record {
+	r := &record{}
+	r.set("WARC-Type", warcType)
+	r.set("WARC-Record-ID", newRecordID())
+	r.set("WARC-Date", date.UTC().Format(warcDateFormat))
+	return r
+}
+
+// set adds a header field to the record.
+func (r *record) set(name, value string) {
+	r.fields = append(r.fields, [2]string{name, value})
+}
+
+// get returns the value of the first header field called name, or "".
+func (r *record) get(name string) string {
+	for _, f := range r.fields {
+		if f[0] == name {
+			return f[1]
+		}
+	}
+	return ""
+}
+
+// writeTo writes the record to w as its own gzip member, as the WARC standard
+// recommends, so each record can be read on its own given its offset.
+func (r *record) writeTo(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	buf := bytes.NewBufferString("WARC/1.0\r\n")
+	for _, f := range r.fields {
+		fmt.Fprintf(buf, "%s: %s\r\n", f[0], f[1])
+	}
+	fmt.Fprintf(buf, "Content-Length: %d\r\n\r\n", len(r.block))
+	if _, err := gz.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if _, err := gz.Write(r.block); err != nil {
+		return err
+	}
+	if _, err := gz.Write([]byte("\r\n\r\n")); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// newRecordID returns a random (version 4) UUID URN, as used for
+// WARC-Record-ID.
+func newRecordID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		// crypto/rand only fails if the system's random source is broken
+		panic(err)
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// digest returns the SHA-1 digest of data in the "sha1:<base32>" form used by
+// WARC-Block-Digest, WARC-Payload-Digest and CDX files.
+func digest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// requestBlock reconstructs the HTTP request that was sent, for a request
+// record.
+func requestBlock(req *http.Request) []byte {
+	buf := &bytes.Buffer{}
+	proto := req.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	fmt.Fprintf(buf, "%s %s %s\r\n", req.Method, req.URL.RequestURI(), proto)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(buf, "Host: %s\r\n", host)
+	req.Header.Write(buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// responseHeaders returns the status line and headers of res, for a response
+// or revisit record. The fetcher has already undone any Content-Encoding and
+// Transfer-Encoding, so those headers are renamed (keeping their values for
+// replay tools) and Content-Length is set to the length of payload. A negative
+// payload (for a revisit, which has none) leaves Content-Length as it was.
+func responseHeaders(res *http.Response, payload int) []byte {
+	buf := &bytes.Buffer{}
+	proto := res.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	status := res.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	} else if !strings.HasPrefix(status, fmt.Sprintf("%d", res.StatusCode)) {
+		status = fmt.Sprintf("%d %s", res.StatusCode, status)
+	}
+	fmt.Fprintf(buf, "%s %s\r\n", proto, status)
+
+	header := http.Header{}
+	for name, values := range res.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Encoding", "Transfer-Encoding":
+			header["X-Archive-Orig-"+http.CanonicalHeaderKey(name)] = values
+		case "Content-Length":
+			if payload < 0 {
+				header[name] = values
+			}
+		default:
+			header[name] = values
+		}
+	}
+	if payload >= 0 {
+		header.Set("Content-Length", fmt.Sprintf("%d", payload))
+	}
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}